@@ -0,0 +1,117 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Admission makes a single admission decision from any number of rate
+// limit allows and concurrency takes, and sends them in one pipelined round
+// trip together with arbitrary bookkeeping commands, such as incrementing a
+// usage counter. It is created by Limiter.Admission.
+//
+// Every command is routed to the shard owning its keys, as in a Pipeline,
+// so the operations are not atomic: bookkeeping commands are applied and
+// rate limit events are counted whether or not the request is admitted.
+// Slots taken for a request that is not admitted are released again.
+type Admission struct {
+	p *pipeline
+}
+
+// AdmissionResult is the outcome of Admission.Exec.
+type AdmissionResult struct {
+	// Admitted is true when every allow and take was allowed.
+	Admitted bool
+
+	// Denied are the keys of the allows and takes that were not allowed, in
+	// the order they were queued.
+	Denied []string
+
+	// RetryAfter is the longest RetryAfter among the denied allows, or -1
+	// if none of them was denied.
+	RetryAfter time.Duration
+}
+
+// Admission returns an empty Admission.
+func (l *Limiter) Admission() *Admission {
+	return &Admission{
+		p: &pipeline{l: l},
+	}
+}
+
+// Allow queues an Allow of key. The result is filled in by Exec.
+func (a *Admission) Allow(ctx context.Context, key string, limit Limit) *Result {
+	return a.p.Allow(ctx, key, limit)
+}
+
+// Take queues a Take of key for requestID. The result is filled in by Exec.
+func (a *Admission) Take(ctx context.Context, key string, requestID string, limit ConcurrencyLimit) *ConcurrencyResult {
+	return a.p.Take(ctx, key, requestID, limit)
+}
+
+// Do queues an arbitrary command, given as its arguments such as "incrby",
+// key, 1. The returned command holds its reply after Exec.
+func (a *Admission) Do(ctx context.Context, args ...interface{}) *redis.Cmd {
+	cmd := redis.NewCmd(ctx, args...)
+	a.p.customCommands = append(a.p.customCommands, cmd)
+	return cmd
+}
+
+// Exec sends every queued operation and decides whether the request is
+// admitted. Failed operations are reported as by Pipeline.Exec, and a
+// request with a failed allow or take is not admitted; the errors of
+// commands queued with Do are only reported on the commands.
+func (a *Admission) Exec(ctx context.Context) (*AdmissionResult, error) {
+	err := a.p.Exec(ctx)
+	var perr *PipelineError
+	if err != nil && !errors.As(err, &perr) {
+		return nil, err
+	}
+
+	rv := &AdmissionResult{
+		Admitted:   err == nil,
+		RetryAfter: -1,
+	}
+	for _, v := range a.p.allowCommands {
+		if v.Err == nil && v.Allowed == 0 {
+			rv.Denied = append(rv.Denied, v.Key)
+			if v.RetryAfter > rv.RetryAfter {
+				rv.RetryAfter = v.RetryAfter
+			}
+		}
+	}
+	for _, v := range a.p.takeCommands {
+		if v.Err == nil && !v.Allowed {
+			rv.Denied = append(rv.Denied, v.Key)
+		}
+	}
+	if len(rv.Denied) > 0 {
+		rv.Admitted = false
+	}
+
+	if !rv.Admitted {
+		if rerr := a.releaseTaken(ctx); rerr != nil && err == nil {
+			err = rerr
+		}
+	}
+	return rv, err
+}
+
+// releaseTaken releases the slots taken by a request that was not admitted.
+func (a *Admission) releaseTaken(ctx context.Context) error {
+	release := a.p.l.Pipeline()
+	n := 0
+	for _, v := range a.p.takeCommands {
+		if v.Err == nil && v.Allowed {
+			release.Release(ctx, v.Key, v.RequestID)
+			n++
+		}
+	}
+	if n == 0 {
+		return nil
+	}
+	return release.Exec(ctx)
+}
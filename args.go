@@ -0,0 +1,98 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"strconv"
+	"sync"
+)
+
+// scriptArgs builds the keys and arguments of script calls. Arguments are
+// formatted into a shared buffer and handed to go-redis as BinaryMarshalers
+// pointing into it, so once a scriptArgs has been through the pool a few
+// times building a call no longer allocates for boxing or formatting.
+//
+// go-redis copies keys and args into each command, so they may be reused for
+// the next call with begin, but the formatted values are referenced until
+// the command is written. A scriptArgs must not be released until every
+// command built from it has been sent.
+type scriptArgs struct {
+	keys []string
+	args []interface{}
+	vals []argValue
+	buf  []byte
+}
+
+// argValue is a formatted argument. It is used through a pointer into
+// scriptArgs.vals, which fits in an interface without allocating.
+type argValue struct {
+	b []byte
+}
+
+func (v *argValue) MarshalBinary() ([]byte, error) {
+	return v.b, nil
+}
+
+var scriptArgsPool = sync.Pool{
+	New: func() interface{} {
+		return &scriptArgs{
+			keys: make([]string, 0, 4),
+			args: make([]interface{}, 0, 8),
+			vals: make([]argValue, 0, 8),
+			buf:  make([]byte, 0, 128),
+		}
+	},
+}
+
+func getScriptArgs() *scriptArgs {
+	return scriptArgsPool.Get().(*scriptArgs)
+}
+
+// release returns a to the pool.
+func (a *scriptArgs) release() {
+	for i := range a.keys {
+		a.keys[i] = ""
+	}
+	for i := range a.args {
+		a.args[i] = nil
+	}
+	a.keys = a.keys[:0]
+	a.args = a.args[:0]
+	a.vals = a.vals[:0]
+	a.buf = a.buf[:0]
+	scriptArgsPool.Put(a)
+}
+
+// begin starts the keys and arguments of the next call.
+func (a *scriptArgs) begin() *scriptArgs {
+	a.keys = a.keys[:0]
+	a.args = a.args[:0]
+	return a
+}
+
+func (a *scriptArgs) key(prefix string, key string) *scriptArgs {
+	a.keys = append(a.keys, prefix+key)
+	return a
+}
+
+func (a *scriptArgs) push(start int) *scriptArgs {
+	a.vals = append(a.vals, argValue{b: a.buf[start:len(a.buf):len(a.buf)]})
+	a.args = append(a.args, &a.vals[len(a.vals)-1])
+	return a
+}
+
+func (a *scriptArgs) int(v int64) *scriptArgs {
+	start := len(a.buf)
+	a.buf = strconv.AppendInt(a.buf, v, 10)
+	return a.push(start)
+}
+
+func (a *scriptArgs) float(v float64) *scriptArgs {
+	start := len(a.buf)
+	a.buf = strconv.AppendFloat(a.buf, v, 'f', -1, 64)
+	return a.push(start)
+}
+
+func (a *scriptArgs) str(v string) *scriptArgs {
+	start := len(a.buf)
+	a.buf = append(a.buf, v...)
+	return a.push(start)
+}
@@ -0,0 +1,93 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"encoding"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestScriptArgs(t *testing.T) {
+	l := &Limiter{ratePrefix: "rate:"}
+	args := getScriptArgs()
+	defer args.release()
+
+	args.begin().key(l.ratePrefix, "foo")
+	l.allowArgs(args, Limit{Rate: 10, Burst: 20, Period: 1500 * time.Millisecond}, 3)
+	require.Equal(t, []string{"rate:foo"}, args.keys)
+
+	var got []string
+	for _, v := range args.args {
+		b, err := v.(encoding.BinaryMarshaler).MarshalBinary()
+		require.NoError(t, err)
+		got = append(got, string(b))
+	}
+	require.Equal(t, []string{"20", "10", "1.5", "3", "", "0"}, got)
+
+	// Values from an earlier call stay intact until release.
+	first := args.args[0]
+	args.begin().key(l.ratePrefix, "bar")
+	l.allowArgs(args, PerHour(100000), 1)
+	b, _ := first.(encoding.BinaryMarshaler).MarshalBinary()
+	require.Equal(t, "20", string(b))
+}
+
+func TestStorageArgs(t *testing.T) {
+	l := &Limiter{ratePrefix: "rate:", storage: StorageCompact}
+	args := getScriptArgs()
+	defer args.release()
+
+	args.begin().key(l.ratePrefix, "foo")
+	l.allowArgs(args, PerSecond(10), 1)
+	l.storageArgs(args, allowN)
+	require.Len(t, args.args, 13)
+	b, _ := args.args[7].(encoding.BinaryMarshaler).MarshalBinary()
+	require.Equal(t, "", string(b))
+	b, _ = args.args[12].(encoding.BinaryMarshaler).MarshalBinary()
+	require.Equal(t, "1", string(b))
+
+	l = &Limiter{ratePrefix: "rate:", keyTTLFactor: 2, keyMaxTTL: 1500 * time.Millisecond}
+	args.begin().key(l.ratePrefix, "foo")
+	l.allowArgs(args, PerSecond(10), 1)
+	l.storageArgs(args, allowN)
+	require.Len(t, args.args, 15)
+	b, _ = args.args[12].(encoding.BinaryMarshaler).MarshalBinary()
+	require.Equal(t, "", string(b))
+	b, _ = args.args[13].(encoding.BinaryMarshaler).MarshalBinary()
+	require.Equal(t, "2", string(b))
+	b, _ = args.args[14].(encoding.BinaryMarshaler).MarshalBinary()
+	require.Equal(t, "2", string(b))
+	require.Equal(t, []interface{}{1, "", 2.0, int64(2)}, l.storageValues([]interface{}{1}))
+
+	tat, err := decodeTAT("\xcb\x41\xb3\x00\x00\x00\x80\x00\x00")
+	require.NoError(t, err)
+	require.Equal(t, 318767104.5, tat)
+	tat, err = decodeTAT("318767104.5")
+	require.NoError(t, err)
+	require.Equal(t, 318767104.5, tat)
+}
+
+var benchArgs []interface{}
+
+func BenchmarkScriptArgs(b *testing.B) {
+	l := &Limiter{ratePrefix: "rate:"}
+	limit := PerSecond(1e6)
+
+	b.Run("boxed", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			benchArgs = []interface{}{limit.Burst, limit.Rate, limit.Period.Seconds(), i, l.scriptNow()}
+		}
+	})
+
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			args := getScriptArgs()
+			l.allowArgs(args, limit, i)
+			benchArgs = args.args
+			args.release()
+		}
+	})
+}
@@ -0,0 +1,211 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// DefaultAuditMaxLen is the approximate number of entries an AuditLog keeps
+// unless WithAuditMaxLen is given.
+const DefaultAuditMaxLen = 10000
+
+// Audit actions recorded by the management APIs.
+const (
+	AuditLimitSet    = "limit.set"
+	AuditLimitDelete = "limit.delete"
+	AuditEpochBump   = "epoch.bump"
+	AuditReset       = "reset"
+	AuditRestore     = "state.restore"
+
+	AuditRegistrySet    = "registry.set"
+	AuditRegistryDelete = "registry.delete"
+	AuditRegistryBind   = "registry.bind"
+
+	AuditBan         = "ban"
+	AuditUnban       = "unban"
+	AuditBoostGrant  = "boost.grant"
+	AuditBoostRevoke = "boost.revoke"
+	AuditFreeze      = "freeze"
+	AuditUnfreeze    = "unfreeze"
+)
+
+// AuditEntry records a single change made through a management API.
+type AuditEntry struct {
+	// ID is the Redis stream entry id, which orders entries.
+	ID string
+
+	// Time is when the change was made, according to the recording
+	// process. It is zero if the stored time cannot be read.
+	Time time.Time
+
+	// Actor is who made the change, as set with WithActor.
+	Actor string
+
+	// Action is one of the Audit constants.
+	Action string
+
+	// Target is what was changed, such as a LimitStore pattern.
+	Target string
+
+	// Old and New describe the value before and after the change, where
+	// applicable.
+	Old string
+	New string
+}
+
+// AuditClient is the part of a Redis client an AuditLog uses, which every
+// go-redis client implements.
+type AuditClient interface {
+	XAdd(ctx context.Context, a *redis.XAddArgs) *redis.StringCmd
+	XRevRangeN(ctx context.Context, stream, start, stop string, count int64) *redis.XMessageSliceCmd
+}
+
+// AuditLog appends AuditEntries to a capped Redis Stream so changes to
+// limits can be traced. Give it to the management APIs with WithAuditLog and
+// WithLimitStoreAuditLog.
+type AuditLog struct {
+	rdb    AuditClient
+	stream string
+	maxLen int64
+	clock  Clock
+}
+
+// NewAuditLog returns an AuditLog writing to the Redis stream key.
+func NewAuditLog(rdb AuditClient, stream string, options ...func(*AuditLog)) *AuditLog {
+	a := &AuditLog{
+		rdb:    rdb,
+		stream: stream,
+		maxLen: DefaultAuditMaxLen,
+	}
+	for _, option := range options {
+		option(a)
+	}
+	return a
+}
+
+// WithAuditMaxLen caps the stream at approximately maxLen entries.
+func WithAuditMaxLen(maxLen int64) func(*AuditLog) {
+	return func(a *AuditLog) {
+		a.maxLen = maxLen
+	}
+}
+
+// WithAuditClock makes the AuditLog stamp entries with clock instead of the
+// wall clock, such as the Clock given to the Limiter with WithClock.
+func WithAuditClock(clock Clock) func(*AuditLog) {
+	return func(a *AuditLog) {
+		a.clock = clock
+	}
+}
+
+// WithAuditLog records the Limiter's BumpEpoch, ResetMany, RestoreState,
+// Ban, Unban, GrantBoost, RevokeBoost, Freeze and Unfreeze calls to log.
+func WithAuditLog(log *AuditLog) func(*Limiter) {
+	return func(l *Limiter) {
+		l.audit = log
+	}
+}
+
+// WithLimitStoreAuditLog records changes made through the LimitStore to log.
+func WithLimitStoreAuditLog(log *AuditLog) func(*LimitStore) {
+	return func(s *LimitStore) {
+		s.audit = log
+	}
+}
+
+type actorKey struct{}
+
+// WithActor returns a copy of ctx naming who is making changes with it, such
+// as an operator's user name, for the AuditLog.
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFromContext returns the actor set with WithActor.
+func ActorFromContext(ctx context.Context) string {
+	actor, _ := ctx.Value(actorKey{}).(string)
+	return actor
+}
+
+// Record appends entry to the log. ID is ignored, and Time and Actor are
+// filled in from the clock and ctx if they are empty.
+func (a *AuditLog) Record(ctx context.Context, entry AuditEntry) error {
+	if entry.Time.IsZero() {
+		entry.Time = a.now()
+	}
+	if entry.Actor == "" {
+		entry.Actor = ActorFromContext(ctx)
+	}
+	return a.rdb.XAdd(ctx, &redis.XAddArgs{
+		Stream: a.stream,
+		MaxLen: a.maxLen,
+		Approx: true,
+		Values: []interface{}{
+			"time", entry.Time.UnixMilli(),
+			"actor", entry.Actor,
+			"action", entry.Action,
+			"target", entry.Target,
+			"old", entry.Old,
+			"new", entry.New,
+		},
+	}).Err()
+}
+
+// Recent returns up to count of the most recent entries, newest first. An
+// entry whose time cannot be read is returned with a zero Time.
+func (a *AuditLog) Recent(ctx context.Context, count int64) ([]AuditEntry, error) {
+	msgs, err := a.rdb.XRevRangeN(ctx, a.stream, "+", "-", count).Result()
+	if err != nil {
+		return nil, err
+	}
+	rv := make([]AuditEntry, 0, len(msgs))
+	for _, msg := range msgs {
+		entry := AuditEntry{
+			ID:     msg.ID,
+			Actor:  auditField(msg, "actor"),
+			Action: auditField(msg, "action"),
+			Target: auditField(msg, "target"),
+			Old:    auditField(msg, "old"),
+			New:    auditField(msg, "new"),
+		}
+		if ms, err := strconv.ParseInt(auditField(msg, "time"), 10, 64); err == nil {
+			entry.Time = time.UnixMilli(ms)
+		}
+		rv = append(rv, entry)
+	}
+	return rv, nil
+}
+
+func (a *AuditLog) now() time.Time {
+	if a.clock == nil {
+		return time.Now()
+	}
+	return a.clock.Now()
+}
+
+func auditField(msg redis.XMessage, field string) string {
+	v, _ := msg.Values[field].(string)
+	return v
+}
+
+// record appends an entry to a, which may be nil. The change has already
+// been made, so a failure is reported as such.
+func (a *AuditLog) record(ctx context.Context, action string, target string, oldValue string, newValue string) error {
+	if a == nil {
+		return nil
+	}
+	err := a.Record(ctx, AuditEntry{
+		Action: action,
+		Target: target,
+		Old:    oldValue,
+		New:    newValue,
+	})
+	if err != nil {
+		return fmt.Errorf("redis_rate: %s applied but not audited: %w", action, err)
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package redis_rate_test
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ductone/redis_rate/v11"
+)
+
+func TestAuditLog(t *testing.T) {
+	ctx := redis_rate.WithActor(context.Background(), "alice")
+	log := redis_rate.NewAuditLog(newTestRing(), "audit", redis_rate.WithAuditMaxLen(100))
+	l := newTestLimiter(t, true, redis_rate.WithEpochs(time.Hour), redis_rate.WithAuditLog(log))
+	store := redis_rate.NewLimitStore(newTestRing(), "limits", redis_rate.WithLimitStoreAuditLog(log))
+
+	require.NoError(t, store.Set(ctx, "tenant:*", redis_rate.PerSecond(10)))
+	require.NoError(t, store.Set(ctx, "tenant:*", redis_rate.PerSecond(20)))
+	require.NoError(t, store.Delete(ctx, "tenant:*"))
+	_, err := l.BumpEpoch(ctx)
+	require.NoError(t, err)
+
+	entries, err := log.Recent(ctx, 10)
+	require.NoError(t, err)
+	require.Len(t, entries, 4)
+
+	require.Equal(t, redis_rate.AuditEpochBump, entries[0].Action)
+	require.Equal(t, "rate:", entries[0].Target)
+	require.Equal(t, "1", entries[0].New)
+
+	require.Equal(t, redis_rate.AuditLimitDelete, entries[1].Action)
+	require.Equal(t, "20/20/1s", entries[1].Old)
+
+	require.Equal(t, redis_rate.AuditLimitSet, entries[2].Action)
+	require.Equal(t, "tenant:*", entries[2].Target)
+	require.Equal(t, "10/10/1s", entries[2].Old)
+	require.Equal(t, "20/20/1s", entries[2].New)
+
+	require.Equal(t, redis_rate.AuditLimitSet, entries[3].Action)
+	require.Equal(t, "", entries[3].Old)
+
+	for _, entry := range entries {
+		require.Equal(t, "alice", entry.Actor)
+		require.WithinDuration(t, time.Now(), entry.Time, time.Minute)
+	}
+}
+
+func TestAuditLogKeyChanges(t *testing.T) {
+	ctx := context.Background()
+	log := redis_rate.NewAuditLog(newTestRing(), "audit")
+	l := newTestLimiter(t, true,
+		redis_rate.WithBans(redis_rate.BanPolicy{}),
+		redis_rate.WithBoosts(),
+		redis_rate.WithFreezes(),
+		redis_rate.WithAuditLog(log))
+	r, err := redis_rate.NewLimitRegistry()
+	require.NoError(t, err)
+	r.SetAuditLog(log)
+
+	require.NoError(t, l.Ban(ctx, "test_id", time.Minute))
+	require.NoError(t, l.Unban(ctx, "test_id"))
+	_, err = l.GrantBoost(ctx, "test_id", 5, time.Minute)
+	require.NoError(t, err)
+	require.NoError(t, l.RevokeBoost(ctx, "test_id"))
+	require.NoError(t, l.Freeze(ctx, "test_id"))
+	require.NoError(t, l.Unfreeze(ctx, "test_id"))
+	require.NoError(t, r.Set(ctx, redis_rate.LimitEntry{Name: "pro", Limit: redis_rate.PerSecond(5)}))
+	require.NoError(t, r.Bind(ctx, "acme:*", "pro"))
+	require.NoError(t, r.Delete(ctx, "pro"))
+
+	entries, err := log.Recent(ctx, 20)
+	require.NoError(t, err)
+	var actions []string
+	for _, entry := range entries {
+		actions = append([]string{entry.Action}, actions...)
+	}
+	require.Equal(t, []string{
+		redis_rate.AuditBan,
+		redis_rate.AuditUnban,
+		redis_rate.AuditBoostGrant,
+		redis_rate.AuditBoostRevoke,
+		redis_rate.AuditFreeze,
+		redis_rate.AuditUnfreeze,
+		redis_rate.AuditRegistrySet,
+		redis_rate.AuditRegistryBind,
+		redis_rate.AuditRegistryDelete,
+	}, actions)
+
+	require.Equal(t, "test_id", entries[8].Target)
+	require.Equal(t, "1m0s", entries[8].New)
+	require.Equal(t, "5 tokens for 1m0s", entries[6].New)
+	require.Equal(t, "pro: 5 req/s (burst 5)", entries[2].New)
+	require.Equal(t, "acme:*", entries[1].Target)
+	require.Equal(t, "pro", entries[1].New)
+	require.Equal(t, "pro: 5 req/s (burst 5)", entries[0].Old)
+}
+
+// streamConn is an AuditClient holding a single stream in memory.
+type streamConn struct {
+	msgs []redis.XMessage
+}
+
+func (c *streamConn) XAdd(ctx context.Context, a *redis.XAddArgs) *redis.StringCmd {
+	values := a.Values.([]interface{})
+	msg := redis.XMessage{ID: strconv.Itoa(len(c.msgs)) + "-0", Values: map[string]interface{}{}}
+	for i := 0; i < len(values); i += 2 {
+		msg.Values[values[i].(string)] = fmt.Sprint(values[i+1])
+	}
+	c.msgs = append(c.msgs, msg)
+	return redis.NewStringResult(msg.ID, nil)
+}
+
+func (c *streamConn) XRevRangeN(ctx context.Context, stream, start, stop string, count int64) *redis.XMessageSliceCmd {
+	var rv []redis.XMessage
+	for i := len(c.msgs) - 1; i >= 0 && int64(len(rv)) < count; i-- {
+		rv = append(rv, c.msgs[i])
+	}
+	return redis.NewXMessageSliceCmdResult(rv, nil)
+}
+
+func TestAuditLogClock(t *testing.T) {
+	ctx := context.Background()
+	conn := &streamConn{}
+	clock := redis_rate.NewManualClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	log := redis_rate.NewAuditLog(conn, "audit", redis_rate.WithAuditClock(clock))
+
+	require.NoError(t, log.Record(ctx, redis_rate.AuditEntry{Action: redis_rate.AuditReset}))
+	conn.msgs[0].Values["time"] = "yesterday"
+	clock.Advance(time.Minute)
+	require.NoError(t, log.Record(ctx, redis_rate.AuditEntry{Action: redis_rate.AuditBan}))
+
+	// an entry with a bad time is kept, with a zero Time.
+	entries, err := log.Recent(ctx, 10)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	require.Equal(t, redis_rate.AuditBan, entries[0].Action)
+	require.True(t, clock.Now().Equal(entries[0].Time))
+	require.Equal(t, redis_rate.AuditReset, entries[1].Action)
+	require.True(t, entries[1].Time.IsZero())
+}
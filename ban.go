@@ -0,0 +1,121 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrInvalidBan is returned by Ban for a non-positive duration.
+var ErrInvalidBan = errors.New("redis_rate: ban duration must be positive")
+
+// Defaults used by WithBans for unset BanPolicy fields.
+const (
+	DefaultBanWindow   = time.Minute
+	DefaultBanDuration = 10 * time.Minute
+)
+
+// BanPolicy escalates repeat offenders to a ban. See WithBans.
+type BanPolicy struct {
+	// Denials is the number of denials within Window after which a key is
+	// banned. If 0 keys are only banned with Ban.
+	Denials int
+
+	// Window is the time denials are counted over. If unset the default is
+	// DefaultBanWindow.
+	Window time.Duration
+
+	// Duration is how long an automatic ban lasts. If unset the default is
+	// DefaultBanDuration.
+	Duration time.Duration
+}
+
+// WithBans makes AllowN, Allow, AllowCost and Pipeline allows with rolling
+// limits deny every request for a key while it is banned, with
+// Result.Banned set and RetryAfter the time until the ban ends, and ban keys
+// that keep being denied as policy says. Keys are also banned with Ban and
+// unbanned with Unban. Requests denied during a ban are not charged to the
+// key.
+//
+// The ban is kept next to the key's state, in the same Redis Cluster slot.
+// Bans are not checked, nor denials counted, by AllowAtMost, calendar
+// limits or other methods, and WithBatching and WithLocalTokenCache are
+// bypassed.
+func WithBans(policy BanPolicy) Option {
+	if policy.Denials < 0 {
+		policy.Denials = 0
+	}
+	if policy.Window <= 0 {
+		policy.Window = DefaultBanWindow
+	}
+	if policy.Duration <= 0 {
+		policy.Duration = DefaultBanDuration
+	}
+	return func(l *Limiter) {
+		l.bans = &policy
+	}
+}
+
+// Ban bans key for d, replacing any ban it already has.
+func (l *Limiter) Ban(ctx context.Context, key string, d time.Duration) error {
+	if err := l.checkWritable("Ban"); err != nil {
+		return err
+	}
+	if d <= 0 {
+		return ErrInvalidBan
+	}
+	_, err := l.runBan(ctx, key, d.Milliseconds())
+	if err != nil {
+		return err
+	}
+	return l.audit.record(ctx, AuditBan, key, "", d.String())
+}
+
+// Unban lifts the ban of key and forgets its recent denials.
+func (l *Limiter) Unban(ctx context.Context, key string) error {
+	if err := l.checkWritable("Unban"); err != nil {
+		return err
+	}
+	_, err := l.runBan(ctx, key, 0)
+	if err != nil {
+		return err
+	}
+	l.denials.forget(key)
+	return l.audit.record(ctx, AuditUnban, key, "", "")
+}
+
+// BannedFor returns the time left of the ban of key, or 0 if it is not
+// banned.
+func (l *Limiter) BannedFor(ctx context.Context, key string) (time.Duration, error) {
+	return l.runBan(ctx, key, -1)
+}
+
+func (l *Limiter) runBan(ctx context.Context, key string, ttl int64) (time.Duration, error) {
+	args := getScriptArgs()
+	args.key(l.allowKeyPrefix(ctx), l.hashTagged(key))
+	l.banKeys(ctx, args, key)
+	args.int(ttl)
+	left, err := l.runScript(ctx, banScript, args.keys, args.args...).Int64()
+	args.release()
+	if err != nil || left < 0 {
+		return 0, err
+	}
+	return time.Duration(left) * time.Millisecond, nil
+}
+
+// banArgs appends the policy of the Limiter's bans and the keys holding the
+// ban of key and its recent denials to args, as script_allow_n.lua takes
+// them.
+func (l *Limiter) banArgs(ctx context.Context, args *scriptArgs, key string) {
+	args.int(int64(l.bans.Denials)).
+		float(l.bans.Window.Seconds()).
+		float(l.bans.Duration.Seconds())
+	l.banKeys(ctx, args, key)
+}
+
+// banKeys appends the keys holding the ban of key and its recent denials to
+// args.
+func (l *Limiter) banKeys(ctx context.Context, args *scriptArgs, key string) {
+	rkey := l.allowKeyPrefix(ctx) + l.hashTagged(key)
+	args.key(sideKey(rkey, ":ban"), "").key(sideKey(rkey, ":strikes"), "")
+}
@@ -0,0 +1,143 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// WithBatching coalesces concurrent Allow calls for the same key and limit
+// made within window of each other into a single round trip to Redis,
+// trading up to window of added latency for fewer commands under high
+// load. A batch is sent as soon as it holds maxBatch calls, or when window
+// has passed since its first call; a maxBatch of 0 means no limit.
+//
+// The batch takes as many events as the limit allows, up to one per call,
+// and they are granted to the calls in the order they joined the batch, so
+// results are the same as if the calls had been made one after another.
+// Only Allow, and AllowN with n of 1, are batched, and not for calendar
+// limits. A batch is sent with the context of its first call, so if that
+// context is canceled every call in the batch fails.
+func WithBatching(window time.Duration, maxBatch int) Option {
+	return func(l *Limiter) {
+		l.batcher = &batcher{
+			l:        l,
+			window:   window,
+			maxBatch: maxBatch,
+			pending:  make(map[localKey]*batch),
+		}
+	}
+}
+
+type batcher struct {
+	l        *Limiter
+	window   time.Duration
+	maxBatch int
+
+	mu      sync.Mutex
+	pending map[localKey]*batch
+}
+
+// localKey identifies the state of a key and limit kept in process.
+type localKey struct {
+	prefix string
+	key    string
+	limit  Limit
+}
+
+type batch struct {
+	n    int
+	full chan struct{}
+	done chan struct{}
+	res  *Result
+	err  error
+}
+
+// batchable reports whether an allow of n events with limit may be batched.
+func (b *batcher) batchable(limit Limit, n int, atMost bool) bool {
+	return b != nil && !b.l.extendedAllows() && n == 1 && !atMost && limit.Calendar == CalendarNone &&
+		limit.WarmUp == 0
+}
+
+// allow joins, or starts, the batch for key and limit and returns this
+// call's share of its result. The first call of a batch sends it.
+func (b *batcher) allow(ctx context.Context, key string, limit Limit) (*Result, error) {
+	bk := localKey{
+		prefix: b.l.localPrefix(ctx),
+		key:    key,
+		limit:  limit,
+	}
+
+	b.mu.Lock()
+	bt := b.pending[bk]
+	first := bt == nil
+	if first {
+		bt = &batch{
+			full: make(chan struct{}),
+			done: make(chan struct{}),
+		}
+		b.pending[bk] = bt
+	}
+	index := bt.n
+	bt.n++
+	if bt.n == b.maxBatch {
+		delete(b.pending, bk)
+		close(bt.full)
+	}
+	b.mu.Unlock()
+
+	if first {
+		timer := time.NewTimer(b.window)
+		select {
+		case <-timer.C:
+		case <-bt.full:
+			timer.Stop()
+		}
+
+		b.mu.Lock()
+		if b.pending[bk] == bt {
+			delete(b.pending, bk)
+		}
+		n := bt.n
+		b.mu.Unlock()
+
+		bt.res, bt.err = b.l.runAllow(ctx, allowAtMost, key, limit, n)
+		close(bt.done)
+	} else {
+		<-bt.done
+	}
+
+	if bt.err != nil {
+		return nil, bt.err
+	}
+	return bt.share(index), nil
+}
+
+// share returns the result of the index'th call in the batch.
+func (bt *batch) share(index int) *Result {
+	res := bt.res
+	rv := &Result{
+		Key:        res.Key,
+		Limit:      res.Limit,
+		RetryAfter: -1,
+		ResetAfter: res.ResetAfter,
+	}
+	allowed := int(res.Allowed)
+	switch {
+	case index < allowed:
+		rv.Allowed = 1
+		rv.Remaining = res.Remaining + int64(allowed-1-index)
+	case allowed == 0:
+		rv.RetryAfter = res.RetryAfter
+	default:
+		// the batch used up the burst, so one more event fits once the
+		// theoretical arrival time is within one emission interval.
+		emission, burstOffset := gcraParams(res.Limit)
+		rv.RetryAfter = res.ResetAfter - dur(burstOffset-emission)
+		if rv.RetryAfter < 0 {
+			rv.RetryAfter = 0
+		}
+	}
+	rv.stamp(res.at, res.now)
+	return rv
+}
@@ -0,0 +1,107 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// ErrInvalidBoost is returned by GrantBoost for a non-positive number of
+// tokens or ttl.
+var ErrInvalidBoost = errors.New("redis_rate: boost tokens and ttl must be positive")
+
+// WithBoosts makes AllowN, Allow and Pipeline allows spend a key's boost
+// tokens, granted with GrantBoost, before its limit. A request is allowed if
+// the boost tokens and the limit together cover it, and boost tokens are
+// only spent when it is; Result.Boosted reports how many were. Remaining
+// does not include boost tokens.
+//
+// Boost tokens are kept next to the key's state, in the same Redis Cluster
+// slot. They are not spent by AllowAtMost, AllowCost, calendar limits or
+// other methods, and WithBatching and WithLocalTokenCache are bypassed.
+func WithBoosts() Option {
+	return func(l *Limiter) {
+		l.boosts = true
+	}
+}
+
+// Boost is the stash of boost tokens of a key.
+type Boost struct {
+	Key string
+
+	// Tokens is the number of boost tokens left.
+	Tokens int64
+
+	// ExpiresAfter is the time until the tokens left expire, or -1 if there
+	// are none.
+	ExpiresAfter time.Duration
+}
+
+// GrantBoost adds tokens to key's boost tokens, such as goodwill credits
+// after an incident, and makes all of them expire after ttl. With
+// WithBoosts they are spent before key's limit.
+func (l *Limiter) GrantBoost(ctx context.Context, key string, tokens int64, ttl time.Duration) (*Boost, error) {
+	if err := l.checkWritable("GrantBoost"); err != nil {
+		return nil, err
+	}
+	if tokens <= 0 || ttl <= 0 {
+		return nil, ErrInvalidBoost
+	}
+	rv, err := l.runBoost(ctx, key, tokens, ttl, false)
+	if err != nil {
+		return nil, err
+	}
+	l.denials.forget(key)
+	return rv, l.audit.record(ctx, AuditBoostGrant, key, "",
+		strconv.FormatInt(tokens, 10)+" tokens for "+ttl.String())
+}
+
+// Boost returns the boost tokens left for key.
+func (l *Limiter) Boost(ctx context.Context, key string) (*Boost, error) {
+	return l.runBoost(ctx, key, 0, 0, false)
+}
+
+// RevokeBoost deletes the boost tokens left for key.
+func (l *Limiter) RevokeBoost(ctx context.Context, key string) error {
+	if err := l.checkWritable("RevokeBoost"); err != nil {
+		return err
+	}
+	_, err := l.runBoost(ctx, key, 0, 0, true)
+	if err != nil {
+		return err
+	}
+	return l.audit.record(ctx, AuditBoostRevoke, key, "", "")
+}
+
+func (l *Limiter) runBoost(ctx context.Context, key string, tokens int64, ttl time.Duration, revoke bool) (*Boost, error) {
+	args := getScriptArgs()
+	args.key(l.allowKeyPrefix(ctx), l.hashTagged(key))
+	l.boostKey(ctx, args, key)
+	args.int(tokens).int(ttl.Milliseconds())
+	if revoke {
+		args.int(1)
+	} else {
+		args.int(0)
+	}
+	reply := replyOf(l.runScript(ctx, boostScript, args.keys, args.args...))
+	args.release()
+
+	rv := &Boost{
+		Key:          key,
+		Tokens:       reply.int(0),
+		ExpiresAfter: -1,
+	}
+	if pttl := reply.int(1); pttl >= 0 {
+		rv.ExpiresAfter = time.Duration(pttl) * time.Millisecond
+	}
+	if reply.err != nil {
+		return nil, reply.err
+	}
+	return rv, nil
+}
+
+// boostKey appends the key holding key's boost tokens to args.
+func (l *Limiter) boostKey(ctx context.Context, args *scriptArgs, key string) {
+	args.key(sideKey(l.allowKeyPrefix(ctx)+l.hashTagged(key), ":boost"), "")
+}
@@ -0,0 +1,115 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"context"
+	"strconv"
+	"time"
+)
+
+// Calendar aligns a Limit to UTC calendar boundaries. A Limit with a
+// Calendar counts up to Rate events in fixed windows, such as a calendar
+// month, and starts over at the next boundary instead of spreading Rate over
+// a rolling Period. Burst is ignored.
+//
+// Window boundaries are computed from the Limiter's Clock, or the local
+// clock if it has none, rather than from Redis server time.
+type Calendar int
+
+const (
+	// CalendarNone is a rolling Limit evaluated with GCRA.
+	CalendarNone Calendar = iota
+
+	// CalendarDay resets at midnight UTC.
+	CalendarDay
+
+	// CalendarMonth resets at midnight UTC on the first of the month.
+	CalendarMonth
+)
+
+func (c Calendar) String() string {
+	switch c {
+	case CalendarNone:
+		return "none"
+	case CalendarDay:
+		return "day"
+	case CalendarMonth:
+		return "month"
+	default:
+		return "calendar(" + strconv.Itoa(int(c)) + ")"
+	}
+}
+
+// window returns the start and end of the window containing now.
+func (c Calendar) window(now time.Time) (time.Time, time.Time) {
+	now = now.UTC()
+	switch c {
+	case CalendarMonth:
+		start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, 1, 0)
+	default:
+		start := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+		return start, start.AddDate(0, 0, 1)
+	}
+}
+
+// PerDay allows rate events per UTC calendar day.
+func PerDay(rate int) Limit {
+	return Limit{
+		Rate:     rate,
+		Period:   24 * time.Hour,
+		Burst:    rate,
+		Calendar: CalendarDay,
+	}
+}
+
+// PerMonth allows rate events per UTC calendar month. Period is a nominal 30
+// days, which is only used where calendar windows are not supported, such as
+// by the local fallback and MemoryLimiter.
+func PerMonth(rate int) Limit {
+	return Limit{
+		Rate:     rate,
+		Period:   30 * 24 * time.Hour,
+		Burst:    rate,
+		Calendar: CalendarMonth,
+	}
+}
+
+// fixedWindowArgs appends the arguments of the fixed window script.
+func (l *Limiter) fixedWindowArgs(args *scriptArgs, limit Limit, n int, atMost bool) {
+	now := l.now()
+	start, end := limit.Calendar.window(now)
+	mode := int64(0)
+	if atMost {
+		mode = 1
+	}
+	args.int(int64(limit.Rate)).
+		int(int64(n)).
+		int(start.Unix()).
+		float(end.Sub(now).Seconds()).
+		int(mode)
+}
+
+func (l *Limiter) runFixedWindow(
+	ctx context.Context,
+	key string,
+	limit Limit,
+	n int,
+	atMost bool,
+) (*Result, error) {
+	args := getScriptArgs()
+	args.key(l.allowKeyPrefix(ctx), l.hashTagged(key))
+	l.fixedWindowArgs(args, limit, n, atMost)
+	l.freezeArgs(ctx, args, allowFixedWindow, key)
+	reply := replyOf(l.runScript(ctx, allowFixedWindow, args.keys, args.args...))
+	args.release()
+
+	rv := &Result{
+		Key:   key,
+		Limit: limit,
+	}
+	if err := rv.parseScriptResult(&reply); err != nil {
+		return nil, err
+	}
+	rv.stamp(l.now(), l.now)
+	return rv, nil
+}
@@ -0,0 +1,64 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"context"
+)
+
+// Request is a rate limit request as seen by a Classifier.
+type Request struct {
+	// Key is the key the caller asked for.
+	Key string
+
+	// Limit is the limit the caller asked for, after the default limit has
+	// been applied. It may be zero if there is no default.
+	Limit Limit
+
+	// Tags are the tags on the call's context.
+	Tags []Tag
+}
+
+// Classifier rewrites or annotates a Request before its Redis key is
+// derived, for example to collapse a crawler's IP range into a single key
+// or to give a class of clients a different limit. The returned Request's
+// Key and Limit are used in place of the caller's, and any Tags it adds are
+// attached to the call's context for hooks and traces. Return req unchanged
+// to leave it alone.
+type Classifier func(ctx context.Context, req Request) Request
+
+// WithClassifier sets the Classifier applied to every Allow, AllowN,
+// AllowAtMost, AllowCost, AllowSlidingWindow and Pipeline allow, including
+// those made by the httplimit middleware, and to each key of
+// AllowAtMostMulti, AllowNWithOverflow, AllowHierarchy, AllowTiered and
+// AllowDimensions. Results report the rewritten key and limit, and the tags
+// added for a key are passed to the hooks called for it.
+func WithClassifier(classifier Classifier) Option {
+	return func(l *Limiter) {
+		l.classifier = classifier
+	}
+}
+
+// classify applies the Limiter's Classifier, if any, to key and limit.
+func (l *Limiter) classify(ctx context.Context, key string, limit Limit) (context.Context, string, Limit) {
+	tags, key, limit := l.classifyTags(ctx, key, limit)
+	return WithTags(ctx, tags...), key, limit
+}
+
+// classifyTags is classify returning the tags added by the Classifier
+// rather than a context carrying them.
+func (l *Limiter) classifyTags(ctx context.Context, key string, limit Limit) ([]Tag, string, Limit) {
+	limit = l.limitOrDefault(limit)
+	if l.classifier == nil {
+		return nil, key, limit
+	}
+
+	tags := TagsFromContext(ctx)
+	req := l.classifier(ctx, Request{
+		Key:   key,
+		Limit: limit,
+		Tags:  tags,
+	})
+	if len(req.Tags) > len(tags) {
+		return req.Tags[len(tags):], req.Key, req.Limit
+	}
+	return nil, req.Key, req.Limit
+}
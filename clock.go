@@ -0,0 +1,74 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Clock tells the Limiter what time it is.
+type Clock interface {
+	Now() time.Time
+}
+
+// WithClock makes the Limiter use clock instead of the wall clock and Redis
+// TIME. The current time is passed to every script, so results depend only on
+// the clock and tests can advance time deterministically. Every process
+// sharing keys must use the same clock; it is not meant for production use.
+func WithClock(clock Clock) func(*Limiter) {
+	return func(s *Limiter) {
+		s.clock = clock
+	}
+}
+
+// ManualClock is a Clock that only moves when told to.
+type ManualClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// NewManualClock returns a ManualClock set to now.
+func NewManualClock(now time.Time) *ManualClock {
+	return &ManualClock{now: now}
+}
+
+func (c *ManualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d.
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// Set sets the clock to now.
+func (c *ManualClock) Set(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = now
+}
+
+func (l *Limiter) now() time.Time {
+	if l.clock == nil {
+		return time.Now()
+	}
+	return l.clock.Now()
+}
+
+// scriptNow is the "now" argument passed to scripts. It is empty, meaning
+// Redis TIME, unless the Limiter has a Clock.
+func (l *Limiter) scriptNow() string {
+	if l.clock == nil {
+		return ""
+	}
+	return strconv.FormatFloat(toScriptTime(l.clock.Now()), 'f', 6, 64)
+}
+
+// toScriptTime converts t to seconds since scriptEpoch.
+func toScriptTime(t time.Time) float64 {
+	return float64(t.Sub(time.Unix(scriptEpoch, 0))) / float64(time.Second)
+}
@@ -1,17 +1,23 @@
 package redis_rate //nolint:revive // upstream used this name
 
 import (
-	"bytes"
 	"context"
+	"errors"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 )
 
+var ErrInvalidWeight = errors.New("redis_rate: concurrency weight must be at least 1")
+
 type ConcurrencyLimit struct {
 	Max int64
 	// RequestMaxDuration is the time period in seconds over which the a request must complete.  If unset it defaults to 30 seconds.
 	RequestMaxDuration time.Duration
+	// MaxPerOwner, if set, is the most slots one owner may hold at once, so
+	// that one tenant cannot take every slot of a shared pool. It applies to
+	// takes made with TakeForOwner.
+	MaxPerOwner int64
 }
 
 type ConcurrencyResult struct {
@@ -36,167 +42,337 @@ type ConcurrencyResult struct {
 	// second and has already received 6 requests for this key this
 	// second, Remaining would be 4.
 	Remaining int64
+
+	// Err is set when this take failed in a Pipeline whose other
+	// operations may have succeeded. See PipelineError.
+	Err error
+
+	// QueuePosition is the 1-based position of the request among callers
+	// waiting for key when it was not allowed by TakeOrQueue or TakeOrWait,
+	// and 0 otherwise.
+	QueuePosition int64
+
+	// EstimatedWait is an estimate of how long a queued request will wait,
+	// based on recent hold durations for key and bounded by when current
+	// holders expire. It is -1 if no estimate is available.
+	EstimatedWait time.Duration
+
+	// Reason is why the take was denied, or empty if it was allowed.
+	Reason Reason
+
+	// Owner is the owner passed to TakeForOwner, and OwnerUsed the number
+	// of slots of key the owner holds, including those just taken.
+	Owner     string
+	OwnerUsed int64
+
+	// FencingToken is a number that increases with every slot granted for
+	// key, or 0 if the take was denied. A resource guarded by the slot can
+	// reject writes carrying a lower token than the highest it has seen,
+	// such as from a holder whose slot was reclaimed after
+	// RequestMaxDuration and granted to another request.
+	FencingToken int64
 }
 
 func (tk *Limiter) Take(ctx context.Context, key string, requestID string, limit ConcurrencyLimit) (ConcurrencyResult, error) {
-	rv, err := tk.takeMulti(ctx, requestID, map[string]ConcurrencyLimit{key: limit}, 0)
+	return tk.TakeN(ctx, key, requestID, limit, 1)
+}
+
+// TakeN acquires n slots of key for requestID at once. The slots are granted
+// all together or not at all, and Used and Remaining count slots rather than
+// requests. Releasing requestID frees all n slots.
+func (tk *Limiter) TakeN(ctx context.Context, key string, requestID string, limit ConcurrencyLimit, n int64) (ConcurrencyResult, error) {
+	if err := tk.checkWritable("TakeN"); err != nil {
+		return ConcurrencyResult{}, err
+	}
+	if n < 1 {
+		return ConcurrencyResult{}, ErrInvalidWeight
+	}
+	ctx, span := tk.startSpan(ctx, OpTake)
+	defer span.End()
+
+	start := time.Now()
+	rv, err := tk.takeMulti(ctx, requestID, "", []pair[string, ConcurrencyLimit]{{key, limit}}, n)
 	if err != nil {
+		tk.onConcurrency(ctx, OpTake, key, requestID, nil, start, err)
+		traceTake(span, key, requestID, nil, err)
 		return ConcurrencyResult{}, err
 	}
-	return rv[key], nil
+	cr := rv[0]
+	tk.onConcurrency(ctx, OpTake, key, requestID, &cr, start, nil)
+	traceTake(span, key, requestID, &cr, nil)
+	return cr, nil
 }
 
-func (p *pipeline) takePipe(ctx context.Context, pipe redis.Pipeliner, rv *ConcurrencyResult) func() error {
-	p.buf.Reset()
-	_, _ = p.buf.WriteString(p.l.concurrentPrefix)
-	_, _ = p.buf.WriteString(rv.Key)
+// TakeForOwner is Take on behalf of owner, such as the tenant a request
+// belongs to. The slot is denied with ReasonOwnerCap when owner already
+// holds limit.MaxPerOwner slots of key, even if the pool has slots left, and
+// the result reports the slots owner holds in OwnerUsed next to the pool's
+// Used. Slots taken with Take have no owner and only count towards the pool.
+func (tk *Limiter) TakeForOwner(ctx context.Context, key string, requestID string, owner string, limit ConcurrencyLimit) (ConcurrencyResult, error) {
+	if err := tk.checkWritable("TakeForOwner"); err != nil {
+		return ConcurrencyResult{}, err
+	}
+	ctx, span := tk.startSpan(ctx, OpTake)
+	defer span.End()
 
-	reqPeriod := rv.Limit.RequestMaxDuration.Round(time.Second) / time.Second
-	if reqPeriod <= 0 {
-		reqPeriod = 60
+	start := time.Now()
+	rv, err := tk.takeMulti(ctx, requestID, owner, []pair[string, ConcurrencyLimit]{{key, limit}}, 1)
+	if err != nil {
+		tk.onConcurrency(ctx, OpTake, key, requestID, nil, start, err)
+		traceTake(span, key, requestID, nil, err)
+		return ConcurrencyResult{}, err
 	}
+	cr := rv[0]
+	tk.onConcurrency(ctx, OpTake, key, requestID, &cr, start, nil)
+	traceTake(span, key, requestID, &cr, nil)
+	return cr, nil
+}
 
-	values := []interface{}{rv.RequestID, rv.Limit.Max, reqPeriod}
+// takePipe queues a take of rv on pipe and returns its command, to be
+// decoded by finishTake.
+func (p *pipeline) takePipe(ctx context.Context, pipe redis.Pipeliner, args *scriptArgs, rv *ConcurrencyResult) *redis.Cmd {
+	args.begin().key(p.l.concurrencyKey(rv.Key), "").key(p.l.fenceKey(rv.Key), "")
+	p.l.takeArgs(args, rv.RequestID, rv.Limit, 1)
+	return p.l.evalSha(ctx, pipe, concurrencyTake, args.keys, args.args...)
+}
 
-	eval := concurrencyTake.EvalSha(ctx, pipe, []string{p.buf.String()}, values...)
-	return func() error {
-		v, err := eval.Result()
-		if err != nil {
-			return err
-		}
-		values := v.([]interface{})
+// finishTake fills in rv from cmd, queued by takePipe.
+func (p *pipeline) finishTake(cmd *redis.Cmd, rv *ConcurrencyResult) error {
+	reply := replyOf(cmd)
+	ok := reply.int(0) == 1
+	current := reply.int(1)
+	token := reply.optInt(2)
+	if reply.err != nil {
+		rv.Err = reply.err
+		return reply.err
+	}
+	rv.Allowed = ok
+	rv.Reason = takeReason(ok)
+	rv.Used = current
+	rv.Remaining = rv.Limit.Max - current
+	rv.FencingToken = token
+	return nil
+}
 
-		ok := values[0].(int64) == 1
-		current := values[1].(int64)
-		rv.Allowed = ok
-		rv.Used = current
-		rv.Remaining = rv.Limit.Max - current
-		return nil
+// fenceKey is the counter of the fencing tokens of key.
+func (tk *Limiter) fenceKey(key string) string {
+	return sideKey(tk.concurrencyKey(key), ":fence")
+}
+
+// takeArgs appends the arguments of the concurrency take scripts.
+func (tk *Limiter) takeArgs(args *scriptArgs, requestID string, limit ConcurrencyLimit, weight int64) {
+	reqPeriod := limit.RequestMaxDuration.Round(time.Second) / time.Second
+	if reqPeriod <= 0 {
+		reqPeriod = 60
 	}
+	args.str(tk.HashRequestID(requestID)).
+		int(limit.Max).
+		int(int64(reqPeriod)).
+		int(weight).
+		str(tk.scriptNow())
 }
 
 func (tk *Limiter) Release(ctx context.Context, key string, requestID string, limit ConcurrencyLimit) error {
-	err := tk.releaseMulti(ctx, requestID, map[string]ConcurrencyLimit{key: limit})
-	if err != nil {
-		return err
+	return tk.ReleaseMulti(ctx, requestID, map[string]ConcurrencyLimit{key: limit})
+}
+
+// releasePipe queues the releases in items on pipe and returns the command
+// of each release, in the same order.
+func (tk *Limiter) releasePipe(ctx context.Context, pipe redis.Pipeliner, items []pair[string, string]) []*redis.Cmd {
+	now := tk.scriptNow()
+	cmds := make([]*redis.Cmd, len(items))
+	for i, v := range items {
+		requestID := tk.HashRequestID(v.B)
+		cmds[i] = tk.evalSha(ctx, pipe, concurrencyRelease, []string{tk.concurrencyKey(v.A), tk.holdSamplesKey(v.A)}, requestID, now, holdSampleSize)
+		pipe.Publish(ctx, tk.releaseChannel(v.A), requestID)
 	}
-	return nil
+	return cmds
+}
+
+// releaseChannel is the pub/sub channel notified whenever a slot for key is
+// released, used to wake up callers blocked in TakeOrWait.
+func (tk *Limiter) releaseChannel(key string) string {
+	return tk.concurrencyKey(key) + ":released"
 }
 
-func (tk *Limiter) releasePipe(ctx context.Context, pipe redis.Pipeliner, items []pair[string, string]) {
-	buf := bytes.Buffer{}
-	for _, v := range items {
-		buf.Reset()
-		_, _ = buf.WriteString(tk.concurrentPrefix)
-		_, _ = buf.WriteString(v.A)
-		pipe.HDel(ctx, buf.String(), v.B)
+// ReleaseMulti releases the slots held by requestID on every key in limits
+// in a single round trip. Releasing a key that requestID does not hold is a
+// no-op, so it is safe to call with the same map passed to TakeMulti even when
+// some of those keys were denied.
+func (tk *Limiter) ReleaseMulti(ctx context.Context, requestID string, limits map[string]ConcurrencyLimit) (err error) {
+	defer tk.recoverPanic(OpRelease, "", &err)
+	if err := tk.checkWritable("ReleaseMulti"); err != nil {
+		return err
 	}
+	ctx, span := tk.startSpan(ctx, OpRelease)
+	defer span.End()
+	span.SetAttributes(
+		Attribute{AttrKeyCount, len(limits)},
+		Attribute{AttrRequestID, requestID},
+	)
+
+	start := time.Now()
+	err = tk.releaseMulti(ctx, requestID, limits)
+	if err != nil {
+		span.RecordError(err)
+	}
+	for key := range limits {
+		tk.onConcurrency(ctx, OpRelease, key, requestID, nil, start, err)
+	}
+	return err
 }
 
 func (tk *Limiter) releaseMulti(ctx context.Context, requestID string, limits map[string]ConcurrencyLimit) error {
+	if len(limits) == 0 {
+		return nil
+	}
+
 	pl := tk.rdb.Pipeline()
 
 	// Release any concurrency limits.
-	buf := bytes.Buffer{}
+	requestID = tk.HashRequestID(requestID)
+	now := tk.scriptNow()
 	for key := range limits {
-		buf.Reset()
-		_, _ = buf.WriteString(tk.concurrentPrefix)
-		_, _ = buf.WriteString(key)
-		pl.HDel(ctx, buf.String(), requestID)
+		tk.evalSha(ctx, pl, concurrencyRelease, []string{tk.concurrencyKey(key), tk.holdSamplesKey(key)}, requestID, now, holdSampleSize)
+		pl.Publish(ctx, tk.releaseChannel(key), requestID)
 	}
 
-	if pl.Len() == 0 {
-		return nil
-	}
-
-	_, err := pl.Exec(ctx)
-	if err != nil {
+	cmds, err := pl.Exec(ctx)
+	if err != nil && !isScriptMissing(err) {
 		return err
 	}
+	tk.retryNoScript(ctx, cmds)
+	for _, cmd := range cmds {
+		if err := cmd.Err(); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-type takeResult struct {
-	key   string
-	limit ConcurrencyLimit
-	cmd   *redis.Cmd
-}
-
-func (tk *Limiter) takeMulti(ctx context.Context, requestID string, limits map[string]ConcurrencyLimit, depth int) (map[string]ConcurrencyResult, error) {
-	if depth > 10 {
-		return nil, ErrTooManyRetries
+// TakeMulti attempts to acquire a slot for requestID on every key in limits in
+// a single round trip. The returned map contains a result for each key.
+//
+// Each key is evaluated independently: a denial on one key does not prevent
+// or roll back slots acquired on the others. Callers that need all-or-nothing
+// semantics should check every result and call ReleaseMulti with the same
+// limits when any key was denied.
+func (tk *Limiter) TakeMulti(ctx context.Context, requestID string, limits map[string]ConcurrencyLimit) (map[string]ConcurrencyResult, error) {
+	if err := tk.checkWritable("TakeMulti"); err != nil {
+		return nil, err
 	}
+	ctx, span := tk.startSpan(ctx, OpTake)
+	defer span.End()
+	span.SetAttributes(
+		Attribute{AttrKeyCount, len(limits)},
+		Attribute{AttrRequestID, requestID},
+	)
 
-	results := make([]*takeResult, 0, len(limits))
-	buf := bytes.Buffer{}
-	pl := tk.rdb.Pipeline()
-	existsCmd := concurrencyTake.Exists(ctx, pl)
+	start := time.Now()
+	keys := make([]pair[string, ConcurrencyLimit], 0, len(limits))
 	for key, limit := range limits {
-		reqPeriod := limit.RequestMaxDuration.Round(time.Second) / time.Second
-		if reqPeriod <= 0 {
-			reqPeriod = 60
-		}
-		values := []interface{}{requestID, limit.Max, reqPeriod}
-
-		buf.Reset()
-		_, _ = buf.WriteString(tk.concurrentPrefix)
-		_, _ = buf.WriteString(key)
-
-		results = append(results, &takeResult{
-			key:   key,
-			limit: limit,
-			cmd: concurrencyTake.EvalSha(
-				ctx,
-				pl,
-				[]string{buf.String()},
-				values...,
-			),
-		})
-	}
-	if len(results) == 0 {
-		return nil, nil
+		keys = append(keys, pair[string, ConcurrencyLimit]{key, limit})
 	}
-	_, err := pl.Exec(ctx)
+	results, err := tk.takeMulti(ctx, requestID, "", keys, 1)
 	if err != nil {
+		span.RecordError(err)
+		for _, kl := range keys {
+			tk.onConcurrency(ctx, OpTake, kl.A, requestID, nil, start, err)
+		}
 		return nil, err
 	}
-
-	exists, err := existsCmd.Result()
-	if err != nil {
-		return nil, err
+	var rv map[string]ConcurrencyResult
+	if len(results) > 0 {
+		rv = make(map[string]ConcurrencyResult, len(results))
 	}
-	if len(exists) != 1 {
-		return nil, ErrScriptFailed
+	for i := range results {
+		rv[results[i].Key] = results[i]
+		tk.onConcurrency(ctx, OpTake, results[i].Key, requestID, &results[i], start, nil)
 	}
+	return rv, nil
+}
 
-	if !exists[0] {
-		err = tk.LoadScripts(ctx)
-		if err != nil {
-			return nil, err
+// takeMulti takes a slot of weight of every key in limits for requestID,
+// on behalf of owner if not empty, and returns the result of each in the
+// same order.
+func (tk *Limiter) takeMulti(
+	ctx context.Context,
+	requestID string,
+	owner string,
+	limits []pair[string, ConcurrencyLimit],
+	weight int64,
+) (rv []ConcurrencyResult, err error) {
+	defer tk.recoverPanic(OpTake, "", &err)
+	if tk.killed(ctx) {
+		rv = make([]ConcurrencyResult, len(limits))
+		for i, kl := range limits {
+			rv[i] = ConcurrencyResult{RequestID: requestID, Key: kl.A, Limit: kl.B, Owner: owner}
+			rv[i].kill()
 		}
-		return tk.takeMulti(ctx, requestID, limits, depth+1)
+		return rv, nil
 	}
+	rv, err = tk.takeMultiOnce(ctx, requestID, owner, limits, weight)
+	for attempt := 1; tk.retry.again(ctx, err, attempt); attempt++ {
+		tk.stats.retried(ctx)
+		rv, err = tk.takeMultiOnce(ctx, requestID, owner, limits, weight)
+	}
+	return rv, err
+}
 
-	rv := make(map[string]ConcurrencyResult, len(results))
-	for _, result := range results {
-		v, err := result.cmd.Result()
-		if err != nil {
-			return nil, err
+func (tk *Limiter) takeMultiOnce(
+	ctx context.Context,
+	requestID string,
+	owner string,
+	limits []pair[string, ConcurrencyLimit],
+	weight int64,
+) ([]ConcurrencyResult, error) {
+	if len(limits) == 0 {
+		return nil, nil
+	}
+	evals := make([]*redis.Cmd, len(limits))
+	args := getScriptArgs()
+	defer args.release()
+	pl := tk.rdb.Pipeline()
+	for i, kl := range limits {
+		args.begin().key(tk.concurrencyKey(kl.A), "").key(tk.fenceKey(kl.A), "")
+		tk.takeArgs(args, requestID, kl.B, weight)
+		if owner != "" {
+			args.str(owner).int(kl.B.MaxPerOwner)
 		}
-		values := v.([]interface{})
+		evals[i] = tk.evalSha(ctx, pl, concurrencyTake, args.keys, args.args...)
+	}
+	cmds, err := pl.Exec(ctx)
+	if err != nil && !isScriptMissing(err) {
+		return nil, err
+	}
+	tk.retryNoScript(ctx, cmds)
 
-		ok := values[0].(int64) == 1
-		current := values[1].(int64)
+	rv := make([]ConcurrencyResult, len(limits))
+	for i, kl := range limits {
+		reply := replyOf(evals[i])
+		ok := reply.int(0) == 1
+		current := reply.int(1)
 		cr := ConcurrencyResult{
-			RequestID: requestID,
-			Key:       result.key,
-			Allowed:   ok,
-			Limit:     result.limit,
-			Used:      current,
-			Remaining: result.limit.Max - current,
+			RequestID:    requestID,
+			Key:          kl.A,
+			Allowed:      ok,
+			Reason:       takeReason(ok),
+			Limit:        kl.B,
+			Used:         current,
+			Remaining:    kl.B.Max - current,
+			FencingToken: reply.optInt(2),
+		}
+		if owner != "" {
+			cr.Owner = owner
+			cr.OwnerUsed = reply.int(3)
+			if reply.int(4) == 1 {
+				cr.Reason = ReasonOwnerCap
+			}
 		}
-		rv[result.key] = cr
+		if reply.err != nil {
+			return nil, reply.err
+		}
+		rv[i] = cr
 	}
-
 	return rv, nil
 }
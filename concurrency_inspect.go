@@ -0,0 +1,237 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// scriptEpoch is the epoch, Jan 1 2017 00:00:00 UTC, that the Lua scripts
+// measure time from.
+const scriptEpoch = 1483228800
+
+// ConcurrencyUsage describes how much of a concurrency limit is in use.
+type ConcurrencyUsage struct {
+	// Name of the key used for this result.
+	Key string
+
+	// Limit is the limit that was used to obtain this result.
+	Limit ConcurrencyLimit
+
+	// Used is the number of slots currently held.
+	Used int64
+
+	// Remaining is the number of slots that could be taken right now.
+	Remaining int64
+
+	// Waiting is the number of callers blocked in TakeOrWait for this key.
+	// On Redis Cluster only waiters connected to the node that owns the key's
+	// release channel are counted.
+	Waiting int64
+}
+
+type snapshotCmds struct {
+	holders *redis.MapStringStringCmd
+	waiting *redis.MapStringIntCmd
+}
+
+// ConcurrencySnapshot reports the usage of every key in limits in a single
+// round trip without modifying any of them. Expired holders that have not
+// been pruned yet are not counted.
+func (tk *Limiter) ConcurrencySnapshot(ctx context.Context, limits map[string]ConcurrencyLimit) (map[string]ConcurrencyUsage, error) {
+	if len(limits) == 0 {
+		return nil, nil
+	}
+
+	pl := tk.rdb.Pipeline()
+	timeCmd := pl.Time(ctx)
+	cmds := make(map[string]snapshotCmds, len(limits))
+	for key := range limits {
+		cmds[key] = snapshotCmds{
+			holders: pl.HGetAll(ctx, tk.concurrencyKey(key)),
+			waiting: pl.PubSubNumSub(ctx, tk.releaseChannel(key)),
+		}
+	}
+
+	_, err := pl.Exec(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	now, err := timeCmd.Result()
+	if err != nil {
+		return nil, err
+	}
+	if tk.clock != nil {
+		now = tk.clock.Now()
+	}
+
+	rv := make(map[string]ConcurrencyUsage, len(limits))
+	for key, limit := range limits {
+		holders, err := cmds[key].holders.Result()
+		if err != nil {
+			return nil, err
+		}
+		waiting, err := cmds[key].waiting.Result()
+		if err != nil {
+			return nil, err
+		}
+
+		used := int64(0)
+		for _, v := range holders {
+			hv, err := parseHolder(v)
+			if err != nil {
+				return nil, err
+			}
+			if hv.expiresAt.Before(now) {
+				continue
+			}
+			used += hv.weight
+		}
+
+		rv[key] = ConcurrencyUsage{
+			Key:       key,
+			Limit:     limit,
+			Used:      used,
+			Remaining: limit.Max - used,
+			Waiting:   waiting[tk.releaseChannel(key)],
+		}
+	}
+
+	return rv, nil
+}
+
+// Holder is a request currently holding slots of a concurrency key.
+type Holder struct {
+	// RequestID is the request id passed to Take, hashed if the Limiter was
+	// created WithRequestIDHash.
+	RequestID string
+
+	// Slots is the number of slots held, which is n for TakeN and 1 otherwise.
+	Slots int64
+
+	// AcquiredAt is when the slots were taken. For slots taken by older
+	// versions it is derived from ExpiresAt and the limit's
+	// RequestMaxDuration.
+	AcquiredAt time.Time
+
+	// ExpiresAt is when the slots are reclaimed if they are not released.
+	ExpiresAt time.Time
+
+	// TTL is the time remaining until ExpiresAt, as seen by Redis.
+	TTL time.Duration
+
+	// Expired is true for holders past ExpiresAt that have not yet been pruned.
+	Expired bool
+
+	// Owner is the owner passed to TakeForOwner, or empty.
+	Owner string
+}
+
+// Holders returns the request ids holding slots of key, oldest first. The
+// limit is only used to derive AcquiredAt for slots taken by older versions
+// and should match the one passed to Take.
+func (tk *Limiter) Holders(ctx context.Context, key string, limit ConcurrencyLimit) ([]Holder, error) {
+	pl := tk.rdb.Pipeline()
+	timeCmd := pl.Time(ctx)
+	holdersCmd := pl.HGetAll(ctx, tk.concurrencyKey(key))
+	_, err := pl.Exec(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	now, err := timeCmd.Result()
+	if err != nil {
+		return nil, err
+	}
+	if tk.clock != nil {
+		now = tk.clock.Now()
+	}
+	holders, err := holdersCmd.Result()
+	if err != nil {
+		return nil, err
+	}
+
+	maxDuration := limit.RequestMaxDuration.Round(time.Second)
+	if maxDuration <= 0 {
+		maxDuration = 60 * time.Second
+	}
+
+	rv := make([]Holder, 0, len(holders))
+	for requestID, v := range holders {
+		hv, err := parseHolder(v)
+		if err != nil {
+			return nil, err
+		}
+		acquiredAt := hv.acquiredAt
+		if acquiredAt.IsZero() {
+			acquiredAt = hv.expiresAt.Add(-maxDuration)
+		}
+		rv = append(rv, Holder{
+			RequestID:  requestID,
+			Slots:      hv.weight,
+			AcquiredAt: acquiredAt,
+			ExpiresAt:  hv.expiresAt,
+			TTL:        hv.expiresAt.Sub(now),
+			Expired:    hv.expiresAt.Before(now),
+			Owner:      hv.owner,
+		})
+	}
+
+	sort.Slice(rv, func(i, j int) bool {
+		return rv[i].AcquiredAt.Before(rv[j].AcquiredAt)
+	})
+	return rv, nil
+}
+
+type holderValue struct {
+	expiresAt  time.Time
+	acquiredAt time.Time
+	weight     int64
+	owner      string
+}
+
+// parseHolder decodes a value from a concurrency hash, which is the
+// expiration time, the number of slots held, the time they were taken and
+// their owner if any, separated by "|". Times are seconds since
+// scriptEpoch. Values written by older versions may be just the expiration
+// time, or omit the time taken.
+func parseHolder(v string) (holderValue, error) {
+	parts := strings.SplitN(v, "|", 4)
+	rv := holderValue{
+		weight: 1,
+	}
+
+	f, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil {
+		return holderValue{}, err
+	}
+	rv.expiresAt = fromScriptTime(f)
+
+	if len(parts) > 1 {
+		rv.weight, err = strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return holderValue{}, err
+		}
+	}
+	if len(parts) > 2 {
+		f, err = strconv.ParseFloat(parts[2], 64)
+		if err != nil {
+			return holderValue{}, err
+		}
+		rv.acquiredAt = fromScriptTime(f)
+	}
+	if len(parts) > 3 {
+		rv.owner = parts[3]
+	}
+	return rv, nil
+}
+
+// fromScriptTime converts seconds since scriptEpoch to a time.
+func fromScriptTime(f float64) time.Time {
+	return time.Unix(scriptEpoch, 0).Add(dur(f))
+}
@@ -2,11 +2,15 @@ package redis_rate_test
 
 import (
 	"context"
+	"net"
+	"strconv"
 	"testing"
 	"time"
 
-	"github.com/ductone/redis_rate/v11"
+	"github.com/redis/go-redis/v9"
 	"github.com/stretchr/testify/require"
+
+	"github.com/ductone/redis_rate/v11"
 )
 
 func TestTake(t *testing.T) {
@@ -59,3 +63,542 @@ func TestTake(t *testing.T) {
 	require.Equal(t, int64(1), r4.Used)
 	require.Equal(t, "test_id", r4.Key)
 }
+
+func TestTakeMulti(t *testing.T) {
+	l := newTestLimiter(t, true)
+	ctx := context.Background()
+
+	limits := map[string]redis_rate.ConcurrencyLimit{
+		"a": {Max: 1, RequestMaxDuration: time.Second * 5},
+		"b": {Max: 2, RequestMaxDuration: time.Second * 5},
+	}
+
+	r1, err := l.TakeMulti(ctx, "req1", limits)
+	require.NoError(t, err)
+	require.Len(t, r1, 2)
+	require.True(t, r1["a"].Allowed)
+	require.True(t, r1["b"].Allowed)
+
+	r2, err := l.TakeMulti(ctx, "req2", limits)
+	require.NoError(t, err)
+	require.False(t, r2["a"].Allowed)
+	require.True(t, r2["b"].Allowed)
+	require.Equal(t, int64(0), r2["b"].Remaining)
+
+	err = l.ReleaseMulti(ctx, "req2", limits)
+	require.NoError(t, err)
+	err = l.ReleaseMulti(ctx, "req1", limits)
+	require.NoError(t, err)
+
+	r3, err := l.TakeMulti(ctx, "req3", limits)
+	require.NoError(t, err)
+	require.True(t, r3["a"].Allowed)
+	require.Equal(t, int64(1), r3["b"].Used)
+}
+
+func BenchmarkTake(b *testing.B) {
+	ctx := context.Background()
+	l := newTestLimiter(b, true)
+	limit := redis_rate.ConcurrencyLimit{Max: 1e9, RequestMaxDuration: time.Minute}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		res, err := l.Take(ctx, "foo", strconv.Itoa(i), limit)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if !res.Allowed {
+			panic("not reached")
+		}
+	}
+}
+
+func BenchmarkTakeMulti(b *testing.B) {
+	ctx := context.Background()
+	l := newTestLimiter(b, true)
+	limit := redis_rate.ConcurrencyLimit{Max: 1e9, RequestMaxDuration: time.Minute}
+	limits := map[string]redis_rate.ConcurrencyLimit{
+		"foo":                     limit,
+		"tenant:exmaple.company":  limit,
+		"ip:123.123.123.200":      limit,
+		"route:/api/v1/resources": limit,
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		res, err := l.TakeMulti(ctx, strconv.Itoa(i), limits)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for _, r := range res {
+			if !r.Allowed {
+				panic("not reached")
+			}
+		}
+	}
+}
+
+func TestTakeOrWait(t *testing.T) {
+	l := newTestLimiter(t, true)
+	ctx := context.Background()
+	limit := redis_rate.ConcurrencyLimit{
+		Max:                1,
+		RequestMaxDuration: time.Second * 5,
+	}
+
+	r1, err := l.Take(ctx, "test_id", "req1", limit)
+	require.NoError(t, err)
+	require.True(t, r1.Allowed)
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		_ = l.Release(ctx, "test_id", "req1", limit)
+	}()
+
+	waitCtx, cancel := context.WithTimeout(ctx, 500*time.Millisecond)
+	defer cancel()
+	r2, err := l.TakeOrWait(waitCtx, "test_id", "req2", limit)
+	require.NoError(t, err)
+	require.True(t, r2.Allowed)
+	require.Equal(t, "req2", r2.RequestID)
+
+	waitCtx, cancel = context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	_, err = l.TakeOrWait(waitCtx, "test_id", "req3", limit)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestTakeWithContext(t *testing.T) {
+	l := newTestLimiter(t, true)
+	ctx := context.Background()
+	limit := redis_rate.ConcurrencyLimit{Max: 1, RequestMaxDuration: time.Minute}
+
+	reqCtx, cancel := context.WithCancel(ctx)
+	slot, err := l.TakeWithContext(reqCtx, "test_id", "req1", limit)
+	require.NoError(t, err)
+	require.True(t, slot.Allowed())
+
+	denied, err := l.TakeWithContext(ctx, "test_id", "req2", limit)
+	require.NoError(t, err)
+	require.False(t, denied.Allowed())
+	require.NoError(t, denied.Release(ctx))
+
+	cancel()
+	select {
+	case <-slot.Done():
+	case <-time.After(time.Second):
+		t.Fatal("slot not released")
+	}
+	require.NoError(t, slot.Err())
+	require.ErrorIs(t, slot.Release(ctx), redis_rate.ErrSlotReleased)
+
+	slot, err = l.TakeWithContext(ctx, "test_id", "req3", limit)
+	require.NoError(t, err)
+	require.True(t, slot.Allowed())
+	require.NoError(t, slot.Release(ctx))
+	require.ErrorIs(t, slot.Release(ctx), redis_rate.ErrSlotReleased)
+
+	res, err := l.Take(ctx, "test_id", "req4", limit)
+	require.NoError(t, err)
+	require.True(t, res.Allowed)
+}
+
+func TestTakeN(t *testing.T) {
+	l := newTestLimiter(t, true)
+	ctx := context.Background()
+	limit := redis_rate.ConcurrencyLimit{
+		Max:                5,
+		RequestMaxDuration: time.Second * 5,
+	}
+
+	r1, err := l.TakeN(ctx, "test_id", "req1", limit, 3)
+	require.NoError(t, err)
+	require.True(t, r1.Allowed)
+	require.Equal(t, int64(3), r1.Used)
+	require.Equal(t, int64(2), r1.Remaining)
+
+	r2, err := l.TakeN(ctx, "test_id", "req2", limit, 3)
+	require.NoError(t, err)
+	require.False(t, r2.Allowed)
+	require.Equal(t, int64(3), r2.Used)
+
+	r3, err := l.Take(ctx, "test_id", "req3", limit)
+	require.NoError(t, err)
+	require.True(t, r3.Allowed)
+	require.Equal(t, int64(4), r3.Used)
+	require.Equal(t, int64(1), r3.Remaining)
+
+	err = l.Release(ctx, "test_id", "req1", limit)
+	require.NoError(t, err)
+
+	r4, err := l.TakeN(ctx, "test_id", "req4", limit, 4)
+	require.NoError(t, err)
+	require.True(t, r4.Allowed)
+	require.Equal(t, int64(5), r4.Used)
+
+	_, err = l.TakeN(ctx, "test_id", "req5", limit, 0)
+	require.ErrorIs(t, err, redis_rate.ErrInvalidWeight)
+}
+
+func TestTakeForOwner(t *testing.T) {
+	l := newTestLimiter(t, true)
+	ctx := context.Background()
+	limit := redis_rate.ConcurrencyLimit{
+		Max:                4,
+		RequestMaxDuration: time.Second * 5,
+		MaxPerOwner:        2,
+	}
+
+	for _, req := range []string{"req1", "req2"} {
+		r, err := l.TakeForOwner(ctx, "pool", req, "tenant|a", limit)
+		require.NoError(t, err)
+		require.True(t, r.Allowed)
+	}
+	r, err := l.TakeForOwner(ctx, "pool", "req3", "tenant|a", limit)
+	require.NoError(t, err)
+	require.False(t, r.Allowed)
+	require.Equal(t, redis_rate.ReasonOwnerCap, r.Reason)
+	require.Equal(t, int64(2), r.Used)
+	require.Equal(t, int64(2), r.OwnerUsed)
+
+	r, err = l.TakeForOwner(ctx, "pool", "req4", "tenant|b", limit)
+	require.NoError(t, err)
+	require.True(t, r.Allowed)
+	require.Equal(t, "tenant|b", r.Owner)
+	require.Equal(t, int64(3), r.Used)
+	require.Equal(t, int64(1), r.OwnerUsed)
+
+	// slots taken without an owner only count towards the pool.
+	r, err = l.Take(ctx, "pool", "req5", limit)
+	require.NoError(t, err)
+	require.True(t, r.Allowed)
+	r, err = l.TakeForOwner(ctx, "pool", "req6", "tenant|b", limit)
+	require.NoError(t, err)
+	require.False(t, r.Allowed)
+	require.Equal(t, redis_rate.ReasonQueueFull, r.Reason)
+	require.Equal(t, int64(1), r.OwnerUsed)
+
+	require.NoError(t, l.Release(ctx, "pool", "req1", limit))
+	r, err = l.TakeForOwner(ctx, "pool", "req7", "tenant|a", limit)
+	require.NoError(t, err)
+	require.True(t, r.Allowed)
+	require.Equal(t, int64(2), r.OwnerUsed)
+
+	holders, err := l.Holders(ctx, "pool", limit)
+	require.NoError(t, err)
+	owners := make(map[string]string)
+	for _, h := range holders {
+		owners[h.RequestID] = h.Owner
+	}
+	require.Equal(t, map[string]string{
+		"req2": "tenant|a",
+		"req4": "tenant|b",
+		"req5": "",
+		"req7": "tenant|a",
+	}, owners)
+}
+
+func TestSweep(t *testing.T) {
+	l := newTestLimiter(t, true)
+	ctx := context.Background()
+
+	_, err := l.Take(ctx, "test_id", "req1", redis_rate.ConcurrencyLimit{
+		Max:                2,
+		RequestMaxDuration: time.Second,
+	})
+	require.NoError(t, err)
+	_, err = l.Take(ctx, "test_id", "req2", redis_rate.ConcurrencyLimit{
+		Max:                2,
+		RequestMaxDuration: time.Second * 30,
+	})
+	require.NoError(t, err)
+
+	stats, err := l.Sweep(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), stats.Keys)
+	require.Equal(t, int64(0), stats.Reclaimed)
+
+	time.Sleep(1100 * time.Millisecond)
+
+	stats, err = l.Sweep(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), stats.Reclaimed)
+}
+
+func TestSweepRing(t *testing.T) {
+	ctx := context.Background()
+	addr := newTestRing().Options().Addrs["server0"]
+	_, port, err := net.SplitHostPort(addr)
+	require.NoError(t, err)
+
+	// Both shards are the test server, kept apart by using different DBs.
+	ring := redis.NewRing(&redis.RingOptions{
+		Addrs: map[string]string{
+			"server0": addr,
+			"server1": net.JoinHostPort("localhost", port),
+		},
+		NewClient: func(opt *redis.Options) *redis.Client {
+			if opt.Addr != addr {
+				opt.DB = 1
+			}
+			return redis.NewClient(opt)
+		},
+	})
+	defer ring.Close()
+	require.NoError(t, ring.ForEachShard(ctx, func(ctx context.Context, client *redis.Client) error {
+		return client.FlushDB(ctx).Err()
+	}))
+	l := redis_rate.New(ring)
+
+	limit := redis_rate.ConcurrencyLimit{Max: 2, RequestMaxDuration: time.Second}
+	for i := 0; i < 20; i++ {
+		_, err := l.Take(ctx, "test_id"+strconv.Itoa(i), "req1", limit)
+		require.NoError(t, err)
+	}
+
+	stats, err := l.Sweep(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(20), stats.Keys)
+}
+
+func TestConcurrencySnapshot(t *testing.T) {
+	l := newTestLimiter(t, true)
+	ctx := context.Background()
+	limits := map[string]redis_rate.ConcurrencyLimit{
+		"a": {Max: 4, RequestMaxDuration: time.Second * 5},
+		"b": {Max: 2, RequestMaxDuration: time.Second * 5},
+	}
+
+	_, err := l.TakeN(ctx, "a", "req1", limits["a"], 3)
+	require.NoError(t, err)
+
+	snap, err := l.ConcurrencySnapshot(ctx, limits)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), snap["a"].Used)
+	require.Equal(t, int64(1), snap["a"].Remaining)
+	require.Equal(t, int64(0), snap["b"].Used)
+	require.Equal(t, int64(2), snap["b"].Remaining)
+	require.Equal(t, int64(0), snap["b"].Waiting)
+}
+
+func TestHolders(t *testing.T) {
+	l := newTestLimiter(t, true)
+	ctx := context.Background()
+	limit := redis_rate.ConcurrencyLimit{
+		Max:                5,
+		RequestMaxDuration: time.Second * 10,
+	}
+
+	_, err := l.Take(ctx, "test_id", "req1", limit)
+	require.NoError(t, err)
+	_, err = l.TakeN(ctx, "test_id", "req2", limit, 2)
+	require.NoError(t, err)
+
+	holders, err := l.Holders(ctx, "test_id", limit)
+	require.NoError(t, err)
+	require.Len(t, holders, 2)
+	require.Equal(t, "req1", holders[0].RequestID)
+	require.Equal(t, int64(1), holders[0].Slots)
+	require.Equal(t, "req2", holders[1].RequestID)
+	require.Equal(t, int64(2), holders[1].Slots)
+	require.False(t, holders[1].Expired)
+	require.InDelta(t, 10*time.Second, holders[1].TTL, float64(time.Second))
+}
+
+func TestTakeOrQueue(t *testing.T) {
+	l := newTestLimiter(t, true)
+	ctx := context.Background()
+	limit := redis_rate.ConcurrencyLimit{
+		Max:                1,
+		RequestMaxDuration: time.Second * 10,
+	}
+
+	r1, err := l.TakeOrQueue(ctx, "test_id", "req1", limit)
+	require.NoError(t, err)
+	require.True(t, r1.Allowed)
+	require.Equal(t, int64(0), r1.QueuePosition)
+
+	r2, err := l.TakeOrQueue(ctx, "test_id", "req2", limit)
+	require.NoError(t, err)
+	require.False(t, r2.Allowed)
+	require.Equal(t, int64(1), r2.QueuePosition)
+	require.InDelta(t, 10*time.Second, r2.EstimatedWait, float64(time.Second))
+
+	r3, err := l.TakeOrQueue(ctx, "test_id", "req3", limit)
+	require.NoError(t, err)
+	require.False(t, r3.Allowed)
+	require.Equal(t, int64(2), r3.QueuePosition)
+
+	err = l.Release(ctx, "test_id", "req1", limit)
+	require.NoError(t, err)
+
+	// req2 is ahead in the queue, so req3 still has to wait.
+	r3, err = l.TakeOrQueue(ctx, "test_id", "req3", limit)
+	require.NoError(t, err)
+	require.False(t, r3.Allowed)
+	require.Equal(t, int64(2), r3.QueuePosition)
+
+	r2, err = l.TakeOrQueue(ctx, "test_id", "req2", limit)
+	require.NoError(t, err)
+	require.True(t, r2.Allowed)
+
+	r3, err = l.TakeOrQueue(ctx, "test_id", "req3", limit)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), r3.QueuePosition)
+}
+
+func TestTakeOrQueueDeadline(t *testing.T) {
+	clock := redis_rate.NewManualClock(time.Now())
+	l := newTestLimiter(t, true, redis_rate.WithClock(clock))
+	ctx := context.Background()
+	limit := redis_rate.ConcurrencyLimit{
+		Max:                1,
+		RequestMaxDuration: time.Second * 10,
+	}
+
+	r1, err := l.TakeOrQueue(ctx, "test_id", "req1", limit)
+	require.NoError(t, err)
+	require.True(t, r1.Allowed)
+
+	// req2 gives up after a second without leaving the queue.
+	dctx, cancel := context.WithDeadline(ctx, clock.Now().Add(time.Second))
+	defer cancel()
+	r2, err := l.TakeOrQueue(dctx, "test_id", "req2", limit)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), r2.QueuePosition)
+
+	r3, err := l.TakeOrQueue(ctx, "test_id", "req3", limit)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), r3.QueuePosition)
+
+	clock.Advance(2 * time.Second)
+	r3, err = l.TakeOrQueue(ctx, "test_id", "req3", limit)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), r3.QueuePosition)
+}
+
+func TestHoldStats(t *testing.T) {
+	clock := redis_rate.NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	l := newTestLimiter(t, true, redis_rate.WithClock(clock))
+	ctx := context.Background()
+	limit := redis_rate.ConcurrencyLimit{
+		Max:                10,
+		RequestMaxDuration: time.Minute,
+	}
+
+	stats, err := l.HoldStats(ctx, "test_id")
+	require.NoError(t, err)
+	require.Equal(t, 0, stats.Samples)
+
+	for i := 1; i <= 20; i++ {
+		_, err := l.Take(ctx, "test_id", "req", limit)
+		require.NoError(t, err)
+		clock.Advance(time.Duration(i) * time.Second)
+		err = l.Release(ctx, "test_id", "req", limit)
+		require.NoError(t, err)
+	}
+
+	stats, err = l.HoldStats(ctx, "test_id")
+	require.NoError(t, err)
+	require.Equal(t, 20, stats.Samples)
+	require.InDelta(t, 10500*time.Millisecond, stats.Mean, float64(time.Millisecond))
+	require.InDelta(t, 19*time.Second, stats.P95, float64(time.Millisecond))
+	require.InDelta(t, 20*time.Second, stats.Max, float64(time.Millisecond))
+}
+
+func TestRequestIDHash(t *testing.T) {
+	l := newTestLimiter(t, true, redis_rate.WithRequestIDHash([]byte("secret")))
+	ctx := context.Background()
+	limit := redis_rate.ConcurrencyLimit{
+		Max:                1,
+		RequestMaxDuration: time.Second * 10,
+	}
+
+	hashed := l.HashRequestID("alice@example.com")
+	require.NotEqual(t, "alice@example.com", hashed)
+	require.Len(t, hashed, 64)
+
+	res, err := l.Take(ctx, "test_id", "alice@example.com", limit)
+	require.NoError(t, err)
+	require.True(t, res.Allowed)
+
+	holders, err := l.Holders(ctx, "test_id", limit)
+	require.NoError(t, err)
+	require.Len(t, holders, 1)
+	require.Equal(t, hashed, holders[0].RequestID)
+
+	err = l.Release(ctx, "test_id", "alice@example.com", limit)
+	require.NoError(t, err)
+
+	holders, err = l.Holders(ctx, "test_id", limit)
+	require.NoError(t, err)
+	require.Empty(t, holders)
+}
+
+func TestHandoff(t *testing.T) {
+	l := newTestLimiter(t, true)
+	ctx := context.Background()
+	limit := redis_rate.ConcurrencyLimit{
+		Max:                1,
+		RequestMaxDuration: time.Second * 10,
+	}
+
+	r1, err := l.Take(ctx, "test_id", "worker1", limit)
+	require.NoError(t, err)
+	require.True(t, r1.Allowed)
+
+	r2, err := l.Handoff(ctx, "test_id", "worker1", "worker2", limit)
+	require.NoError(t, err)
+	require.True(t, r2.Allowed)
+	require.Equal(t, int64(1), r2.Used)
+	require.Equal(t, "worker2", r2.RequestID)
+
+	holders, err := l.Holders(ctx, "test_id", limit)
+	require.NoError(t, err)
+	require.Len(t, holders, 1)
+	require.Equal(t, "worker2", holders[0].RequestID)
+
+	_, err = l.Handoff(ctx, "test_id", "worker1", "worker3", limit)
+	require.ErrorIs(t, err, redis_rate.ErrNotHeld)
+
+	_, err = l.Handoff(ctx, "test_id", "worker2", "worker2", limit)
+	require.ErrorIs(t, err, redis_rate.ErrAlreadyHeld)
+
+	require.NoError(t, l.Release(ctx, "test_id", "worker2", limit))
+	r4, err := l.Take(ctx, "test_id", "worker4", limit)
+	require.NoError(t, err)
+	require.True(t, r4.Allowed)
+}
+
+func TestFencingTokens(t *testing.T) {
+	ctx := context.Background()
+	clock := redis_rate.NewManualClock(time.Now())
+	l := newTestLimiter(t, true, redis_rate.WithClock(clock))
+	limit := redis_rate.ConcurrencyLimit{
+		Max:                1,
+		RequestMaxDuration: time.Second,
+	}
+
+	r1, err := l.Take(ctx, "test_id", "req1", limit)
+	require.NoError(t, err)
+	require.True(t, r1.Allowed)
+	require.Greater(t, r1.FencingToken, int64(0))
+
+	r2, err := l.Take(ctx, "test_id", "req2", limit)
+	require.NoError(t, err)
+	require.False(t, r2.Allowed)
+	require.Equal(t, int64(0), r2.FencingToken)
+
+	// req1's slot is reclaimed, so its token is stale.
+	clock.Advance(2 * time.Second)
+	r2, err = l.Take(ctx, "test_id", "req2", limit)
+	require.NoError(t, err)
+	require.True(t, r2.Allowed)
+	require.Greater(t, r2.FencingToken, r1.FencingToken)
+
+	r3, err := l.Handoff(ctx, "test_id", "req2", "req3", limit)
+	require.NoError(t, err)
+	require.Greater(t, r3.FencingToken, r2.FencingToken)
+}
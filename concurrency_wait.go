@@ -0,0 +1,168 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// concurrencyWaitPoll bounds how long TakeOrWait sleeps between attempts.
+// Slots held by requests that exceed RequestMaxDuration expire without a
+// Release, so no notification is sent for them.
+const concurrencyWaitPoll = time.Second
+
+// redisSubscriber is implemented by clients that support pub/sub, such as
+// *redis.Client, *redis.Ring and *redis.ClusterClient.
+type redisSubscriber interface {
+	Subscribe(ctx context.Context, channels ...string) *redis.PubSub
+}
+
+// TakeOrQueue is like Take but grants slots in first-come, first-served
+// order among callers using TakeOrQueue and TakeOrWait. A request that is not
+// allowed joins the queue for key and the result reports its QueuePosition
+// and EstimatedWait. Call it again with the same requestID to retry without
+// losing its place, and DequeueTake to give up.
+//
+// Requests queued for longer than five times RequestMaxDuration are dropped
+// from the queue. If ctx has a deadline the request is also dropped once it
+// passes, so callers that gave up without DequeueTake do not hold up the
+// queue. Plain Take calls do not respect the queue.
+func (tk *Limiter) TakeOrQueue(ctx context.Context, key string, requestID string, limit ConcurrencyLimit) (_ ConcurrencyResult, err error) {
+	defer tk.recoverPanic(OpTakeOrQueue, key, &err)
+	if err := tk.checkWritable("TakeOrQueue"); err != nil {
+		return ConcurrencyResult{}, err
+	}
+	if tk.killed(ctx) {
+		rv := ConcurrencyResult{Key: key, RequestID: requestID, Limit: limit, EstimatedWait: -1}
+		rv.kill()
+		return rv, nil
+	}
+	args := getScriptArgs()
+	args.key(tk.concurrencyKey(key), "").
+		key(tk.queueKey(key), "").
+		key(tk.holdSamplesKey(key), "").
+		key(tk.queueDeadlinesKey(key), "").
+		key(tk.fenceKey(key), "")
+	tk.takeArgs(args, requestID, limit, 1)
+	waitFor := ""
+	if deadline, ok := ctx.Deadline(); ok {
+		waitFor = strconv.FormatFloat(deadline.Sub(tk.now()).Seconds(), 'f', -1, 64)
+	}
+	args.str(waitFor)
+	reply := replyOf(tk.runScript(ctx, concurrencyQueueTake, args.keys, args.args...))
+	args.release()
+
+	current := reply.int(1)
+	ok := reply.int(0) == 1
+	rv := ConcurrencyResult{
+		Key:           key,
+		RequestID:     requestID,
+		Limit:         limit,
+		Allowed:       ok,
+		Reason:        takeReason(ok),
+		FencingToken:  reply.optInt(4),
+		Used:          current,
+		Remaining:     limit.Max - current,
+		QueuePosition: reply.int(2),
+		EstimatedWait: reply.seconds(3),
+	}
+	if reply.err != nil {
+		return ConcurrencyResult{}, reply.err
+	}
+	return rv, nil
+}
+
+// DequeueTake removes requestID from the queue for key joined by
+// TakeOrQueue.
+func (tk *Limiter) DequeueTake(ctx context.Context, key string, requestID string) error {
+	if err := tk.checkWritable("DequeueTake"); err != nil {
+		return err
+	}
+	requestID = tk.HashRequestID(requestID)
+	pl := tk.rdb.Pipeline()
+	pl.ZRem(ctx, tk.queueKey(key), requestID)
+	pl.ZRem(ctx, tk.queueDeadlinesKey(key), requestID)
+	_, err := pl.Exec(ctx)
+	return err
+}
+
+func (tk *Limiter) queueKey(key string) string {
+	return sideKey(tk.concurrencyKey(key), ":queue")
+}
+
+// queueDeadlinesKey is the sorted set of when each waiter in the queue for
+// key gives up.
+func (tk *Limiter) queueDeadlinesKey(key string) string {
+	return sideKey(tk.concurrencyKey(key), ":queue:deadlines")
+}
+
+// TakeOrWait is like TakeOrQueue but blocks until a slot becomes available or
+// ctx is done, in which case the request leaves the queue and ctx.Err() is
+// returned.
+//
+// When the underlying client supports pub/sub, waiters are woken as soon as
+// a slot is released for key. Otherwise, and to pick up slots freed by
+// expiry, the slot is re-checked at least once per second.
+func (tk *Limiter) TakeOrWait(ctx context.Context, key string, requestID string, limit ConcurrencyLimit) (ConcurrencyResult, error) {
+	return tk.TakeOrWaitFunc(ctx, key, requestID, limit, nil)
+}
+
+// TakeOrWaitFunc is like TakeOrWait but calls progress with the queue
+// position and estimated wait after every attempt that was not allowed.
+func (tk *Limiter) TakeOrWaitFunc(
+	ctx context.Context,
+	key string,
+	requestID string,
+	limit ConcurrencyLimit,
+	progress func(ConcurrencyResult),
+) (ConcurrencyResult, error) {
+	var released <-chan *redis.Message
+	if sub, ok := tk.rdb.(redisSubscriber); ok {
+		ps := sub.Subscribe(ctx, tk.releaseChannel(key))
+		defer ps.Close()
+		// Wait for the subscription to be confirmed so that a release between
+		// the first Take and the subscription is not missed.
+		_, err := ps.Receive(ctx)
+		if err != nil {
+			return ConcurrencyResult{}, err
+		}
+		released = ps.Channel()
+	}
+
+	timer := time.NewTimer(concurrencyWaitPoll)
+	defer timer.Stop()
+
+	for {
+		rv, err := tk.TakeOrQueue(ctx, key, requestID, limit)
+		if err != nil {
+			return ConcurrencyResult{}, err
+		}
+		if rv.Allowed {
+			return rv, nil
+		}
+		if progress != nil {
+			progress(rv)
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(concurrencyWaitPoll)
+
+		select {
+		case <-ctx.Done():
+			// ctx is done, so leave the queue with a fresh context.
+			dctx, cancel := context.WithTimeout(context.Background(), concurrencyWaitPoll)
+			_ = tk.DequeueTake(dctx, key, requestID)
+			cancel()
+			return ConcurrencyResult{}, ctx.Err()
+		case <-released:
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// ConfigSnapshot is the effective configuration of a Limiter at a point in
+// time, taken by Limiter.ConfigSnapshot. Snapshots taken before and after a
+// rollout can be compared with DiffConfig to verify what actually changed.
+type ConfigSnapshot struct {
+	// Time is when the snapshot was taken.
+	Time time.Time
+
+	// Settings are the Limiter's options by name, such as "rate_prefix" or
+	// "default_limit", formatted as text. Options that are not set are left
+	// out.
+	Settings map[string]string
+
+	// Limits are the limits stored in the Limiter's LimitStore by pattern,
+	// or nil without one.
+	Limits map[string]Limit
+}
+
+// ConfigSnapshot returns the Limiter's effective configuration, reading the
+// current epoch and the limits of its LimitStore from Redis.
+func (l *Limiter) ConfigSnapshot(ctx context.Context) (*ConfigSnapshot, error) {
+	rv := &ConfigSnapshot{
+		Time:     l.now(),
+		Settings: l.settings(ctx),
+	}
+	if l.limitStore != nil {
+		limits, err := l.limitStore.All(ctx)
+		if err != nil {
+			return nil, err
+		}
+		rv.Limits = limits
+	}
+	return rv, nil
+}
+
+// settings returns the Settings of a ConfigSnapshot.
+func (l *Limiter) settings(ctx context.Context) map[string]string {
+	rv := map[string]string{
+		"rate_prefix":        l.ratePrefix,
+		"concurrency_prefix": l.concurrentPrefix,
+	}
+	set := func(name string, ok bool, value string) {
+		if ok {
+			rv[name] = value
+		}
+	}
+	set("default_limit", !l.defaultLimit.IsZero(), l.defaultLimit.String())
+	set("fallback", l.fallbackPolicy != FallbackNone, l.fallbackPolicy.String())
+	set("fallback_probe_interval", l.fallbackProbe > 0, l.fallbackProbe.String())
+	set("storage_format", l.storage != StorageText, l.storage.String())
+	set("key_ttl_factor", l.keyTTLFactor > 0 && l.keyTTLFactor != 1, strconv.FormatFloat(l.keyTTLFactor, 'g', -1, 64))
+	set("key_max_ttl", l.keyMaxTTL > 0, l.keyMaxTTL.String())
+	set("read_only", l.readOnly, "true")
+	set("shadow", l.shadow, "true")
+	set("kill_switch", l.killSwitch != nil, "true")
+	set("boosts", l.boosts, "true")
+	set("freezes", l.freezes, "true")
+	set("redis_functions", l.functions.active(), "true")
+	set("cluster_hash_tag", l.hashTag != nil, "true")
+	set("classifier", l.classifier != nil, "true")
+	set("request_id_hash", l.requestIDKey != nil, "true")
+	set("audit_log", l.audit != nil, "true")
+	set("hooks", len(l.hooks) > 0, strconv.Itoa(len(l.hooks)))
+	set("tracer", l.tracer != nil, "true")
+	set("panic_recovery", l.recoverPanics, "true")
+	if l.epoch != nil {
+		rv["epoch"] = strconv.FormatInt(l.Epoch(ctx), 10)
+		rv["epoch_refresh"] = l.epoch.refresh.String()
+	}
+	if b := l.batcher; b != nil {
+		rv["batching"] = fmt.Sprintf("window=%s max=%d", b.window, b.maxBatch)
+	}
+	if c := l.tokenCache; c != nil {
+		rv["local_token_cache"] = fmt.Sprintf("block=%d refill_below=%d max_staleness=%s max_keys=%d",
+			c.opts.Block, c.opts.RefillBelow, c.opts.MaxStaleness, c.opts.MaxKeys)
+	}
+	if c := l.denials; c != nil {
+		rv["denial_cache"] = fmt.Sprintf("max_ttl=%s max_keys=%d", c.maxTTL, c.maxKeys)
+	}
+	if r := l.retry; r != nil {
+		rv["retry"] = fmt.Sprintf("max_attempts=%d backoff=%s", r.maxAttempts, r.backoff)
+	}
+	if s := l.shares; s != nil {
+		rv["rate_shares"] = fmt.Sprintf("instance=%s interval=%s max_keys=%d",
+			s.opts.Instance, s.opts.Interval, s.opts.MaxKeys)
+	}
+	if s := l.shedder; s != nil {
+		rv["load_shedding"] = fmt.Sprintf("latency_threshold=%s error_rate_threshold=%g max_ratio=%g window=%d",
+			s.opts.LatencyThreshold, s.opts.ErrorRateThreshold, s.opts.MaxRatio, s.opts.Window)
+	}
+	if t := l.top; t != nil {
+		rv["top_consumers"] = t.window.String()
+	}
+	if f := l.fairness; f != nil {
+		rv["fairness"] = fmt.Sprintf("window=%s keep=%d", f.window, f.keep)
+	}
+	if c := l.decisions; c != nil {
+		rv["decision_cache"] = fmt.Sprintf("ttl=%s max_keys=%d", c.ttl, c.maxKeys)
+	}
+	if b := l.bans; b != nil {
+		rv["bans"] = fmt.Sprintf("denials=%d window=%s duration=%s", b.Denials, b.Window, b.Duration)
+	}
+	if l.pipelineBatchSize > 0 {
+		rv["pipeline_partitions"] = fmt.Sprintf("batch_size=%d concurrency=%d",
+			l.pipelineBatchSize, l.pipelineConcurrency)
+	}
+	set("pipeline_all_or_nothing", l.pipelineAllOrNothing, "true")
+	set("sharded_pipelines", l.pipelineSharding, fmt.Sprintf("concurrency=%d", l.shardConcurrency))
+	if s := l.limitStore; s != nil {
+		rv["limit_store"] = s.key
+		rv["limit_store_cache_ttl"] = s.ttl.String()
+		set("limit_store_grace_period", s.grace > 0, s.grace.String())
+	}
+	return rv
+}
+
+// ConfigChange is a single difference between two ConfigSnapshots.
+type ConfigChange struct {
+	// Name is the name of a setting, or "limit " followed by the pattern of
+	// a stored limit.
+	Name string
+
+	// Old and New are the values before and after, or "" where the setting
+	// or limit is absent.
+	Old string
+	New string
+}
+
+func (c ConfigChange) String() string {
+	switch {
+	case c.Old == "":
+		return fmt.Sprintf("%s: added %q", c.Name, c.New)
+	case c.New == "":
+		return fmt.Sprintf("%s: removed %q", c.Name, c.Old)
+	default:
+		return fmt.Sprintf("%s: %q -> %q", c.Name, c.Old, c.New)
+	}
+}
+
+// DiffConfig returns the differences from before to after, sorted by name.
+func DiffConfig(before, after *ConfigSnapshot) []ConfigChange {
+	var rv []ConfigChange
+	diff := func(a, b map[string]string) {
+		for name, v := range a {
+			if b[name] != v {
+				rv = append(rv, ConfigChange{Name: name, Old: v, New: b[name]})
+			}
+		}
+		for name, v := range b {
+			if _, ok := a[name]; !ok {
+				rv = append(rv, ConfigChange{Name: name, New: v})
+			}
+		}
+	}
+	diff(before.Settings, after.Settings)
+	diff(formatConfigLimits(before.Limits), formatConfigLimits(after.Limits))
+	sort.Slice(rv, func(i, j int) bool {
+		return rv[i].Name < rv[j].Name
+	})
+	return rv
+}
+
+// formatConfigLimits formats stored limits for DiffConfig.
+func formatConfigLimits(limits map[string]Limit) map[string]string {
+	rv := make(map[string]string, len(limits))
+	for pattern, limit := range limits {
+		rv["limit "+pattern] = limit.String()
+	}
+	return rv
+}
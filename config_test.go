@@ -0,0 +1,54 @@
+package redis_rate_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ductone/redis_rate/v11"
+)
+
+func TestConfigSnapshot(t *testing.T) {
+	ctx := context.Background()
+
+	before, err := newUnreachableLimiter().ConfigSnapshot(ctx)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"rate_prefix":        "rate:",
+		"concurrency_prefix": "concurrency:",
+	}, before.Settings)
+	require.Nil(t, before.Limits)
+
+	after, err := newUnreachableLimiter(
+		redis_rate.WithKeyPrefix("api:"),
+		redis_rate.WithDefaultLimit(redis_rate.PerSecond(10)),
+		redis_rate.WithFallback(redis_rate.FailOpen),
+		redis_rate.WithDenialCache(time.Second, 100),
+	).ConfigSnapshot(ctx)
+	require.NoError(t, err)
+
+	require.Empty(t, redis_rate.DiffConfig(before, before))
+	require.Equal(t, []redis_rate.ConfigChange{
+		{Name: "default_limit", New: "10 req/s (burst 10)"},
+		{Name: "denial_cache", New: "max_ttl=1s max_keys=100"},
+		{Name: "fallback", New: "fail_open"},
+		{Name: "rate_prefix", Old: "rate:", New: "api:"},
+	}, redis_rate.DiffConfig(before, after))
+
+	before.Limits = map[string]redis_rate.Limit{
+		"tenant:*": redis_rate.PerSecond(10),
+		"tenant:a": redis_rate.PerSecond(20),
+	}
+	after.Settings = before.Settings
+	after.Limits = map[string]redis_rate.Limit{
+		"tenant:*": redis_rate.PerSecond(5),
+	}
+	changes := redis_rate.DiffConfig(before, after)
+	require.Equal(t, []redis_rate.ConfigChange{
+		{Name: "limit tenant:*", Old: "10 req/s (burst 10)", New: "5 req/s (burst 5)"},
+		{Name: "limit tenant:a", Old: "20 req/s (burst 20)"},
+	}, changes)
+	require.Equal(t, `limit tenant:a: removed "20 req/s (burst 20)"`, changes[1].String())
+}
@@ -0,0 +1,156 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"context"
+	"errors"
+	"math"
+	"time"
+)
+
+// ErrInvalidCost is returned by AllowCost for a negative or NaN cost.
+var ErrInvalidCost = errors.New("redis_rate: cost must be a non-negative number")
+
+// AllowCost is like AllowN but charges a fractional cost, such as 0.25 for a
+// lightweight call and 3.5 for a heavy one. The request is allowed, with
+// Allowed set to 1, if the whole cost fits within the limit, and Cost and
+// RemainingCost report the exact amounts. Fractional and integer costs share
+// the same state, so AllowCost and AllowN can be mixed on a key.
+//
+// Calendar limits are not supported. When the Limiter's FallbackPolicy is in
+// effect the cost is rounded up to a whole number of events.
+func (l *Limiter) AllowCost(ctx context.Context, key string, limit Limit, cost float64) (_ *Result, err error) {
+	defer l.recoverPanic(OpAllowCost, key, &err)
+	ctx, key, limit = l.classify(ctx, key, limit)
+	ctx, span := l.startSpan(ctx, OpAllowCost)
+	defer span.End()
+
+	err = l.checkCost(limit, cost)
+	if err != nil {
+		traceAllow(span, key, limit, nil, err)
+		return nil, err
+	}
+
+	start := time.Now()
+	n := int(math.Ceil(cost))
+	var rv *Result
+	if l.killed(ctx) {
+		rv = &Result{Key: key, Limit: limit}
+		rv.kill()
+		rv.stamp(l.now(), l.now)
+	} else if l.fallback != nil && l.fallback.bypass() {
+		rv = l.fallbackCost(key, limit, n, cost)
+	} else if l.shadowed(ctx) {
+		rv, err = l.runAllowCost(ctx, key, limit, cost)
+		if err == nil {
+			rv.grantShadow(1)
+		}
+	} else {
+		rv, err = l.runAllowCost(ctx, key, limit, cost)
+		if l.fallback != nil && isUnavailable(ctx, err) {
+			l.fallback.markDown()
+			rv, err = l.fallbackCost(key, limit, n, cost), nil
+		}
+	}
+	l.onAllow(ctx, OpAllowCost, key, n, rv, start, err)
+	traceAllow(span, key, limit, rv, err)
+	if err != nil {
+		return nil, err
+	}
+	return rv, nil
+}
+
+func (l *Limiter) checkCost(limit Limit, cost float64) error {
+	if limit.IsZero() {
+		return ErrNoLimit
+	}
+	if limit.Calendar != CalendarNone {
+		return ErrCalendarLimit
+	}
+	if cost < 0 || math.IsNaN(cost) {
+		return ErrInvalidCost
+	}
+	return l.checkWritable("AllowCost")
+}
+
+func (l *Limiter) runAllowCost(ctx context.Context, key string, limit Limit, cost float64) (*Result, error) {
+	args := getScriptArgs()
+	args.key(l.allowKeyPrefix(ctx), l.hashTagged(key)).
+		int(int64(limit.Burst)).
+		int(int64(limit.Rate)).
+		float(limit.Period.Seconds()).
+		float(cost).
+		str(l.scriptNow()).
+		int(int64(limit.Penalty)).
+		str("1")
+	if l.bans != nil || l.freezes {
+		// the bans and freezes of allowExtraArgs without the boosts, so that
+		// the reply stays exact.
+		args.str("")
+		if l.bans != nil {
+			l.banArgs(ctx, args, key)
+		} else {
+			args.str("").str("").str("")
+		}
+		if l.freezes {
+			args.int(1)
+			l.frozenKey(ctx, args, key)
+		}
+	}
+	l.storageArgs(args, allowN)
+	l.warmUpArgs(args, allowN, limit)
+	reply := replyOf(l.runScript(ctx, allowN, args.keys, args.args...))
+	args.release()
+
+	rv := &Result{
+		Key:   key,
+		Limit: limit,
+	}
+	if err := rv.parseCostResult(&reply); err != nil {
+		return nil, err
+	}
+	rv.stamp(l.now(), l.now)
+	return rv, nil
+}
+
+// parseCostResult parses the result of script_allow_n.lua run with exact
+// results.
+func (rv *Result) parseCostResult(reply *scriptReply) error {
+	cost := reply.float(0)
+	remaining := reply.float(1)
+	retryAfter := reply.float(2)
+	resetAfter := reply.float(3)
+	denied := reply.optInt(6)
+	if reply.err != nil {
+		return reply.err
+	}
+
+	rv.Cost = cost
+	rv.RemainingCost = remaining
+	rv.Remaining = int64(math.Floor(remaining + 1e-9))
+	switch {
+	case denied == 1:
+		rv.Banned = true
+		rv.Reason = ReasonBanned
+	case denied == 2:
+		rv.Frozen = true
+		rv.Reason = ReasonFrozen
+	case retryAfter < 0:
+		rv.Allowed = 1
+	}
+	rv.RetryAfter = dur(retryAfter)
+	rv.ResetAfter = dur(resetAfter)
+	return nil
+}
+
+// fallbackCost evaluates a cost with the local fallback, which only counts
+// whole events.
+func (l *Limiter) fallbackCost(key string, limit Limit, n int, cost float64) *Result {
+	rv := l.fallback.allow(key, limit, n, false)
+	if rv.Allowed > 0 || n == 0 {
+		rv.Allowed = 1
+		rv.Cost = cost
+		rv.Reason = ""
+	}
+	rv.RemainingCost = float64(rv.Remaining)
+	return rv
+}
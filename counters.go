@@ -0,0 +1,138 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// defaultCounterFlushInterval is how often a windowCounter sends its counts
+// to Redis.
+const defaultCounterFlushInterval = time.Second
+
+// windowCounter adds up counts of the members of named sets in fixed windows
+// in process, and sends them to Redis in the background about once every
+// interval, in one round trip. It backs WithTopConsumers and WithFairness.
+type windowCounter struct {
+	l        *Limiter
+	window   time.Duration
+	keep     int
+	interval time.Duration
+
+	// key returns the Redis key of the set name in the window starting at
+	// the unix time start.
+	key func(start int64, name string) string
+
+	// incr queues adding n to member of the set in the Redis key on pipe.
+	incr func(ctx context.Context, pipe redis.Pipeliner, key string, member string, n int64)
+
+	mu        sync.Mutex
+	counts    map[windowCount]int64
+	lastFlush time.Time
+	flushing  bool
+}
+
+type windowCount struct {
+	start  int64
+	name   string
+	member string
+}
+
+// newWindowCounter returns a windowCounter keeping the sets of keep windows
+// in Redis.
+func newWindowCounter(l *Limiter, window time.Duration, keep int) *windowCounter {
+	return &windowCounter{
+		l:        l,
+		window:   window,
+		keep:     keep,
+		interval: defaultCounterFlushInterval,
+		counts:   make(map[windowCount]int64),
+	}
+}
+
+// start returns the unix time of the start of the window containing at.
+func (c *windowCounter) start(at time.Time) int64 {
+	return at.Truncate(c.window).Unix()
+}
+
+// record adds n to member of the set name in the current window, and sends
+// the counts to Redis in the background once they are due.
+func (c *windowCounter) record(name string, member string, n int64) {
+	if n <= 0 || c.l.readOnly {
+		return
+	}
+	now := c.l.now()
+	wc := windowCount{start: c.start(now), name: name, member: member}
+
+	c.mu.Lock()
+	c.counts[wc] += n
+	due := !c.flushing && now.Sub(c.lastFlush) >= c.interval
+	if due {
+		c.flushing = true
+		c.lastFlush = now
+	}
+	c.mu.Unlock()
+
+	if due {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), c.interval)
+			defer cancel()
+			_ = c.send(ctx)
+		}()
+	}
+}
+
+// flush sends the counts to Redis now.
+func (c *windowCounter) flush(ctx context.Context) error {
+	c.mu.Lock()
+	c.flushing = true
+	c.mu.Unlock()
+	return c.send(ctx)
+}
+
+// send sends the counts to Redis, keeping those of windows still kept for
+// the next time if that fails. c.flushing must be set by the caller and is
+// cleared.
+func (c *windowCounter) send(ctx context.Context) error {
+	c.mu.Lock()
+	counts := c.counts
+	c.counts = make(map[windowCount]int64)
+	c.mu.Unlock()
+
+	var err error
+	if len(counts) > 0 {
+		now := c.l.now()
+		pl := c.l.rdb.Pipeline()
+		expiring := make(map[string]bool)
+		for wc, n := range counts {
+			key := c.key(wc.start, wc.name)
+			c.incr(ctx, pl, key, wc.member, n)
+			if !expiring[key] {
+				expiring[key] = true
+				// relative to the Limiter's clock, which need not be Redis's.
+				ttl := time.Unix(wc.start, 0).Add(time.Duration(c.keep) * c.window).Sub(now)
+				if ttl < time.Second {
+					ttl = time.Second
+				}
+				pl.Expire(ctx, key, ttl)
+			}
+		}
+		_, err = pl.Exec(ctx)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.flushing = false
+	if err != nil {
+		oldest := c.start(c.l.now()) - int64(c.keep-1)*int64(c.window/time.Second)
+		for wc, n := range counts {
+			if wc.start >= oldest {
+				c.counts[wc] += n
+			}
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	// ErrScriptRegistered is returned by RegisterScript for a name already
+	// registered with a different script.
+	ErrScriptRegistered = errors.New("redis_rate: script already registered")
+
+	// ErrUnknownScript is returned by EvalCustom for a name that was not
+	// registered.
+	ErrUnknownScript = errors.New("redis_rate: unknown script")
+)
+
+// customScripts holds the scripts added with RegisterScript.
+var customScripts struct {
+	mu      sync.RWMutex
+	byName  map[string]*redis.Script
+	files   []scriptFile
+	sources map[string]string
+}
+
+// RegisterScript adds a Lua script under name, to be run with
+// Limiter.EvalCustom and Pipeline.EvalCustom. Registered scripts are loaded
+// by LoadScripts, checked by VerifyScripts and kept loaded by a
+// ScriptWatcher along with the Limiter's own, and are re-sent with EVAL on
+// nodes that lost them.
+//
+// Scripts are registered for every Limiter of the process, typically from
+// an init function. Registering the same script under the same name again
+// does nothing; registering another script under a taken name fails with
+// ErrScriptRegistered. They are always run with EVALSHA, also when the
+// Limiter uses WithRedisFunctions.
+func RegisterScript(name string, lua string) error {
+	if name == "" || lua == "" {
+		return errors.New("redis_rate: script name and source must not be empty")
+	}
+	script := redis.NewScript(lua)
+
+	customScripts.mu.Lock()
+	defer customScripts.mu.Unlock()
+	if s, ok := customScripts.byName[name]; ok {
+		if s.Hash() == script.Hash() {
+			return nil
+		}
+		return ErrScriptRegistered
+	}
+	if customScripts.byName == nil {
+		customScripts.byName = make(map[string]*redis.Script)
+		customScripts.sources = make(map[string]string)
+	}
+	customScripts.byName[name] = script
+	customScripts.sources[script.Hash()] = lua
+	customScripts.files = append(customScripts.files, scriptFile{name, lua, script})
+	return nil
+}
+
+// customScript returns the script registered under name.
+func customScript(name string) (*redis.Script, bool) {
+	customScripts.mu.RLock()
+	defer customScripts.mu.RUnlock()
+	s, ok := customScripts.byName[name]
+	return s, ok
+}
+
+// allScripts returns the Limiter's scripts followed by the registered ones.
+func allScripts() []scriptFile {
+	customScripts.mu.RLock()
+	defer customScripts.mu.RUnlock()
+	if len(customScripts.files) == 0 {
+		return scriptFiles
+	}
+	rv := make([]scriptFile, 0, len(scriptFiles)+len(customScripts.files))
+	rv = append(rv, scriptFiles...)
+	return append(rv, customScripts.files...)
+}
+
+// scriptSource returns the source of the script whose SHA1 is hash.
+func scriptSource(hash string) (string, bool) {
+	if src, ok := scriptSources[hash]; ok {
+		return src, true
+	}
+	customScripts.mu.RLock()
+	defer customScripts.mu.RUnlock()
+	src, ok := customScripts.sources[hash]
+	return src, ok
+}
+
+// EvalCustom runs the script registered under name with RegisterScript,
+// with keys and args, and returns its reply, or ErrUnknownScript if name was
+// not registered. The script is sent with EVALSHA and re-sent with EVAL if
+// the node lost it, and transient failures are retried as configured by
+// WithRetry, as for the Limiter's own scripts. Keys are used as given,
+// without the Limiter's prefixes, so on a cluster they must hash to the
+// same slot.
+func (l *Limiter) EvalCustom(ctx context.Context, name string, keys []string, args ...interface{}) (cmd *redis.Cmd) {
+	var panicErr error
+	defer func() {
+		if panicErr != nil {
+			cmd = redis.NewCmd(ctx)
+			cmd.SetErr(panicErr)
+		}
+	}()
+	defer l.recoverPanic(OpEvalCustom, "", &panicErr)
+	script, ok := customScript(name)
+	if !ok {
+		cmd := redis.NewCmd(ctx)
+		cmd.SetErr(ErrUnknownScript)
+		return cmd
+	}
+	if err := l.checkWritable("EvalCustom"); err != nil {
+		cmd := redis.NewCmd(ctx)
+		cmd.SetErr(err)
+		return cmd
+	}
+	ctx, span := l.startSpan(ctx, OpEvalCustom)
+	defer span.End()
+
+	cmd = l.runScript(ctx, script, keys, args...)
+	if err := cmd.Err(); err != nil && err != redis.Nil {
+		span.RecordError(err)
+	}
+	return cmd
+}
+
+// EvalCustom queues a run of the script registered under name, as
+// Limiter.EvalCustom. The returned command holds its reply after Exec, or
+// ErrUnknownScript if name was not registered.
+func (p *pipeline) EvalCustom(ctx context.Context, name string, keys []string, args ...interface{}) *redis.Cmd {
+	script, ok := customScript(name)
+	if !ok {
+		cmd := redis.NewCmd(ctx)
+		cmd.SetErr(ErrUnknownScript)
+		return cmd
+	}
+	cmdArgs := make([]interface{}, 0, 3+len(keys)+len(args))
+	cmdArgs = append(cmdArgs, "evalsha", script.Hash(), len(keys))
+	for _, key := range keys {
+		cmdArgs = append(cmdArgs, key)
+	}
+	cmdArgs = append(cmdArgs, args...)
+	cmd := redis.NewCmd(ctx, cmdArgs...)
+	p.customCommands = append(p.customCommands, cmd)
+	return cmd
+}
@@ -0,0 +1,30 @@
+package redis_rate_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ductone/redis_rate/v11"
+)
+
+func TestRegisterScript(t *testing.T) {
+	ctx := context.Background()
+
+	require.NoError(t, redis_rate.RegisterScript("test_register", "return 1"))
+	require.NoError(t, redis_rate.RegisterScript("test_register", "return 1"))
+	require.ErrorIs(t, redis_rate.RegisterScript("test_register", "return 2"), redis_rate.ErrScriptRegistered)
+	require.Error(t, redis_rate.RegisterScript("", "return 1"))
+	require.Error(t, redis_rate.RegisterScript("test_empty", ""))
+
+	l := newUnreachableLimiter()
+	cmd := l.EvalCustom(ctx, "test_missing", nil)
+	require.ErrorIs(t, cmd.Err(), redis_rate.ErrUnknownScript)
+
+	cmd = l.Pipeline().EvalCustom(ctx, "test_missing", nil)
+	require.ErrorIs(t, cmd.Err(), redis_rate.ErrUnknownScript)
+
+	cmd = redis_rate.NewMemory().Pipeline().EvalCustom(ctx, "test_register", nil)
+	require.ErrorIs(t, cmd.Err(), redis_rate.ErrScriptsUnsupported)
+}
@@ -0,0 +1,187 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// WithDecisionCache remembers, in process, that Redis allowed a request for
+// a trusted key, selected by trusted, and allows further requests for it
+// locally for ttl, taking Redis off the critical path of high-volume
+// internal callers. At most maxKeys verdicts are remembered at once.
+//
+// Once half of ttl has passed, the next request starts a revalidation in the
+// background, which charges the events allowed locally to the limit and
+// renews the verdict if they fit. If they do not, the verdict is dropped and
+// requests go to Redis again; if revalidation fails, the verdict expires
+// after ttl. In between, a trusted key may exceed its limit by whatever it
+// is sent within ttl, so ttl should be short.
+//
+// Results served locally report the Remaining and ResetAfter of the last
+// verdict. Calendar limits, AllowAtMost and requests for no events always go
+// to Redis, and Reset drops the verdicts of its key.
+func WithDecisionCache(trusted func(key string) bool, ttl time.Duration, maxKeys int) Option {
+	return func(l *Limiter) {
+		l.decisions = &decisionCache{
+			l:       l,
+			trusted: trusted,
+			ttl:     ttl,
+			maxKeys: maxKeys,
+			entries: make(map[localKey]*decision),
+		}
+	}
+}
+
+type decisionCache struct {
+	l       *Limiter
+	trusted func(key string) bool
+	ttl     time.Duration
+	maxKeys int
+
+	mu      sync.Mutex
+	entries map[localKey]*decision
+}
+
+// decision is a remembered verdict allowing a key.
+type decision struct {
+	mu           sync.Mutex
+	until        time.Time
+	pending      int64
+	revalidating bool
+
+	// last is the result of the last request that went to Redis.
+	last *Result
+}
+
+// cacheable reports whether an allow of n events of key with limit may be
+// served from the cache.
+func (c *decisionCache) cacheable(key string, limit Limit, n int, atMost bool) bool {
+	return c != nil && !c.l.extendedAllows() && !atMost && n >= 1 &&
+		limit.Calendar == CalendarNone && limit.WarmUp == 0 && c.trusted(key)
+}
+
+// allow allows n events of key locally if a verdict for it is remembered,
+// and otherwise asks Redis and remembers the verdict if it allowed them.
+func (c *decisionCache) allow(ctx context.Context, key string, limit Limit, n int) (*Result, error) {
+	lk := localKey{prefix: c.l.localPrefix(ctx), key: key, limit: limit}
+	if rv := c.lookup(lk, key, limit, n); rv != nil {
+		return rv, nil
+	}
+
+	rv, err := c.l.runAllow(ctx, allowN, key, limit, n)
+	if err != nil {
+		return nil, err
+	}
+	if rv.Allowed > 0 {
+		c.record(lk, rv)
+	}
+	return rv, nil
+}
+
+// lookup returns a result allowing n events from the verdict for lk, or nil,
+// and starts a revalidation when the verdict is due for one.
+func (c *decisionCache) lookup(lk localKey, key string, limit Limit, n int) *Result {
+	now := c.l.now()
+	c.mu.Lock()
+	d, ok := c.entries[lk]
+	if ok && !now.Before(d.until) {
+		delete(c.entries, lk)
+		ok = false
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	d.mu.Lock()
+	d.pending += int64(n)
+	rv := &Result{
+		Key:        key,
+		Limit:      limit,
+		Allowed:    int64(n),
+		Remaining:  d.last.Remaining,
+		RetryAfter: -1,
+		ResetAfter: d.last.ResetAfter - now.Sub(d.last.at),
+	}
+	revalidate := !d.revalidating && !now.Before(d.until.Add(-c.ttl/2))
+	if revalidate {
+		d.revalidating = true
+	}
+	d.mu.Unlock()
+
+	if rv.ResetAfter < 0 {
+		rv.ResetAfter = 0
+	}
+	rv.stamp(now, c.l.now)
+	if revalidate {
+		go c.revalidate(lk, d)
+	}
+	return rv
+}
+
+// record remembers the verdict rv for lk.
+func (c *decisionCache) record(lk localKey, rv *Result) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[lk]; !ok && len(c.entries) >= c.maxKeys {
+		for k, d := range c.entries {
+			d.mu.Lock()
+			expired := !d.revalidating && !rv.at.Before(d.until)
+			d.mu.Unlock()
+			if expired {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= c.maxKeys {
+			return
+		}
+	}
+	c.entries[lk] = &decision{
+		until: rv.at.Add(c.ttl),
+		last:  rv,
+	}
+}
+
+// revalidate charges the events allowed locally from d to Redis in the
+// background, renewing d if they fit and dropping it otherwise. Failures
+// are ignored; d then expires on its own.
+func (c *decisionCache) revalidate(lk localKey, d *decision) {
+	d.mu.Lock()
+	pending := d.pending
+	d.pending = 0
+	d.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.ttl)
+	defer cancel()
+	res, err := c.l.runAllow(ctx, allowAtMost, lk.key, lk.limit, int(pending))
+
+	d.mu.Lock()
+	d.revalidating = false
+	if err == nil && res.Allowed >= pending {
+		d.until = res.at.Add(c.ttl)
+		d.last = res
+	}
+	d.mu.Unlock()
+	if err == nil && res.Allowed < pending {
+		c.mu.Lock()
+		if c.entries[lk] == d {
+			delete(c.entries, lk)
+		}
+		c.mu.Unlock()
+	}
+}
+
+// forget removes the verdicts remembered for key.
+func (c *decisionCache) forget(key string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for lk := range c.entries {
+		if lk.key == key {
+			delete(c.entries, lk)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultDecisionQueueSize is the number of decisions an
+	// AsyncDecisionLog holds before it starts dropping them.
+	DefaultDecisionQueueSize = 10000
+
+	// DefaultDecisionBatchSize is the largest number of decisions an
+	// AsyncDecisionLog writes at once.
+	DefaultDecisionBatchSize = 500
+
+	// DefaultDecisionFlushInterval is how long an AsyncDecisionLog waits
+	// for a batch to fill before writing it anyway.
+	DefaultDecisionFlushInterval = time.Second
+
+	// DefaultDecisionWriteTimeout bounds each write of an AsyncDecisionLog.
+	DefaultDecisionWriteTimeout = 10 * time.Second
+)
+
+// DecisionSink stores batches of decisions written by an AsyncDecisionLog,
+// such as a Kafka topic or a DecisionLog. WriteDecisions is called from a
+// single goroutine and must not keep decisions after it returns.
+type DecisionSink interface {
+	WriteDecisions(ctx context.Context, decisions []Decision) error
+}
+
+// AsyncDecisionLogOptions controls the batching of an AsyncDecisionLog. Zero
+// fields use the defaults.
+type AsyncDecisionLogOptions struct {
+	QueueSize     int
+	BatchSize     int
+	FlushInterval time.Duration
+	WriteTimeout  time.Duration
+}
+
+// AsyncDecisionLogStats counts what happened to the decisions recorded to an
+// AsyncDecisionLog.
+type AsyncDecisionLogStats struct {
+	// Written is the number of decisions written to the sink.
+	Written int64
+
+	// Dropped is the number of decisions dropped because the queue was full
+	// or the log was closed.
+	Dropped int64
+
+	// Failed is the number of decisions lost to failed writes.
+	Failed int64
+
+	// Batches and Errors count the writes to the sink and those that failed.
+	Batches int64
+	Errors  int64
+}
+
+// AsyncDecisionLog records the Limiter's decisions to a DecisionSink in
+// batches from a background goroutine, so decisions can be logged at high
+// volume without a round trip per decision and without slowing down
+// allows. The queue is bounded: when the sink cannot keep up, decisions are
+// dropped and counted rather than held. Register it on a Limiter with
+// WithHooks(log.Hooks()) and close it on shutdown.
+type AsyncDecisionLog struct {
+	sink DecisionSink
+	opts AsyncDecisionLogOptions
+
+	mu     sync.RWMutex
+	closed bool
+	queue  chan Decision
+	done   chan struct{}
+	exited chan struct{}
+
+	written atomic.Int64
+	dropped atomic.Int64
+	failed  atomic.Int64
+	batches atomic.Int64
+	errors  atomic.Int64
+}
+
+// NewAsyncDecisionLog returns an AsyncDecisionLog writing to sink and starts
+// its goroutine.
+func NewAsyncDecisionLog(sink DecisionSink, opts AsyncDecisionLogOptions) *AsyncDecisionLog {
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = DefaultDecisionQueueSize
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultDecisionBatchSize
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = DefaultDecisionFlushInterval
+	}
+	if opts.WriteTimeout <= 0 {
+		opts.WriteTimeout = DefaultDecisionWriteTimeout
+	}
+	a := &AsyncDecisionLog{
+		sink:   sink,
+		opts:   opts,
+		queue:  make(chan Decision, opts.QueueSize),
+		done:   make(chan struct{}),
+		exited: make(chan struct{}),
+	}
+	go a.run()
+	return a
+}
+
+// Hooks returns Hooks recording every successful rate limit decision to a.
+func (a *AsyncDecisionLog) Hooks() Hooks {
+	return Hooks{
+		OnAllow: func(ctx context.Context, ev AllowEvent) {
+			if decision, ok := decisionOf(ev); ok {
+				a.Record(decision)
+			}
+		},
+	}
+}
+
+// Record queues decision to be written and reports whether it was queued.
+// It never blocks. Time is filled in from the wall clock if it is empty.
+func (a *AsyncDecisionLog) Record(decision Decision) bool {
+	if decision.Time.IsZero() {
+		decision.Time = time.Now()
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if !a.closed {
+		select {
+		case a.queue <- decision:
+			return true
+		default:
+		}
+	}
+	a.dropped.Add(1)
+	return false
+}
+
+// Stats returns the counts so far.
+func (a *AsyncDecisionLog) Stats() AsyncDecisionLogStats {
+	return AsyncDecisionLogStats{
+		Written: a.written.Load(),
+		Dropped: a.dropped.Load(),
+		Failed:  a.failed.Load(),
+		Batches: a.batches.Load(),
+		Errors:  a.errors.Load(),
+	}
+}
+
+// Close stops accepting decisions and waits until those queued are written,
+// or until ctx is done, in which case it returns ctx.Err() and the rest are
+// written in the background.
+func (a *AsyncDecisionLog) Close(ctx context.Context) error {
+	a.mu.Lock()
+	if !a.closed {
+		a.closed = true
+		close(a.done)
+	}
+	a.mu.Unlock()
+
+	select {
+	case <-a.exited:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (a *AsyncDecisionLog) run() {
+	defer close(a.exited)
+	ticker := time.NewTicker(a.opts.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]Decision, 0, a.opts.BatchSize)
+	flush := func() {
+		if len(batch) > 0 {
+			a.write(batch)
+			batch = batch[:0]
+		}
+	}
+	for {
+		select {
+		case decision := <-a.queue:
+			batch = append(batch, decision)
+			if len(batch) == a.opts.BatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-a.done:
+			// nothing is queued once closed, so drain what is left.
+			for {
+				select {
+				case decision := <-a.queue:
+					batch = append(batch, decision)
+					if len(batch) == a.opts.BatchSize {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+func (a *AsyncDecisionLog) write(batch []Decision) {
+	ctx, cancel := context.WithTimeout(context.Background(), a.opts.WriteTimeout)
+	defer cancel()
+	a.batches.Add(1)
+	if err := a.sink.WriteDecisions(ctx, batch); err != nil {
+		a.errors.Add(1)
+		a.failed.Add(int64(len(batch)))
+		return
+	}
+	a.written.Add(int64(len(batch)))
+}
@@ -0,0 +1,67 @@
+package redis_rate_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ductone/redis_rate/v11"
+)
+
+type blockingSink struct {
+	mu        sync.Mutex
+	decisions []redis_rate.Decision
+	release   chan struct{}
+	err       error
+}
+
+func (s *blockingSink) WriteDecisions(ctx context.Context, decisions []redis_rate.Decision) error {
+	<-s.release
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	s.decisions = append(s.decisions, decisions...)
+	return nil
+}
+
+func TestAsyncDecisionLog(t *testing.T) {
+	ctx := context.Background()
+	sink := &blockingSink{release: make(chan struct{})}
+	log := redis_rate.NewAsyncDecisionLog(sink, redis_rate.AsyncDecisionLogOptions{QueueSize: 2, BatchSize: 1})
+	l := newUnreachableLimiter(
+		redis_rate.WithFallback(redis_rate.FallbackLocal),
+		redis_rate.WithHooks(log.Hooks()),
+	)
+
+	// the first decision is taken by the blocked write, the next two fill
+	// the queue and the rest are dropped.
+	for i := 0; i < 5; i++ {
+		_, err := l.Allow(ctx, "test_id", redis_rate.PerMinute(2))
+		require.NoError(t, err)
+		if i == 0 {
+			require.Eventually(t, func() bool { return log.Stats().Batches == 1 }, time.Second, time.Millisecond)
+		}
+	}
+	close(sink.release)
+	require.NoError(t, log.Close(ctx))
+	require.False(t, log.Record(redis_rate.Decision{Key: "test_id"}))
+
+	require.Equal(t, redis_rate.AsyncDecisionLogStats{Written: 3, Dropped: 3, Batches: 3}, log.Stats())
+	require.Len(t, sink.decisions, 3)
+	require.Equal(t, "test_id", sink.decisions[0].Key)
+	require.Equal(t, int64(1), sink.decisions[0].Allowed)
+	require.Equal(t, int64(0), sink.decisions[2].Allowed)
+
+	sink = &blockingSink{release: make(chan struct{}), err: errors.New("sink down")}
+	close(sink.release)
+	log = redis_rate.NewAsyncDecisionLog(sink, redis_rate.AsyncDecisionLogOptions{})
+	require.True(t, log.Record(redis_rate.Decision{Key: "test_id"}))
+	require.NoError(t, log.Close(ctx))
+	require.Equal(t, redis_rate.AsyncDecisionLogStats{Failed: 1, Batches: 1, Errors: 1}, log.Stats())
+}
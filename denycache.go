@@ -0,0 +1,131 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// WithDenialCache remembers, in process, keys that Redis denied until their
+// RetryAfter has passed, or maxTTL if that is sooner, and denies requests
+// for them locally instead of making a round trip. At most maxKeys denials
+// are remembered at once.
+//
+// A denial is only served locally to requests for at least as many events
+// as were denied, and it does not charge limit.Penalty. Reset clears the
+// remembered denials of its key, but resets made through other Limiters are
+// not seen until the denials expire.
+func WithDenialCache(maxTTL time.Duration, maxKeys int) Option {
+	return func(l *Limiter) {
+		l.denials = &denialCache{
+			l:       l,
+			maxTTL:  maxTTL,
+			maxKeys: maxKeys,
+			entries: make(map[localKey]denial),
+		}
+	}
+}
+
+type denialCache struct {
+	l       *Limiter
+	maxTTL  time.Duration
+	maxKeys int
+
+	mu      sync.Mutex
+	entries map[localKey]denial
+}
+
+// denial is a remembered denial of n events.
+type denial struct {
+	n       int
+	until   time.Time
+	resetAt time.Time
+	reason  Reason
+}
+
+// lookup returns a denial of n events served from the cache, or nil.
+func (c *denialCache) lookup(ctx context.Context, key string, limit Limit, n int) *Result {
+	if c == nil {
+		return nil
+	}
+	now := c.l.now()
+	lk := localKey{prefix: c.l.localPrefix(ctx), key: key, limit: limit}
+	c.mu.Lock()
+	d, ok := c.entries[lk]
+	if ok && !now.Before(d.until) {
+		delete(c.entries, lk)
+		ok = false
+	}
+	c.mu.Unlock()
+	if !ok || n < d.n {
+		return nil
+	}
+
+	rv := &Result{
+		Key:        key,
+		Limit:      limit,
+		RetryAfter: d.until.Sub(now),
+		ResetAfter: d.resetAt.Sub(now),
+		Banned:     d.reason == ReasonBanned,
+		Reason:     d.reason,
+	}
+	rv.stamp(now, c.l.now)
+	return rv
+}
+
+// record remembers rv if it denied n events.
+func (c *denialCache) record(ctx context.Context, rv *Result, n int) {
+	if c == nil || rv.Allowed > 0 || rv.RetryAfter <= 0 || n <= 0 {
+		return
+	}
+	wait := rv.RetryAfter
+	if wait > c.maxTTL {
+		wait = c.maxTTL
+	}
+	if wait <= 0 {
+		return
+	}
+	lk := localKey{prefix: c.l.localPrefix(ctx), key: rv.Key, limit: rv.Limit}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[lk]; !ok && len(c.entries) >= c.maxKeys {
+		for k, d := range c.entries {
+			if !rv.at.Before(d.until) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= c.maxKeys {
+			return
+		}
+	}
+	c.entries[lk] = denial{
+		n:       n,
+		until:   rv.at.Add(wait),
+		resetAt: rv.ResetAt,
+		reason:  rv.Reason,
+	}
+}
+
+// forget removes the denials remembered for key.
+func (c *denialCache) forget(key string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for lk := range c.entries {
+		if lk.key == key {
+			delete(c.entries, lk)
+		}
+	}
+}
+
+// denialSize is the number of events a denied request for n events shows
+// do not fit: all of them, or for AllowAtMost even a single one.
+func denialSize(n int, atMost bool) int {
+	if atMost {
+		return 1
+	}
+	return n
+}
@@ -0,0 +1,97 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"context"
+	"time"
+)
+
+// Dimension is one attribute of a request that is limited on its own, such
+// as its IP address, user or route.
+type Dimension struct {
+	// Name identifies the dimension, such as "ip".
+	Name string
+
+	// Value is the request's value for the dimension, such as "10.0.0.1".
+	Value string
+
+	Limit Limit
+}
+
+// DimensionsResult is the outcome of AllowDimensions.
+type DimensionsResult struct {
+	// Allowed is true if the events were allowed on every dimension.
+	Allowed bool
+
+	// Results are the results of each dimension, in the order given.
+	Results []*Result
+
+	// Denied names the dimensions that were exhausted.
+	Denied []string
+}
+
+// RetryAfter is the time until every exhausted dimension would allow the
+// events again, or -1 if they were allowed.
+func (r *DimensionsResult) RetryAfter() time.Duration {
+	if r.Allowed {
+		return -1
+	}
+	retryAfter := time.Duration(-1)
+	for _, res := range r.Results {
+		if res.RetryAfter > retryAfter {
+			retryAfter = res.RetryAfter
+		}
+	}
+	return retryAfter
+}
+
+// DimensionKey returns the key AllowDimensions uses for dim within group,
+// for use with Reset, Usage and friends.
+func DimensionKey(group string, dim Dimension) string {
+	return "{" + group + "}:" + dim.Name + ":" + dim.Value
+}
+
+// AllowDimensions reports whether n events may happen at time now on every
+// dimension of a request, evaluating all of them in a single script. The
+// events are taken from every dimension or, if any is exhausted, from none.
+//
+// Every dimension's key includes group as a Redis Cluster hash tag, see
+// DimensionKey, so that they are stored on the same node. Dimensions are
+// therefore limited within a group: with a tenant as the group, an IP
+// address has a separate budget with each tenant. If WithClusterHashTag is
+// set it must keep these keys together, for example by returning "" for
+// keys that already start with a tag.
+func (l *Limiter) AllowDimensions(
+	ctx context.Context,
+	group string,
+	dims []Dimension,
+	n int,
+) (*DimensionsResult, error) {
+	limits := make([]KeyLimit, len(dims))
+	for i, dim := range dims {
+		limits[i] = KeyLimit{
+			Key:   DimensionKey(group, dim),
+			Limit: dim.Limit,
+		}
+	}
+
+	res, err := l.allowMulti(ctx, limits, n, multiDimensions)
+	if err != nil {
+		return nil, err
+	}
+
+	// Like Verdict.Allowed, asking for no events is always allowed, even on
+	// exhausted dimensions.
+	rv := &DimensionsResult{
+		Allowed: n == 0 || len(res) > 0 && res[0].Allowed > 0,
+		Results: res,
+	}
+	if rv.Allowed {
+		return rv, nil
+	}
+	for i, r := range res {
+		if r.RetryAfter >= 0 {
+			rv.Denied = append(rv.Denied, dims[i].Name)
+		}
+	}
+	return rv, nil
+}
@@ -0,0 +1,231 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrNoEpochs is returned by BumpEpoch when the Limiter was created without
+// WithEpochs.
+var ErrNoEpochs = errors.New("redis_rate: epochs are not enabled")
+
+// epochKeySuffix is appended to the rate limit prefix to name the epoch
+// counter. On Redis Cluster the scripts read a copy of it in each slot,
+// named with the slot's hash tag appended.
+const epochKeySuffix = "__epoch__"
+
+// epochArg marks the arguments of a script called with epochs; see
+// script_epoch.lua.
+const epochArg = "__epoch__"
+
+// WithEpochs enables epochs for rate limit keys. Every rate limit key is
+// named after the current epoch of the Limiter's rate prefix, so bumping the
+// epoch with BumpEpoch starts every bucket under the prefix afresh without
+// deleting any keys; the old ones are left to expire.
+//
+// The scripts read the epoch from a counter next to the key they evaluate,
+// in the same call, so once BumpEpoch returns every allow, in every process,
+// charges the new buckets. Reads made outside the scripts, such as Usage,
+// Inspect, Reset and the local caches, use the epoch read with a separate
+// GET, which is cached and re-read at most once per refresh; a refresh of 0
+// re-reads it on every call.
+//
+// Epoch N names a key by appending ":eN" to it, in the same slot, so keys
+// are named differently from keys without epochs: enabling epochs on an
+// existing deployment starts every bucket afresh. Bans, boosts and freezes
+// are kept across epochs, and concurrency keys are not affected.
+func WithEpochs(refresh time.Duration) func(*Limiter) {
+	return func(l *Limiter) {
+		l.epoch = &epoch{
+			refresh: refresh,
+		}
+	}
+}
+
+// epochScripts maps the SHA1 of every script evaluating rate limit keys to
+// the number of its leading keys that are rate limit keys, or -1 if all of
+// them are.
+var epochScripts = map[string]int{
+	allowN.Hash():             1,
+	allowAtMost.Hash():        1,
+	allowMulti.Hash():         -1,
+	allowSlidingWindow.Hash(): 1,
+	allowFixedWindow.Hash():   1,
+	freezeScript.Hash():       1,
+	leaseScript.Hash():        1,
+}
+
+type epoch struct {
+	refresh time.Duration
+
+	mu       sync.Mutex
+	value    int64
+	loadedAt time.Time
+}
+
+// BumpEpoch starts a new epoch for the Limiter's rate prefix, resetting every
+// rate limit under it, and returns the new epoch. It writes the epoch to
+// every shard of a Ring and every slot of a ClusterClient, so a bump that
+// fails part way should be retried; until then some keys may still be
+// evaluated in the old epoch.
+func (l *Limiter) BumpEpoch(ctx context.Context) (int64, error) {
+	if l.epoch == nil {
+		return 0, ErrNoEpochs
+	}
+	if err := l.checkWritable("BumpEpoch"); err != nil {
+		return 0, err
+	}
+	rdb, ok := l.rdb.(interface {
+		Incr(ctx context.Context, key string) *redis.IntCmd
+	})
+	if !ok {
+		return 0, unsupported("INCR")
+	}
+	v, err := rdb.Incr(ctx, l.ratePrefix+epochKeySuffix).Result()
+	if err != nil {
+		return 0, err
+	}
+	if err := l.raiseEpoch(ctx, v); err != nil {
+		return 0, err
+	}
+	l.epoch.set(v)
+	return v, l.audit.record(ctx, AuditEpochBump, l.ratePrefix, strconv.FormatInt(v-1, 10), strconv.FormatInt(v, 10))
+}
+
+// raiseEpoch raises every copy of the epoch counter read by the scripts to
+// v: the counter itself on every node, or its copy in every slot of a
+// ClusterClient.
+func (l *Limiter) raiseEpoch(ctx context.Context, v int64) error {
+	counter := l.ratePrefix + epochKeySuffix
+	if _, ok := l.rdb.(*redis.ClusterClient); ok {
+		err := l.forEachNode(ctx, func(ctx context.Context, node redisNode) error {
+			return node.ScriptLoad(ctx, epochRaiseScript).Err()
+		})
+		if err != nil {
+			return err
+		}
+		pipe := l.rdb.Pipeline()
+		for slot := 0; slot < clusterSlots; slot++ {
+			epochRaise.EvalSha(ctx, pipe, []string{counter + "{" + slotTag(slot) + "}"}, v)
+		}
+		_, err = pipe.Exec(ctx)
+		return err
+	}
+	return l.forEachNode(ctx, func(ctx context.Context, node redisNode) error {
+		pipe := node.Pipeline()
+		pipe.ScriptLoad(ctx, epochRaiseScript)
+		epochRaise.EvalSha(ctx, pipe, []string{counter}, v)
+		_, err := pipe.Exec(ctx)
+		return err
+	})
+}
+
+// Epoch returns the current epoch of the Limiter's rate prefix, which is
+// always 0 without WithEpochs.
+func (l *Limiter) Epoch(ctx context.Context) int64 {
+	if l.epoch == nil {
+		return 0
+	}
+
+	e := l.epoch
+	e.mu.Lock()
+	value, loadedAt := e.value, e.loadedAt
+	e.mu.Unlock()
+	if !loadedAt.IsZero() && time.Since(loadedAt) < e.refresh {
+		return value
+	}
+
+	// A failed read keeps the cached epoch; the call using it will most
+	// likely fail against the same Redis anyway.
+	rdb, ok := l.rdb.(interface {
+		Get(ctx context.Context, key string) *redis.StringCmd
+	})
+	if !ok {
+		return value
+	}
+	v, err := rdb.Get(ctx, l.ratePrefix+epochKeySuffix).Int64()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return value
+	}
+	e.set(v)
+	return v
+}
+
+func (e *epoch) set(v int64) {
+	e.mu.Lock()
+	if v > e.value || e.loadedAt.IsZero() {
+		e.value = v
+	}
+	e.loadedAt = time.Now()
+	e.mu.Unlock()
+}
+
+// epochCounter returns the copy of the epoch counter the scripts read for
+// the Redis key redisKey, in its slot on a ClusterClient.
+func (l *Limiter) epochCounter(redisKey string) string {
+	if _, ok := l.rdb.(*redis.ClusterClient); ok {
+		return l.ratePrefix + epochKeySuffix + "{" + slotTag(clusterSlot(redisKey)) + "}"
+	}
+	return l.ratePrefix + epochKeySuffix
+}
+
+// withEpoch adds the arguments of script_epoch.lua to the keys and args of
+// script if it evaluates rate limit keys and the Limiter uses epochs.
+func (l *Limiter) withEpoch(script *redis.Script, keys []string, args []interface{}) ([]string, []interface{}) {
+	n, ok := epochScripts[script.Hash()]
+	if l.epoch == nil || !ok || len(keys) == 0 {
+		return keys, args
+	}
+	if n < 0 {
+		n = len(keys)
+	}
+	keys = append(keys[:len(keys):len(keys)], l.epochCounter(keys[0]))
+	args = append([]interface{}{epochArg, n}, args...)
+	return keys, args
+}
+
+// epochKey returns the name of the rate limit key redisKey in the current
+// epoch, as script_epoch.lua names it, for reads made outside the scripts.
+func (l *Limiter) epochKey(ctx context.Context, redisKey string) string {
+	if l.epoch == nil {
+		return redisKey
+	}
+	return sideKey(redisKey, ":e"+strconv.FormatInt(l.Epoch(ctx), 10))
+}
+
+// rateKey returns the Redis key of the rate limit key key in the current
+// epoch.
+func (l *Limiter) rateKey(ctx context.Context, key string) string {
+	return l.epochKey(ctx, l.ratePrefix+l.hashTagged(key))
+}
+
+// rateKeys returns the Redis keys of the rate limit keys keys in the
+// current epoch, reading the epoch once.
+func (l *Limiter) rateKeys(ctx context.Context, keys []string) []string {
+	suffix := ""
+	if l.epoch != nil {
+		suffix = ":e" + strconv.FormatInt(l.Epoch(ctx), 10)
+	}
+	rv := make([]string, len(keys))
+	for i, key := range keys {
+		rv[i] = l.ratePrefix + l.hashTagged(key)
+		if suffix != "" {
+			rv[i] = sideKey(rv[i], suffix)
+		}
+	}
+	return rv
+}
+
+// localPrefix returns the prefix identifying the rate limit keys of the
+// current epoch in the local caches.
+func (l *Limiter) localPrefix(ctx context.Context) string {
+	if l.epoch == nil {
+		return l.ratePrefix
+	}
+	return l.ratePrefix + ":e" + strconv.FormatInt(l.Epoch(ctx), 10)
+}
@@ -0,0 +1,63 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClusterSlot(t *testing.T) {
+	require.Equal(t, 12182, clusterSlot("foo"))
+	require.Equal(t, clusterSlot("user1000"), clusterSlot("{user1000}.following"))
+	for slot := 0; slot < clusterSlots; slot++ {
+		require.Equal(t, slot, clusterSlot("{"+slotTag(slot)+"}"), slot)
+	}
+}
+
+func TestEpochKeys(t *testing.T) {
+	ctx := context.Background()
+	rdb := redis.NewClusterClient(&redis.ClusterOptions{
+		Addrs:       []string{"127.0.0.1:1"},
+		DialTimeout: 10 * time.Millisecond,
+		MaxRetries:  -1,
+	})
+	l := New(rdb, WithEpochs(time.Hour))
+	l.epoch.set(3)
+
+	for _, key := range []string{"foo", "{t}foo"} {
+		rkey := l.ratePrefix + key
+		frozen := sideKey(rkey, ":frozen")
+		keys, args := l.withEpoch(allowN, []string{rkey, frozen}, []interface{}{"1"})
+		require.Equal(t, []string{rkey, frozen, l.epochCounter(rkey)}, keys)
+		require.Equal(t, []interface{}{epochArg, 1, "1"}, args)
+
+		// the counter and the key in the epoch share the key's slot.
+		require.Equal(t, clusterSlot(rkey), clusterSlot(keys[2]))
+		require.Equal(t, clusterSlot(rkey), clusterSlot(l.epochKey(ctx, rkey)))
+	}
+	require.Equal(t, "{rate:foo}:e3", l.rateKey(ctx, "foo"))
+
+	// keys in different epochs never collide, even with keys that look
+	// like an epoch.
+	l = New(rdb, WithEpochs(time.Hour))
+	l.epoch.set(0)
+	old := l.rateKey(ctx, "e1:foo")
+	l.epoch.set(1)
+	require.NotEqual(t, old, l.rateKey(ctx, "foo"))
+
+	keys, args := l.withEpoch(allowMulti, []string{"a", "b"}, []interface{}{"1"})
+	require.Len(t, keys, 3)
+	require.Equal(t, 2, args[1])
+
+	keys, args = l.withEpoch(banScript, []string{"a", "b"}, []interface{}{"1"})
+	require.Equal(t, []string{"a", "b"}, keys)
+	require.Equal(t, []interface{}{"1"}, args)
+
+	l = New(rdb)
+	keys, _ = l.withEpoch(allowN, []string{"a"}, nil)
+	require.Equal(t, []string{"a"}, keys)
+	require.Equal(t, "rate:foo", l.rateKey(ctx, "foo"))
+}
@@ -0,0 +1,151 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrNoFairness is returned by FairnessReport without WithFairness.
+var ErrNoFairness = errors.New("redis_rate: fairness tracking is not enabled")
+
+// fairnessPrefix follows the rate limit prefix in the keys of the hashes
+// kept by WithFairness.
+const fairnessPrefix = "fair:"
+
+// WithFairness makes AllowHierarchy and AllowNWithOverflow count the events
+// each child takes from its parent's budget in windows of the given length,
+// for the last keep windows, so FairnessReport can show whether one child
+// is monopolizing a shared parent. With AllowHierarchy each level is the
+// parent of the next; with AllowNWithOverflow the pool is the parent of the
+// key drawing the shortfall from it.
+//
+// The counts of a parent in a window are kept in a hash named by the rate
+// limit prefix, "fair:", the unix time the window starts and the parent key.
+// Like WithTopConsumers, counts are added up in process and sent to Redis in
+// the background about once a second.
+func WithFairness(window time.Duration, keep int) Option {
+	return func(l *Limiter) {
+		if keep < 1 {
+			keep = 1
+		}
+		c := newWindowCounter(l, window, keep)
+		c.key = func(start int64, parent string) string {
+			return l.ratePrefix + fairnessPrefix + strconv.FormatInt(start, 10) + ":" + parent
+		}
+		c.incr = func(ctx context.Context, pipe redis.Pipeliner, key string, child string, n int64) {
+			pipe.HIncrBy(ctx, key, child, n)
+		}
+		l.fairness = c
+	}
+}
+
+// ChildShare is the number of events a child took from its parent and its
+// share of all the events taken from the parent, between 0 and 1.
+type ChildShare struct {
+	Child  string
+	Events int64
+	Share  float64
+}
+
+// FairnessWindow is the consumption of a parent in one window.
+type FairnessWindow struct {
+	// Start is when the window started.
+	Start time.Time
+
+	// Total is the number of events taken from the parent by all children.
+	Total int64
+
+	// Children are the children that took events, largest share first.
+	Children []ChildShare
+}
+
+// FairnessReport is the consumption of a parent by its children over recent
+// windows, returned by FairnessReport.
+type FairnessReport struct {
+	Parent string
+
+	// Windows are the windows reported, the current one first.
+	Windows []FairnessWindow
+
+	// Children are the shares of the children over all the windows,
+	// largest first.
+	Children []ChildShare
+}
+
+// FairnessReport returns each child's share of the events taken from parent
+// in the last windows windows, including the current one, so that a child
+// monopolizing a shared budget can be spotted and the weights tuned. windows
+// is capped to the number kept by WithFairness, which it requires. The
+// counts of this process are sent first.
+func (l *Limiter) FairnessReport(ctx context.Context, parent string, windows int) (*FairnessReport, error) {
+	f := l.fairness
+	if f == nil {
+		return nil, ErrNoFairness
+	}
+	if windows > f.keep {
+		windows = f.keep
+	}
+	rv := &FairnessReport{Parent: parent}
+	if windows <= 0 {
+		return rv, nil
+	}
+	if err := f.flush(ctx); err != nil {
+		return nil, err
+	}
+
+	current := f.start(l.now())
+	step := int64(f.window / time.Second)
+	pl := l.rdb.Pipeline()
+	cmds := make([]*redis.MapStringStringCmd, windows)
+	for i := range cmds {
+		cmds[i] = pl.HGetAll(ctx, f.key(current-int64(i)*step, parent))
+	}
+	if _, err := pl.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	totals := make(map[string]int64)
+	var total int64
+	for i, cmd := range cmds {
+		w := FairnessWindow{Start: time.Unix(current-int64(i)*step, 0)}
+		counts := make(map[string]int64, len(cmd.Val()))
+		for child, s := range cmd.Val() {
+			n, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			counts[child] = n
+			totals[child] += n
+			w.Total += n
+		}
+		w.Children = childShares(counts, w.Total)
+		total += w.Total
+		rv.Windows = append(rv.Windows, w)
+	}
+	rv.Children = childShares(totals, total)
+	return rv, nil
+}
+
+// childShares returns the shares of total of counts, largest first.
+func childShares(counts map[string]int64, total int64) []ChildShare {
+	rv := make([]ChildShare, 0, len(counts))
+	for child, n := range counts {
+		cs := ChildShare{Child: child, Events: n}
+		if total > 0 {
+			cs.Share = float64(n) / float64(total)
+		}
+		rv = append(rv, cs)
+	}
+	sort.Slice(rv, func(i, j int) bool {
+		if rv[i].Events != rv[j].Events {
+			return rv[i].Events > rv[j].Events
+		}
+		return rv[i].Child < rv[j].Child
+	})
+	return rv
+}
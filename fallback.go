@@ -0,0 +1,150 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// FallbackPolicy decides what Allow, AllowN and AllowAtMost return when
+// Redis is unavailable.
+type FallbackPolicy int
+
+const (
+	// FallbackNone returns the Redis error to the caller. It is the default.
+	FallbackNone FallbackPolicy = iota
+
+	// FailOpen allows every event while Redis is unavailable.
+	FailOpen
+
+	// FailClosed denies every event while Redis is unavailable.
+	FailClosed
+
+	// FallbackLocal enforces each limit with an in-process GCRA limiter while
+	// Redis is unavailable. Every process enforces the limit on its own, so
+	// the effective limit across N processes is up to N times higher.
+	FallbackLocal
+)
+
+func (p FallbackPolicy) String() string {
+	switch p {
+	case FallbackNone:
+		return "none"
+	case FailOpen:
+		return "fail_open"
+	case FailClosed:
+		return "fail_closed"
+	case FallbackLocal:
+		return "local"
+	default:
+		return "fallback(" + strconv.Itoa(int(p)) + ")"
+	}
+}
+
+// defaultFallbackProbeInterval is how long Redis is bypassed after a failure
+// before it is tried again.
+const defaultFallbackProbeInterval = time.Second
+
+// localFallbackMaxKeys is the number of keys the local fallback tracks before
+// it prunes keys that have returned to their initial state.
+const localFallbackMaxKeys = 10000
+
+// WithFallback sets what happens when Redis is unavailable. Once a call
+// fails, Redis is bypassed for the probe interval, after which the next call
+// probes Redis again and switches back if it succeeds. Errors returned by
+// Redis itself, such as script errors, are not treated as unavailability.
+// Results produced by the fallback have Fallback set.
+func WithFallback(policy FallbackPolicy) func(*Limiter) {
+	return func(s *Limiter) {
+		s.fallbackPolicy = policy
+	}
+}
+
+// WithFallbackProbeInterval sets how long Redis is bypassed after a failure
+// when a fallback policy is set. If unset the default is one second.
+func WithFallbackProbeInterval(interval time.Duration) func(*Limiter) {
+	return func(s *Limiter) {
+		s.fallbackProbe = interval
+	}
+}
+
+type fallback struct {
+	now           func() time.Time
+	policy        FallbackPolicy
+	probeInterval time.Duration
+
+	// downUntil is the unix nano time until which Redis is bypassed.
+	downUntil atomic.Int64
+
+	local gcraBuckets
+}
+
+func newFallback(now func() time.Time, policy FallbackPolicy, probeInterval time.Duration) *fallback {
+	if probeInterval <= 0 {
+		probeInterval = defaultFallbackProbeInterval
+	}
+	return &fallback{
+		now:           now,
+		policy:        policy,
+		probeInterval: probeInterval,
+		local:         newGCRABuckets(localFallbackMaxKeys),
+	}
+}
+
+// bypass reports whether Redis should be skipped because it recently failed.
+func (f *fallback) bypass() bool {
+	return f.now().UnixNano() < f.downUntil.Load()
+}
+
+func (f *fallback) markDown() {
+	f.downUntil.Store(f.now().Add(f.probeInterval).UnixNano())
+}
+
+// isUnavailable reports whether err, returned by a call made with ctx, means
+// Redis could not be reached, as opposed to Redis rejecting the command or
+// the caller giving up: a deadline of ctx itself passing says nothing about
+// Redis.
+func isUnavailable(ctx context.Context, err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) && ctx.Err() != nil {
+		return false
+	}
+	var rerr redis.Error
+	if errors.As(err, &rerr) {
+		return redis.HasErrorPrefix(err, "LOADING") ||
+			redis.HasErrorPrefix(err, "CLUSTERDOWN") ||
+			redis.HasErrorPrefix(err, "MASTERDOWN") ||
+			redis.HasErrorPrefix(err, "TRYAGAIN")
+	}
+	return true
+}
+
+func (f *fallback) allow(key string, limit Limit, n int, atMost bool) *Result {
+	rv := &Result{
+		Key:      key,
+		Limit:    limit,
+		Fallback: true,
+		at:       f.now(),
+	}
+
+	switch f.policy {
+	case FailOpen:
+		rv.Allowed = int64(n)
+		rv.Remaining = int64(limit.Burst)
+		rv.RetryAfter = -1
+	case FailClosed:
+		rv.RetryAfter = f.probeInterval
+		rv.ResetAfter = f.probeInterval
+		rv.Reason = ReasonDegradedFailClosed
+	default:
+		f.local.allow(rv, n, atMost)
+	}
+	rv.stamp(rv.at, f.now)
+	return rv
+}
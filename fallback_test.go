@@ -0,0 +1,89 @@
+package redis_rate_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ductone/redis_rate/v11"
+)
+
+func newUnreachableLimiter(options ...func(*redis_rate.Limiter)) *redis_rate.Limiter {
+	rdb := redis.NewClient(&redis.Options{
+		Addr:        "127.0.0.1:1",
+		DialTimeout: 10 * time.Millisecond,
+		MaxRetries:  -1,
+	})
+	return redis_rate.New(rdb, options...)
+}
+
+func TestFallback(t *testing.T) {
+	ctx := context.Background()
+	limit := redis_rate.PerSecond(10)
+
+	l := newUnreachableLimiter()
+	_, err := l.Allow(ctx, "test_id", limit)
+	require.Error(t, err)
+
+	l = newUnreachableLimiter(redis_rate.WithFallback(redis_rate.FailOpen))
+	res, err := l.AllowN(ctx, "test_id", limit, 100)
+	require.NoError(t, err)
+	require.True(t, res.Fallback)
+	require.Equal(t, int64(100), res.Allowed)
+
+	l = newUnreachableLimiter(redis_rate.WithFallback(redis_rate.FailClosed))
+	res, err = l.Allow(ctx, "test_id", limit)
+	require.NoError(t, err)
+	require.True(t, res.Fallback)
+	require.Equal(t, int64(0), res.Allowed)
+	require.Greater(t, res.RetryAfter, time.Duration(0))
+	require.Equal(t, redis_rate.ReasonDegradedFailClosed, res.Reason)
+}
+
+func TestFallbackCallerDeadline(t *testing.T) {
+	limit := redis_rate.PerSecond(10)
+	l := newUnreachableLimiter(redis_rate.WithFallback(redis_rate.FailOpen))
+
+	// the caller's own deadline passing does not mean Redis is down.
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	_, err := l.Allow(ctx, "test_id", limit)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestFallbackLocal(t *testing.T) {
+	ctx := context.Background()
+	limit := redis_rate.PerSecond(10)
+	l := newUnreachableLimiter(redis_rate.WithFallback(redis_rate.FallbackLocal))
+
+	res, err := l.Allow(ctx, "test_id", limit)
+	require.NoError(t, err)
+	require.True(t, res.Fallback)
+	require.Equal(t, int64(1), res.Allowed)
+	require.Equal(t, int64(9), res.Remaining)
+	require.Equal(t, time.Duration(-1), res.RetryAfter)
+	require.InDelta(t, 100*time.Millisecond, res.ResetAfter, float64(10*time.Millisecond))
+
+	res, err = l.AllowN(ctx, "test_id", limit, 20)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), res.Allowed)
+	require.InDelta(t, 1100*time.Millisecond, res.RetryAfter, float64(10*time.Millisecond))
+
+	res, err = l.AllowAtMost(ctx, "test_id", limit, 20)
+	require.NoError(t, err)
+	require.Equal(t, int64(9), res.Allowed)
+	require.Equal(t, int64(0), res.Remaining)
+	require.InDelta(t, time.Second, res.ResetAfter, float64(10*time.Millisecond))
+
+	res, err = l.Allow(ctx, "test_id", limit)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), res.Allowed)
+	require.InDelta(t, 100*time.Millisecond, res.RetryAfter, float64(10*time.Millisecond))
+
+	res, err = l.Allow(ctx, "other_id", limit)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), res.Allowed)
+}
@@ -0,0 +1,101 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrForecastLimit is returned by Forecast for limits without a Calendar.
+var ErrForecastLimit = errors.New("redis_rate: forecasts need a calendar limit")
+
+// Forecast projects when a key will use up its quota.
+type Forecast struct {
+	Key   string
+	Limit Limit
+
+	// Used and Remaining are the events used and left in the current window.
+	Used      int64
+	Remaining int64
+
+	// Rate is the average number of events per second so far in the current
+	// window.
+	Rate float64
+
+	// ExhaustAfter is the time until Remaining runs out if events keep
+	// happening at Rate, or -1 if the quota lasts until the window resets.
+	// ExhaustAt is the corresponding time, or the zero time.
+	ExhaustAfter time.Duration
+	ExhaustAt    time.Time
+
+	// ResetAt is when the current window ends.
+	ResetAt time.Time
+}
+
+// Exhausts reports whether the quota is projected to run out before the
+// window resets.
+func (f *Forecast) Exhausts() bool {
+	return f.ExhaustAfter >= 0
+}
+
+// Forecast projects when key will exhaust a calendar limit, such as a daily
+// or monthly quota, if it keeps consuming at its average rate so far in the
+// current window, so callers can warn before the limit is hit. Nothing is
+// consumed. A zero limit is replaced by the Limiter's default limit.
+//
+// Early in a window the projection rests on little data, so callers may
+// want to hold off warnings until some of the window has passed.
+func (l *Limiter) Forecast(ctx context.Context, key string, limit Limit) (_ *Forecast, err error) {
+	defer l.recoverPanic(OpForecast, key, &err)
+	limit = l.limitOrDefault(limit)
+	if limit.IsZero() {
+		return nil, ErrNoLimit
+	}
+	if limit.Calendar == CalendarNone {
+		return nil, ErrForecastLimit
+	}
+
+	states, now, err := l.readState(ctx, []string{key}, []Limit{limit})
+	if err != nil {
+		return nil, err
+	}
+	used, _, err := parseCalendarUsed(states[0], limit, now)
+	if err != nil {
+		return nil, err
+	}
+	return forecast(key, limit, used, now), nil
+}
+
+// forecast projects the exhaustion of a calendar limit with used events in
+// the window containing now.
+func forecast(key string, limit Limit, used int64, now time.Time) *Forecast {
+	start, end := limit.Calendar.window(now)
+	rv := &Forecast{
+		Key:          key,
+		Limit:        limit,
+		Used:         used,
+		Remaining:    int64(limit.Rate) - used,
+		ExhaustAfter: -1,
+		ResetAt:      end,
+	}
+	if rv.Remaining < 0 {
+		rv.Remaining = 0
+	}
+	if elapsed := now.Sub(start).Seconds(); elapsed > 0 {
+		rv.Rate = float64(used) / elapsed
+	}
+
+	switch {
+	case rv.Remaining == 0:
+		rv.ExhaustAfter = 0
+	case rv.Rate > 0:
+		after := dur(float64(rv.Remaining) / rv.Rate)
+		if now.Add(after).Before(end) {
+			rv.ExhaustAfter = after
+		}
+	}
+	if rv.ExhaustAfter >= 0 {
+		rv.ExhaustAt = now.Add(rv.ExhaustAfter)
+	}
+	return rv
+}
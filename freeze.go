@@ -0,0 +1,106 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// WithFreezes makes AllowN, Allow, AllowAtMost, AllowCost and Pipeline allows
+// deny every request for a key while it is frozen with Freeze, with
+// Result.Frozen set. Unlike
+// lowering its limit, freezing pins the key's state: it does not refill
+// while frozen, so once unfrozen the key continues where it left off, which
+// suits suspending a customer for abuse.
+//
+// The freeze is kept next to the key's state, in the same Redis Cluster
+// slot. Calendar limits are denied while frozen too, but their windows go
+// on. Freezes are not checked by multi-key and sliding window methods, and
+// WithBatching and WithLocalTokenCache are bypassed.
+func WithFreezes() Option {
+	return func(l *Limiter) {
+		l.freezes = true
+	}
+}
+
+// Freeze freezes key until Unfreeze is called. Freezing a frozen key does
+// nothing.
+func (l *Limiter) Freeze(ctx context.Context, key string) error {
+	if err := l.checkWritable("Freeze"); err != nil {
+		return err
+	}
+	_, err := l.runFreeze(ctx, key, "1")
+	if err != nil {
+		return err
+	}
+	return l.audit.record(ctx, AuditFreeze, key, "", "frozen")
+}
+
+// Unfreeze unfreezes key, moving its state forward by the time it was frozen.
+func (l *Limiter) Unfreeze(ctx context.Context, key string) error {
+	if err := l.checkWritable("Unfreeze"); err != nil {
+		return err
+	}
+	_, err := l.runFreeze(ctx, key, "0")
+	if err != nil {
+		return err
+	}
+	return l.audit.record(ctx, AuditUnfreeze, key, "frozen", "")
+}
+
+// FrozenSince returns when key was frozen, or the zero time if it is not.
+func (l *Limiter) FrozenSince(ctx context.Context, key string) (time.Time, error) {
+	return l.runFreeze(ctx, key, "")
+}
+
+func (l *Limiter) runFreeze(ctx context.Context, key string, op string) (time.Time, error) {
+	args := getScriptArgs()
+	args.key(l.allowKeyPrefix(ctx), l.hashTagged(key))
+	l.frozenKey(ctx, args, key)
+	args.str(op).str(l.scriptNow())
+	l.storageArgs(args, freezeScript)
+	v, err := l.runScript(ctx, freezeScript, args.keys, args.args...).Text()
+	args.release()
+	if errors.Is(err, redis.Nil) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	at, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return fromScriptTime(at), nil
+}
+
+// freezeArgs appends the argument and key checking whether key is frozen to a
+// call of script, padding the optional arguments before them, if the Limiter
+// uses freezes. AllowN's freeze is appended by allowExtraArgs.
+func (l *Limiter) freezeArgs(ctx context.Context, args *scriptArgs, script *redis.Script, key string) {
+	if !l.freezes {
+		return
+	}
+	argc := 0
+	switch script {
+	case allowAtMost:
+		argc = 11
+	case allowFixedWindow:
+		argc = 5
+	default:
+		return
+	}
+	for len(args.args) < argc {
+		args.str("")
+	}
+	args.int(1)
+	l.frozenKey(ctx, args, key)
+}
+
+// frozenKey appends the key holding when key was frozen to args.
+func (l *Limiter) frozenKey(ctx context.Context, args *scriptArgs, key string) {
+	args.key(sideKey(l.allowKeyPrefix(ctx)+l.hashTagged(key), ":frozen"), "")
+}
@@ -0,0 +1,172 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"context"
+	"crypto/sha1" //nolint:gosec // names the library, as Redis names scripts
+	"encoding/hex"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// WithRedisFunctions calls the Limiter's scripts as Redis 7 functions with
+// FCALL instead of EVALSHA. The scripts are registered as a library with
+// FUNCTION LOAD, by LoadScripts or on first use, and functions survive
+// restarts and are copied to replicas, so the NOSCRIPT reload dance is not
+// needed.
+//
+// The library is named after the scripts it holds, so services running
+// different versions of this package can share a server. On servers without
+// functions the Limiter switches to EVALSHA for good once FCALL is rejected.
+func WithRedisFunctions() Option {
+	return func(l *Limiter) {
+		l.functions = &functionsBackend{}
+	}
+}
+
+type functionsBackend struct {
+	unsupported atomic.Bool
+}
+
+// active reports whether scripts are called as functions.
+func (f *functionsBackend) active() bool {
+	return f != nil && !f.unsupported.Load()
+}
+
+// functionLibrary registers every script as a function of a library named
+// after them, and functionNames maps the SHA1 of each script to its
+// function name.
+var functionLibrary, functionNames = buildFunctionLibrary()
+
+// functionSources maps every function name to its script's source, so calls
+// that failed can be re-sent with EVAL.
+var functionSources = func() map[string]string {
+	rv := make(map[string]string, len(scriptFiles))
+	for _, f := range scriptFiles {
+		rv[functionNames[f.script.Hash()]] = f.src
+	}
+	return rv
+}()
+
+func buildFunctionLibrary() (string, map[string]string) {
+	h := sha1.New() //nolint:gosec // not used for security
+	for _, f := range scriptFiles {
+		h.Write([]byte(f.src))
+	}
+	lib := "redis_rate_" + hex.EncodeToString(h.Sum(nil))[:12]
+
+	var b strings.Builder
+	b.WriteString("#!lua name=" + lib + "\n\n")
+	names := make(map[string]string, len(scriptFiles))
+	for _, f := range scriptFiles {
+		name := lib + "_" + strings.TrimSuffix(strings.TrimPrefix(f.name, "script_"), ".lua")
+		names[f.script.Hash()] = name
+
+		// functions always replicate their effects, and may not call
+		// replicate_commands.
+		src := strings.ReplaceAll(f.src, "redis.replicate_commands()", "")
+		b.WriteString("redis.register_function('" + name + "', function(KEYS, ARGV)\n")
+		b.WriteString(src)
+		b.WriteString("\nend)\n\n")
+	}
+	return b.String(), names
+}
+
+// runScript runs script with keys and args, as a function if the Limiter
+// uses them and script is one of its own, retrying transient failures as configured by WithRetry.
+func (l *Limiter) runScript(ctx context.Context, script *redis.Script, keys []string, args ...interface{}) *redis.Cmd {
+	keys, args = l.withEpoch(script, keys, args)
+	cmd := l.runScriptOnce(ctx, script, keys, args...)
+	for attempt := 1; l.retry.again(ctx, cmd.Err(), attempt); attempt++ {
+		l.stats.retried(ctx)
+		cmd = l.runScriptOnce(ctx, script, keys, args...)
+	}
+	return cmd
+}
+
+func (l *Limiter) runScriptOnce(ctx context.Context, script *redis.Script, keys []string, args ...interface{}) (cmd *redis.Cmd) {
+	if l.shedder != nil {
+		start := time.Now()
+		defer func() { l.shedder.observe(ctx, time.Since(start), cmd.Err()) }()
+	}
+	if _, ok := functionNames[script.Hash()]; ok && l.functions.active() {
+		cmd = l.fcall(ctx, script, keys, args...)
+		if !l.recoverFunctions(ctx, cmd.Err()) {
+			return cmd
+		}
+		if l.functions.active() {
+			cmd = l.fcall(ctx, script, keys, args...)
+			if !isMissingFunction(cmd.Err()) {
+				return cmd
+			}
+		}
+	}
+	return script.Run(ctx, l.rdb, keys, args...)
+}
+
+// evalSha queues script with keys and args on pipe, as a function if the
+// Limiter uses them. Failures are recovered by retryNoScript.
+func (l *Limiter) evalSha(ctx context.Context, pipe redis.Pipeliner, script *redis.Script, keys []string, args ...interface{}) *redis.Cmd {
+	keys, args = l.withEpoch(script, keys, args)
+	if l.functions.active() {
+		return pipe.FCall(ctx, functionNames[script.Hash()], keys, args...)
+	}
+	return script.EvalSha(ctx, pipe, keys, args...)
+}
+
+func (l *Limiter) fcall(ctx context.Context, script *redis.Script, keys []string, args ...interface{}) *redis.Cmd {
+	pipe := l.rdb.Pipeline()
+	cmd := pipe.FCall(ctx, functionNames[script.Hash()], keys, args...)
+	_, _ = pipe.Exec(ctx)
+	return cmd
+}
+
+// recoverFunctions handles a function call that failed with err, loading
+// the library if it is missing and giving up on functions if the server
+// does not support them. It reports whether the call should be retried.
+func (l *Limiter) recoverFunctions(ctx context.Context, err error) bool {
+	switch {
+	case isUnknownCommand(err):
+		l.functions.unsupported.Store(true)
+		return true
+	case isMissingFunction(err):
+		_ = l.loadFunctions(ctx)
+		return true
+	default:
+		return false
+	}
+}
+
+// loadFunctions loads the library on every node. If a node does not support
+// functions the Limiter stops using them and no error is returned.
+func (l *Limiter) loadFunctions(ctx context.Context) error {
+	return l.forEachScriptNode(ctx, func(ctx context.Context, node redisNode) error {
+		return l.loadFunctionsOn(ctx, node)
+	})
+}
+
+// loadFunctionsOn loads the library on node, if the Limiter uses functions.
+func (l *Limiter) loadFunctionsOn(ctx context.Context, node redisNode) error {
+	if !l.functions.active() {
+		return nil
+	}
+	pipe := node.Pipeline()
+	cmd := pipe.FunctionLoadReplace(ctx, functionLibrary)
+	_, _ = pipe.Exec(ctx)
+	err := cmd.Err()
+	if isUnknownCommand(err) {
+		l.functions.unsupported.Store(true)
+		return nil
+	}
+	return err
+}
+
+func isMissingFunction(err error) bool {
+	return redis.HasErrorPrefix(err, "ERR Function not found")
+}
+
+func isUnknownCommand(err error) bool {
+	return redis.HasErrorPrefix(err, "ERR unknown command")
+}
@@ -0,0 +1,105 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// gcraBuckets is an in-process implementation of the GCRA scripts, keeping
+// the theoretical arrival time of each key in memory.
+type gcraBuckets struct {
+	mu      sync.Mutex
+	tats    map[string]time.Time
+	maxKeys int
+}
+
+// newGCRABuckets returns buckets that prune keys which have returned to their
+// initial state once more than maxKeys are tracked. A maxKeys of 0 never
+// prunes.
+func newGCRABuckets(maxKeys int) gcraBuckets {
+	return gcraBuckets{
+		tats:    make(map[string]time.Time),
+		maxKeys: maxKeys,
+	}
+}
+
+// allow fills in rv for n events on rv.Key at rv.at, with the semantics of
+// script_allow_n.lua, or script_allow_at_most.lua if atMost is set.
+func (b *gcraBuckets) allow(rv *Result, n int, atMost bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := rv.at
+	limit := rv.Limit
+	emission := float64(limit.Period) / float64(limit.Rate)
+	burstOffset := emission * float64(limit.Burst)
+
+	tat, ok := b.tats[rv.Key]
+	if !ok || tat.Before(now) {
+		tat = now
+	}
+	// diff is how far, in nanoseconds, now is past the point at which the
+	// bucket was last full.
+	diff := float64(now.Sub(tat)) + burstOffset
+	remaining := math.Floor(diff/emission + 1e-9)
+
+	cost := float64(n)
+	if atMost {
+		if remaining < 1 && cost > 0 {
+			tat, diff = b.penalize(rv.Key, limit, tat, diff, emission)
+			rv.RetryAfter = time.Duration(emission - diff)
+			rv.ResetAfter = tat.Sub(now)
+			return
+		}
+		cost = math.Min(cost, remaining)
+	} else if remaining < cost {
+		if cost > 0 {
+			tat, diff = b.penalize(rv.Key, limit, tat, diff, emission)
+		}
+		rv.RetryAfter = time.Duration(emission*cost - diff)
+		rv.ResetAfter = tat.Sub(now)
+		return
+	}
+
+	newTat := tat.Add(time.Duration(emission * cost))
+	if cost > 0 {
+		b.tats[rv.Key] = newTat
+		if b.maxKeys > 0 && len(b.tats) > b.maxKeys {
+			b.prune(now)
+		}
+	}
+
+	rv.Allowed = int64(cost)
+	rv.Remaining = int64(remaining - cost)
+	rv.RetryAfter = -1
+	rv.ResetAfter = newTat.Sub(now)
+}
+
+// penalize charges limit.Penalty events to key after a denied attempt,
+// returning the updated tat and diff.
+func (b *gcraBuckets) penalize(key string, limit Limit, tat time.Time, diff, emission float64) (time.Time, float64) {
+	if limit.Penalty <= 0 {
+		return tat, diff
+	}
+	penalty := emission * float64(limit.Penalty)
+	tat = tat.Add(time.Duration(penalty))
+	b.tats[key] = tat
+	return tat, diff - penalty
+}
+
+func (b *gcraBuckets) reset(key string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.tats, key)
+}
+
+// prune drops keys whose bucket is full again, which behave the same as keys
+// that were never seen.
+func (b *gcraBuckets) prune(now time.Time) {
+	for key, tat := range b.tats {
+		if !tat.After(now) {
+			delete(b.tats, key)
+		}
+	}
+}
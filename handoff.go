@@ -0,0 +1,80 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	// ErrNotHeld is returned by Handoff when the current request id does
+	// not hold any slots of the key, for example because they expired.
+	ErrNotHeld = errors.New("redis_rate: request id does not hold a slot")
+
+	// ErrAlreadyHeld is returned by Handoff when the new request id already
+	// holds slots of the key.
+	ErrAlreadyHeld = errors.New("redis_rate: request id already holds a slot")
+)
+
+// Handoff atomically transfers the slots of key held by fromRequestID to
+// toRequestID, for work that migrates between workers mid-flight. The slots
+// are never freed in between, so they cannot be taken by another request or
+// a queued waiter. The new holder gets a fresh RequestMaxDuration from limit,
+// and must be released with toRequestID.
+func (tk *Limiter) Handoff(ctx context.Context, key string, fromRequestID string, toRequestID string, limit ConcurrencyLimit) (ConcurrencyResult, error) {
+	if err := tk.checkWritable("Handoff"); err != nil {
+		return ConcurrencyResult{}, err
+	}
+	ctx, span := tk.startSpan(ctx, OpHandoff)
+	defer span.End()
+
+	start := time.Now()
+	rv, err := tk.handoff(ctx, key, fromRequestID, toRequestID, limit)
+	if err != nil {
+		tk.onConcurrency(ctx, OpHandoff, key, toRequestID, nil, start, err)
+		traceTake(span, key, toRequestID, nil, err)
+		return ConcurrencyResult{}, err
+	}
+	tk.onConcurrency(ctx, OpHandoff, key, toRequestID, &rv, start, nil)
+	traceTake(span, key, toRequestID, &rv, nil)
+	return rv, nil
+}
+
+func (tk *Limiter) handoff(ctx context.Context, key string, fromRequestID string, toRequestID string, limit ConcurrencyLimit) (ConcurrencyResult, error) {
+	reqPeriod := limit.RequestMaxDuration.Round(time.Second) / time.Second
+	if reqPeriod <= 0 {
+		reqPeriod = 60
+	}
+	args := getScriptArgs()
+	args.key(tk.concurrencyKey(key), "").
+		key(tk.fenceKey(key), "").
+		str(tk.HashRequestID(fromRequestID)).
+		str(tk.HashRequestID(toRequestID)).
+		int(int64(reqPeriod)).
+		str(tk.scriptNow())
+	reply := replyOf(tk.runScript(ctx, concurrencyHandoff, args.keys, args.args...))
+	args.release()
+	switch moved := reply.int(0); {
+	case reply.err != nil:
+		return ConcurrencyResult{}, reply.err
+	case moved == 0:
+		return ConcurrencyResult{}, ErrNotHeld
+	case moved < 0:
+		return ConcurrencyResult{}, ErrAlreadyHeld
+	}
+
+	used := reply.int(1)
+	token := reply.optInt(2)
+	if reply.err != nil {
+		return ConcurrencyResult{}, reply.err
+	}
+	return ConcurrencyResult{
+		Key:          key,
+		RequestID:    toRequestID,
+		Limit:        limit,
+		Allowed:      true,
+		Used:         used,
+		Remaining:    limit.Max - used,
+		FencingToken: token,
+	}, nil
+}
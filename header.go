@@ -0,0 +1,72 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Header returns the IETF RateLimit header fields for r: RateLimit-Limit,
+// RateLimit-Remaining, RateLimit-Reset and RateLimit-Policy, plus
+// Retry-After when the request was not allowed. See SetHeaders.
+func (r *Result) Header() http.Header {
+	h := make(http.Header, 5)
+	r.SetHeaders(h)
+	return h
+}
+
+// SetHeaders sets the fields returned by Header on h, typically
+// w.Header() before writing a response. Durations are rounded up to whole
+// seconds, so clients never retry early, and negative values are clamped
+// to 0.
+//
+// The quota is Burst for rolling limits, which Remaining counts down, and
+// Rate for calendar limits. RateLimit-Limit and RateLimit-Policy advertise
+// the same quota, with the policy window being the time the limit takes to
+// grant it, for example "10;w=1" for 10 req/s, or "20;w=2" when the burst is
+// 20.
+func (r *Result) SetHeaders(h http.Header) {
+	quota, _ := r.Limit.quota()
+	remaining := r.Remaining
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	h.Set("RateLimit-Limit", strconv.Itoa(quota))
+	h.Set("RateLimit-Remaining", strconv.FormatInt(remaining, 10))
+	h.Set("RateLimit-Reset", strconv.FormatInt(ceilSeconds(r.ResetAfter), 10))
+	h.Set("RateLimit-Policy", r.Limit.policy())
+	if r.Allowed == 0 && r.RetryAfter >= 0 {
+		h.Set("Retry-After", strconv.FormatInt(ceilSeconds(r.RetryAfter), 10))
+	} else {
+		h.Del("Retry-After")
+	}
+}
+
+// quota returns the quota of l advertised by SetHeaders and the window
+// over which l grants it.
+func (l Limit) quota() (int, time.Duration) {
+	if l.Calendar != CalendarNone || l.Rate <= 0 || l.Burst == l.Rate {
+		return l.Rate, l.Period
+	}
+	return l.Burst, l.Period * time.Duration(l.Burst) / time.Duration(l.Rate)
+}
+
+// policy returns the RateLimit-Policy value of l.
+func (l Limit) policy() string {
+	quota, window := l.quota()
+	w := ceilSeconds(window)
+	if w < 1 {
+		w = 1
+	}
+	return strconv.Itoa(quota) + ";w=" + strconv.FormatInt(w, 10)
+}
+
+// ceilSeconds returns d in whole seconds, rounded up, or 0 if d is negative.
+func ceilSeconds(d time.Duration) int64 {
+	if d <= 0 {
+		return 0
+	}
+	return int64(math.Ceil(d.Seconds()))
+}
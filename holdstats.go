@@ -0,0 +1,82 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// holdSampleSize is the number of recent hold durations kept per key.
+const holdSampleSize = 128
+
+// HoldStats summarizes how long recent requests held slots of a
+// concurrency key, measured from Take to Release. Requests whose slots
+// expired without a Release are not included.
+type HoldStats struct {
+	// Key is the concurrency key.
+	Key string
+
+	// Samples is the number of releases the statistics are based on, up to
+	// the most recent 128.
+	Samples int
+
+	// Mean is the average hold duration.
+	Mean time.Duration
+
+	// P95 is the 95th percentile hold duration.
+	P95 time.Duration
+
+	// Max is the longest hold duration.
+	Max time.Duration
+}
+
+func (tk *Limiter) holdSamplesKey(key string) string {
+	return sideKey(tk.concurrencyKey(key), ":holds")
+}
+
+// HoldStats returns hold duration statistics for key, for capacity planning
+// of ConcurrencyLimit.Max. All durations are zero if there are no samples.
+func (tk *Limiter) HoldStats(ctx context.Context, key string) (HoldStats, error) {
+	rdb, ok := tk.rdb.(interface {
+		LRange(ctx context.Context, key string, start, stop int64) *redis.StringSliceCmd
+	})
+	if !ok {
+		return HoldStats{}, unsupported("LRANGE")
+	}
+	raw, err := rdb.LRange(ctx, tk.holdSamplesKey(key), 0, -1).Result()
+	if err != nil {
+		return HoldStats{}, err
+	}
+
+	samples := make([]time.Duration, 0, len(raw))
+	for _, v := range raw {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return HoldStats{}, err
+		}
+		samples = append(samples, dur(f))
+	}
+
+	rv := HoldStats{
+		Key:     key,
+		Samples: len(samples),
+	}
+	if len(samples) == 0 {
+		return rv, nil
+	}
+
+	sort.Slice(samples, func(i, j int) bool {
+		return samples[i] < samples[j]
+	})
+	total := time.Duration(0)
+	for _, s := range samples {
+		total += s
+	}
+	rv.Mean = total / time.Duration(len(samples))
+	rv.P95 = samples[(len(samples)*95+99)/100-1]
+	rv.Max = samples[len(samples)-1]
+	return rv, nil
+}
@@ -0,0 +1,304 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"context"
+	"time"
+)
+
+// Operation names the Limiter method that produced an event.
+type Operation string
+
+const (
+	OpAllowN             Operation = "allow_n"
+	OpAllowAtMost        Operation = "allow_at_most"
+	OpAllowAtMostMulti   Operation = "allow_at_most_multi"
+	OpAllowNWithOverflow Operation = "allow_n_with_overflow"
+	OpAllowSlidingWindow Operation = "allow_sliding_window"
+	OpAllowHierarchy     Operation = "allow_hierarchy"
+	OpAllowDimensions    Operation = "allow_dimensions"
+	OpAllowTiered        Operation = "allow_tiered"
+	OpAllowCost          Operation = "allow_cost"
+	OpPipelineAllow      Operation = "pipeline_allow"
+	OpTake               Operation = "take"
+	OpPipelineTake       Operation = "pipeline_take"
+	OpRelease            Operation = "release"
+	OpPipelineRelease    Operation = "pipeline_release"
+	OpHandoff            Operation = "handoff"
+	OpPipelineExec       Operation = "pipeline_exec"
+	OpEvalCustom         Operation = "eval_custom"
+	OpTakeOrQueue        Operation = "take_or_queue"
+	OpLease              Operation = "lease"
+	OpWaitAtMost         Operation = "wait_at_most"
+	OpForecast           Operation = "forecast"
+	OpInspect            Operation = "inspect"
+	OpUsage              Operation = "usage"
+	OpSnapshot           Operation = "snapshot"
+	OpDumpState          Operation = "dump_state"
+	OpRestoreState       Operation = "restore_state"
+)
+
+// Hooks receives events from a Limiter. Any field may be left nil.
+type Hooks struct {
+	// OnAllow is called for every rate limit key evaluated, including those
+	// evaluated in a Pipeline.
+	OnAllow func(ctx context.Context, ev AllowEvent)
+
+	// OnConcurrency is called for every concurrency key taken or released,
+	// including those in a Pipeline.
+	OnConcurrency func(ctx context.Context, ev ConcurrencyEvent)
+
+	// OnScriptLoad is called whenever the Lua scripts are loaded into Redis,
+	// which happens on an explicit LoadScripts and when pipelined commands
+	// that failed with NOSCRIPT are re-sent with EVAL.
+	OnScriptLoad func(ctx context.Context, ev ScriptLoadEvent)
+
+	// OnPipelineExec is called once for every Pipeline.Exec.
+	OnPipelineExec func(ctx context.Context, ev PipelineEvent)
+
+	// OnGrace is called whenever AllowDynamic allows a request exceeding a
+	// limit that is still in its grace period.
+	OnGrace func(ctx context.Context, ev GraceEvent)
+
+	// OnShadowDeny is called, after OnAllow, whenever a limit evaluated in
+	// shadow mode would have denied the request. See WithShadow.
+	OnShadowDeny func(ctx context.Context, ev AllowEvent)
+
+	// OnShed is called, before OnAllow, whenever a call skips Redis to shed
+	// load. See WithLoadShedding.
+	OnShed func(ctx context.Context, ev AllowEvent)
+
+	// OnKeyEvent is called whenever a key is created, expires or is
+	// deleted, while a KeyWatcher is running. See StartKeyWatcher.
+	OnKeyEvent func(ctx context.Context, ev KeyEvent)
+}
+
+// AllowEvent describes the evaluation of a single rate limit key.
+type AllowEvent struct {
+	Op Operation
+
+	// Prefix is the rate limit key prefix of the Limiter.
+	Prefix string
+
+	// Key is the key without Prefix.
+	Key string
+
+	// N is the number of events requested. For multi-key operations it is
+	// the number requested from the whole call.
+	N int
+
+	// Tags are the tags on the call's context.
+	Tags []Tag
+
+	// Result is nil when Err is set.
+	Result *Result
+
+	// Duration is the time spent waiting on Redis. For pipelined operations
+	// it covers the whole pipeline.
+	Duration time.Duration
+
+	Err error
+}
+
+// ConcurrencyEvent describes a single take or release of a concurrency key.
+type ConcurrencyEvent struct {
+	Op Operation
+
+	// Prefix is the concurrency key prefix of the Limiter.
+	Prefix string
+
+	// Key is the key without Prefix.
+	Key string
+
+	RequestID string
+
+	// Tags are the tags on the call's context.
+	Tags []Tag
+
+	// Result is nil for releases and when Err is set.
+	Result *ConcurrencyResult
+
+	// Duration is the time spent waiting on Redis. For pipelined and multi-key
+	// operations it covers the whole round trip.
+	Duration time.Duration
+
+	Err error
+}
+
+// ScriptLoadEvent describes a call to LoadScripts.
+type ScriptLoadEvent struct {
+	Duration time.Duration
+	Err      error
+}
+
+// GraceEvent describes a violation of a limit in its grace period.
+type GraceEvent struct {
+	// Key is the key without the Limiter's prefix.
+	Key string
+
+	// Tags are the tags on the call's context.
+	Tags []Tag
+
+	// Result is the result returned to the caller, with Grace set.
+	Result *Result
+
+	// EnforceAt is when the limit starts being enforced.
+	EnforceAt time.Time
+}
+
+// PipelineEvent describes a single Pipeline.Exec.
+type PipelineEvent struct {
+	// Allows, Takes and Releases are the number of each operation queued.
+	Allows   int
+	Takes    int
+	Releases int
+
+	// Denied is the number of Allow and Take operations that were not allowed.
+	Denied int
+
+	// Attempts is the number of times the pipeline was sent to Redis. It is
+	// greater than 1 when scripts had to be reloaded.
+	Attempts int
+
+	// Duration is the wall time spent in Exec, including retries.
+	Duration time.Duration
+
+	// Shards is the timing of each sub-pipeline when WithShardedPipelines
+	// split the pipeline by shard, and nil otherwise.
+	Shards []ShardTiming
+
+	// Tags are the tags on the context passed to Exec.
+	Tags []Tag
+
+	// Err is the error returned by Exec, if any.
+	Err error
+}
+
+// ShardTiming describes the sub-pipeline of a single shard in a
+// PipelineEvent.
+type ShardTiming struct {
+	// Addr is the address of a ClusterClient master or the name of a Ring
+	// shard.
+	Addr string
+
+	// Duration is the wall time spent executing the sub-pipeline.
+	Duration time.Duration
+
+	// Commands is the number of operations in the sub-pipeline.
+	Commands int
+
+	// Err is the error of the sub-pipeline, if any.
+	Err error
+}
+
+// BatchSize is the total number of operations in the pipeline.
+func (ev PipelineEvent) BatchSize() int {
+	return ev.Allows + ev.Takes + ev.Releases
+}
+
+// WithHooks registers hooks on the Limiter. It may be given more than once,
+// in which case every registered hook is called in order.
+func WithHooks(hooks Hooks) func(*Limiter) {
+	return func(s *Limiter) {
+		s.hooks = append(s.hooks, hooks)
+	}
+}
+
+func (l *Limiter) onPipelineExec(ctx context.Context, ev PipelineEvent) {
+	for _, h := range l.hooks {
+		if h.OnPipelineExec != nil {
+			h.OnPipelineExec(ctx, ev)
+		}
+	}
+}
+
+func (l *Limiter) onAllow(ctx context.Context, op Operation, key string, n int, rv *Result, start time.Time, err error) {
+	d := time.Since(start)
+	l.stats.record(op, d, err == nil && rv != nil && rv.Allowed == 0, err)
+	if len(l.hooks) == 0 {
+		return
+	}
+	if err != nil {
+		rv = nil
+	}
+	ev := AllowEvent{
+		Op:       op,
+		Prefix:   l.ratePrefix,
+		Key:      key,
+		N:        n,
+		Tags:     TagsFromContext(ctx),
+		Result:   rv,
+		Duration: d,
+		Err:      err,
+	}
+	for _, h := range l.hooks {
+		if h.OnAllow != nil {
+			h.OnAllow(ctx, ev)
+		}
+	}
+	if rv == nil || !rv.shadowDenied(n) {
+		return
+	}
+	for _, h := range l.hooks {
+		if h.OnShadowDeny != nil {
+			h.OnShadowDeny(ctx, ev)
+		}
+	}
+}
+
+func (l *Limiter) onConcurrency(ctx context.Context, op Operation, key string, requestID string, rv *ConcurrencyResult, start time.Time, err error) {
+	d := time.Since(start)
+	l.stats.record(op, d, err == nil && rv != nil && !rv.Allowed, err)
+	if len(l.hooks) == 0 {
+		return
+	}
+	if err != nil {
+		rv = nil
+	}
+	ev := ConcurrencyEvent{
+		Op:        op,
+		Prefix:    l.concurrentPrefix,
+		Key:       key,
+		RequestID: requestID,
+		Tags:      TagsFromContext(ctx),
+		Result:    rv,
+		Duration:  d,
+		Err:       err,
+	}
+	for _, h := range l.hooks {
+		if h.OnConcurrency != nil {
+			h.OnConcurrency(ctx, ev)
+		}
+	}
+}
+
+func (l *Limiter) onScriptLoad(ctx context.Context, start time.Time, err error) {
+	if len(l.hooks) == 0 {
+		return
+	}
+	ev := ScriptLoadEvent{
+		Duration: time.Since(start),
+		Err:      err,
+	}
+	for _, h := range l.hooks {
+		if h.OnScriptLoad != nil {
+			h.OnScriptLoad(ctx, ev)
+		}
+	}
+}
+
+func (l *Limiter) onGrace(ctx context.Context, key string, rv *Result, enforceAt time.Time) {
+	if len(l.hooks) == 0 {
+		return
+	}
+	ev := GraceEvent{
+		Key:       key,
+		Tags:      TagsFromContext(ctx),
+		Result:    rv,
+		EnforceAt: enforceAt,
+	}
+	for _, h := range l.hooks {
+		if h.OnGrace != nil {
+			h.OnGrace(ctx, ev)
+		}
+	}
+}
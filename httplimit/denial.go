@@ -0,0 +1,147 @@
+package httplimit
+
+import (
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ductone/redis_rate/v11"
+)
+
+// DenialHandler writes the response to a request denied by the Middleware,
+// such as an error envelope mandated by an API. res is the denied result.
+type DenialHandler interface {
+	Deny(w http.ResponseWriter, r *http.Request, res *redis_rate.Result)
+}
+
+// DenialHandlerFunc adapts a function to a DenialHandler.
+type DenialHandlerFunc func(w http.ResponseWriter, r *http.Request, res *redis_rate.Result)
+
+// Deny calls f(w, r, res).
+func (f DenialHandlerFunc) Deny(w http.ResponseWriter, r *http.Request, res *redis_rate.Result) {
+	f(w, r, res)
+}
+
+// WithDenialHandler sets how denied requests are answered. If unset the
+// default is a zero DenialResponse: 429 Too Many Requests with the RateLimit
+// header fields, Retry-After and a plain text body.
+func WithDenialHandler(h DenialHandler) func(*Middleware) {
+	return func(m *Middleware) {
+		m.denialHandler = h
+	}
+}
+
+// DenialResponse is a DenialHandler whose status code, header fields, body
+// and message can each be changed, with the defaults for those left unset.
+type DenialResponse struct {
+	// Status is the status code. If unset the default is 429 Too Many
+	// Requests.
+	Status int
+
+	// Headers sets the header fields of the response. If unset the default
+	// is SetHeaders.
+	Headers func(h http.Header, res *redis_rate.Result)
+
+	// Message is the message of the response when none of Messages matches
+	// the request. If unset the default is the status text of Status.
+	Message string
+
+	// Messages are localized messages by language tag, such as "fr" or
+	// "pt-BR", chosen from the request's Accept-Language header. A tag with
+	// a region falls back to its language.
+	Messages map[string]string
+
+	// ContentType is the Content-Type of the body written by Render. If
+	// unset the default is "text/plain; charset=utf-8".
+	ContentType string
+
+	// Render writes the body. If unset the default writes the message and
+	// a newline, as http.Error does.
+	Render func(w io.Writer, r *http.Request, res *redis_rate.Result, message string) error
+}
+
+// Deny writes the response for the denied request r.
+func (d *DenialResponse) Deny(w http.ResponseWriter, r *http.Request, res *redis_rate.Result) {
+	status := d.Status
+	if status == 0 {
+		status = http.StatusTooManyRequests
+	}
+	if d.Headers != nil {
+		d.Headers(w.Header(), res)
+	} else {
+		SetHeaders(w.Header(), res)
+	}
+
+	contentType := d.ContentType
+	if contentType == "" {
+		contentType = "text/plain; charset=utf-8"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+
+	message := d.message(r, status)
+	if d.Render != nil {
+		_ = d.Render(w, r, res, message)
+		return
+	}
+	_, _ = io.WriteString(w, message+"\n")
+}
+
+// message returns the message matching the Accept-Language of r best.
+func (d *DenialResponse) message(r *http.Request, status int) string {
+	if len(d.Messages) > 0 {
+		for _, tag := range acceptLanguages(r.Header.Get("Accept-Language")) {
+			if msg, ok := d.Messages[tag]; ok {
+				return msg
+			}
+			if i := strings.IndexByte(tag, '-'); i > 0 {
+				if msg, ok := d.Messages[tag[:i]]; ok {
+					return msg
+				}
+			}
+		}
+	}
+	if d.Message != "" {
+		return d.Message
+	}
+	return http.StatusText(status)
+}
+
+// acceptLanguages returns the language tags of an Accept-Language header,
+// most preferred first, leaving out those with a weight of 0 and "*".
+func acceptLanguages(header string) []string {
+	type weighted struct {
+		tag string
+		q   float64
+	}
+	var tags []weighted
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		tag = strings.TrimSpace(tag)
+		if tag == "" || tag == "*" {
+			continue
+		}
+		q := 1.0
+		if params = strings.TrimSpace(params); strings.HasPrefix(params, "q=") {
+			f, err := strconv.ParseFloat(params[len("q="):], 64)
+			if err != nil {
+				continue
+			}
+			q = f
+		}
+		if q > 0 {
+			tags = append(tags, weighted{tag, q})
+		}
+	}
+	sort.SliceStable(tags, func(i, j int) bool {
+		return tags[i].q > tags[j].q
+	})
+	rv := make([]string, len(tags))
+	for i, t := range tags {
+		rv[i] = t.tag
+	}
+	return rv
+}
@@ -0,0 +1,123 @@
+// Package httplimit provides net/http middleware that rate limits requests
+// with a redis_rate.Limiter and reports the outcome using the RateLimit
+// header fields from the IETF httpapi draft.
+package httplimit
+
+import (
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/ductone/redis_rate/v11"
+)
+
+// ErrNoKey is returned by a KeyFunc when the request carries nothing to key
+// the limit on.
+var ErrNoKey = errors.New("httplimit: no rate limit key for request")
+
+// KeyFunc derives the rate limit key for a request.
+type KeyFunc func(r *http.Request) (string, error)
+
+// IPKey keys requests by the remote IP address of the connection.
+func IPKey(r *http.Request) (string, error) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if host == "" {
+		return "", ErrNoKey
+	}
+	return "ip:" + host, nil
+}
+
+// HeaderKey keys requests by the value of the named header, such as a
+// tenant or API key header. Requests without the header are rejected with
+// ErrNoKey.
+func HeaderKey(name string) KeyFunc {
+	return func(r *http.Request) (string, error) {
+		v := r.Header.Get(name)
+		if v == "" {
+			return "", ErrNoKey
+		}
+		return name + ":" + v, nil
+	}
+}
+
+// Middleware rate limits an http.Handler. It is created by New.
+type Middleware struct {
+	limiter       *redis_rate.Limiter
+	limit         redis_rate.Limit
+	keyFunc       KeyFunc
+	errorHandler  func(w http.ResponseWriter, r *http.Request, err error)
+	denialHandler DenialHandler
+}
+
+// WithKeyFunc sets how the rate limit key is derived. If unset the default
+// is IPKey.
+func WithKeyFunc(keyFunc KeyFunc) func(*Middleware) {
+	return func(m *Middleware) {
+		m.keyFunc = keyFunc
+	}
+}
+
+// WithErrorHandler sets the handler called when the key cannot be derived
+// or the limiter fails. If unset the default responds with 500 Internal
+// Server Error.
+func WithErrorHandler(fn func(w http.ResponseWriter, r *http.Request, err error)) func(*Middleware) {
+	return func(m *Middleware) {
+		m.errorHandler = fn
+	}
+}
+
+// New returns a Middleware that allows each key limit requests.
+func New(limiter *redis_rate.Limiter, limit redis_rate.Limit, options ...func(*Middleware)) *Middleware {
+	m := &Middleware{
+		limiter:       limiter,
+		limit:         limit,
+		keyFunc:       IPKey,
+		errorHandler:  defaultErrorHandler,
+		denialHandler: &DenialResponse{},
+	}
+
+	for _, option := range options {
+		option(m)
+	}
+	return m
+}
+
+// Handler wraps next so that it is only called for allowed requests. Denied
+// requests are answered by the DenialHandler, by default with a 429 Too Many
+// Requests response with a Retry-After header.
+func (m *Middleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, err := m.keyFunc(r)
+		if err != nil {
+			m.errorHandler(w, r, err)
+			return
+		}
+
+		res, err := m.limiter.Allow(r.Context(), key, m.limit)
+		if err != nil {
+			m.errorHandler(w, r, err)
+			return
+		}
+
+		if res.Allowed == 0 {
+			m.denialHandler.Deny(w, r, res)
+			return
+		}
+		SetHeaders(w.Header(), res)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// SetHeaders writes the RateLimit-Limit, RateLimit-Remaining,
+// RateLimit-Reset and RateLimit-Policy fields for res, and Retry-After if
+// res was denied. It is res.SetHeaders(h).
+func SetHeaders(h http.Header, res *redis_rate.Result) {
+	res.SetHeaders(h)
+}
+
+func defaultErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+}
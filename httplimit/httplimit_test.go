@@ -0,0 +1,101 @@
+package httplimit_test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ductone/redis_rate/v11"
+	"github.com/ductone/redis_rate/v11/httplimit"
+)
+
+func TestSetHeaders(t *testing.T) {
+	h := http.Header{}
+	httplimit.SetHeaders(h, &redis_rate.Result{
+		Limit:      redis_rate.PerMinute(60),
+		Allowed:    1,
+		Remaining:  59,
+		RetryAfter: -1,
+		ResetAfter: 1500 * time.Millisecond,
+	})
+	require.Equal(t, "60", h.Get("RateLimit-Limit"))
+	require.Equal(t, "59", h.Get("RateLimit-Remaining"))
+	require.Equal(t, "2", h.Get("RateLimit-Reset"))
+	require.Empty(t, h.Get("Retry-After"))
+
+	h = http.Header{}
+	httplimit.SetHeaders(h, &redis_rate.Result{
+		Limit:      redis_rate.PerMinute(60),
+		Allowed:    0,
+		Remaining:  0,
+		RetryAfter: 200 * time.Millisecond,
+		ResetAfter: time.Minute,
+	})
+	require.Equal(t, "0", h.Get("RateLimit-Remaining"))
+	require.Equal(t, "60", h.Get("RateLimit-Reset"))
+	require.Equal(t, "1", h.Get("Retry-After"))
+}
+
+func TestKeyFuncs(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("X-Tenant", "acme")
+
+	key, err := httplimit.IPKey(r)
+	require.NoError(t, err)
+	require.Equal(t, "ip:10.0.0.1", key)
+
+	key, err = httplimit.HeaderKey("X-Tenant")(r)
+	require.NoError(t, err)
+	require.Equal(t, "X-Tenant:acme", key)
+
+	_, err = httplimit.HeaderKey("X-Missing")(r)
+	require.ErrorIs(t, err, httplimit.ErrNoKey)
+}
+
+func TestDenialResponse(t *testing.T) {
+	res := &redis_rate.Result{
+		Limit:      redis_rate.PerMinute(60),
+		RetryAfter: 2 * time.Second,
+		ResetAfter: time.Minute,
+	}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	w := httptest.NewRecorder()
+	(&httplimit.DenialResponse{}).Deny(w, r, res)
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+	require.Equal(t, "2", w.Header().Get("Retry-After"))
+	require.Equal(t, "Too Many Requests\n", w.Body.String())
+
+	d := &httplimit.DenialResponse{
+		Status: http.StatusServiceUnavailable,
+		Headers: func(h http.Header, res *redis_rate.Result) {
+			h.Set("X-Retry-In", res.RetryAfter.String())
+		},
+		Message:     "slow down",
+		Messages:    map[string]string{"fr": "ralentissez", "pt-BR": "devagar"},
+		ContentType: "application/json",
+		Render: func(w io.Writer, r *http.Request, res *redis_rate.Result, message string) error {
+			_, err := fmt.Fprintf(w, `{"error":{"code":"rate_limited","message":%q}}`, message)
+			return err
+		},
+	}
+	w = httptest.NewRecorder()
+	r.Header.Set("Accept-Language", "de;q=0.5, fr-CA, en;q=0.8")
+	d.Deny(w, r, res)
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+	require.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	require.Equal(t, "2s", w.Header().Get("X-Retry-In"))
+	require.Empty(t, w.Header().Get("Retry-After"))
+	require.Equal(t, `{"error":{"code":"rate_limited","message":"ralentissez"}}`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	r.Header.Set("Accept-Language", "pt-BR;q=0, de")
+	d.Deny(w, r, res)
+	require.Equal(t, `{"error":{"code":"rate_limited","message":"slow down"}}`, w.Body.String())
+}
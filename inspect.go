@@ -0,0 +1,170 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// KeyState is the stored state of a rate limit key, as reported by Inspect
+// and InspectMulti. It does not depend on the key's Limit; use Usage to
+// compute Remaining for a known Limit.
+type KeyState struct {
+	// Name of the key used for this state.
+	Key string
+
+	// Exists is false for keys with no stored state, which are in their
+	// initial state.
+	Exists bool
+
+	// ResetAt is when the key returns to its initial state. It is the zero
+	// Time for keys that do not exist.
+	ResetAt time.Time
+
+	// Used is the number of events counted in the stored window of a
+	// calendar key, which may be a past window. It is 0 for other keys.
+	Used int64
+
+	// TTL is the time until Redis removes the key, or -1 if it does not
+	// expire.
+	TTL time.Duration
+
+	// Err is set when the state of this key could not be read. The states
+	// of other keys are still valid.
+	Err error
+}
+
+type inspectCmds struct {
+	typ  *redis.StatusCmd
+	pttl *redis.DurationCmd
+
+	// value is the tat of a GCRA key or the count of a calendar key, read
+	// once the type of the key is known.
+	value *redis.StringCmd
+}
+
+// Inspect reports the stored state of key without modifying it.
+func (l *Limiter) Inspect(ctx context.Context, key string) (_ *KeyState, err error) {
+	defer l.recoverPanic(OpInspect, key, &err)
+	states, err := l.InspectMulti(ctx, []string{key})
+	if err != nil {
+		return nil, err
+	}
+	if states[0].Err != nil {
+		return nil, states[0].Err
+	}
+	return states[0], nil
+}
+
+// InspectMulti reports the stored state of every key in two pipelined round
+// trips, one for the type of each key and one for its value, without
+// modifying any of them, for example for an admin dashboard. The returned states are in the same order as keys. A key that
+// cannot be read has its Err set instead of failing the whole call; an error
+// is only returned if Redis could not be reached.
+func (l *Limiter) InspectMulti(ctx context.Context, keys []string) (_ []*KeyState, err error) {
+	defer l.recoverPanic(OpInspect, "", &err)
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	rkeys := l.rateKeys(ctx, keys)
+	pl := l.rdb.Pipeline()
+	timeCmd := pl.Time(ctx)
+	cmds := make([]inspectCmds, len(keys))
+	for i, rkey := range rkeys {
+		cmds[i] = inspectCmds{
+			typ:  pl.Type(ctx, rkey),
+			pttl: pl.PTTL(ctx, rkey),
+		}
+	}
+	_, err = pl.Exec(ctx)
+	var rerr redis.Error
+	if err != nil && !errors.As(err, &rerr) {
+		return nil, err
+	}
+
+	// GCRA keys are strings and calendar keys hashes, so read each with the
+	// command for its type.
+	pl = l.rdb.Pipeline()
+	for i, rkey := range rkeys {
+		switch cmds[i].typ.Val() {
+		case "string":
+			cmds[i].value = pl.Get(ctx, rkey)
+		case "hash":
+			cmds[i].value = pl.HGet(ctx, rkey, "n")
+		}
+	}
+	if pl.Len() > 0 {
+		_, err = pl.Exec(ctx)
+		if err != nil && !errors.As(err, &rerr) {
+			return nil, err
+		}
+	}
+
+	now, err := timeCmd.Result()
+	if err != nil {
+		return nil, err
+	}
+	if l.clock != nil {
+		now = l.clock.Now()
+	}
+
+	rv := make([]*KeyState, len(keys))
+	for i, key := range keys {
+		state := &KeyState{
+			Key: key,
+		}
+		state.Err = state.read(cmds[i], now)
+		rv[i] = state
+	}
+	return rv, nil
+}
+
+func (s *KeyState) read(cmds inspectCmds, now time.Time) error {
+	typ, err := cmds.typ.Result()
+	if err != nil {
+		return err
+	}
+	if typ == "none" {
+		return nil
+	}
+	s.Exists = true
+
+	s.TTL, err = cmds.pttl.Result()
+	if err != nil {
+		return err
+	}
+	if s.TTL > 0 {
+		s.ResetAt = now.Add(s.TTL)
+	}
+
+	if cmds.value == nil {
+		return nil
+	}
+	v, err := cmds.value.Result()
+	if err == redis.Nil {
+		// the key expired or, for a sliding window key, is a hash without
+		// a count, which only reports its TTL.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	switch typ {
+	case "string":
+		tat, err := decodeTAT(v)
+		if err != nil {
+			return err
+		}
+		s.ResetAt = fromScriptTime(tat)
+	case "hash":
+		s.Used, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
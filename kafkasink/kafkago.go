@@ -0,0 +1,35 @@
+package kafkasink
+
+import (
+	"context"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// kafkaWriter is a Writer producing through a kafka-go Writer.
+type kafkaWriter struct {
+	w *kafka.Writer
+}
+
+// NewKafkaWriter returns a Writer producing through w, a Writer of
+// github.com/segmentio/kafka-go, which handles connections, TLS, SASL,
+// compression and retries. w must not be in use yet: if its Balancer is
+// unset it is set to a kafka.Murmur2Balancer, so that the decisions of a key
+// go to the partition the Java client would pick and stay in order.
+//
+// kafka-go's Writer waits for no acks unless RequiredAcks is set, such as
+// to kafka.RequireAll.
+func NewKafkaWriter(w *kafka.Writer) Writer {
+	if w.Balancer == nil {
+		w.Balancer = &kafka.Murmur2Balancer{}
+	}
+	return kafkaWriter{w: w}
+}
+
+func (k kafkaWriter) WriteMessages(ctx context.Context, msgs ...Message) error {
+	out := make([]kafka.Message, len(msgs))
+	for i, m := range msgs {
+		out[i] = kafka.Message{Key: m.Key, Value: m.Value, Time: m.Time}
+	}
+	return k.w.WriteMessages(ctx, out...)
+}
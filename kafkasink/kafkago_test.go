@@ -0,0 +1,111 @@
+package kafkasink_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/protocol"
+	metadataAPI "github.com/segmentio/kafka-go/protocol/metadata"
+	produceAPI "github.com/segmentio/kafka-go/protocol/produce"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ductone/redis_rate/v11/kafkasink"
+)
+
+// fakeTransport is a kafka.RoundTripper standing in for a broker leading the
+// two partitions of a topic, recording the messages produced to each.
+type fakeTransport struct {
+	topic string
+
+	mu   sync.Mutex
+	acks []int16
+	msgs map[int32][]kafkasink.Message
+}
+
+func (f *fakeTransport) RoundTrip(ctx context.Context, addr net.Addr, req kafka.Request) (kafka.Response, error) {
+	switch req := req.(type) {
+	case *metadataAPI.Request:
+		return &metadataAPI.Response{
+			Brokers: []metadataAPI.ResponseBroker{{NodeID: 1, Host: "localhost", Port: 9092}},
+			Topics: []metadataAPI.ResponseTopic{{
+				Name: f.topic,
+				Partitions: []metadataAPI.ResponsePartition{
+					{PartitionIndex: 0, LeaderID: 1},
+					{PartitionIndex: 1, LeaderID: 1},
+				},
+			}},
+		}, nil
+	case *produceAPI.Request:
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.acks = append(f.acks, req.Acks)
+		res := &produceAPI.Response{}
+		for _, topic := range req.Topics {
+			rt := produceAPI.ResponseTopic{Topic: topic.Topic}
+			for _, p := range topic.Partitions {
+				for {
+					r, err := p.RecordSet.Records.ReadRecord()
+					if errors.Is(err, io.EOF) {
+						break
+					}
+					if err != nil {
+						return nil, err
+					}
+					key, _ := protocol.ReadAll(r.Key)
+					value, _ := protocol.ReadAll(r.Value)
+					f.msgs[p.Partition] = append(f.msgs[p.Partition], kafkasink.Message{
+						Key:   key,
+						Value: value,
+						Time:  r.Time.UTC(),
+					})
+				}
+				rt.Partitions = append(rt.Partitions, produceAPI.ResponsePartition{Partition: p.Partition})
+			}
+			res.Topics = append(res.Topics, rt)
+		}
+		return res, nil
+	default:
+		return nil, errors.New("unexpected request")
+	}
+}
+
+func TestKafkaWriter(t *testing.T) {
+	ctx := context.Background()
+	transport := &fakeTransport{
+		topic: "decisions",
+		msgs:  make(map[int32][]kafkasink.Message),
+	}
+	kw := &kafka.Writer{
+		Addr:         kafka.TCP("localhost:9092"),
+		Topic:        "decisions",
+		RequiredAcks: kafka.RequireAll,
+		BatchTimeout: time.Millisecond,
+		Transport:    transport,
+	}
+	defer kw.Close()
+	w := kafkasink.NewKafkaWriter(kw)
+
+	at := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	msgs := []kafkasink.Message{
+		{Key: []byte("21"), Value: []byte("a"), Time: at},
+		{Key: []byte("abc"), Value: []byte("b"), Time: at.Add(time.Second)},
+		{Key: []byte("21"), Value: []byte("c"), Time: at.Add(2 * time.Second)},
+	}
+	require.NoError(t, w.WriteMessages(ctx, msgs...))
+
+	// The murmur2 hashes of "21" and "abc" are -973932308 and 479470107, as
+	// in the Java client's tests.
+	transport.mu.Lock()
+	defer transport.mu.Unlock()
+	require.Equal(t, []kafkasink.Message{msgs[0], msgs[2]}, transport.msgs[0])
+	require.Equal(t, []kafkasink.Message{msgs[1]}, transport.msgs[1])
+	for _, acks := range transport.acks {
+		require.Equal(t, int16(kafka.RequireAll), acks)
+	}
+}
@@ -0,0 +1,133 @@
+// Package kafkasink writes the decisions of a redis_rate.Limiter to a Kafka
+// topic, batched from a background goroutine by a
+// redis_rate.AsyncDecisionLog, so high-volume decision logging does not
+// depend on the capacity of a Redis stream.
+//
+// Messages are written through a Writer, such as a kafka-go Writer adapted
+// by NewKafkaWriter:
+//
+//	w := kafkasink.NewKafkaWriter(&kafka.Writer{
+//		Addr:         kafka.TCP("kafka-1:9092", "kafka-2:9092"),
+//		Topic:        "rate-limit-decisions",
+//		RequiredAcks: kafka.RequireAll,
+//	})
+//	log := kafkasink.NewAsync(w, redis_rate.AsyncDecisionLogOptions{})
+//	limiter := redis_rate.New(rdb, redis_rate.WithHooks(log.Hooks()))
+//
+// Any other producer can be adapted to Writer in a few lines.
+package kafkasink
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/ductone/redis_rate/v11"
+)
+
+// Message is a Kafka message.
+type Message struct {
+	Key   []byte
+	Value []byte
+	Time  time.Time
+}
+
+// Writer produces messages to a Kafka topic. WriteMessages returns once
+// every message was written or the write failed.
+type Writer interface {
+	WriteMessages(ctx context.Context, msgs ...Message) error
+}
+
+// Encoder encodes a decision as the value of a message.
+type Encoder func(decision redis_rate.Decision) ([]byte, error)
+
+// Sink is a redis_rate.DecisionSink producing a message per decision, keyed
+// by the decision's key so that the decisions of a key stay in order on one
+// partition. It is created by New.
+type Sink struct {
+	w      Writer
+	encode Encoder
+}
+
+// WithEncoder sets how decisions are encoded. If unset the default is
+// EncodeJSON.
+func WithEncoder(encode Encoder) func(*Sink) {
+	return func(s *Sink) {
+		s.encode = encode
+	}
+}
+
+// New returns a Sink writing to w.
+func New(w Writer, options ...func(*Sink)) *Sink {
+	s := &Sink{
+		w:      w,
+		encode: EncodeJSON,
+	}
+	for _, option := range options {
+		option(s)
+	}
+	return s
+}
+
+// NewAsync returns a redis_rate.AsyncDecisionLog writing to w through a Sink.
+func NewAsync(w Writer, opts redis_rate.AsyncDecisionLogOptions, options ...func(*Sink)) *redis_rate.AsyncDecisionLog {
+	return redis_rate.NewAsyncDecisionLog(New(w, options...), opts)
+}
+
+// WriteDecisions writes a message per decision in one call to the Writer.
+func (s *Sink) WriteDecisions(ctx context.Context, decisions []redis_rate.Decision) error {
+	msgs := make([]Message, len(decisions))
+	for i, decision := range decisions {
+		value, err := s.encode(decision)
+		if err != nil {
+			return err
+		}
+		msgs[i] = Message{
+			Key:   []byte(decision.Key),
+			Value: value,
+			Time:  decision.Time,
+		}
+	}
+	return s.w.WriteMessages(ctx, msgs...)
+}
+
+// record is the JSON encoding of a decision.
+type record struct {
+	Time    time.Time `json:"time"`
+	Op      string    `json:"op"`
+	Key     string    `json:"key"`
+	N       int       `json:"n"`
+	Allowed int64     `json:"allowed"`
+	Limit   string    `json:"limit,omitempty"`
+	Reason  string    `json:"reason,omitempty"`
+	Shadow  bool      `json:"shadow,omitempty"`
+	Tags    []tag     `json:"tags,omitempty"`
+}
+
+type tag struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// EncodeJSON encodes a decision as a JSON object with the fields time, op,
+// key, n and allowed, and limit, reason, shadow and tags when they are set.
+// The limit is in the format of redis_rate.ParseLimit, and tags are an array
+// of objects with the fields key and value.
+func EncodeJSON(decision redis_rate.Decision) ([]byte, error) {
+	rec := record{
+		Time:    decision.Time,
+		Op:      string(decision.Op),
+		Key:     decision.Key,
+		N:       decision.N,
+		Allowed: decision.Allowed,
+		Reason:  string(decision.Reason),
+		Shadow:  decision.Shadow,
+	}
+	if !decision.Limit.IsZero() {
+		rec.Limit = decision.Limit.String()
+	}
+	for _, t := range decision.Tags {
+		rec.Tags = append(rec.Tags, tag{Key: t.Key, Value: t.Value})
+	}
+	return json.Marshal(rec)
+}
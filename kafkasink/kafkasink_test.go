@@ -0,0 +1,84 @@
+package kafkasink_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ductone/redis_rate/v11"
+	"github.com/ductone/redis_rate/v11/kafkasink"
+)
+
+type fakeWriter struct {
+	mu   sync.Mutex
+	msgs []kafkasink.Message
+	err  error
+}
+
+func (w *fakeWriter) WriteMessages(ctx context.Context, msgs ...kafkasink.Message) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	w.msgs = append(w.msgs, msgs...)
+	return nil
+}
+
+func TestSink(t *testing.T) {
+	ctx := context.Background()
+	w := &fakeWriter{}
+	at := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	err := kafkasink.New(w).WriteDecisions(ctx, []redis_rate.Decision{
+		{Time: at, Op: redis_rate.OpAllowN, Key: "tenant1", N: 2, Allowed: 2},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []kafkasink.Message{{
+		Key:   []byte("tenant1"),
+		Value: []byte(`{"time":"2024-01-01T00:00:00Z","op":"allow_n","key":"tenant1","n":2,"allowed":2}`),
+		Time:  at,
+	}}, w.msgs)
+
+	w.msgs = nil
+	err = kafkasink.New(w).WriteDecisions(ctx, []redis_rate.Decision{{
+		Time:   at,
+		Op:     redis_rate.OpAllowN,
+		Key:    "tenant1",
+		N:      1,
+		Limit:  redis_rate.PerSecond(10),
+		Reason: redis_rate.ReasonRateExceeded,
+		Shadow: true,
+		Tags:   []redis_rate.Tag{{Key: "route", Value: "/v1/things"}},
+	}})
+	require.NoError(t, err)
+	require.JSONEq(t, `{
+		"time": "2024-01-01T00:00:00Z",
+		"op": "allow_n",
+		"key": "tenant1",
+		"n": 1,
+		"allowed": 0,
+		"limit": "10 req/s (burst 10)",
+		"reason": "rate_exceeded",
+		"shadow": true,
+		"tags": [{"key": "route", "value": "/v1/things"}]
+	}`, string(w.msgs[0].Value))
+
+	w.err = errors.New("broker down")
+	require.ErrorIs(t, kafkasink.New(w).WriteDecisions(ctx, []redis_rate.Decision{{Key: "tenant1"}}), w.err)
+}
+
+func TestNewAsync(t *testing.T) {
+	w := &fakeWriter{}
+	log := kafkasink.NewAsync(w, redis_rate.AsyncDecisionLogOptions{BatchSize: 2})
+	for i := 0; i < 5; i++ {
+		require.True(t, log.Record(redis_rate.Decision{Op: redis_rate.OpAllowN, Key: "tenant1", N: 1, Allowed: 1}))
+	}
+	require.NoError(t, log.Close(context.Background()))
+	require.Len(t, w.msgs, 5)
+	require.Equal(t, int64(5), log.Stats().Written)
+	require.Equal(t, int64(3), log.Stats().Batches)
+}
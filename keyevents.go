@@ -0,0 +1,265 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// KeyEventType is what happened to a key in a KeyEvent.
+type KeyEventType string
+
+const (
+	// KeyCreated is reported when a key is written while it does not exist,
+	// such as the first Allow of a key or of a key that had expired.
+	KeyCreated KeyEventType = "created"
+
+	// KeyExpired is reported when a key expires, once it has returned to
+	// its initial state.
+	KeyExpired KeyEventType = "expired"
+
+	// KeyDeleted is reported when a key is deleted, such as by Reset or when
+	// the last slot of a concurrency key is released.
+	KeyDeleted KeyEventType = "deleted"
+)
+
+// KeyKind tells rate limit keys and concurrency keys apart in a KeyEvent.
+type KeyKind string
+
+const (
+	KeyKindRate        KeyKind = "rate"
+	KeyKindConcurrency KeyKind = "concurrency"
+)
+
+// KeyEvent describes a key of the Limiter appearing or going away, reported
+// to Hooks.OnKeyEvent by a KeyWatcher.
+type KeyEvent struct {
+	Type KeyEventType
+	Kind KeyKind
+
+	// Prefix is the rate limit or concurrency key prefix of the Limiter.
+	Prefix string
+
+	// Key is the key without Prefix, epoch or hash tag.
+	Key string
+
+	// Addr is the address of the node the key lives on, if known.
+	Addr string
+}
+
+// ErrKeyEventsUnsupported is returned by StartKeyWatcher when the Limiter's
+// client cannot subscribe to keyspace notifications.
+var ErrKeyEventsUnsupported = errors.New("redis_rate: client does not support keyspace notifications")
+
+// keyEventChannels are the keyspace notification channels a KeyWatcher
+// subscribes to, by the event they report.
+var keyEventChannels = map[string]KeyEventType{
+	"new":     KeyCreated,
+	"expired": KeyExpired,
+	"del":     KeyDeleted,
+}
+
+// KeyWatcherStats counts the events reported by a KeyWatcher.
+type KeyWatcherStats struct {
+	Created int64
+	Expired int64
+	Deleted int64
+}
+
+// KeyWatcher reports the keys of a Limiter being created, expiring and being
+// deleted to the OnKeyEvent of its Hooks, so that inventories of active
+// tenants can be kept up to date. It is created by StartKeyWatcher.
+type KeyWatcher struct {
+	l      *Limiter
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	subs   []*redis.PubSub
+
+	created atomic.Int64
+	expired atomic.Int64
+	deleted atomic.Int64
+}
+
+// StartKeyWatcher subscribes to the keyspace notifications of every node and
+// reports the events of the Limiter's own keys until ctx is done or Stop is
+// called. Side keys, such as those of bans or boosts, and keys evaluated in
+// shadow mode are not reported.
+//
+// Notifications must be enabled on the servers with at least the "Exgn"
+// flags of notify-keyspace-events, which for key creation needs Redis 7.
+// They are delivered at most once and only while subscribed, so events that
+// happen while a node is unreachable are lost; an inventory kept from them
+// should be reconciled with a scan now and then. The nodes are those at the
+// time of the call.
+func (l *Limiter) StartKeyWatcher(ctx context.Context) (*KeyWatcher, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	w := &KeyWatcher{l: l, cancel: cancel}
+
+	patterns := make([]string, 0, len(keyEventChannels))
+	for event := range keyEventChannels {
+		patterns = append(patterns, "__keyevent@*__:"+event)
+	}
+	subs, err := l.subscribeKeyEvents(ctx, patterns, &w.wg, func(addr string, msg *redis.Message) {
+		w.handle(ctx, addr, msg)
+	})
+	w.subs = subs
+	if err != nil {
+		w.Stop()
+		return nil, err
+	}
+	return w, nil
+}
+
+// subscribeKeyEvents subscribes to the keyspace notification patterns on
+// every node and calls handle with each message received, from a goroutine
+// per node added to wg, until the returned subscriptions are closed. On
+// error the subscriptions made so far are returned too.
+func (l *Limiter) subscribeKeyEvents(
+	ctx context.Context,
+	patterns []string,
+	wg *sync.WaitGroup,
+	handle func(addr string, msg *redis.Message),
+) ([]*redis.PubSub, error) {
+	var mu sync.Mutex
+	var subs []*redis.PubSub
+	err := l.forEachNode(ctx, func(_ context.Context, node redisNode) error {
+		sub, ok := node.(interface {
+			PSubscribe(ctx context.Context, channels ...string) *redis.PubSub
+		})
+		if !ok {
+			return ErrKeyEventsUnsupported
+		}
+		ps := sub.PSubscribe(ctx, patterns...)
+		if _, err := ps.Receive(ctx); err != nil {
+			_ = ps.Close()
+			return err
+		}
+		mu.Lock()
+		subs = append(subs, ps)
+		mu.Unlock()
+
+		addr := nodeAddr(node)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for msg := range ps.Channel() {
+				handle(addr, msg)
+			}
+		}()
+		return nil
+	})
+	return subs, err
+}
+
+// Stop unsubscribes and waits for the events received so far to be
+// reported.
+func (w *KeyWatcher) Stop() {
+	w.cancel()
+	for _, ps := range w.subs {
+		_ = ps.Close()
+	}
+	w.wg.Wait()
+}
+
+// Stats returns the number of events reported so far.
+func (w *KeyWatcher) Stats() KeyWatcherStats {
+	return KeyWatcherStats{
+		Created: w.created.Load(),
+		Expired: w.expired.Load(),
+		Deleted: w.deleted.Load(),
+	}
+}
+
+func (w *KeyWatcher) handle(ctx context.Context, addr string, msg *redis.Message) {
+	typ, ok := keyEventChannels[msg.Channel[strings.LastIndexByte(msg.Channel, ':')+1:]]
+	if !ok {
+		return
+	}
+	ev, ok := w.l.parseKeyEvent(msg.Payload)
+	if !ok {
+		return
+	}
+	ev.Type = typ
+	ev.Addr = addr
+
+	switch typ {
+	case KeyCreated:
+		w.created.Add(1)
+	case KeyExpired:
+		w.expired.Add(1)
+	case KeyDeleted:
+		w.deleted.Add(1)
+	}
+	for _, h := range w.l.hooks {
+		if h.OnKeyEvent != nil {
+			h.OnKeyEvent(ctx, ev)
+		}
+	}
+}
+
+// rateSideKeys and concurrencySideKeys are the suffixes of the keys kept
+// next to rate limit and concurrency keys.
+var (
+	rateSideKeys        = []string{":boost", ":ban", ":strikes", ":frozen", ":shares", warmUpKeySuffix}
+	concurrencySideKeys = []string{":fence", ":released", ":queue", ":deadlines", ":holds"}
+)
+
+// parseKeyEvent returns the event of the Redis key redisKey, with its Kind,
+// Prefix and Key set, or false if redisKey is not a key of the Limiter.
+func (l *Limiter) parseKeyEvent(redisKey string) (KeyEvent, bool) {
+	var ev KeyEvent
+	var side []string
+	if l.epoch != nil {
+		if base := trimEpoch(redisKey); base != redisKey && strings.HasPrefix(base, l.ratePrefix) {
+			redisKey = base
+		}
+	}
+	switch {
+	case strings.HasPrefix(redisKey, l.concurrentPrefix):
+		ev.Kind, ev.Prefix, side = KeyKindConcurrency, l.concurrentPrefix, concurrencySideKeys
+	case strings.HasPrefix(redisKey, l.ratePrefix):
+		ev.Kind, ev.Prefix, side = KeyKindRate, l.ratePrefix, rateSideKeys
+	default:
+		return ev, false
+	}
+	key := redisKey[len(ev.Prefix):]
+	if ev.Kind == KeyKindRate {
+		if strings.HasPrefix(key, epochKeySuffix) || strings.HasPrefix(key, topConsumersPrefix) ||
+			strings.HasPrefix(key, fairnessPrefix) {
+			return ev, false
+		}
+		if strings.HasPrefix(key, shadowPrefix) {
+			return ev, false
+		}
+	}
+	for _, suffix := range side {
+		if strings.HasSuffix(key, suffix) {
+			return ev, false
+		}
+	}
+	if l.hashTag != nil && strings.HasPrefix(key, "{") {
+		if i := strings.IndexByte(key, '}'); i > 0 {
+			key = key[i+1:]
+		}
+	}
+	ev.Key = key
+	return ev, true
+}
+
+// trimEpoch returns the rate limit key script_epoch.lua named redisKey
+// after for an epoch, or redisKey if it is not named for one.
+func trimEpoch(redisKey string) string {
+	i := strings.LastIndex(redisKey, ":e")
+	if i < 0 || i+2 == len(redisKey) || strings.Trim(redisKey[i+2:], "0123456789") != "" {
+		return redisKey
+	}
+	base := redisKey[:i]
+	if len(base) > 1 && base[0] == '{' && strings.IndexByte(base, '}') == len(base)-1 {
+		return base[1 : len(base)-1]
+	}
+	return base
+}
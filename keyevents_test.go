@@ -0,0 +1,64 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseKeyEvent(t *testing.T) {
+	l := New(nil, WithEpochs(0), WithClusterHashTag(func(key string) string { return "t" }))
+
+	for _, tt := range []struct {
+		redisKey string
+		kind     KeyKind
+		key      string
+	}{
+		{redisKey: "rate:{t}foo", kind: KeyKindRate, key: "foo"},
+		{redisKey: "rate:{t}foo:e3", kind: KeyKindRate, key: "foo"},
+		{redisKey: "rate:{t}foo:e3:e0", kind: KeyKindRate, key: "foo:e3"},
+		{redisKey: "rate:{t}foo:boost:e1"},
+		{redisKey: "concurrency:{t}foo", kind: KeyKindConcurrency, key: "foo"},
+		{redisKey: "rate:{t}foo:boost"},
+		{redisKey: "rate:shadow:{t}foo"},
+		{redisKey: "rate:__epoch__"},
+		{redisKey: "rate:__epoch__{123}"},
+		{redisKey: "concurrency:{t}foo:queue:deadlines"},
+		{redisKey: "other:foo"},
+	} {
+		ev, ok := l.parseKeyEvent(tt.redisKey)
+		require.Equal(t, tt.kind != "", ok, tt.redisKey)
+		if ok {
+			require.Equal(t, tt.kind, ev.Kind, tt.redisKey)
+			require.Equal(t, tt.key, ev.Key, tt.redisKey)
+		}
+	}
+}
+
+func TestParseKeyEventUntagged(t *testing.T) {
+	l := New(nil, WithEpochs(0))
+	ev, ok := l.parseKeyEvent("{rate:foo}:e3")
+	require.True(t, ok)
+	require.Equal(t, "foo", ev.Key)
+
+	_, ok = l.parseKeyEvent("{rate:foo}:ban")
+	require.False(t, ok)
+}
+
+func TestSideKey(t *testing.T) {
+	for _, tt := range []struct {
+		redisKey string
+		want     string
+	}{
+		{redisKey: "concurrency:foo", want: "{concurrency:foo}:queue"},
+		{redisKey: "concurrency:{t}foo", want: "concurrency:{t}foo:queue"},
+		{redisKey: "concurrency:{}foo", want: "concurrency:{}foo:queue"},
+		{redisKey: "concurrency:{foo", want: "{concurrency:{foo}:queue"},
+	} {
+		require.Equal(t, tt.want, sideKey(tt.redisKey, ":queue"), tt.redisKey)
+	}
+
+	l := New(nil)
+	_, ok := l.parseKeyEvent(l.queueKey("foo"))
+	require.False(t, ok)
+}
@@ -0,0 +1,60 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import "context"
+
+// WithKillSwitch sets a kill switch consulted before every rate limit allow
+// and concurrency take. While killed returns true for the ctx of a call,
+// the call is denied with ReasonKillSwitch without contacting Redis, for
+// shutting off traffic in an incident without redeploying. killed is called
+// on every allow and take, so it should be cheap, such as reading an
+// atomic.Bool or a feature flag cached in memory.
+//
+// Denied results have RetryAfter -1, since when the switch is turned off is
+// unknown. Releases, resets and other methods are not affected.
+func WithKillSwitch(killed func(ctx context.Context) bool) Option {
+	return func(l *Limiter) {
+		l.killSwitch = killed
+	}
+}
+
+// killed reports whether the kill switch denies calls made with ctx.
+func (l *Limiter) killed(ctx context.Context) bool {
+	return l.killSwitch != nil && l.killSwitch(ctx)
+}
+
+// kill fills in rv as denied by the kill switch.
+func (rv *Result) kill() {
+	rv.Allowed = 0
+	rv.Remaining = 0
+	rv.RetryAfter = -1
+	rv.ResetAfter = 0
+	rv.Reason = ReasonKillSwitch
+}
+
+// kill fills in rv as denied by the kill switch.
+func (rv *ConcurrencyResult) kill() {
+	rv.Allowed = false
+	rv.Reason = ReasonKillSwitch
+}
+
+// execKilled denies the allows and takes queued on p with the kill switch
+// and executes the rest of the pipeline as usual.
+func (p *pipeline) execKilled(ctx context.Context) error {
+	now := p.l.now()
+	for _, rv := range p.allowCommands {
+		rv.kill()
+		rv.stamp(now, p.l.now)
+	}
+	for _, rv := range p.takeCommands {
+		rv.kill()
+	}
+	allows, takes := p.allowCommands, p.takeCommands
+	p.allowCommands, p.takeCommands = nil, nil
+	defer func() {
+		p.allowCommands, p.takeCommands = allows, takes
+	}()
+	if p.len() == 0 {
+		return nil
+	}
+	return p.execLazy(ctx)
+}
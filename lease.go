@@ -0,0 +1,157 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrLeaseClosed is returned by Lease.Close for a lease that was already
+// closed.
+var ErrLeaseClosed = errors.New("redis_rate: lease already closed")
+
+// Lease is a number of events of a rate limit key reserved up front by a
+// batch job, drawn locally without going to Redis. It is created by
+// Limiter.Lease and must be closed with Close, which returns the events
+// that were not drawn to the key.
+type Lease struct {
+	l      *Limiter
+	prefix string
+	key    string
+	limit  Limit
+	expiry time.Time
+
+	mu      sync.Mutex
+	granted int64
+	drawn   int64
+	closed  bool
+}
+
+// Lease reserves up to n events of key for a job that will use them within
+// d, as many as the key can supply by then on top of the events it has
+// already allowed. The events are charged to the key at once, so other
+// callers of the key are denied what the lease holds until they would have
+// been allowed again, but the job then draws them with Lease.Draw without a
+// round trip each. Events not drawn by Close are refunded to the key.
+//
+// A lease granting fewer than n events, or none, is not an error; check
+// Granted. Calendar limits are not supported.
+func (l *Limiter) Lease(ctx context.Context, key string, limit Limit, n int, d time.Duration) (_ *Lease, err error) {
+	defer l.recoverPanic(OpLease, key, &err)
+	if err := l.checkWritable("Lease"); err != nil {
+		return nil, err
+	}
+	limit = l.limitOrDefault(limit)
+	if limit.IsZero() {
+		return nil, ErrNoLimit
+	}
+	if limit.Calendar != CalendarNone {
+		return nil, ErrCalendarLimit
+	}
+	if d < 0 {
+		d = 0
+	}
+
+	ls := &Lease{
+		l:      l,
+		prefix: l.localPrefix(ctx),
+		key:    key,
+		limit:  limit,
+		expiry: l.now().Add(d),
+	}
+	if n <= 0 {
+		return ls, nil
+	}
+	granted, err := ls.run(ctx, int64(n), d)
+	if err != nil {
+		return nil, err
+	}
+	ls.granted = granted
+	return ls, nil
+}
+
+// run reserves, or refunds if negative, n events of the lease's key.
+func (ls *Lease) run(ctx context.Context, n int64, within time.Duration) (int64, error) {
+	l := ls.l
+	args := getScriptArgs()
+	args.key(ls.prefix, l.hashTagged(ls.key)).
+		int(int64(ls.limit.Burst)).
+		int(int64(ls.limit.Rate)).
+		float(ls.limit.Period.Seconds()).
+		int(n).
+		float(within.Seconds()).
+		str(l.scriptNow())
+	l.storageArgs(args, leaseScript)
+	reply := replyOf(l.runScript(ctx, leaseScript, args.keys, args.args...))
+	args.release()
+	granted := reply.int(0)
+	return granted, reply.err
+}
+
+// Key returns the key the lease reserved events of.
+func (ls *Lease) Key() string {
+	return ls.key
+}
+
+// Granted returns the number of events reserved.
+func (ls *Lease) Granted() int64 {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	return ls.granted
+}
+
+// Remaining returns the number of events that can still be drawn.
+func (ls *Lease) Remaining() int64 {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if ls.closed || !ls.l.now().Before(ls.expiry) {
+		return 0
+	}
+	return ls.granted - ls.drawn
+}
+
+// ExpiresAt returns when the lease expires, after which nothing more can be
+// drawn from it.
+func (ls *Lease) ExpiresAt() time.Time {
+	return ls.expiry
+}
+
+// Draw draws up to n events from the lease and returns how many it drew,
+// which is 0 once the lease is used up, expired or closed.
+func (ls *Lease) Draw(n int) int64 {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	if ls.closed || n <= 0 || !ls.l.now().Before(ls.expiry) {
+		return 0
+	}
+	drawn := ls.granted - ls.drawn
+	if int64(n) < drawn {
+		drawn = int64(n)
+	}
+	ls.drawn += drawn
+	return drawn
+}
+
+// Close ends the lease and refunds the events that were not drawn to the
+// key, returning how many it refunded. The lease is closed even if the
+// refund fails, in which case the events stay charged.
+func (ls *Lease) Close(ctx context.Context) (int64, error) {
+	ls.mu.Lock()
+	if ls.closed {
+		ls.mu.Unlock()
+		return 0, ErrLeaseClosed
+	}
+	ls.closed = true
+	unused := ls.granted - ls.drawn
+	ls.mu.Unlock()
+
+	if unused == 0 {
+		return 0, nil
+	}
+	refunded, err := ls.run(ctx, -unused, 0)
+	if err != nil {
+		return 0, err
+	}
+	return -refunded, nil
+}
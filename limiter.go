@@ -2,7 +2,12 @@ package redis_rate //nolint:revive // upstream used this name
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/redis/go-redis/v9"
 )
@@ -12,23 +17,61 @@ const (
 	defaultRedisPrefix          = "rate:"
 )
 
+// Option configures a Limiter created with New.
+type Option = func(*Limiter)
+
 // WithRatePrefix sets the prefix for rate limit keys
 // when using the Limiter.  If unset the default is "rate:".
-func WithRatePrefix(ratePrefix string) func(*Limiter) {
+func WithRatePrefix(ratePrefix string) Option {
 	return func(s *Limiter) {
 		s.ratePrefix = ratePrefix
 	}
 }
 
 // WithConcurrencyPrefix sets the prefix for concurrency limit keys.  If unset the default is "concurrency:".
-func WithConcurrencyPrefix(concurrentPrefix string) func(*Limiter) {
+func WithConcurrencyPrefix(concurrentPrefix string) Option {
 	return func(s *Limiter) {
 		s.concurrentPrefix = concurrentPrefix
 	}
 }
 
+// WithKeyPrefix is WithRatePrefix, named to pair with
+// WithConcurrencyKeyPrefix. Applications sharing a Redis should each use
+// their own prefixes to avoid key collisions.
+func WithKeyPrefix(prefix string) Option {
+	return WithRatePrefix(prefix)
+}
+
+// WithConcurrencyKeyPrefix is WithConcurrencyPrefix.
+func WithConcurrencyKeyPrefix(prefix string) Option {
+	return WithConcurrencyPrefix(prefix)
+}
+
+// WithClusterHashTag sets a function returning the Redis Cluster hash tag for
+// a key. Keys with a non-empty tag are stored as the prefix, the tag in
+// braces and then the key, so keys with the same tag land in the same slot,
+// as AllowHierarchy, AllowAtMostMulti and AllowNWithOverflow require. The
+// side keys of a key, such as its boost tokens, ban, queue, hold statistics
+// and fencing tokens, share its slot with or without a tag.
+//
+// Changing the function moves every key, which resets their state.
+func WithClusterHashTag(tag func(key string) string) Option {
+	return func(s *Limiter) {
+		s.hashTag = tag
+	}
+}
+
+// WithDefaultLimit sets the Limit used when a zero Limit is passed to Allow,
+// AllowN, AllowAtMost or a Pipeline. Without it a zero Limit is rejected with
+// ErrNoLimit.
+func WithDefaultLimit(limit Limit) func(*Limiter) {
+	return func(s *Limiter) {
+		s.defaultLimit = limit
+	}
+}
+
 // New returns a new Limiter.
-func New(rdb RedisClientConn, options ...func(*Limiter)) *Limiter {
+func New(rdb RedisClientConn, options ...Option) *Limiter {
 	l := &Limiter{
 		rdb:              rdb,
 		ratePrefix:       defaultRedisPrefix,
@@ -38,28 +81,183 @@ func New(rdb RedisClientConn, options ...func(*Limiter)) *Limiter {
 	for _, option := range options {
 		option(l)
 	}
+
+	if l.fallbackPolicy != FallbackNone {
+		l.fallback = newFallback(l.now, l.fallbackPolicy, l.fallbackProbe)
+	}
 	return l
 }
 
+// hashTagged returns key preceded by its hash tag, if any.
+func (l *Limiter) hashTagged(key string) string {
+	if l.hashTag == nil {
+		return key
+	}
+	tag := l.hashTag(key)
+	if tag == "" {
+		return key
+	}
+	return "{" + tag + "}" + key
+}
+
+// sideKey returns the Redis key named suffix kept next to redisKey, in the
+// same Redis Cluster slot so that one script can use both. A key without a
+// hash tag hashes by its whole name, so the side key is tagged with it. Keys
+// holding a stray closing brace cannot be tagged and are only suffixed.
+func sideKey(redisKey, suffix string) string {
+	if i := strings.IndexByte(redisKey, '{'); i >= 0 {
+		if j := strings.IndexByte(redisKey[i+1:], '}'); j > 0 {
+			return redisKey + suffix
+		}
+	}
+	if strings.IndexByte(redisKey, '}') >= 0 {
+		return redisKey + suffix
+	}
+	return "{" + redisKey + "}" + suffix
+}
+
+// concurrencyKey returns the Redis key of the concurrency key key.
+func (tk *Limiter) concurrencyKey(key string) string {
+	return tk.concurrentPrefix + tk.hashTagged(key)
+}
+
+// ErrScriptNotLoaded is reported by VerifyScripts for nodes missing some of
+// the Limiter's scripts.
+var ErrScriptNotLoaded = errors.New("redis_rate: scripts not loaded")
+
+// ScriptError reports the nodes on which LoadScripts or VerifyScripts failed.
+type ScriptError struct {
+	// Nodes maps the address of each failed node to its error. The address
+	// is "" for clients that are not a Ring or ClusterClient.
+	Nodes map[string]error
+
+	// Total is the number of nodes that were visited.
+	Total int
+}
+
+func (e *ScriptError) Error() string {
+	if len(e.Nodes) == 1 {
+		for addr, err := range e.Nodes {
+			if addr == "" {
+				return err.Error()
+			}
+		}
+	}
+
+	addrs := make([]string, 0, len(e.Nodes))
+	for addr := range e.Nodes {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "redis_rate: scripts failed on %d of %d nodes", len(e.Nodes), e.Total)
+	for _, addr := range addrs {
+		fmt.Fprintf(&b, "; %s: %v", addr, e.Nodes[addr])
+	}
+	return b.String()
+}
+
+// Is reports whether the error of any node matches target.
+func (e *ScriptError) Is(target error) bool {
+	for _, err := range e.Nodes {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadScripts loads the Limiter's scripts on every shard of a Ring, every
+// master of a ClusterClient, or the client itself. Failures are reported
+// for each node in a *ScriptError; nodes that succeeded keep their scripts.
 func (l *Limiter) LoadScripts(ctx context.Context) error {
-	_, err := concurrencyTake.Load(ctx, l.rdb).Result()
-	if err != nil {
-		return fmt.Errorf("redis_rate: failed to load 'script_concurrency_take.lua': %w", err)
+	start := time.Now()
+	err := l.loadScripts(ctx)
+	l.onScriptLoad(ctx, start, err)
+	return err
+}
+
+func (l *Limiter) loadScripts(ctx context.Context) error {
+	return l.forEachScriptNode(ctx, func(ctx context.Context, node redisNode) error {
+		for _, f := range allScripts() {
+			_, err := node.ScriptLoad(ctx, f.src).Result()
+			if err != nil {
+				return fmt.Errorf("redis_rate: failed to load '%s': %w", f.name, err)
+			}
+		}
+		if err := l.loadFunctionsOn(ctx, node); err != nil {
+			return fmt.Errorf("redis_rate: failed to load functions: %w", err)
+		}
+		return nil
+	})
+}
+
+// VerifyScripts checks that every script is loaded on every node, as
+// LoadScripts would leave them, for use in readiness probes. Nodes missing
+// scripts are reported in a *ScriptError matching ErrScriptNotLoaded.
+func (l *Limiter) VerifyScripts(ctx context.Context) error {
+	files := allScripts()
+	hashes := make([]string, len(files))
+	for i, f := range files {
+		hashes[i] = f.script.Hash()
 	}
 
-	_, err = allowN.Load(ctx, l.rdb).Result()
-	if err != nil {
-		return fmt.Errorf("redis_rate: failed to load 'script_allow_n.lua': %w", err)
+	return l.forEachScriptNode(ctx, func(ctx context.Context, node redisNode) error {
+		exists, err := node.ScriptExists(ctx, hashes...).Result()
+		if err != nil {
+			return err
+		}
+		var missing []string
+		for i, ok := range exists {
+			if !ok {
+				missing = append(missing, files[i].name)
+			}
+		}
+		if len(missing) > 0 {
+			return fmt.Errorf("%w: %s", ErrScriptNotLoaded, strings.Join(missing, ", "))
+		}
+		return nil
+	})
+}
+
+// forEachScriptNode calls fn for every node, collecting the nodes it failed
+// on into a *ScriptError instead of stopping at the first failure.
+func (l *Limiter) forEachScriptNode(ctx context.Context, fn func(ctx context.Context, node redisNode) error) error {
+	var mu sync.Mutex
+	rv := &ScriptError{
+		Nodes: make(map[string]error),
 	}
+	err := l.forEachNode(ctx, func(ctx context.Context, node redisNode) error {
+		err := fn(ctx, node)
 
-	_, err = allowAtMost.Load(ctx, l.rdb).Result()
+		mu.Lock()
+		defer mu.Unlock()
+		rv.Total++
+		if err != nil {
+			rv.Nodes[nodeAddr(node)] = err
+		}
+		return nil
+	})
 	if err != nil {
-		return fmt.Errorf("redis_rate: failed to load 'script_allow_at_most.lua': %w", err)
+		return err
+	}
+	if len(rv.Nodes) > 0 {
+		return rv
 	}
-
 	return nil
 }
 
+// ErrUnsupportedClient is returned by operations that need a Redis command
+// beyond RedisClientConn, such as SCAN, when the client given to New does not
+// implement it. Every go-redis client does.
+var ErrUnsupportedClient = errors.New("redis_rate: Redis client does not support the command")
+
+// unsupported returns an ErrUnsupportedClient error for the command cmd.
+func unsupported(cmd string) error {
+	return fmt.Errorf("%w %s", ErrUnsupportedClient, cmd)
+}
+
 type RedisClientConn interface {
 	Pipeline() redis.Pipeliner
 	Pipelined(ctx context.Context, fn func(redis.Pipeliner) error) ([]redis.Cmder, error)
@@ -0,0 +1,422 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// DefaultLimitStoreCacheTTL is how long a LimitStore caches limits unless
+// WithLimitStoreCacheTTL is given.
+const DefaultLimitStoreCacheTTL = 10 * time.Second
+
+// StoredLimitError is returned by LimitStore.All and Refresh when some of
+// the stored limits cannot be parsed. Those limits are skipped: All still
+// returns the others, and the LimitStore uses them.
+type StoredLimitError struct {
+	// Patterns are the patterns whose limits are invalid, sorted.
+	Patterns []string
+
+	// Err is the error of the first of them.
+	Err error
+}
+
+func (e *StoredLimitError) Error() string {
+	return fmt.Sprintf("redis_rate: %d stored limits are invalid, first for %q: %v", len(e.Patterns), e.Patterns[0], e.Err)
+}
+
+func (e *StoredLimitError) Unwrap() error {
+	return e.Err
+}
+
+// ErrNoLimitStore is returned by AllowDynamic when the Limiter was created
+// without WithLimitStore.
+var ErrNoLimitStore = errors.New("redis_rate: no limit store configured")
+
+// LimitStoreClient is the part of a Redis client a LimitStore uses, which
+// every go-redis client implements.
+type LimitStoreClient interface {
+	Pipeline() redis.Pipeliner
+	HGet(ctx context.Context, key, field string) *redis.StringCmd
+	HSet(ctx context.Context, key string, values ...interface{}) *redis.IntCmd
+	HGetAll(ctx context.Context, key string) *redis.MapStringStringCmd
+}
+
+// LimitStore keeps limits in a Redis hash of pattern to limit, so operators
+// can change them at runtime without redeploying every service. Patterns
+// are matched like Policy patterns: an exact key, or a prefix followed by
+// "*". An exact match wins, then the longest matching prefix.
+//
+// Limits are stored as "rate/burst/period", for example "100/20/1m0s", so
+// they can also be edited with redis-cli. Limits with a Penalty or a WarmUp,
+// which that form cannot hold, are stored as their String, for example
+// "100 req/m (burst 20, penalty 5)"; either form is read back. Older
+// versions only read the first form.
+//
+// The whole hash is cached locally and reloaded once the cache is older than
+// its TTL. If the reload fails the stale limits keep being used.
+type LimitStore struct {
+	rdb   LimitStoreClient
+	key   string
+	ttl   time.Duration
+	grace time.Duration
+
+	audit *AuditLog
+
+	mu       sync.Mutex
+	limits   map[string]Limit
+	enforce  map[string]time.Time
+	loadedAt time.Time
+}
+
+// NewLimitStore returns a LimitStore backed by the Redis hash key.
+func NewLimitStore(rdb LimitStoreClient, key string, options ...func(*LimitStore)) *LimitStore {
+	s := &LimitStore{
+		rdb: rdb,
+		key: key,
+		ttl: DefaultLimitStoreCacheTTL,
+	}
+	for _, option := range options {
+		option(s)
+	}
+	return s
+}
+
+// WithLimitStoreCacheTTL sets how long limits are cached. A ttl of zero or
+// less reads Redis on every lookup.
+func WithLimitStoreCacheTTL(ttl time.Duration) func(*LimitStore) {
+	return func(s *LimitStore) {
+		s.ttl = ttl
+	}
+}
+
+// WithLimitStoreGracePeriod makes limits that are added or tightened with
+// Set only flag violations, instead of enforcing them, for d. The deadline
+// is taken from the Redis server's clock and stored next to the limits, so
+// every process switches to enforcing at the same time. See AllowDynamic.
+func WithLimitStoreGracePeriod(d time.Duration) func(*LimitStore) {
+	return func(s *LimitStore) {
+		s.grace = d
+	}
+}
+
+// WithLimitStore sets the LimitStore used by AllowDynamic.
+func WithLimitStore(store *LimitStore) func(*Limiter) {
+	return func(l *Limiter) {
+		l.limitStore = store
+	}
+}
+
+// Set stores limit for pattern. Other processes pick it up once their cache
+// expires. With WithLimitStoreGracePeriod, a limit for a new pattern or one
+// that is tighter than the stored limit starts a grace period.
+func (s *LimitStore) Set(ctx context.Context, pattern string, limit Limit) error {
+	if limit.Calendar != CalendarNone {
+		return ErrCalendarLimit
+	}
+	var old string
+	if s.audit != nil || s.grace > 0 {
+		var err error
+		old, err = s.rdb.HGet(ctx, s.key, pattern).Result()
+		if err != nil && !errors.Is(err, redis.Nil) {
+			return err
+		}
+	}
+	v := formatStoredLimit(limit)
+	err := s.rdb.HSet(ctx, s.key, pattern, v).Err()
+	if err != nil {
+		return err
+	}
+	if s.grace > 0 && tightens(old, limit) {
+		err = s.startGrace(ctx, pattern)
+		if err != nil {
+			return err
+		}
+	}
+	s.invalidate()
+	return s.audit.record(ctx, AuditLimitSet, pattern, old, v)
+}
+
+// tightens reports whether limit is new, or stricter than the stored limit
+// old in either its rate or its burst.
+func tightens(old string, limit Limit) bool {
+	if old == "" {
+		return true
+	}
+	prev, err := parseStoredLimit(old)
+	if err != nil {
+		return true
+	}
+	return perSecond(limit) < perSecond(prev) || limit.Burst < prev.Burst
+}
+
+// graceKey is the Redis hash of pattern to the time, in Unix milliseconds,
+// at which its limit starts being enforced.
+func (s *LimitStore) graceKey() string {
+	return s.key + ":grace"
+}
+
+func (s *LimitStore) startGrace(ctx context.Context, pattern string) error {
+	now, err := s.redisTime(ctx)
+	if err != nil {
+		return err
+	}
+	enforceAt := now.Add(s.grace).UnixMilli()
+	return s.rdb.HSet(ctx, s.graceKey(), pattern, enforceAt).Err()
+}
+
+func (s *LimitStore) redisTime(ctx context.Context) (time.Time, error) {
+	pl := s.rdb.Pipeline()
+	cmd := pl.Time(ctx)
+	_, err := pl.Exec(ctx)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return cmd.Val(), nil
+}
+
+// Delete removes the limit for pattern.
+func (s *LimitStore) Delete(ctx context.Context, pattern string) error {
+	var old string
+	if s.audit != nil {
+		var err error
+		old, err = s.rdb.HGet(ctx, s.key, pattern).Result()
+		if err != nil && !errors.Is(err, redis.Nil) {
+			return err
+		}
+	}
+	pl := s.rdb.Pipeline()
+	pl.HDel(ctx, s.key, pattern)
+	pl.HDel(ctx, s.graceKey(), pattern)
+	_, err := pl.Exec(ctx)
+	if err != nil {
+		return err
+	}
+	s.invalidate()
+	return s.audit.record(ctx, AuditLimitDelete, pattern, old, "")
+}
+
+// All returns every stored limit by pattern, bypassing the cache. Invalid
+// limits are skipped and reported with a *StoredLimitError, returned along
+// with the valid ones.
+func (s *LimitStore) All(ctx context.Context) (map[string]Limit, error) {
+	values, err := s.rdb.HGetAll(ctx, s.key).Result()
+	if err != nil {
+		return nil, err
+	}
+	return parseStoredLimits(values)
+}
+
+func parseStoredLimits(values map[string]string) (map[string]Limit, error) {
+	rv := make(map[string]Limit, len(values))
+	var invalid *StoredLimitError
+	for pattern, v := range values {
+		limit, err := parseStoredLimit(v)
+		if err != nil {
+			if invalid == nil {
+				invalid = &StoredLimitError{}
+			}
+			invalid.Patterns = append(invalid.Patterns, pattern)
+			continue
+		}
+		rv[pattern] = limit
+	}
+	if invalid == nil {
+		return rv, nil
+	}
+	sort.Strings(invalid.Patterns)
+	_, invalid.Err = parseStoredLimit(values[invalid.Patterns[0]])
+	return rv, invalid
+}
+
+// Refresh reloads the cache from Redis. Invalid limits are skipped, and
+// reported with a *StoredLimitError once the others are loaded.
+func (s *LimitStore) Refresh(ctx context.Context) error {
+	if s.grace <= 0 {
+		limits, err := s.All(ctx)
+		var invalid *StoredLimitError
+		if err != nil && !errors.As(err, &invalid) {
+			return err
+		}
+		s.mu.Lock()
+		s.limits = limits
+		s.loadedAt = time.Now()
+		s.mu.Unlock()
+		return err
+	}
+
+	pl := s.rdb.Pipeline()
+	timeCmd := pl.Time(ctx)
+	limitsCmd := pl.HGetAll(ctx, s.key)
+	graceCmd := pl.HGetAll(ctx, s.graceKey())
+	_, err := pl.Exec(ctx)
+	if err != nil {
+		return err
+	}
+	limits, invalid := parseStoredLimits(limitsCmd.Val())
+
+	// Deadlines are converted to the local clock, so they are compared
+	// against the same clock that set them.
+	skew := time.Since(timeCmd.Val())
+	enforce := make(map[string]time.Time)
+	for pattern, v := range graceCmd.Val() {
+		ms, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("redis_rate: invalid grace deadline for %q: %w", pattern, err)
+		}
+		enforce[pattern] = time.UnixMilli(ms).Add(skew)
+	}
+
+	s.mu.Lock()
+	s.limits = limits
+	s.enforce = enforce
+	s.loadedAt = time.Now()
+	s.mu.Unlock()
+	return invalid
+}
+
+// Limit returns the limit for key, or a zero Limit if no pattern matches.
+// It implements LimitProvider, so a LimitStore can also be used with
+// Pipeline.AllowLazy.
+func (s *LimitStore) Limit(ctx context.Context, key string) (Limit, error) {
+	limit, _, err := s.lookup(ctx, key)
+	return limit, err
+}
+
+// lookup returns the limit for key and the time it starts being enforced,
+// which is the zero Time unless it is in a grace period.
+func (s *LimitStore) lookup(ctx context.Context, key string) (Limit, time.Time, error) {
+	s.mu.Lock()
+	limits, enforce, loadedAt := s.limits, s.enforce, s.loadedAt
+	s.mu.Unlock()
+
+	if limits == nil || s.ttl <= 0 || time.Since(loadedAt) >= s.ttl {
+		// Invalid limits are skipped; the others were still loaded.
+		err := s.Refresh(ctx)
+		var invalid *StoredLimitError
+		if errors.As(err, &invalid) {
+			err = nil
+		}
+		if err != nil && limits == nil {
+			return Limit{}, time.Time{}, err
+		}
+		if err == nil {
+			s.mu.Lock()
+			limits, enforce = s.limits, s.enforce
+			s.mu.Unlock()
+		}
+	}
+
+	pattern, limit := matchPattern(limits, key)
+	enforceAt := enforce[pattern]
+	if !time.Now().Before(enforceAt) {
+		enforceAt = time.Time{}
+	}
+	return limit, enforceAt, nil
+}
+
+func (s *LimitStore) invalidate() {
+	s.mu.Lock()
+	s.loadedAt = time.Time{}
+	s.mu.Unlock()
+}
+
+// matchPattern returns the exact match for key among patterns, or else the
+// longest prefix pattern matching it, and its value. The pattern is empty if
+// none matches.
+func matchPattern[V any](patterns map[string]V, key string) (string, V) {
+	if v, ok := patterns[key]; ok {
+		return key, v
+	}
+	best := -1
+	var rv V
+	var match string
+	for pattern, v := range patterns {
+		prefix := strings.TrimSuffix(pattern, "*")
+		if len(prefix) == len(pattern) || len(prefix) <= best {
+			continue
+		}
+		if strings.HasPrefix(key, prefix) {
+			best = len(prefix)
+			rv = v
+			match = pattern
+		}
+	}
+	return match, rv
+}
+
+// formatStoredLimit returns limit as stored in a LimitStore: in the
+// rate/burst/period form older versions read, unless it has fields that
+// form cannot hold.
+func formatStoredLimit(limit Limit) string {
+	if limit.Penalty != 0 || limit.WarmUp != 0 || limit.WarmUpRate != 0 {
+		return limit.String()
+	}
+	return fmt.Sprintf("%d/%d/%s", limit.Rate, limit.Burst, limit.Period)
+}
+
+// parseStoredLimit parses a limit stored in a LimitStore, either as written
+// by formatStoredLimit or in the older rate/burst/period form.
+func parseStoredLimit(v string) (Limit, error) {
+	if strings.Contains(v, " ") {
+		return parseLimit(v)
+	}
+	parts := strings.Split(v, "/")
+	if len(parts) != 3 {
+		return Limit{}, fmt.Errorf("expected rate/burst/period, got %q", v)
+	}
+	rate, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return Limit{}, err
+	}
+	burst, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return Limit{}, err
+	}
+	period, err := time.ParseDuration(parts[2])
+	if err != nil {
+		return Limit{}, err
+	}
+	return Limit{
+		Rate:   rate,
+		Burst:  burst,
+		Period: period,
+	}, nil
+}
+
+// AllowDynamic is like Allow, but uses the limit for key from the Limiter's
+// LimitStore. Keys without a stored limit use the default limit, or fail
+// with ErrNoLimit if there is none.
+//
+// While the limit is in a grace period, see WithLimitStoreGracePeriod, a
+// request exceeding it is allowed anyway with Result.Grace set, and the
+// OnGrace hooks are called. Allowed requests count against the limit as
+// usual, so enforcement picks up from the real usage once the period ends.
+func (l *Limiter) AllowDynamic(ctx context.Context, key string) (*Result, error) {
+	if l.limitStore == nil {
+		return nil, ErrNoLimitStore
+	}
+	limit, enforceAt, err := l.limitStore.lookup(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	res, err := l.AllowN(ctx, key, limit, 1)
+	if err != nil {
+		return nil, err
+	}
+	if res.Allowed == 0 && !enforceAt.IsZero() {
+		res.Grace = true
+		res.Allowed = 1
+		res.RetryAfter = -1
+		res.Reason = ""
+		l.onGrace(ctx, key, res, enforceAt)
+	}
+	return res, nil
+}
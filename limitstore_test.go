@@ -0,0 +1,161 @@
+package redis_rate_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/require"
+
+	"github.com/ductone/redis_rate/v11"
+)
+
+func TestLimitStore(t *testing.T) {
+	ctx := context.Background()
+	store := redis_rate.NewLimitStore(newTestRing(), "limits", redis_rate.WithLimitStoreCacheTTL(time.Hour))
+	l := newTestLimiter(t, true, redis_rate.WithLimitStore(store))
+
+	require.NoError(t, store.Set(ctx, "tenant:*", redis_rate.PerSecond(10)))
+	require.NoError(t, store.Set(ctx, "tenant:big*", redis_rate.PerSecond(100)))
+	require.NoError(t, store.Set(ctx, "tenant:bigger", redis_rate.PerMinute(5)))
+
+	limit, err := store.Limit(ctx, "tenant:small")
+	require.NoError(t, err)
+	require.Equal(t, redis_rate.PerSecond(10), limit)
+	limit, err = store.Limit(ctx, "tenant:biggest")
+	require.NoError(t, err)
+	require.Equal(t, redis_rate.PerSecond(100), limit)
+	limit, err = store.Limit(ctx, "tenant:bigger")
+	require.NoError(t, err)
+	require.Equal(t, redis_rate.PerMinute(5), limit)
+	limit, err = store.Limit(ctx, "other")
+	require.NoError(t, err)
+	require.True(t, limit.IsZero())
+
+	strict := redis_rate.PerSecond(10)
+	strict.Penalty = 2
+	require.NoError(t, store.Set(ctx, "strict", strict))
+	limit, err = store.Limit(ctx, "strict")
+	require.NoError(t, err)
+	require.Equal(t, strict, limit)
+
+	warming := redis_rate.PerSecond(100)
+	warming.WarmUp = 10 * time.Second
+	warming.WarmUpRate = 10
+	require.NoError(t, store.Set(ctx, "warming", warming))
+	limit, err = store.Limit(ctx, "warming")
+	require.NoError(t, err)
+	require.Equal(t, warming, limit)
+
+	res, err := l.AllowDynamic(ctx, "tenant:small")
+	require.NoError(t, err)
+	require.Equal(t, int64(1), res.Allowed)
+	require.Equal(t, int64(9), res.Remaining)
+
+	_, err = l.AllowDynamic(ctx, "other")
+	require.ErrorIs(t, err, redis_rate.ErrNoLimit)
+
+	// Another process changing the limit is only seen after a refresh.
+	other := redis_rate.NewLimitStore(newTestRing(), "limits")
+	require.NoError(t, other.Set(ctx, "tenant:*", redis_rate.PerSecond(20)))
+	limit, err = store.Limit(ctx, "tenant:small")
+	require.NoError(t, err)
+	require.Equal(t, redis_rate.PerSecond(10), limit)
+
+	require.NoError(t, store.Refresh(ctx))
+	limit, err = store.Limit(ctx, "tenant:small")
+	require.NoError(t, err)
+	require.Equal(t, redis_rate.PerSecond(20), limit)
+
+	_, err = newTestLimiter(t, false).AllowDynamic(ctx, "tenant:small")
+	require.ErrorIs(t, err, redis_rate.ErrNoLimitStore)
+}
+
+func TestLimitStoreGracePeriod(t *testing.T) {
+	ctx := context.Background()
+	store := redis_rate.NewLimitStore(newTestRing(), "limits", redis_rate.WithLimitStoreGracePeriod(time.Hour))
+	var events []redis_rate.GraceEvent
+	l := newTestLimiter(t, true, redis_rate.WithLimitStore(store), redis_rate.WithHooks(redis_rate.Hooks{
+		OnGrace: func(ctx context.Context, ev redis_rate.GraceEvent) {
+			events = append(events, ev)
+		},
+	}))
+
+	// A new limit is only flagged.
+	require.NoError(t, store.Set(ctx, "tenant:*", redis_rate.PerMinute(1)))
+	res, err := l.AllowDynamic(ctx, "tenant:a")
+	require.NoError(t, err)
+	require.Equal(t, int64(1), res.Allowed)
+	require.False(t, res.Grace)
+
+	res, err = l.AllowDynamic(ctx, "tenant:a")
+	require.NoError(t, err)
+	require.Equal(t, int64(1), res.Allowed)
+	require.True(t, res.Grace)
+	require.Len(t, events, 1)
+	require.Equal(t, "tenant:a", events[0].Key)
+	require.WithinDuration(t, time.Now().Add(time.Hour), events[0].EnforceAt, time.Minute)
+
+	// Loosening a limit does not start a new grace period.
+	enforced := redis_rate.NewLimitStore(newTestRing(), "limits", redis_rate.WithLimitStoreGracePeriod(time.Hour))
+	l = newTestLimiter(t, true, redis_rate.WithLimitStore(enforced))
+	require.NoError(t, enforced.Set(ctx, "user:*", redis_rate.PerMinute(1)))
+	require.NoError(t, newTestRing().Del(ctx, "limits:grace").Err())
+	require.NoError(t, enforced.Set(ctx, "user:*", redis_rate.PerMinute(2)))
+	for i := 0; i < 2; i++ {
+		res, err = l.AllowDynamic(ctx, "user:a")
+		require.NoError(t, err)
+		require.Equal(t, int64(1), res.Allowed)
+	}
+	res, err = l.AllowDynamic(ctx, "user:a")
+	require.NoError(t, err)
+	require.Equal(t, int64(0), res.Allowed)
+	require.False(t, res.Grace)
+}
+
+// hashConn is a LimitStoreClient holding a single hash in memory.
+type hashConn struct {
+	redis_rate.LimitStoreClient
+	values map[string]string
+}
+
+func (c *hashConn) HSet(ctx context.Context, key string, values ...interface{}) *redis.IntCmd {
+	c.values[values[0].(string)] = values[1].(string)
+	return redis.NewIntResult(1, nil)
+}
+
+func (c *hashConn) HGetAll(ctx context.Context, key string) *redis.MapStringStringCmd {
+	return redis.NewMapStringStringResult(c.values, nil)
+}
+
+func TestLimitStoreFormat(t *testing.T) {
+	ctx := context.Background()
+	conn := &hashConn{values: map[string]string{}}
+	store := redis_rate.NewLimitStore(conn, "limits")
+
+	// Limits older versions can read are stored in the form they read.
+	require.NoError(t, store.Set(ctx, "plain", redis_rate.Limit{Rate: 100, Burst: 20, Period: time.Minute}))
+	require.Equal(t, "100/20/1m0s", conn.values["plain"])
+	strict := redis_rate.PerSecond(5)
+	strict.Penalty = 2
+	require.NoError(t, store.Set(ctx, "strict", strict))
+	require.Equal(t, strict.String(), conn.values["strict"])
+
+	// Invalid limits are skipped and reported, and the others still used.
+	conn.values["bad"] = "lots"
+	conn.values["worse"] = "1/2"
+	limits, err := store.All(ctx)
+	var invalid *redis_rate.StoredLimitError
+	require.ErrorAs(t, err, &invalid)
+	require.Equal(t, []string{"bad", "worse"}, invalid.Patterns)
+	require.Equal(t, map[string]redis_rate.Limit{
+		"plain":  {Rate: 100, Burst: 20, Period: time.Minute},
+		"strict": strict,
+	}, limits)
+
+	require.ErrorAs(t, store.Refresh(ctx), &invalid)
+	limit, err := store.Limit(ctx, "strict")
+	require.NoError(t, err)
+	require.Equal(t, strict, limit)
+}
@@ -0,0 +1,276 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrScriptsUnsupported is set on the commands queued with EvalCustom on the
+// Pipeline of a MemoryLimiter, which cannot run Lua scripts.
+var ErrScriptsUnsupported = errors.New("redis_rate: MemoryLimiter cannot run scripts")
+
+// LimiterI is the set of Limiter operations most services depend on. Accept
+// it instead of *Limiter to be able to substitute a MemoryLimiter in tests.
+type LimiterI interface {
+	Allow(ctx context.Context, key string, limit Limit) (*Result, error)
+	AllowN(ctx context.Context, key string, limit Limit, n int) (*Result, error)
+	AllowAtMost(ctx context.Context, key string, limit Limit, n int) (*Result, error)
+	Reset(ctx context.Context, key string) error
+	Pipeline() Pipeline
+	Take(ctx context.Context, key string, requestID string, limit ConcurrencyLimit) (ConcurrencyResult, error)
+	Release(ctx context.Context, key string, requestID string, limit ConcurrencyLimit) error
+}
+
+var (
+	_ LimiterI = (*Limiter)(nil)
+	_ LimiterI = (*MemoryLimiter)(nil)
+)
+
+// MemoryLimiter implements LimiterI in process memory with the same GCRA and
+// concurrency semantics as Limiter. It is intended for unit tests of code
+// that uses a Limiter, without needing a Redis server.
+type MemoryLimiter struct {
+	clock   Clock
+	buckets gcraBuckets
+
+	mu      sync.Mutex
+	holders map[string]map[string]memoryHolder
+
+	// fence is the last fencing token handed out, for any key.
+	fence int64
+}
+
+type memoryHolder struct {
+	expiresAt time.Time
+	weight    int64
+}
+
+// WithMemoryClock makes the MemoryLimiter use clock instead of the wall
+// clock.
+func WithMemoryClock(clock Clock) func(*MemoryLimiter) {
+	return func(m *MemoryLimiter) {
+		m.clock = clock
+	}
+}
+
+// NewMemory returns a new MemoryLimiter.
+func NewMemory(options ...func(*MemoryLimiter)) *MemoryLimiter {
+	m := &MemoryLimiter{
+		buckets: newGCRABuckets(0),
+		holders: make(map[string]map[string]memoryHolder),
+	}
+
+	for _, option := range options {
+		option(m)
+	}
+	return m
+}
+
+func (m *MemoryLimiter) now() time.Time {
+	if m.clock == nil {
+		return time.Now()
+	}
+	return m.clock.Now()
+}
+
+// Allow is a shortcut for AllowN(ctx, key, limit, 1).
+func (m *MemoryLimiter) Allow(ctx context.Context, key string, limit Limit) (*Result, error) {
+	return m.AllowN(ctx, key, limit, 1)
+}
+
+// AllowN reports whether n events may happen at time now.
+func (m *MemoryLimiter) AllowN(ctx context.Context, key string, limit Limit, n int) (*Result, error) {
+	return m.allow(key, limit, n, false)
+}
+
+// AllowAtMost reports whether at most n events may happen at time now.
+// It returns number of allowed events that is less than or equal to n.
+func (m *MemoryLimiter) AllowAtMost(ctx context.Context, key string, limit Limit, n int) (*Result, error) {
+	return m.allow(key, limit, n, true)
+}
+
+func (m *MemoryLimiter) allow(key string, limit Limit, n int, atMost bool) (*Result, error) {
+	if limit.IsZero() {
+		return nil, ErrNoLimit
+	}
+	rv := &Result{
+		Key:   key,
+		Limit: limit,
+		at:    m.now(),
+	}
+	m.buckets.allow(rv, n, atMost)
+	rv.stamp(rv.at, m.now)
+	return rv, nil
+}
+
+// Reset gets a key and reset all limitations and previous usages.
+func (m *MemoryLimiter) Reset(ctx context.Context, key string) error {
+	m.buckets.reset(key)
+	return nil
+}
+
+func (m *MemoryLimiter) Take(ctx context.Context, key string, requestID string, limit ConcurrencyLimit) (ConcurrencyResult, error) {
+	return m.TakeN(ctx, key, requestID, limit, 1)
+}
+
+// TakeN acquires n slots of key for requestID at once, like Limiter.TakeN.
+func (m *MemoryLimiter) TakeN(ctx context.Context, key string, requestID string, limit ConcurrencyLimit, n int64) (ConcurrencyResult, error) {
+	if n < 1 {
+		return ConcurrencyResult{}, ErrInvalidWeight
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	holders := m.holders[key]
+	if holders == nil {
+		holders = make(map[string]memoryHolder)
+		m.holders[key] = holders
+	}
+
+	count := int64(0)
+	for id, h := range holders {
+		if h.expiresAt.Before(now) {
+			delete(holders, id)
+			continue
+		}
+		count += h.weight
+	}
+
+	rv := ConcurrencyResult{
+		Key:       key,
+		RequestID: requestID,
+		Limit:     limit,
+	}
+	if count+n > limit.Max {
+		rv.Used = count
+		rv.Remaining = limit.Max - count
+		rv.Reason = ReasonQueueFull
+		return rv, nil
+	}
+
+	maxDuration := limit.RequestMaxDuration.Round(time.Second)
+	if maxDuration <= 0 {
+		maxDuration = 60 * time.Second
+	}
+	holders[requestID] = memoryHolder{
+		expiresAt: now.Add(maxDuration),
+		weight:    n,
+	}
+	m.fence++
+	rv.Allowed = true
+	rv.Used = count + n
+	rv.Remaining = limit.Max - rv.Used
+	rv.FencingToken = m.fence
+	return rv, nil
+}
+
+func (m *MemoryLimiter) Release(ctx context.Context, key string, requestID string, limit ConcurrencyLimit) error {
+	m.release(key, requestID)
+	return nil
+}
+
+func (m *MemoryLimiter) release(key string, requestID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.holders[key], requestID)
+	if len(m.holders[key]) == 0 {
+		delete(m.holders, key)
+	}
+}
+
+// Pipeline returns a Pipeline whose operations are applied in order when
+// Exec is called.
+func (m *MemoryLimiter) Pipeline() Pipeline {
+	return &memoryPipeline{
+		m: m,
+	}
+}
+
+type memoryPipeline struct {
+	m   *MemoryLimiter
+	ops []func(ctx context.Context) error
+}
+
+func (p *memoryPipeline) Allow(ctx context.Context, key string, limit Limit) *Result {
+	rv := &Result{
+		Key:   key,
+		Limit: limit,
+	}
+	p.ops = append(p.ops, func(ctx context.Context) error {
+		res, err := p.m.AllowN(ctx, key, rv.Limit, 1)
+		if err != nil {
+			return err
+		}
+		*rv = *res
+		return nil
+	})
+	return rv
+}
+
+func (p *memoryPipeline) AllowLazy(ctx context.Context, key string, provider LimitProvider) *Result {
+	rv := &Result{
+		Key: key,
+	}
+	p.ops = append(p.ops, func(ctx context.Context) error {
+		limit, err := provider.Limit(ctx, key)
+		if err != nil || limit.IsZero() {
+			return err
+		}
+		res, err := p.m.AllowN(ctx, key, limit, 1)
+		if err != nil {
+			return err
+		}
+		*rv = *res
+		return nil
+	})
+	return rv
+}
+
+func (p *memoryPipeline) Take(ctx context.Context, key string, requestID string, limit ConcurrencyLimit) *ConcurrencyResult {
+	rv := &ConcurrencyResult{
+		Key:       key,
+		Limit:     limit,
+		RequestID: requestID,
+	}
+	p.ops = append(p.ops, func(ctx context.Context) error {
+		res, err := p.m.Take(ctx, key, requestID, limit)
+		if err != nil {
+			return err
+		}
+		*rv = res
+		return nil
+	})
+	return rv
+}
+
+func (p *memoryPipeline) Release(ctx context.Context, key string, requestID string) {
+	p.ops = append(p.ops, func(ctx context.Context) error {
+		p.m.release(key, requestID)
+		return nil
+	})
+}
+
+func (p *memoryPipeline) EvalCustom(ctx context.Context, name string, keys []string, args ...interface{}) *redis.Cmd {
+	cmd := redis.NewCmd(ctx)
+	cmd.SetErr(ErrScriptsUnsupported)
+	return cmd
+}
+
+func (p *memoryPipeline) Exec(ctx context.Context) error {
+	ops := p.ops
+	p.ops = nil
+	for _, op := range ops {
+		err := op(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
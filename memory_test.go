@@ -0,0 +1,175 @@
+package redis_rate_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ductone/redis_rate/v11"
+)
+
+func TestMemoryAllow(t *testing.T) {
+	ctx := context.Background()
+	var l redis_rate.LimiterI = redis_rate.NewMemory()
+	limit := redis_rate.PerSecond(10)
+
+	res, err := l.Allow(ctx, "test_id", limit)
+	require.Nil(t, err)
+	require.Equal(t, int64(1), res.Allowed)
+	require.Equal(t, int64(9), res.Remaining)
+	require.Equal(t, time.Duration(-1), res.RetryAfter)
+	require.InDelta(t, 100*time.Millisecond, res.ResetAfter, float64(10*time.Millisecond))
+
+	res, err = l.AllowN(ctx, "test_id", limit, 2)
+	require.Nil(t, err)
+	require.Equal(t, int64(2), res.Allowed)
+	require.Equal(t, int64(7), res.Remaining)
+
+	res, err = l.AllowAtMost(ctx, "test_id", limit, 10)
+	require.Nil(t, err)
+	require.Equal(t, int64(7), res.Allowed)
+	require.Equal(t, int64(0), res.Remaining)
+	require.InDelta(t, 999*time.Millisecond, res.ResetAfter, float64(10*time.Millisecond))
+
+	res, err = l.AllowN(ctx, "test_id", limit, 1000)
+	require.Nil(t, err)
+	require.Equal(t, int64(0), res.Allowed)
+	require.InDelta(t, 99*time.Second, res.RetryAfter, float64(time.Second))
+
+	err = l.Reset(ctx, "test_id")
+	require.Nil(t, err)
+
+	p := l.Pipeline()
+	r1 := p.Allow(ctx, "test_id", limit)
+	r2 := p.Allow(ctx, "test_id", limit)
+	err = p.Exec(ctx)
+	require.Nil(t, err)
+	require.Equal(t, int64(9), r1.Remaining)
+	require.Equal(t, int64(8), r2.Remaining)
+}
+
+func TestMemoryTake(t *testing.T) {
+	ctx := context.Background()
+	var l redis_rate.LimiterI = redis_rate.NewMemory()
+	limit := redis_rate.ConcurrencyLimit{
+		Max:                1,
+		RequestMaxDuration: time.Second * 5,
+	}
+
+	r1, err := l.Take(ctx, "test_id", "req1", limit)
+	require.NoError(t, err)
+	require.True(t, r1.Allowed)
+	require.Equal(t, int64(1), r1.Used)
+
+	r2, err := l.Take(ctx, "test_id", "req2", limit)
+	require.NoError(t, err)
+	require.False(t, r2.Allowed)
+	require.Equal(t, int64(0), r2.Remaining)
+
+	err = l.Release(ctx, "test_id", "req1", limit)
+	require.NoError(t, err)
+
+	p := l.Pipeline()
+	r3 := p.Take(ctx, "test_id", "req3", limit)
+	p.Release(ctx, "test_id", "req3")
+	r4 := p.Take(ctx, "test_id", "req4", limit)
+	err = p.Exec(ctx)
+	require.NoError(t, err)
+	require.True(t, r3.Allowed)
+	require.True(t, r4.Allowed)
+	require.Equal(t, int64(0), r2.FencingToken)
+	require.Greater(t, r3.FencingToken, r1.FencingToken)
+	require.Greater(t, r4.FencingToken, r3.FencingToken)
+}
+
+func TestMemoryClock(t *testing.T) {
+	ctx := context.Background()
+	clock := redis_rate.NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	l := redis_rate.NewMemory(redis_rate.WithMemoryClock(clock))
+	limit := redis_rate.PerSecond(10)
+
+	res, err := l.AllowN(ctx, "test_id", limit, 10)
+	require.Nil(t, err)
+	require.Equal(t, int64(10), res.Allowed)
+	require.Equal(t, time.Second, res.ResetAfter)
+	require.Equal(t, clock.Now().Add(time.Second), res.ResetAt)
+	require.Equal(t, "test_id", res.Key)
+	require.Equal(t, limit, res.Limit)
+
+	res, err = l.Allow(ctx, "test_id", limit)
+	require.Nil(t, err)
+	require.Equal(t, int64(0), res.Allowed)
+	require.Equal(t, 100*time.Millisecond, res.RetryAfter)
+	require.Equal(t, clock.Now().Add(100*time.Millisecond), res.RetryAt())
+
+	clock.Advance(250 * time.Millisecond)
+	res, err = l.AllowAtMost(ctx, "test_id", limit, 5)
+	require.Nil(t, err)
+	require.Equal(t, int64(2), res.Allowed)
+	require.Equal(t, int64(0), res.Remaining)
+	require.Equal(t, 950*time.Millisecond, res.ResetAfter)
+}
+
+func TestMemoryPenalty(t *testing.T) {
+	ctx := context.Background()
+	clock := redis_rate.NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	l := redis_rate.NewMemory(redis_rate.WithMemoryClock(clock))
+	limit := redis_rate.PerSecond(10)
+	limit.Penalty = 2
+
+	res, err := l.AllowN(ctx, "test_id", limit, 10)
+	require.Nil(t, err)
+	require.Equal(t, int64(10), res.Allowed)
+
+	// Each denied attempt charges two more events.
+	res, err = l.Allow(ctx, "test_id", limit)
+	require.Nil(t, err)
+	require.Equal(t, int64(0), res.Allowed)
+	require.Equal(t, 300*time.Millisecond, res.RetryAfter)
+	require.Equal(t, 1200*time.Millisecond, res.ResetAfter)
+
+	res, err = l.AllowAtMost(ctx, "test_id", limit, 1)
+	require.Nil(t, err)
+	require.Equal(t, int64(0), res.Allowed)
+	require.Equal(t, 500*time.Millisecond, res.RetryAfter)
+
+	// Peeking is never penalized.
+	res, err = l.AllowN(ctx, "test_id", limit, 0)
+	require.Nil(t, err)
+	require.Equal(t, 1400*time.Millisecond, res.ResetAfter)
+
+	clock.Advance(500 * time.Millisecond)
+	res, err = l.Allow(ctx, "test_id", limit)
+	require.Nil(t, err)
+	require.Equal(t, int64(1), res.Allowed)
+}
+
+func TestResultHeader(t *testing.T) {
+	ctx := context.Background()
+	clock := redis_rate.NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	l := redis_rate.NewMemory(redis_rate.WithMemoryClock(clock))
+	limit := redis_rate.Limit{Rate: 10, Burst: 20, Period: time.Second}
+
+	res, err := l.AllowN(ctx, "test_id", limit, 15)
+	require.Nil(t, err)
+	h := res.Header()
+	require.Equal(t, "20", h.Get("RateLimit-Limit"))
+	require.Equal(t, "5", h.Get("RateLimit-Remaining"))
+	require.Equal(t, "2", h.Get("RateLimit-Reset"))
+	require.Equal(t, "20;w=2", h.Get("RateLimit-Policy"))
+	require.Empty(t, h.Get("Retry-After"))
+
+	res, err = l.AllowN(ctx, "test_id", limit, 6)
+	require.Nil(t, err)
+	require.Equal(t, int64(0), res.Allowed)
+	res.SetHeaders(h)
+	require.Equal(t, "1", h.Get("Retry-After"))
+
+	res = &redis_rate.Result{Limit: redis_rate.PerDay(100), Remaining: -1, RetryAfter: -1}
+	h = res.Header()
+	require.Equal(t, "100;w=86400", h.Get("RateLimit-Policy"))
+	require.Equal(t, "0", h.Get("RateLimit-Remaining"))
+	require.Equal(t, "0", h.Get("RateLimit-Reset"))
+}
@@ -0,0 +1,42 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrRateLimited is matched by every RateLimitedError.
+var ErrRateLimited = errors.New("redis_rate: rate limited")
+
+// RateLimitedError is returned by MustAllow when the event is denied.
+type RateLimitedError struct {
+	// Result is the result of the denied event.
+	Result *Result
+}
+
+func (e *RateLimitedError) Error() string {
+	msg := "redis_rate: " + e.Result.Key + " is rate limited"
+	if e.Result.RetryAfter >= 0 {
+		msg += ", retry after " + e.Result.RetryAfter.Round(time.Millisecond).String()
+	}
+	return msg
+}
+
+func (e *RateLimitedError) Is(target error) bool {
+	return target == ErrRateLimited
+}
+
+// MustAllow is Allow for callers that only need to know whether to proceed:
+// it returns nil when the event is allowed, a *RateLimitedError carrying the
+// Result when it is denied, and the error of Allow when that fails.
+func (l *Limiter) MustAllow(ctx context.Context, key string, limit Limit) error {
+	res, err := l.Allow(ctx, key, limit)
+	if err != nil {
+		return err
+	}
+	if res.Allowed == 0 {
+		return &RateLimitedError{Result: res}
+	}
+	return nil
+}
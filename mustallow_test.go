@@ -0,0 +1,32 @@
+package redis_rate_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ductone/redis_rate/v11"
+)
+
+func TestMustAllow(t *testing.T) {
+	ctx := context.Background()
+	l := newUnreachableLimiter(redis_rate.WithFallback(redis_rate.FallbackLocal))
+	limit := redis_rate.PerMinute(1)
+
+	require.NoError(t, l.MustAllow(ctx, "test_id", limit))
+
+	err := l.MustAllow(ctx, "test_id", limit)
+	require.ErrorIs(t, err, redis_rate.ErrRateLimited)
+	var rle *redis_rate.RateLimitedError
+	require.True(t, errors.As(err, &rle))
+	require.Equal(t, "test_id", rle.Result.Key)
+	require.Equal(t, int64(0), rle.Result.Allowed)
+	require.Greater(t, rle.Result.RetryAfter, time.Duration(0))
+
+	err = newUnreachableLimiter().MustAllow(ctx, "test_id", limit)
+	require.Error(t, err)
+	require.NotErrorIs(t, err, redis_rate.ErrRateLimited)
+}
@@ -0,0 +1,59 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"context"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisNode is the part of a Redis client needed from each node by
+// operations that must visit the whole keyspace.
+type redisNode interface {
+	Pipeline() redis.Pipeliner
+	ScriptExists(ctx context.Context, hashes ...string) *redis.BoolSliceCmd
+	ScriptLoad(ctx context.Context, script string) *redis.StringCmd
+}
+
+// scanner is a node that can SCAN its keys, as every go-redis client can.
+type scanner interface {
+	Scan(ctx context.Context, cursor uint64, match string, count int64) *redis.ScanCmd
+}
+
+// scanNode returns node as a scanner, or an ErrUnsupportedClient error if it
+// cannot SCAN.
+func scanNode(node redisNode) (scanner, error) {
+	s, ok := node.(scanner)
+	if !ok {
+		return nil, unsupported("SCAN")
+	}
+	return s, nil
+}
+
+// forEachNode calls fn for every node holding part of the keyspace: every
+// shard of a Ring, every master of a ClusterClient, or the client itself.
+func (l *Limiter) forEachNode(ctx context.Context, fn func(ctx context.Context, node redisNode) error) error {
+	switch rdb := l.rdb.(type) {
+	case interface {
+		ForEachShard(ctx context.Context, fn func(ctx context.Context, client *redis.Client) error) error
+	}:
+		return rdb.ForEachShard(ctx, func(ctx context.Context, client *redis.Client) error {
+			return fn(ctx, client)
+		})
+	case interface {
+		ForEachMaster(ctx context.Context, fn func(ctx context.Context, client *redis.Client) error) error
+	}:
+		return rdb.ForEachMaster(ctx, func(ctx context.Context, client *redis.Client) error {
+			return fn(ctx, client)
+		})
+	default:
+		return fn(ctx, l.rdb)
+	}
+}
+
+// nodeAddr returns the address of node, or "" if it is not a *redis.Client.
+func nodeAddr(node redisNode) string {
+	if c, ok := node.(interface{ Options() *redis.Options }); ok {
+		return c.Options().Addr
+	}
+	return ""
+}
@@ -0,0 +1,90 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// scriptSources maps the SHA1 of every script to its source, so commands
+// that failed with NOSCRIPT can be re-sent with EVAL.
+var scriptSources = func() map[string]string {
+	rv := make(map[string]string, len(scriptFiles))
+	for _, f := range scriptFiles {
+		rv[f.script.Hash()] = f.src
+	}
+	return rv
+}()
+
+// retryNoScript re-sends every EVALSHA in cmds that failed with NOSCRIPT as
+// an EVAL of the same script, keys and arguments, and stores the outcome in
+// the original command. EVAL also caches the script on the node that owns
+// the keys, so only the nodes that lost their scripts, after a restart or
+// when a shard is added to a Ring, are reloaded. EVAL cannot fail with
+// NOSCRIPT, so a single retry is enough. It reports whether anything was
+// retried, and has a running ScriptWatcher check every node.
+//
+// FCALLs that failed because the library or functions are missing are
+// re-sent the same way, after the library is loaded for the next calls.
+func (l *Limiter) retryNoScript(ctx context.Context, cmds []redis.Cmder) bool {
+	var failed []*redis.Cmd
+	var functionErr error
+	for _, cmd := range cmds {
+		c, ok := cmd.(*redis.Cmd)
+		if !ok || !isScriptMissing(c.Err()) {
+			continue
+		}
+		failed = append(failed, c)
+		if c.Name() == "fcall" {
+			functionErr = c.Err()
+		}
+	}
+	if len(failed) == 0 {
+		return false
+	}
+	if functionErr != nil {
+		l.recoverFunctions(ctx, functionErr)
+	} else if w := l.scriptWatcher.Load(); w != nil {
+		w.invalidate()
+	}
+
+	start := time.Now()
+	pipe := l.rdb.Pipeline()
+	retries := make([]*redis.Cmd, 0, len(failed))
+	for _, c := range failed {
+		args := c.Args()
+		name, _ := args[1].(string)
+		src, ok := scriptSource(name)
+		if c.Name() == "fcall" {
+			src, ok = functionSources[name]
+		}
+		if !ok {
+			retries = append(retries, nil)
+			continue
+		}
+		eval := make([]interface{}, 0, len(args))
+		eval = append(eval, "eval", src)
+		eval = append(eval, args[2:]...)
+		retry := redis.NewCmd(ctx, eval...)
+		_ = pipe.Process(ctx, retry)
+		retries = append(retries, retry)
+	}
+
+	_, err := pipe.Exec(ctx)
+	l.onScriptLoad(ctx, start, err)
+	for i, c := range failed {
+		if retries[i] == nil {
+			continue
+		}
+		c.SetVal(retries[i].Val())
+		c.SetErr(retries[i].Err())
+	}
+	return true
+}
+
+// isScriptMissing reports whether a script or function call failed because
+// it is not loaded on the node.
+func isScriptMissing(err error) bool {
+	return redis.HasErrorPrefix(err, "NOSCRIPT") || isMissingFunction(err) || isUnknownCommand(err)
+}
@@ -0,0 +1,62 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// WithPanicRecovery makes Allow and friends, AllowCost, AllowSlidingWindow,
+// AllowTiered and the other multi-key allows, WaitAtMost, Lease, Forecast,
+// Take and friends, TakeOrQueue and TakeOrWait, Release and ReleaseMulti,
+// Inspect, Usage, Snapshot, DumpState, RestoreState, EvalCustom and
+// Pipeline.Exec return a *PanicError instead of panicking, for instance on a
+// malformed reply from Redis, so that a bug in the Limiter cannot crash the
+// process serving requests.
+//
+// Hooks and spans of a call that panicked may not have been completed.
+func WithPanicRecovery() Option {
+	return func(l *Limiter) {
+		l.recoverPanics = true
+	}
+}
+
+// PanicError is returned by a Limiter with WithPanicRecovery in place of a
+// panic.
+type PanicError struct {
+	// Op is the operation that panicked.
+	Op Operation
+
+	// Key is the key the operation was called with, or empty for
+	// operations on several keys.
+	Key string
+
+	// Value is the value the operation panicked with.
+	Value interface{}
+
+	// Stack is the stack trace of the goroutine when it panicked.
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	if e.Key == "" {
+		return fmt.Sprintf("redis_rate: panic in %s: %v", e.Op, e.Value)
+	}
+	return fmt.Sprintf("redis_rate: panic in %s of %q: %v", e.Op, e.Key, e.Value)
+}
+
+// Unwrap returns Value if it is an error.
+func (e *PanicError) Unwrap() error {
+	err, _ := e.Value.(error)
+	return err
+}
+
+// recoverPanic sets *err to a *PanicError if the Limiter recovers panics and
+// the call deferring it panicked. It must be deferred directly.
+func (l *Limiter) recoverPanic(op Operation, key string, err *error) {
+	if !l.recoverPanics {
+		return
+	}
+	if v := recover(); v != nil {
+		*err = &PanicError{Op: op, Key: key, Value: v, Stack: debug.Stack()}
+	}
+}
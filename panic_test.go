@@ -0,0 +1,63 @@
+package redis_rate_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ductone/redis_rate/v11"
+)
+
+func TestPanicRecovery(t *testing.T) {
+	ctx := context.Background()
+	limit := redis_rate.PerSecond(10)
+	bug := errors.New("bug")
+	classifier := func(ctx context.Context, req redis_rate.Request) redis_rate.Request {
+		panic(bug)
+	}
+
+	l := newUnreachableLimiter(redis_rate.WithClassifier(classifier))
+	require.Panics(t, func() {
+		_, _ = l.Allow(ctx, "test_id", limit)
+	})
+
+	l = newUnreachableLimiter(redis_rate.WithClassifier(classifier), redis_rate.WithPanicRecovery())
+	res, err := l.Allow(ctx, "test_id", limit)
+	require.Nil(t, res)
+	var perr *redis_rate.PanicError
+	require.ErrorAs(t, err, &perr)
+	require.Equal(t, redis_rate.OpAllowN, perr.Op)
+	require.Equal(t, "test_id", perr.Key)
+	require.NotEmpty(t, perr.Stack)
+	require.ErrorIs(t, err, bug)
+
+	pipe := l.Pipeline()
+	pipe.AllowLazy(ctx, "test_id", redis_rate.LimitProviderFunc(func(ctx context.Context, key string) (redis_rate.Limit, error) {
+		panic("provider")
+	}))
+	err = pipe.Exec(ctx)
+	require.ErrorAs(t, err, &perr)
+	require.Equal(t, redis_rate.OpPipelineExec, perr.Op)
+	require.Equal(t, "provider", perr.Value)
+}
+
+type panicClock struct{}
+
+func (panicClock) Now() time.Time { panic("clock") }
+
+func TestPanicRecoveryOtherMethods(t *testing.T) {
+	ctx := context.Background()
+	l := newUnreachableLimiter(redis_rate.WithClock(panicClock{}), redis_rate.WithPanicRecovery())
+	var perr *redis_rate.PanicError
+
+	_, err := l.Lease(ctx, "test_id", redis_rate.PerSecond(10), 1, time.Second)
+	require.ErrorAs(t, err, &perr)
+	require.Equal(t, redis_rate.OpLease, perr.Op)
+
+	_, err = l.TakeOrQueue(ctx, "test_id", "req1", redis_rate.ConcurrencyLimit{Max: 1, RequestMaxDuration: time.Minute})
+	require.ErrorAs(t, err, &perr)
+	require.Equal(t, redis_rate.OpTakeOrQueue, perr.Op)
+}
@@ -0,0 +1,290 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParseLimit parses a Limit written as "rate/period", optionally followed by
+// "burst N", "penalty N", "warmup D" and "from N", such as "100/1m burst
+// 200" or "100/s warmup 10m from 5". The period is a duration such as "10s",
+// a unit such as "s", "m" or "h" meaning one of that unit, or "day" or
+// "month" for calendar limits. Burst defaults to the rate.
+//
+// ParseLimit also accepts the output of Limit.String, such as
+// "100 req/m (burst 200)" or "1000 req/day (UTC)".
+func ParseLimit(s string) (Limit, error) {
+	limit, err := parseLimit(s)
+	if err != nil {
+		return Limit{}, fmt.Errorf("redis_rate: invalid limit %q: %w", s, err)
+	}
+	return limit, nil
+}
+
+func parseLimit(s string) (Limit, error) {
+	fields := limitFields(strings.Replace(s, " req/", "/", 1))
+	if len(fields) == 0 {
+		return Limit{}, fmt.Errorf("expected rate/period")
+	}
+
+	rateStr, periodStr, ok := strings.Cut(fields[0], "/")
+	if !ok {
+		return Limit{}, fmt.Errorf("expected rate/period, got %q", fields[0])
+	}
+	rate, err := strconv.Atoi(rateStr)
+	if err != nil || rate <= 0 {
+		return Limit{}, fmt.Errorf("invalid rate %q", rateStr)
+	}
+
+	var limit Limit
+	switch periodStr {
+	case "day":
+		limit = PerDay(rate)
+	case "month":
+		limit = PerMonth(rate)
+	default:
+		period, err := parsePeriod(periodStr)
+		if err != nil {
+			return Limit{}, err
+		}
+		limit = Limit{Rate: rate, Burst: rate, Period: period}
+	}
+
+	fields = fields[1:]
+	if limit.Calendar != CalendarNone {
+		// Limit.String marks calendar limits as UTC.
+		if len(fields) == 1 && fields[0] == "UTC" {
+			fields = nil
+		}
+		if len(fields) > 0 {
+			return Limit{}, fmt.Errorf("calendar limits take no options, got %q", strings.Join(fields, " "))
+		}
+		return limit, nil
+	}
+
+	for len(fields) > 0 {
+		if len(fields) < 2 {
+			return Limit{}, fmt.Errorf("missing value for %q", fields[0])
+		}
+		if fields[0] == "warmup" {
+			d, err := time.ParseDuration(fields[1])
+			if err != nil || d < 0 {
+				return Limit{}, fmt.Errorf("invalid warmup %q", fields[1])
+			}
+			limit.WarmUp = d
+			fields = fields[2:]
+			continue
+		}
+		n, err := strconv.Atoi(fields[1])
+		if err != nil || n < 0 {
+			return Limit{}, fmt.Errorf("invalid %s %q", fields[0], fields[1])
+		}
+		switch fields[0] {
+		case "burst":
+			limit.Burst = n
+		case "penalty":
+			limit.Penalty = n
+		case "from":
+			limit.WarmUpRate = n
+		default:
+			return Limit{}, fmt.Errorf("unknown option %q", fields[0])
+		}
+		fields = fields[2:]
+	}
+	return limit, nil
+}
+
+// limitFields splits s into fields, ignoring the parentheses and commas
+// used by the String methods.
+func limitFields(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return r == ' ' || r == '\t' || r == '(' || r == ')' || r == ','
+	})
+}
+
+// parsePeriod parses a duration, or a bare unit as formatted by fmtDur.
+func parsePeriod(s string) (time.Duration, error) {
+	switch s {
+	case "s":
+		return time.Second, nil
+	case "m":
+		return time.Minute, nil
+	case "h":
+		return time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid period %q", s)
+	}
+	return d, nil
+}
+
+// MarshalText implements encoding.TextMarshaler, so a Limit is written to
+// JSON and YAML as its String. The zero Limit is written as "".
+func (l Limit) MarshalText() ([]byte, error) {
+	if l.IsZero() {
+		return []byte{}, nil
+	}
+	return []byte(l.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler using ParseLimit, so a
+// Limit can be read from JSON, YAML and environment variables. An empty
+// text is the zero Limit.
+func (l *Limit) UnmarshalText(text []byte) error {
+	if len(strings.TrimSpace(string(text))) == 0 {
+		*l = Limit{}
+		return nil
+	}
+	limit, err := ParseLimit(string(text))
+	if err != nil {
+		return err
+	}
+	*l = limit
+	return nil
+}
+
+// UnmarshalJSON reads a Limit written as a string, as MarshalText writes
+// it, or as the object of its fields, such as {"Rate":10,"Burst":10,
+// "Period":1000000000}, which Limits were written as before they
+// implemented encoding.TextMarshaler.
+func (l *Limit) UnmarshalJSON(data []byte) error {
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		return unmarshalJSONText(data, l)
+	}
+	type fields Limit
+	var v fields
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*l = Limit(v)
+	return nil
+}
+
+func (l ConcurrencyLimit) String() string {
+	var opts []string
+	if l.RequestMaxDuration != 0 {
+		opts = append(opts, "max "+l.RequestMaxDuration.String())
+	}
+	if l.MaxPerOwner != 0 {
+		opts = append(opts, fmt.Sprintf("%d per owner", l.MaxPerOwner))
+	}
+	if len(opts) == 0 {
+		return fmt.Sprintf("%d concurrent", l.Max)
+	}
+	return fmt.Sprintf("%d concurrent (%s)", l.Max, strings.Join(opts, ", "))
+}
+
+// ParseConcurrencyLimit parses a ConcurrencyLimit written as "max" or
+// "max/duration", such as "10/30s" for 10 requests that each complete
+// within 30 seconds, optionally followed by "n per owner" to set
+// MaxPerOwner, as in "10/30s 2 per owner". It also accepts the output of
+// ConcurrencyLimit.String, such as "10 concurrent (max 30s, 2 per owner)".
+func ParseConcurrencyLimit(s string) (ConcurrencyLimit, error) {
+	limit, err := parseConcurrencyLimit(s)
+	if err != nil {
+		return ConcurrencyLimit{}, fmt.Errorf("redis_rate: invalid concurrency limit %q: %w", s, err)
+	}
+	return limit, nil
+}
+
+func parseConcurrencyLimit(s string) (ConcurrencyLimit, error) {
+	fields := limitFields(s)
+	if len(fields) == 0 {
+		return ConcurrencyLimit{}, fmt.Errorf("expected max")
+	}
+
+	var limit ConcurrencyLimit
+	maxStr, durStr, hasDur := strings.Cut(fields[0], "/")
+	n, err := strconv.ParseInt(maxStr, 10, 64)
+	if err != nil || n <= 0 {
+		return ConcurrencyLimit{}, fmt.Errorf("invalid max %q", maxStr)
+	}
+	limit.Max = n
+
+	fields = fields[1:]
+	if len(fields) > 0 && fields[0] == "concurrent" {
+		fields = fields[1:]
+	}
+	for len(fields) > 0 {
+		switch {
+		case !hasDur && len(fields) >= 2 && fields[0] == "max":
+			durStr, hasDur = fields[1], true
+			fields = fields[2:]
+		case limit.MaxPerOwner == 0 && len(fields) >= 3 && fields[1] == "per" && fields[2] == "owner":
+			n, err := strconv.ParseInt(fields[0], 10, 64)
+			if err != nil || n <= 0 {
+				return ConcurrencyLimit{}, fmt.Errorf("invalid max per owner %q", fields[0])
+			}
+			limit.MaxPerOwner = n
+			fields = fields[3:]
+		default:
+			return ConcurrencyLimit{}, fmt.Errorf("unexpected %q", strings.Join(fields, " "))
+		}
+	}
+	if hasDur {
+		if limit.RequestMaxDuration, err = parsePeriod(durStr); err != nil {
+			return ConcurrencyLimit{}, err
+		}
+	}
+	return limit, nil
+}
+
+// MarshalText implements encoding.TextMarshaler, so a ConcurrencyLimit is
+// written to JSON and YAML as its String. The zero ConcurrencyLimit is
+// written as "".
+func (l ConcurrencyLimit) MarshalText() ([]byte, error) {
+	if l == (ConcurrencyLimit{}) {
+		return []byte{}, nil
+	}
+	return []byte(l.String()), nil
+}
+
+// UnmarshalJSON reads a ConcurrencyLimit written as a string, as
+// MarshalText writes it, or as the object of its fields, such as
+// {"Max":10,"RequestMaxDuration":30000000000}, which ConcurrencyLimits were
+// written as before they implemented encoding.TextMarshaler.
+func (l *ConcurrencyLimit) UnmarshalJSON(data []byte) error {
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		return unmarshalJSONText(data, l)
+	}
+	type fields ConcurrencyLimit
+	var v fields
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*l = ConcurrencyLimit(v)
+	return nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler using
+// ParseConcurrencyLimit. An empty text is the zero ConcurrencyLimit.
+func (l *ConcurrencyLimit) UnmarshalText(text []byte) error {
+	if len(strings.TrimSpace(string(text))) == 0 {
+		*l = ConcurrencyLimit{}
+		return nil
+	}
+	limit, err := ParseConcurrencyLimit(string(text))
+	if err != nil {
+		return err
+	}
+	*l = limit
+	return nil
+}
+
+// unmarshalJSONText reads the JSON string data into v with UnmarshalText,
+// leaving v as it is for null, as encoding/json does.
+func unmarshalJSONText(data []byte, v interface{ UnmarshalText([]byte) error }) error {
+	if string(bytes.TrimSpace(data)) == "null" {
+		return nil
+	}
+	var text string
+	if err := json.Unmarshal(data, &text); err != nil {
+		return err
+	}
+	return v.UnmarshalText([]byte(text))
+}
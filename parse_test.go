@@ -0,0 +1,137 @@
+package redis_rate_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/ductone/redis_rate/v11"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLimit(t *testing.T) {
+	tests := []struct {
+		s     string
+		limit redis_rate.Limit
+	}{
+		{"100/1m burst 200", redis_rate.Limit{Rate: 100, Burst: 200, Period: time.Minute}},
+		{"10/s", redis_rate.PerSecond(10)},
+		{"5/90s penalty 2", redis_rate.Limit{Rate: 5, Burst: 5, Period: 90 * time.Second, Penalty: 2}},
+		{"100/s warmup 10m from 5", redis_rate.Limit{Rate: 100, Burst: 100, Period: time.Second, WarmUp: 10 * time.Minute, WarmUpRate: 5}},
+		{"1000/day", redis_rate.PerDay(1000)},
+		{"1000 req/month (UTC)", redis_rate.PerMonth(1000)},
+	}
+	for _, test := range tests {
+		limit, err := redis_rate.ParseLimit(test.s)
+		require.NoError(t, err, test.s)
+		require.Equal(t, test.limit, limit, test.s)
+	}
+
+	for _, s := range []string{"", "100", "0/s", "10/0s", "10/fortnight", "10/s burst", "10/s burst -1", "10/s jitter 2", "10/day burst 20", "10/s warmup 5"} {
+		_, err := redis_rate.ParseLimit(s)
+		require.Error(t, err, s)
+	}
+}
+
+func TestParseLimitRoundTrip(t *testing.T) {
+	for _, limit := range []redis_rate.Limit{
+		redis_rate.PerSecond(10),
+		redis_rate.PerMinute(100),
+		redis_rate.PerHour(1000),
+		{Rate: 3, Burst: 7, Period: 1500 * time.Millisecond, Penalty: 1},
+		{Rate: 50, Burst: 50, Period: time.Second, WarmUp: time.Hour},
+		{Rate: 50, Burst: 60, Period: time.Second, WarmUp: 90 * time.Second, WarmUpRate: 5},
+		redis_rate.PerDay(50),
+		redis_rate.PerMonth(500),
+	} {
+		parsed, err := redis_rate.ParseLimit(limit.String())
+		require.NoError(t, err, limit.String())
+		require.Equal(t, limit, parsed)
+	}
+}
+
+func TestParseConcurrencyLimit(t *testing.T) {
+	limit, err := redis_rate.ParseConcurrencyLimit("10/30s")
+	require.NoError(t, err)
+	require.Equal(t, redis_rate.ConcurrencyLimit{Max: 10, RequestMaxDuration: 30 * time.Second}, limit)
+
+	limit, err = redis_rate.ParseConcurrencyLimit("4")
+	require.NoError(t, err)
+	require.Equal(t, redis_rate.ConcurrencyLimit{Max: 4}, limit)
+
+	limit, err = redis_rate.ParseConcurrencyLimit("10/30s 2 per owner")
+	require.NoError(t, err)
+	require.Equal(t, redis_rate.ConcurrencyLimit{Max: 10, RequestMaxDuration: 30 * time.Second, MaxPerOwner: 2}, limit)
+
+	for _, limit := range []redis_rate.ConcurrencyLimit{
+		{Max: 10, RequestMaxDuration: time.Minute},
+		{Max: 2},
+		{Max: 10, MaxPerOwner: 3},
+		{Max: 10, RequestMaxDuration: time.Minute, MaxPerOwner: 3},
+	} {
+		parsed, err := redis_rate.ParseConcurrencyLimit(limit.String())
+		require.NoError(t, err, limit.String())
+		require.Equal(t, limit, parsed)
+
+		text, err := limit.MarshalText()
+		require.NoError(t, err)
+		var unmarshaled redis_rate.ConcurrencyLimit
+		require.NoError(t, unmarshaled.UnmarshalText(text))
+		require.Equal(t, limit, unmarshaled)
+	}
+	require.Equal(t, "10 concurrent (max 1m0s, 3 per owner)",
+		redis_rate.ConcurrencyLimit{Max: 10, RequestMaxDuration: time.Minute, MaxPerOwner: 3}.String())
+
+	for _, s := range []string{"", "0", "10/", "10 max", "10 parallel", "10 0 per owner", "10 2 per tenant"} {
+		_, err := redis_rate.ParseConcurrencyLimit(s)
+		require.Error(t, err, s)
+	}
+}
+
+func TestLimitJSON(t *testing.T) {
+	var config struct {
+		API         redis_rate.Limit
+		Uploads     redis_rate.Limit
+		Unset       redis_rate.Limit
+		Concurrency redis_rate.ConcurrencyLimit
+	}
+	err := json.Unmarshal([]byte(`{"API": "100/1m burst 200", "Uploads": "10/day", "Unset": "", "Concurrency": "8/10s"}`), &config)
+	require.NoError(t, err)
+	require.Equal(t, redis_rate.Limit{Rate: 100, Burst: 200, Period: time.Minute}, config.API)
+	require.Equal(t, redis_rate.PerDay(10), config.Uploads)
+	require.True(t, config.Unset.IsZero())
+	require.Equal(t, redis_rate.ConcurrencyLimit{Max: 8, RequestMaxDuration: 10 * time.Second}, config.Concurrency)
+
+	b, err := json.Marshal(config)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"API": "100 req/m (burst 200)", "Uploads": "10 req/day (UTC)", "Unset": "", "Concurrency": "8 concurrent (max 10s)"}`, string(b))
+
+	err = json.Unmarshal([]byte(`{"API": "fast"}`), &config)
+	require.Error(t, err)
+}
+
+func TestLimitLegacyJSON(t *testing.T) {
+	var config struct {
+		API         redis_rate.Limit
+		Monthly     redis_rate.Limit
+		Text        redis_rate.Limit
+		Unset       redis_rate.Limit
+		Concurrency redis_rate.ConcurrencyLimit
+	}
+	err := json.Unmarshal([]byte(`{
+		"API": {"Rate": 100, "Burst": 200, "Period": 60000000000},
+		"Monthly": {"Rate": 10, "Burst": 10, "Period": 2592000000000000, "Calendar": 2},
+		"Text": "5/s",
+		"Unset": null,
+		"Concurrency": {"Max": 8, "RequestMaxDuration": 10000000000}
+	}`), &config)
+	require.NoError(t, err)
+	require.Equal(t, redis_rate.Limit{Rate: 100, Burst: 200, Period: time.Minute}, config.API)
+	require.Equal(t, redis_rate.PerMonth(10), config.Monthly)
+	require.Equal(t, redis_rate.PerSecond(5), config.Text)
+	require.True(t, config.Unset.IsZero())
+	require.Equal(t, redis_rate.ConcurrencyLimit{Max: 8, RequestMaxDuration: 10 * time.Second}, config.Concurrency)
+
+	err = json.Unmarshal([]byte(`{"API": 5}`), &config)
+	require.Error(t, err)
+}
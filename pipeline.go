@@ -1,26 +1,77 @@
 package redis_rate //nolint:revive // upstream used this name
 
 import (
-	"bytes"
 	"context"
 	"errors"
+	"fmt"
+	"time"
 
 	"github.com/redis/go-redis/v9"
 )
 
+// Deprecated: ErrScriptFailed is no longer returned; scripts missing from a
+// node are now re-sent with EVAL instead of being checked with SCRIPT EXISTS.
 var ErrScriptFailed = errors.New("redis_rate: invalid result from SCRIPT EXISTS in pipeline")
+
+// Deprecated: ErrTooManyRetries is no longer returned; scripts missing from a
+// node are now re-sent with EVAL, which needs a single retry.
 var ErrTooManyRetries = errors.New("redis_rate: pipeline too many retries to load scripts")
 
+// PipelineError is returned by Pipeline.Exec when some of its operations
+// failed, such as a key holding a value of the wrong type. The other
+// operations were applied and their results are valid; failed results have
+// their Err set. See WithPipelineAllOrNothing for the previous behavior.
+type PipelineError struct {
+	// Keys are the keys of the failed operations, in the order they were
+	// queued: allows, then takes, then releases.
+	Keys []string
+
+	// Err is the error of the first failed operation.
+	Err error
+}
+
+func (e *PipelineError) Error() string {
+	return fmt.Sprintf("redis_rate: %d pipeline operations failed, first on %q: %v", len(e.Keys), e.Keys[0], e.Err)
+}
+
+func (e *PipelineError) Unwrap() error {
+	return e.Err
+}
+
+// WithPipelineAllOrNothing makes Pipeline.Exec return the error of the first
+// failed operation, without a PipelineError, leaving the results of later
+// operations unset.
+func WithPipelineAllOrNothing() Option {
+	return func(s *Limiter) {
+		s.pipelineAllOrNothing = true
+	}
+}
+
 type Pipeline interface {
 	Allow(ctx context.Context,
 		key string,
 		limit Limit,
 	) *Result
 
+	// AllowLazy queues an Allow whose limit is resolved from provider when
+	// Exec is called rather than when the call is queued. Keys that resolve
+	// to a zero Limit use the Limiter's default limit, or fail Exec with
+	// ErrNoLimit if it has none.
+	AllowLazy(ctx context.Context, key string, provider LimitProvider) *Result
+
+	// Take queues a Take of key for requestID, sent in the same round trip
+	// as the Pipeline's allows. Slots taken are kept even if other
+	// operations are denied or fail; use an Admission to have them released
+	// again when the request is not admitted.
 	Take(ctx context.Context, key string, requestID string, limit ConcurrencyLimit) *ConcurrencyResult
 
 	Release(ctx context.Context, key string, requestID string)
 
+	// EvalCustom queues a run of a script registered with RegisterScript.
+	// The returned command holds its reply after Exec; its errors are only
+	// reported on the command.
+	EvalCustom(ctx context.Context, name string, keys []string, args ...interface{}) *redis.Cmd
+
 	Exec(ctx context.Context) error
 }
 
@@ -37,23 +88,59 @@ type pair[TA any, TB any] struct {
 
 type pipeline struct {
 	l               *Limiter
-	buf             bytes.Buffer
 	releaseCommands []pair[string, string]
 	allowCommands   []*Result
+	lazyCommands    []pair[*Result, LimitProvider]
 	takeCommands    []*ConcurrencyResult
+	attempts        int
+	shards          []ShardTiming
+
+	// customCommands are arbitrary commands queued by an Admission.
+	customCommands []redis.Cmder
+
+	// releaseErrs holds the error of each release, by its index in
+	// releaseCommands, or is nil if none failed.
+	releaseErrs []error
+
+	// allowTags holds the tags the Classifier added to allows, for their
+	// hooks.
+	allowTags map[*Result][]Tag
 }
 
 func (p *pipeline) Allow(ctx context.Context,
 	key string,
 	limit Limit) *Result {
+	tags, key, limit := p.l.classifyTags(ctx, key, limit)
 	rv := &Result{
 		Key:   key,
 		Limit: limit,
 	}
+	p.tagAllow(rv, tags)
 	p.allowCommands = append(p.allowCommands, rv)
 	return rv
 }
 
+// tagAllow records the tags the Classifier added to the allow of rv.
+func (p *pipeline) tagAllow(rv *Result, tags []Tag) {
+	if len(tags) == 0 {
+		return
+	}
+	if p.allowTags == nil {
+		p.allowTags = make(map[*Result][]Tag)
+	}
+	p.allowTags[rv] = tags
+}
+
+func (p *pipeline) AllowLazy(ctx context.Context,
+	key string,
+	provider LimitProvider) *Result {
+	rv := &Result{
+		Key: key,
+	}
+	p.lazyCommands = append(p.lazyCommands, pair[*Result, LimitProvider]{rv, provider})
+	return rv
+}
+
 func (p *pipeline) Take(ctx context.Context,
 	key string, requestID string,
 	limit ConcurrencyLimit) *ConcurrencyResult {
@@ -71,66 +158,243 @@ func (p *pipeline) Release(ctx context.Context,
 	p.releaseCommands = append(p.releaseCommands, pair[string, string]{key, requestID})
 }
 
-func (p *pipeline) Exec(ctx context.Context) error {
-	return p.exec(ctx, 0)
-}
-
-func (p *pipeline) exec(ctx context.Context, depth int) error {
-	if depth > 10 {
-		return ErrTooManyRetries
+func (p *pipeline) Exec(ctx context.Context) (err error) {
+	defer p.l.recoverPanic(OpPipelineExec, "", &err)
+	p.clearErrs()
+	if len(p.l.hooks) == 0 && p.l.tracer == nil {
+		return p.execLazy(ctx)
 	}
 
-	finishFuncs := make([]func() error, 0, len(p.allowCommands))
-	pipe := p.l.rdb.Pipeline()
-
-	var scriptExistChecks []*redis.BoolSliceCmd
+	ctx, span := p.l.startSpan(ctx, OpPipelineExec)
+	defer span.End()
 
-	if len(p.allowCommands) > 0 {
-		scriptExistChecks = append(scriptExistChecks, allowN.Exists(ctx, pipe))
+	start := time.Now()
+	p.attempts = 0
+	p.shards = nil
+	err = p.execLazy(ctx)
+	var perr *PipelineError
+	partial := errors.As(err, &perr)
+	for _, v := range p.allowCommands {
+		p.l.onAllow(WithTags(ctx, p.allowTags[v]...), OpPipelineAllow, v.Key, 1, v, start, opErr(err, partial, v.Err))
+	}
+	for _, v := range p.takeCommands {
+		p.l.onConcurrency(ctx, OpPipelineTake, v.Key, v.RequestID, v, start, opErr(err, partial, v.Err))
+	}
+	for i, v := range p.releaseCommands {
+		p.l.onConcurrency(ctx, OpPipelineRelease, v.A, v.B, nil, start, opErr(err, partial, p.releaseErr(i)))
+	}
+	ev := PipelineEvent{
+		Allows:   len(p.allowCommands),
+		Takes:    len(p.takeCommands),
+		Releases: len(p.releaseCommands),
+		Attempts: p.attempts,
+		Duration: time.Since(start),
+		Shards:   p.shards,
+		Tags:     TagsFromContext(ctx),
+		Err:      err,
+	}
+	if err == nil || partial {
 		for _, v := range p.allowCommands {
-			finishFuncs = append(finishFuncs, p.allowPipe(ctx, pipe, v))
+			if v.Err == nil && v.Allowed == 0 {
+				ev.Denied++
+			}
 		}
-	}
-
-	if len(p.takeCommands) > 0 {
-		scriptExistChecks = append(scriptExistChecks, concurrencyTake.Exists(ctx, pipe))
 		for _, v := range p.takeCommands {
-			finishFuncs = append(finishFuncs, p.takePipe(ctx, pipe, v))
+			if v.Err == nil && !v.Allowed {
+				ev.Denied++
+			}
 		}
 	}
+	p.l.onPipelineExec(ctx, ev)
+	span.SetAttributes(
+		Attribute{AttrBatchSize, ev.BatchSize()},
+		Attribute{AttrDenied, ev.Denied},
+	)
+	if err != nil {
+		span.RecordError(err)
+	}
+	return err
+}
 
-	if len(p.releaseCommands) > 0 {
-		p.l.releasePipe(ctx, pipe, p.releaseCommands)
+// opErr returns the error to report for a single operation of a pipeline
+// whose Exec returned err.
+func opErr(err error, partial bool, own error) error {
+	if partial {
+		return own
 	}
+	return err
+}
 
-	_, err := pipe.Exec(ctx)
-	if err != nil && !redis.HasErrorPrefix(err, "NOSCRIPT") {
+func (p *pipeline) execLazy(ctx context.Context) error {
+	err := p.prepare(ctx)
+	if err != nil {
 		return err
 	}
+	if p.l.killed(ctx) && (len(p.allowCommands) > 0 || len(p.takeCommands) > 0) {
+		return p.execKilled(ctx)
+	}
+	if p.l.readOnly {
+		if len(p.takeCommands) > 0 || len(p.releaseCommands) > 0 || len(p.customCommands) > 0 {
+			return &ReadOnlyError{Method: "Pipeline.Exec"}
+		}
+		if len(p.allowCommands) == 0 {
+			return nil
+		}
+		return p.l.peek(ctx, p.allowCommands, 1, false)
+	}
+	if p.l.pipelineSharding {
+		if ok, err := p.execSharded(ctx); ok {
+			return err
+		}
+	}
+	if p.l.pipelineBatchSize > 0 && p.len() > p.l.pipelineBatchSize {
+		return p.execPartitioned(ctx)
+	}
+	return p.exec(ctx)
+}
 
-	for _, se := range scriptExistChecks {
-		exists, err := se.Result()
+// prepare checks the queued Allow commands have a limit, then resolves the
+// limits of commands queued with AllowLazy and moves them onto allowCommands.
+// Like Allow, lazy keys that resolve to a zero Limit use the default limit,
+// and fail the Exec with ErrNoLimit if there is none.
+func (p *pipeline) prepare(ctx context.Context) error {
+	for _, v := range p.allowCommands {
+		if v.Limit.IsZero() {
+			return ErrNoLimit
+		}
+	}
+	for _, v := range p.lazyCommands {
+		limit, err := v.B.Limit(ctx, v.A.Key)
 		if err != nil {
 			return err
 		}
-		if len(exists) != 1 {
-			return ErrScriptFailed
-		}
-		if !exists[0] {
-			err = p.l.LoadScripts(ctx)
-			if err != nil {
-				return err
-			}
-			return p.exec(ctx, depth+1)
+		var tags []Tag
+		tags, v.A.Key, limit = p.l.classifyTags(ctx, v.A.Key, limit)
+		if limit.IsZero() {
+			return ErrNoLimit
 		}
+		p.tagAllow(v.A, tags)
+		v.A.Limit = limit
+		p.allowCommands = append(p.allowCommands, v.A)
 	}
+	p.lazyCommands = nil
+	return nil
+}
 
-	for _, fn := range finishFuncs {
-		err := fn()
-		if err != nil {
+func (p *pipeline) exec(ctx context.Context) error {
+	p.attempts++
+	pipe := p.l.rdb.Pipeline()
+	args := getScriptArgs()
+	defer args.release()
+
+	evals := make([]*redis.Cmd, 0, len(p.allowCommands)+len(p.takeCommands))
+	for _, v := range p.allowCommands {
+		evals = append(evals, p.allowPipe(ctx, pipe, args, v))
+	}
+	for _, v := range p.takeCommands {
+		evals = append(evals, p.takePipe(ctx, pipe, args, v))
+	}
+
+	var releases []*redis.Cmd
+	if len(p.releaseCommands) > 0 {
+		releases = p.l.releasePipe(ctx, pipe, p.releaseCommands)
+	}
+
+	for _, cmd := range p.customCommands {
+		_ = pipe.Process(ctx, cmd)
+	}
+
+	cmds, err := pipe.Exec(ctx)
+	var rerr redis.Error
+	if err != nil && !errors.As(err, &rerr) {
+		return err
+	}
+	if p.l.retryNoScript(ctx, cmds) {
+		p.attempts++
+	}
+	for i, v := range p.allowCommands {
+		err := p.finishAllow(ctx, evals[i], v)
+		if err != nil && p.l.pipelineAllOrNothing {
+			return err
+		}
+	}
+	for i, v := range p.takeCommands {
+		err := p.finishTake(evals[len(p.allowCommands)+i], v)
+		if err != nil && p.l.pipelineAllOrNothing {
+			return err
+		}
+	}
+	p.releaseErrs = nil
+	for i, cmd := range releases {
+		err := cmd.Err()
+		if err == nil {
+			continue
+		}
+		if p.l.pipelineAllOrNothing {
 			return err
 		}
+		p.setReleaseErr(i, err)
 	}
 
-	return nil
+	return p.failures()
+}
+
+// releaseErr returns the error of the i-th release.
+func (p *pipeline) releaseErr(i int) error {
+	if p.releaseErrs == nil {
+		return nil
+	}
+	return p.releaseErrs[i]
+}
+
+// setReleaseErr records err as the error of the i-th release.
+func (p *pipeline) setReleaseErr(i int, err error) {
+	if p.releaseErrs == nil {
+		p.releaseErrs = make([]error, len(p.releaseCommands))
+	}
+	p.releaseErrs[i] = err
+}
+
+// clearErrs forgets the errors of a previous Exec.
+func (p *pipeline) clearErrs() {
+	for _, v := range p.allowCommands {
+		v.Err = nil
+	}
+	for _, v := range p.lazyCommands {
+		v.A.Err = nil
+	}
+	for _, v := range p.takeCommands {
+		v.Err = nil
+	}
+	p.releaseErrs = nil
+}
+
+// failures returns a PipelineError for the failed operations, if any.
+func (p *pipeline) failures() error {
+	var rv *PipelineError
+	add := func(key string, err error) {
+		if rv == nil {
+			rv = &PipelineError{Err: err}
+		}
+		rv.Keys = append(rv.Keys, key)
+	}
+	for _, v := range p.allowCommands {
+		if v.Err != nil {
+			add(v.Key, v.Err)
+		}
+	}
+	for _, v := range p.takeCommands {
+		if v.Err != nil {
+			add(v.Key, v.Err)
+		}
+	}
+	for i, err := range p.releaseErrs {
+		if err != nil {
+			add(p.releaseCommands[i].A, err)
+		}
+	}
+	if rv == nil {
+		return nil
+	}
+	return rv
 }
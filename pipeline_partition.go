@@ -0,0 +1,207 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// WithPipelinePartitions splits a Pipeline with more than batchSize
+// operations into sub-pipelines of roughly batchSize operations each and
+// executes up to concurrency of them at once. Operations on the same key
+// always land in the same sub-pipeline, so they are still applied in the
+// order they were queued, and on a *redis.Ring or *redis.ClusterClient each
+// sub-pipeline only holds keys of one shard. This spreads very large batches
+// over several connections per shard instead of a single long pipeline.
+//
+// Partitioning is disabled by default. A concurrency below 1 runs every
+// sub-pipeline at once.
+func WithPipelinePartitions(batchSize int, concurrency int) func(*Limiter) {
+	return func(s *Limiter) {
+		s.pipelineBatchSize = batchSize
+		s.pipelineConcurrency = concurrency
+	}
+}
+
+func (p *pipeline) len() int {
+	return len(p.allowCommands) + len(p.takeCommands) + len(p.releaseCommands) + len(p.customCommands)
+}
+
+// partitions assigns the operations of the pipeline to sub-pipelines of
+// roughly batchSize operations, returning the sub-pipeline of each rate limit
+// key and of each concurrency key, and the number of sub-pipelines. Keys are
+// grouped by the shard they live on, as WithShardedPipelines finds it, and
+// each key is placed with the keys of its shard queued before it while there
+// is room.
+func (p *pipeline) partitions(ctx context.Context, batchSize int) (rateParts, takeParts map[string]int, parts int) {
+	shardOf := p.l.shardOf(ctx)
+	// current is the sub-pipeline keys of each shard are being added to, and
+	// sizes the number of operations of each sub-pipeline.
+	current := make(map[string]int)
+	var sizes []int
+	partOf := func(parts map[string]int, key, redisKey string) {
+		i, ok := parts[key]
+		if !ok {
+			shard := ""
+			if shardOf != nil {
+				shard = shardOf(redisKey)
+			}
+			i, ok = current[shard]
+			if !ok || sizes[i] >= batchSize {
+				i = len(sizes)
+				sizes = append(sizes, 0)
+				current[shard] = i
+			}
+			parts[key] = i
+		}
+		sizes[i]++
+	}
+
+	ratePrefix := p.l.allowKeyPrefix(ctx)
+	rateParts = make(map[string]int, len(p.allowCommands))
+	for _, v := range p.allowCommands {
+		partOf(rateParts, v.Key, ratePrefix+p.l.hashTagged(v.Key))
+	}
+	takeParts = make(map[string]int, len(p.takeCommands)+len(p.releaseCommands))
+	for _, v := range p.takeCommands {
+		partOf(takeParts, v.Key, p.l.concurrencyKey(v.Key))
+	}
+	for _, v := range p.releaseCommands {
+		partOf(takeParts, v.A, p.l.concurrencyKey(v.A))
+	}
+	// custom commands go to the first sub-pipeline, which must exist.
+	if len(sizes) == 0 {
+		return rateParts, takeParts, 1
+	}
+	return rateParts, takeParts, len(sizes)
+}
+
+// execPartitioned runs the pipeline as concurrent sub-pipelines, returning
+// the first error encountered other than a PipelineError, or else a
+// PipelineError covering every sub-pipeline.
+func (p *pipeline) execPartitioned(ctx context.Context) error {
+	rateParts, takeParts, parts := p.partitions(ctx, p.l.pipelineBatchSize)
+	return p.execSplit(ctx, parts, p.l.pipelineConcurrency,
+		func(key string) int { return rateParts[key] },
+		func(key string) int { return takeParts[key] },
+		nil)
+}
+
+// execSplit runs the pipeline as parts concurrent sub-pipelines, up to
+// concurrency at once, placing rate limit keys with ratePart and concurrency
+// keys with takePart. It returns the first error encountered other than a
+// PipelineError, or else a PipelineError covering every sub-pipeline. With
+// shards, naming the shard of each sub-pipeline, a sub-pipeline that failed
+// as a whole only fails its own operations, unless WithPipelineAllOrNothing
+// is set, and the timing of each shard is recorded.
+func (p *pipeline) execSplit(ctx context.Context, parts int, concurrency int, ratePart, takePart func(key string) int, shards []string) error {
+	children := make([]*pipeline, parts)
+	for i := range children {
+		children[i] = &pipeline{l: p.l}
+	}
+	for _, v := range p.allowCommands {
+		c := children[ratePart(v.Key)]
+		c.allowCommands = append(c.allowCommands, v)
+	}
+	for _, v := range p.takeCommands {
+		c := children[takePart(v.Key)]
+		c.takeCommands = append(c.takeCommands, v)
+	}
+	// releases holds the index in p of each release of each child.
+	releases := make([][]int, parts)
+	for i, v := range p.releaseCommands {
+		part := takePart(v.A)
+		c := children[part]
+		c.releaseCommands = append(c.releaseCommands, v)
+		releases[part] = append(releases[part], i)
+	}
+	// custom commands are kept together, in the order they were queued.
+	children[0].customCommands = p.customCommands
+
+	if concurrency < 1 {
+		concurrency = parts
+	}
+	sem := make(chan struct{}, concurrency)
+	errs := make([]error, parts)
+	durations := make([]time.Duration, parts)
+
+	var wg sync.WaitGroup
+	for i, c := range children {
+		if c.len() == 0 {
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, c *pipeline) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			start := time.Now()
+			errs[i] = c.exec(ctx)
+			durations[i] = time.Since(start)
+		}(i, c)
+	}
+	wg.Wait()
+
+	if shards != nil {
+		for i, c := range children {
+			if c.len() == 0 {
+				continue
+			}
+			p.shards = append(p.shards, ShardTiming{
+				Addr:     shards[i],
+				Duration: durations[i],
+				Commands: c.len(),
+				Err:      errs[i],
+			})
+		}
+	}
+
+	for _, c := range children {
+		if c.attempts > p.attempts {
+			p.attempts = c.attempts
+		}
+	}
+	partial := false
+	for i, err := range errs {
+		var perr *PipelineError
+		if errors.As(err, &perr) {
+			partial = true
+			continue
+		}
+		if err == nil {
+			continue
+		}
+		if shards == nil || p.l.pipelineAllOrNothing {
+			return err
+		}
+		children[i].fail(err)
+		partial = true
+	}
+	if !partial {
+		return nil
+	}
+	p.releaseErrs = nil
+	for i, c := range children {
+		for j, err := range c.releaseErrs {
+			if err != nil {
+				p.setReleaseErr(releases[i][j], err)
+			}
+		}
+	}
+	return p.failures()
+}
+
+// fail records err as the error of every operation in the pipeline.
+func (p *pipeline) fail(err error) {
+	for _, v := range p.allowCommands {
+		v.Err = err
+	}
+	for _, v := range p.takeCommands {
+		v.Err = err
+	}
+	p.releaseErrs = nil
+	for i := range p.releaseCommands {
+		p.setReleaseErr(i, err)
+	}
+}
@@ -0,0 +1,50 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPipelinePartitionsByShard(t *testing.T) {
+	ctx := context.Background()
+	ring := redis.NewRing(&redis.RingOptions{
+		Addrs: map[string]string{
+			"server0": "127.0.0.1:1",
+			"server1": "127.0.0.1:2",
+		},
+		HeartbeatFrequency: time.Hour,
+	})
+	defer ring.Close()
+	l := New(ring, WithPipelinePartitions(4, 0))
+	shardOf := l.shardOf(ctx)
+
+	p := l.Pipeline().(*pipeline)
+	limit := PerSecond(10)
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("tenant:%d", i)
+		p.Allow(ctx, key, limit)
+		p.Allow(ctx, key, limit)
+	}
+	rateParts, _, parts := p.partitions(ctx, 4)
+
+	shards := make(map[int]string)
+	sizes := make([]int, parts)
+	for key, part := range rateParts {
+		shard := shardOf(l.ratePrefix + key)
+		if s, ok := shards[part]; ok {
+			require.Equal(t, s, shard, key)
+		}
+		shards[part] = shard
+		sizes[part] += 2
+	}
+	for _, size := range sizes {
+		require.LessOrEqual(t, size, 4)
+	}
+	require.Len(t, shards, parts)
+	require.GreaterOrEqual(t, parts, 10)
+}
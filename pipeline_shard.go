@@ -0,0 +1,110 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// WithShardedPipelines splits a Pipeline executed on a *redis.Ring or
+// *redis.ClusterClient into one sub-pipeline per shard and executes up to
+// concurrency of them at once, merging their results. A shard that fails,
+// for instance because it is down, then only fails the operations of its
+// keys, reported in a PipelineError, instead of the whole Pipeline, and each
+// shard recovers from missing scripts on its own.
+//
+// Shards are found the way go-redis routes keys; for a Ring the hash is
+// taken over every shard, live or not, which at worst groups keys less
+// tightly while a shard is down. Other clients are unaffected, and
+// WithPipelinePartitions is only applied to Pipelines whose keys all live on
+// one shard. A concurrency below 1 runs every sub-pipeline at once.
+func WithShardedPipelines(concurrency int) Option {
+	return func(l *Limiter) {
+		l.pipelineSharding = true
+		l.shardConcurrency = concurrency
+	}
+}
+
+// shardOf returns a function naming the shard a Redis key lives on, or nil
+// if the Limiter's client is not sharded.
+func (l *Limiter) shardOf(ctx context.Context) func(key string) string {
+	switch rdb := l.rdb.(type) {
+	case *redis.ClusterClient:
+		return func(key string) string {
+			node, err := rdb.MasterForKey(ctx, key)
+			if err != nil {
+				return ""
+			}
+			return node.Options().Addr
+		}
+	case *redis.Ring:
+		opt := rdb.Options()
+		names := make([]string, 0, len(opt.Addrs))
+		for name := range opt.Addrs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		hash := opt.NewConsistentHash(names)
+		return func(key string) string {
+			return hash.Get(hashSlotKey(key))
+		}
+	default:
+		return nil
+	}
+}
+
+// hashSlotKey returns the part of key Redis hashes: the contents of its
+// first non-empty hash tag, or else the whole key.
+func hashSlotKey(key string) string {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			return key[start+1 : start+1+end]
+		}
+	}
+	return key
+}
+
+// execSharded runs the pipeline as one sub-pipeline per shard. It reports
+// false without running anything if the Limiter's client is not sharded or
+// every key lives on one shard.
+func (p *pipeline) execSharded(ctx context.Context) (bool, error) {
+	shardOf := p.l.shardOf(ctx)
+	if shardOf == nil {
+		return false, nil
+	}
+
+	parts := make(map[string]int)
+	var names []string
+	partOf := func(key string) int {
+		shard := shardOf(key)
+		i, ok := parts[shard]
+		if !ok {
+			i = len(parts)
+			parts[shard] = i
+			names = append(names, shard)
+		}
+		return i
+	}
+	ratePrefix := p.l.allowKeyPrefix(ctx)
+	rateParts := make(map[string]int, len(p.allowCommands))
+	for _, v := range p.allowCommands {
+		rateParts[v.Key] = partOf(ratePrefix + p.l.hashTagged(v.Key))
+	}
+	takeParts := make(map[string]int, len(p.takeCommands)+len(p.releaseCommands))
+	for _, v := range p.takeCommands {
+		takeParts[v.Key] = partOf(p.l.concurrencyKey(v.Key))
+	}
+	for _, v := range p.releaseCommands {
+		takeParts[v.A] = partOf(p.l.concurrencyKey(v.A))
+	}
+	if len(parts) < 2 {
+		return false, nil
+	}
+
+	return true, p.execSplit(ctx, len(parts), p.l.shardConcurrency,
+		func(key string) int { return rateParts[key] },
+		func(key string) int { return takeParts[key] },
+		names)
+}
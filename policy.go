@@ -0,0 +1,224 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Policy applies a Limit to the keys matching Pattern, optionally only
+// during a recurring Schedule. Policies are matched in order and the first
+// match wins.
+type Policy struct {
+	// Name identifies the policy in reports.
+	Name string
+
+	// Pattern is an exact key, or a prefix followed by "*" to match every key
+	// starting with that prefix. A lone "*" matches every key.
+	Pattern string
+
+	Limit Limit
+
+	// Schedule restricts when the policy applies. A nil Schedule always
+	// applies.
+	Schedule *Schedule
+}
+
+// Schedule is a recurring daily window in UTC.
+type Schedule struct {
+	// Days the window applies on. Empty means every day.
+	Days []time.Weekday
+
+	// Start and End are offsets from midnight UTC. The window is [Start, End)
+	// and must not cross midnight; use two policies for windows that do.
+	Start time.Duration
+	End   time.Duration
+}
+
+// Severity classifies a ConfigIssue.
+type Severity int
+
+const (
+	// SeverityWarning marks configuration that works but is likely a mistake.
+	SeverityWarning Severity = iota
+	// SeverityError marks configuration that cannot work as written.
+	SeverityError
+)
+
+func (s Severity) String() string {
+	if s == SeverityError {
+		return "error"
+	}
+	return "warning"
+}
+
+// ConfigIssue is a single problem found by VerifyConfig.
+type ConfigIssue struct {
+	Severity Severity
+
+	// Policy is the name of the policy with the problem.
+	Policy string
+
+	// Other is the name of the conflicting or shadowing policy, if any.
+	Other string
+
+	Message string
+}
+
+func (i ConfigIssue) String() string {
+	return fmt.Sprintf("%s: policy %q: %s", i.Severity, i.Policy, i.Message)
+}
+
+// ConfigReport is the result of VerifyConfig.
+type ConfigReport struct {
+	Issues []ConfigIssue
+}
+
+// Err returns an error describing every SeverityError issue, or nil if there
+// are none.
+func (r ConfigReport) Err() error {
+	var msgs []string
+	for _, issue := range r.Issues {
+		if issue.Severity == SeverityError {
+			msgs = append(msgs, issue.String())
+		}
+	}
+	if len(msgs) == 0 {
+		return nil
+	}
+	return errors.New("redis_rate: invalid policy config:\n" + strings.Join(msgs, "\n"))
+}
+
+// VerifyConfig checks a set of policies without contacting Redis. It reports
+// limits that can never allow a request, invalid schedules, policies with the
+// same pattern whose schedules overlap, and policies that can never match
+// because an earlier policy always matches first. It is intended to run in
+// CI before a policy set is deployed.
+func VerifyConfig(policies []Policy) ConfigReport {
+	report := ConfigReport{}
+	add := func(sev Severity, p Policy, other string, format string, args ...interface{}) {
+		report.Issues = append(report.Issues, ConfigIssue{
+			Severity: sev,
+			Policy:   p.Name,
+			Other:    other,
+			Message:  fmt.Sprintf(format, args...),
+		})
+	}
+
+	names := make(map[string]bool, len(policies))
+	for _, p := range policies {
+		if p.Name == "" {
+			add(SeverityWarning, p, "", "policy has no name")
+		} else if names[p.Name] {
+			add(SeverityError, p, "", "duplicate policy name")
+		}
+		names[p.Name] = true
+
+		if p.Pattern == "" {
+			add(SeverityError, p, "", "empty pattern")
+		} else if i := strings.Index(p.Pattern, "*"); i >= 0 && i != len(p.Pattern)-1 {
+			add(SeverityError, p, "", "wildcard is only supported at the end of a pattern")
+		}
+
+		if p.Limit.Rate < 1 {
+			add(SeverityError, p, "", "rate must be at least 1, got %d", p.Limit.Rate)
+		}
+		if p.Limit.Burst < 1 {
+			add(SeverityError, p, "", "burst must be at least 1, got %d", p.Limit.Burst)
+		}
+		if p.Limit.Period <= 0 {
+			add(SeverityError, p, "", "period must be positive, got %s", p.Limit.Period)
+		}
+
+		if s := p.Schedule; s != nil {
+			if s.Start < 0 || s.End > 24*time.Hour {
+				add(SeverityError, p, "", "schedule must be within a single day")
+			}
+			if s.Start >= s.End {
+				add(SeverityError, p, "", "schedule window is empty; split windows that cross midnight")
+			}
+			for _, d := range s.Days {
+				if d < time.Sunday || d > time.Saturday {
+					add(SeverityError, p, "", "invalid weekday %d", d)
+				}
+			}
+		}
+	}
+
+	for i, p := range policies {
+		for _, earlier := range policies[:i] {
+			if earlier.Pattern == p.Pattern && schedulesOverlap(earlier.Schedule, p.Schedule) && earlier.Limit != p.Limit {
+				add(SeverityError, p, earlier.Name, "conflicts with %q: same pattern and overlapping schedule with a different limit", earlier.Name)
+				continue
+			}
+			if patternCovers(earlier.Pattern, p.Pattern) && scheduleCovers(earlier.Schedule, p.Schedule) {
+				add(SeverityWarning, p, earlier.Name, "shadowed by %q, which always matches first", earlier.Name)
+			}
+		}
+	}
+
+	return report
+}
+
+// patternCovers reports whether every key matched by b is also matched by a.
+func patternCovers(a, b string) bool {
+	if a == b {
+		return true
+	}
+	if !strings.HasSuffix(a, "*") {
+		return false
+	}
+	return strings.HasPrefix(strings.TrimSuffix(b, "*"), strings.TrimSuffix(a, "*"))
+}
+
+func scheduleDays(s *Schedule) map[time.Weekday]bool {
+	days := make(map[time.Weekday]bool, 7)
+	if len(s.Days) == 0 {
+		for d := time.Sunday; d <= time.Saturday; d++ {
+			days[d] = true
+		}
+		return days
+	}
+	for _, d := range s.Days {
+		days[d] = true
+	}
+	return days
+}
+
+// schedulesOverlap reports whether a and b are ever active at the same time.
+func schedulesOverlap(a, b *Schedule) bool {
+	if a == nil || b == nil {
+		return true
+	}
+	if a.Start >= b.End || b.Start >= a.End {
+		return false
+	}
+	bDays := scheduleDays(b)
+	for d := range scheduleDays(a) {
+		if bDays[d] {
+			return true
+		}
+	}
+	return false
+}
+
+// scheduleCovers reports whether a is active whenever b is.
+func scheduleCovers(a, b *Schedule) bool {
+	if a == nil {
+		return true
+	}
+	if b == nil {
+		return false
+	}
+	if a.Start > b.Start || a.End < b.End {
+		return false
+	}
+	aDays := scheduleDays(a)
+	for d := range scheduleDays(b) {
+		if !aDays[d] {
+			return false
+		}
+	}
+	return true
+}
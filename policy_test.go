@@ -0,0 +1,62 @@
+package redis_rate_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ductone/redis_rate/v11"
+)
+
+func TestVerifyConfig(t *testing.T) {
+	business := &redis_rate.Schedule{
+		Days:  []time.Weekday{time.Monday, time.Tuesday},
+		Start: 9 * time.Hour,
+		End:   17 * time.Hour,
+	}
+	morning := &redis_rate.Schedule{
+		Days:  []time.Weekday{time.Monday},
+		Start: 9 * time.Hour,
+		End:   12 * time.Hour,
+	}
+
+	report := redis_rate.VerifyConfig([]redis_rate.Policy{
+		{Name: "tenant-a", Pattern: "tenant:a", Limit: redis_rate.PerSecond(10)},
+		{Name: "tenants", Pattern: "tenant:*", Limit: redis_rate.PerSecond(5)},
+		{Name: "tenant-a-2", Pattern: "tenant:a", Limit: redis_rate.PerSecond(20)},
+		{Name: "tenant-b", Pattern: "tenant:b", Limit: redis_rate.PerSecond(5)},
+		{Name: "ip-business", Pattern: "ip:*", Limit: redis_rate.PerMinute(100), Schedule: business},
+		{Name: "ip-morning", Pattern: "ip:*", Limit: redis_rate.PerMinute(50), Schedule: morning},
+		{Name: "broken", Pattern: "user:*:x", Limit: redis_rate.Limit{Rate: 1, Period: time.Second}},
+	})
+
+	byPolicy := map[string][]redis_rate.ConfigIssue{}
+	for _, issue := range report.Issues {
+		byPolicy[issue.Policy] = append(byPolicy[issue.Policy], issue)
+	}
+
+	require.Len(t, byPolicy["tenant-a"], 0)
+	require.Len(t, byPolicy["tenants"], 0)
+
+	require.Len(t, byPolicy["tenant-a-2"], 2)
+	require.Equal(t, redis_rate.SeverityError, byPolicy["tenant-a-2"][0].Severity)
+	require.Equal(t, "tenant-a", byPolicy["tenant-a-2"][0].Other)
+	require.Equal(t, redis_rate.SeverityWarning, byPolicy["tenant-a-2"][1].Severity)
+	require.Equal(t, "tenants", byPolicy["tenant-a-2"][1].Other)
+
+	require.Len(t, byPolicy["tenant-b"], 1)
+	require.Equal(t, "tenants", byPolicy["tenant-b"][0].Other)
+
+	require.Len(t, byPolicy["ip-morning"], 1)
+	require.Equal(t, redis_rate.SeverityError, byPolicy["ip-morning"][0].Severity)
+
+	require.Len(t, byPolicy["broken"], 2)
+	require.Error(t, report.Err())
+
+	report = redis_rate.VerifyConfig([]redis_rate.Policy{
+		{Name: "tenants", Pattern: "tenant:*", Limit: redis_rate.PerSecond(5)},
+	})
+	require.Empty(t, report.Issues)
+	require.NoError(t, report.Err())
+}
@@ -2,27 +2,94 @@ package redis_rate //nolint:revive // upstream used this name
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 )
 
+// ErrNoLimit is returned when a zero Limit is used and the Limiter has no
+// default limit.
+var ErrNoLimit = errors.New("redis_rate: zero limit and no default limit configured")
+
+// ErrCalendarLimit is returned by methods that do not support limits with a
+// Calendar.
+var ErrCalendarLimit = errors.New("redis_rate: calendar limits are not supported")
+
 type Limit struct {
 	Rate   int
 	Burst  int
 	Period time.Duration
+
+	// Calendar, if set, makes this a fixed window limit aligned to UTC
+	// calendar boundaries. See PerDay and PerMonth.
+	Calendar Calendar
+
+	// Penalty is the number of events charged to the key each time AllowN,
+	// AllowAtMost or a Pipeline denies a request, so callers that keep
+	// retrying without waiting for RetryAfter push their own reset time
+	// further out. It is ignored by calendar and multi-key limits.
+	Penalty int
+
+	// WarmUp, if set, ramps the rate of a key up linearly from WarmUpRate
+	// to Rate over this long after the key is first seen, with the burst
+	// scaled along, to protect cold backends from a new tenant or a
+	// recovered service. When the key was first seen is kept in Redis until
+	// the warm-up ends, and a warm key left unused until its state expires
+	// starts over. It is honored by AllowN, AllowAtMost, AllowCost and
+	// Pipeline allows, and ignored by calendar and multi-key limits and by
+	// local caches and fallbacks, which apply the full rate.
+	WarmUp time.Duration
+
+	// WarmUpRate is the rate a warming key starts at, in events per Period.
+	// It defaults to 1.
+	WarmUpRate int
 }
 
 func (l Limit) String() string {
-	return fmt.Sprintf("%d req/%s (burst %d)", l.Rate, fmtDur(l.Period), l.Burst)
+	if l.Calendar != CalendarNone {
+		return fmt.Sprintf("%d req/%s (UTC)", l.Rate, l.Calendar)
+	}
+	s := fmt.Sprintf("%d req/%s (burst %d", l.Rate, fmtDur(l.Period), l.Burst)
+	if l.Penalty > 0 {
+		s += fmt.Sprintf(", penalty %d", l.Penalty)
+	}
+	if l.WarmUp > 0 {
+		s += fmt.Sprintf(", warmup %s", l.WarmUp)
+	}
+	if l.WarmUpRate > 0 {
+		s += fmt.Sprintf(", from %d", l.WarmUpRate)
+	}
+	return s + ")"
+}
+
+// warmUpRate returns the rate a warming key starts at.
+func (l Limit) warmUpRate() int {
+	if l.WarmUpRate > 0 {
+		return l.WarmUpRate
+	}
+	return 1
 }
 
 func (l Limit) IsZero() bool {
 	return l == Limit{}
 }
 
+// LimitProvider resolves the Limit for a key, typically from a registry of
+// per-tenant configuration.
+type LimitProvider interface {
+	Limit(ctx context.Context, key string) (Limit, error)
+}
+
+// LimitProviderFunc adapts an ordinary function to a LimitProvider.
+type LimitProviderFunc func(ctx context.Context, key string) (Limit, error)
+
+func (f LimitProviderFunc) Limit(ctx context.Context, key string) (Limit, error) {
+	return f(ctx, key)
+}
+
 func fmtDur(d time.Duration) string {
 	switch d {
 	case time.Second:
@@ -67,6 +134,55 @@ type Limiter struct {
 	rdb              RedisClientConn
 	ratePrefix       string
 	concurrentPrefix string
+	hooks            []Hooks
+	tracer           Tracer
+	defaultLimit     Limit
+	fallbackPolicy   FallbackPolicy
+	fallbackProbe    time.Duration
+	fallback         *fallback
+	clock            Clock
+	requestIDKey     []byte
+	limitStore       *LimitStore
+	epoch            *epoch
+	audit            *AuditLog
+	readOnly         bool
+	classifier       Classifier
+	hashTag          func(key string) string
+	batcher          *batcher
+	tokenCache       *tokenCache
+	denials          *denialCache
+	decisions        *decisionCache
+	retry            *retryPolicy
+	recoverPanics    bool
+	shares           *rateShares
+	shedder          *shedder
+	storage          StorageFormat
+	keyTTLFactor     float64
+	keyMaxTTL        time.Duration
+	top              *windowCounter
+	fairness         *windowCounter
+	stats            limiterStats
+	scriptWatcher    atomic.Pointer[ScriptWatcher]
+	shadow           bool
+	killSwitch       func(ctx context.Context) bool
+	boosts           bool
+	bans             *BanPolicy
+	freezes          bool
+	functions        *functionsBackend
+
+	pipelineBatchSize    int
+	pipelineConcurrency  int
+	pipelineAllOrNothing bool
+	pipelineSharding     bool
+	shardConcurrency     int
+}
+
+// limitOrDefault returns limit, or the Limiter's default limit if it is zero.
+func (l *Limiter) limitOrDefault(limit Limit) Limit {
+	if limit.IsZero() {
+		return l.defaultLimit
+	}
+	return limit
 }
 
 // Allow is a shortcut for AllowN(ctx, key, limit, 1).
@@ -74,49 +190,70 @@ func (l *Limiter) Allow(ctx context.Context, key string, limit Limit) (*Result,
 	return l.AllowN(ctx, key, limit, 1)
 }
 
-func (p *pipeline) allowPipe(ctx context.Context, pipe redis.Pipeliner, rv *Result) func() error {
-	values := []interface{}{rv.Limit.Burst, rv.Limit.Rate, rv.Limit.Period.Seconds(), int(1)}
-	p.buf.Reset()
-	_, _ = p.buf.WriteString(p.l.ratePrefix)
-	_, _ = p.buf.WriteString(rv.Key)
+// allowPipe queues an allow of rv on pipe and returns its command, to be
+// decoded by finishAllow.
+func (p *pipeline) allowPipe(ctx context.Context, pipe redis.Pipeliner, args *scriptArgs, rv *Result) *redis.Cmd {
+	script := allowN
+	args.begin().key(p.l.allowKeyPrefix(ctx), p.l.hashTagged(rv.Key))
+	if rv.Limit.Calendar != CalendarNone {
+		script = allowFixedWindow
+		p.l.fixedWindowArgs(args, rv.Limit, 1, false)
+		p.l.freezeArgs(ctx, args, script, rv.Key)
+	} else {
+		p.l.allowArgs(args, rv.Limit, 1)
+		p.l.allowExtraArgs(ctx, args, script, rv.Key, rv.Limit)
+		p.l.storageArgs(args, script)
+		p.l.warmUpArgs(args, script, rv.Limit)
+	}
 
-	eval := allowN.EvalSha(
+	return p.l.evalSha(
 		ctx,
 		pipe,
-		[]string{p.buf.String()},
-		values...,
+		script,
+		args.keys,
+		args.args...,
 	)
-
-	return func() error {
-		v, err := eval.Result()
-		if err != nil {
-			return err
-		}
-		values := v.([]interface{})
-		err = rv.parseScriptResult(values)
-		if err != nil {
-			return err
-		}
-		return nil
-	}
 }
 
-func (rv *Result) parseScriptResult(values []interface{}) error {
-	retryAfter, err := strconv.ParseFloat(values[2].(string), 64)
-	if err != nil {
+// finishAllow fills in rv from cmd, queued by allowPipe.
+func (p *pipeline) finishAllow(ctx context.Context, cmd *redis.Cmd, rv *Result) error {
+	reply := replyOf(cmd)
+	if err := rv.parseScriptResult(&reply); err != nil {
+		rv.Err = err
 		return err
 	}
-
-	resetAfter, err := strconv.ParseFloat(values[3].(string), 64)
-	if err != nil {
-		return err
+	if p.l.shadowed(ctx) {
+		rv.grantShadow(1)
 	}
+	rv.stamp(p.l.now(), p.l.now)
+	return nil
+}
 
-	rv.Allowed = values[0].(int64)
-	rv.Remaining = values[1].(int64)
-	rv.Used = 0
-	rv.RetryAfter = dur(retryAfter)
-	rv.ResetAfter = dur(resetAfter)
+// parseScriptResult fills in rv from the reply of a GCRA or fixed window
+// script.
+func (rv *Result) parseScriptResult(reply *scriptReply) error {
+	rv.Allowed = reply.int(0)
+	rv.Remaining = reply.int(1)
+	rv.RetryAfter = reply.seconds(2)
+	rv.ResetAfter = reply.seconds(3)
+	rv.Used = reply.optInt(4)
+	rv.Boosted = reply.optInt(5)
+	denied := reply.optInt(6)
+	if reply.err != nil {
+		return reply.err
+	}
+	rv.Banned = denied == 1
+	rv.Frozen = denied == 2
+	switch {
+	case rv.Banned:
+		rv.Reason = ReasonBanned
+	case rv.Frozen:
+		rv.Reason = ReasonFrozen
+	case denied == 3:
+		rv.Reason = ReasonExceedsLimit
+	default:
+		rv.Reason = ""
+	}
 	return nil
 }
 
@@ -127,55 +264,385 @@ func (l *Limiter) AllowN(
 	limit Limit,
 	n int,
 ) (*Result, error) {
-	values := []interface{}{limit.Burst, limit.Rate, limit.Period.Seconds(), n}
-	v, err := allowN.Run(ctx, l.rdb, []string{l.ratePrefix + key}, values...).Result()
+	return l.allow(ctx, OpAllowN, allowN, key, limit, n)
+}
+
+// AllowAtMost reports whether at most n events may happen at time now.
+// It returns number of allowed events that is less than or equal to n.
+func (l *Limiter) AllowAtMost(
+	ctx context.Context,
+	key string,
+	limit Limit,
+	n int,
+) (*Result, error) {
+	return l.allow(ctx, OpAllowAtMost, allowAtMost, key, limit, n)
+}
+
+func (l *Limiter) allow(
+	ctx context.Context,
+	op Operation,
+	script *redis.Script,
+	key string,
+	limit Limit,
+	n int,
+) (_ *Result, err error) {
+	defer l.recoverPanic(op, key, &err)
+	ctx, key, limit = l.classify(ctx, key, limit)
+	ctx, span := l.startSpan(ctx, op)
+	defer span.End()
+
+	if limit.IsZero() {
+		traceAllow(span, key, limit, nil, ErrNoLimit)
+		return nil, ErrNoLimit
+	}
+
+	if l.top != nil {
+		l.top.record("", key, int64(n))
+	}
+	start := time.Now()
+	atMost := script == allowAtMost
+	var rv *Result
+	if l.killed(ctx) {
+		rv = &Result{Key: key, Limit: limit}
+		rv.kill()
+		rv.stamp(l.now(), l.now)
+	} else if l.readOnly {
+		rv = &Result{Key: key, Limit: limit}
+		err = l.peek(ctx, []*Result{rv}, n, atMost)
+	} else if l.fallback != nil && l.fallback.bypass() {
+		rv = l.fallback.allow(key, limit, n, atMost)
+	} else if l.shedder.shouldShed() {
+		rv = l.shedder.allow(key, limit, n, l.now)
+		l.onShed(ctx, op, key, n, rv)
+	} else if l.shadowed(ctx) {
+		rv, err = l.runAllow(ctx, script, key, limit, n)
+		if err == nil {
+			rv.grantShadow(n)
+		}
+	} else if rv = l.denials.lookup(ctx, key, limit, denialSize(n, atMost)); rv == nil {
+		if l.shares.cacheable(key, limit) {
+			rv, err = l.shares.allow(ctx, key, limit, n, atMost)
+		} else if l.decisions.cacheable(key, limit, n, atMost) {
+			rv, err = l.decisions.allow(ctx, key, limit, n)
+		} else if l.tokenCache.cacheable(key, limit, n, atMost) {
+			rv, err = l.tokenCache.allow(ctx, key, limit, n)
+		} else if l.batcher.batchable(limit, n, atMost) {
+			rv, err = l.batcher.allow(ctx, key, limit)
+		} else {
+			rv, err = l.runAllow(ctx, script, key, limit, n)
+		}
+		if err == nil {
+			l.denials.record(ctx, rv, denialSize(n, atMost))
+		}
+		if l.fallback != nil && isUnavailable(ctx, err) {
+			l.fallback.markDown()
+			rv, err = l.fallback.allow(key, limit, n, atMost), nil
+		}
+	}
+	l.onAllow(ctx, op, key, n, rv, start, err)
+	traceAllow(span, key, limit, rv, err)
 	if err != nil {
 		return nil, err
 	}
+	return rv, nil
+}
 
-	values = v.([]interface{})
+func (l *Limiter) runAllow(
+	ctx context.Context,
+	script *redis.Script,
+	key string,
+	limit Limit,
+	n int,
+) (*Result, error) {
+	if limit.Calendar != CalendarNone {
+		return l.runFixedWindow(ctx, key, limit, n, script == allowAtMost)
+	}
+
+	args := getScriptArgs()
+	args.key(l.allowKeyPrefix(ctx), l.hashTagged(key))
+	l.allowArgs(args, limit, n)
+	l.allowExtraArgs(ctx, args, script, key, limit)
+	l.storageArgs(args, script)
+	l.warmUpArgs(args, script, limit)
+	l.freezeArgs(ctx, args, script, key)
+	reply := replyOf(l.runScript(ctx, script, args.keys, args.args...))
+	args.release()
 
 	rv := &Result{
 		Key:   key,
 		Limit: limit,
 	}
-	err = rv.parseScriptResult(values)
-	if err != nil {
+	if err := rv.parseScriptResult(&reply); err != nil {
 		return nil, err
 	}
+	rv.stamp(l.now(), l.now)
 	return rv, nil
 }
 
-// AllowAtMost reports whether at most n events may happen at time now.
-// It returns number of allowed events that is less than or equal to n.
-func (l *Limiter) AllowAtMost(
+// allowArgs appends the arguments of the GCRA scripts.
+func (l *Limiter) allowArgs(args *scriptArgs, limit Limit, n int) {
+	args.int(int64(limit.Burst)).
+		int(int64(limit.Rate)).
+		float(limit.Period.Seconds()).
+		int(int64(n)).
+		str(l.scriptNow()).
+		int(int64(limit.Penalty))
+}
+
+// allowExtraArgs appends the keys and arguments of the boost tokens and ban
+// of key to a call of script with limit, if the Limiter uses them.
+func (l *Limiter) allowExtraArgs(ctx context.Context, args *scriptArgs, script *redis.Script, key string, limit Limit) {
+	if !l.extendedAllows() || script != allowN || limit.Calendar != CalendarNone {
+		return
+	}
+	args.int(0)
+	if l.boosts {
+		args.int(1)
+		l.boostKey(ctx, args, key)
+	} else {
+		args.int(0)
+	}
+	if l.bans != nil {
+		l.banArgs(ctx, args, key)
+	} else {
+		args.str("").str("").str("")
+	}
+	if l.freezes {
+		args.int(1)
+		l.frozenKey(ctx, args, key)
+	}
+}
+
+// extendedAllows reports whether allows spend boost tokens or check bans or
+// freezes, which local caches cannot do.
+func (l *Limiter) extendedAllows() bool {
+	return l.boosts || l.bans != nil || l.freezes
+}
+
+// KeyLimit pairs a key with the Limit applied to it.
+type KeyLimit struct {
+	Key   string
+	Limit Limit
+}
+
+// AllowAtMostMulti takes up to n events spread across limits in order,
+// atomically. Each key is drained as far as it allows before the next key is
+// consulted, so a tenant budget can spill over into a shared overflow pool.
+//
+// The returned results are in the same order as limits and each Result's
+// Allowed reports how many events were taken from that key. The total number
+// of allowed events is the sum over all results and is at most n.
+//
+// All keys are evaluated in one script, so on Redis Cluster they must hash to
+// the same slot.
+func (l *Limiter) AllowAtMostMulti(
+	ctx context.Context,
+	limits []KeyLimit,
+	n int,
+) ([]*Result, error) {
+	return l.allowMulti(ctx, limits, n, multiAtMost)
+}
+
+// OverflowResult is the outcome of AllowNWithOverflow.
+type OverflowResult struct {
+	// Primary is the result for the primary key.
+	Primary *Result
+
+	// Overflow is the result for the shared pool key.
+	Overflow *Result
+}
+
+// Allowed is the total number of events allowed across both keys.
+func (r *OverflowResult) Allowed() int64 {
+	return r.Primary.Allowed + r.Overflow.Allowed
+}
+
+// AllowNWithOverflow reports whether n events may happen at time now, taking
+// them from key first and only drawing the shortfall from the shared pool
+// once key is exhausted. Both keys are evaluated in one script, so events are
+// granted in full or not at all and never charged twice under contention.
+//
+// Both keys must hash to the same slot on Redis Cluster.
+func (l *Limiter) AllowNWithOverflow(
 	ctx context.Context,
 	key string,
 	limit Limit,
+	overflow KeyLimit,
 	n int,
-) (*Result, error) {
-	values := []interface{}{limit.Burst, limit.Rate, limit.Period.Seconds(), n}
-	v, err := allowAtMost.Run(ctx, l.rdb, []string{l.ratePrefix + key}, values...).Result()
+) (*OverflowResult, error) {
+	res, err := l.allowMulti(ctx, []KeyLimit{{Key: key, Limit: limit}, overflow}, n, multiOverflow)
 	if err != nil {
 		return nil, err
 	}
+	return &OverflowResult{
+		Primary:  res[0],
+		Overflow: res[1],
+	}, nil
+}
 
-	values = v.([]interface{})
+// AllowHierarchy reports whether n events may happen at time now on every
+// level of a hierarchy of keys, such as an organization and one of its
+// users. levels are ordered from the outermost parent to the most specific
+// child. The events are taken from every level in a single script, or from
+// none of them if any level is exhausted, so a denied child never consumes
+// its parent's budget and vice versa.
+//
+// The returned results are in the same order as levels, and either all of
+// them or none of them have Allowed set to n. The RetryAfter of a denied
+// result is -1 for levels that were not exhausted.
+//
+// All keys must hash to the same slot on Redis Cluster, for example by
+// sharing a hash tag such as "{org:123}" and "{org:123}:user:456".
+func (l *Limiter) AllowHierarchy(
+	ctx context.Context,
+	levels []KeyLimit,
+	n int,
+) ([]*Result, error) {
+	return l.allowMulti(ctx, levels, n, multiHierarchy)
+}
 
-	rv := &Result{
-		Key:   key,
-		Limit: limit,
+// multiMode selects how script_allow_multi.lua spreads events over its keys.
+type multiMode int
+
+const (
+	// multiSpill takes as many events as are available, draining each key
+	// before moving to the next.
+	multiSpill multiMode = iota
+
+	// multiSpillAllOrNothing is multiSpill, but denies unless all n events
+	// can be taken.
+	multiSpillAllOrNothing
+
+	// multiEach takes n events from every key, or none from any of them.
+	multiEach
+)
+
+// multiOp describes a Limiter method built on script_allow_multi.lua.
+type multiOp struct {
+	op     Operation
+	method string
+	mode   multiMode
+}
+
+var (
+	multiAtMost     = multiOp{OpAllowAtMostMulti, "AllowAtMostMulti", multiSpill}
+	multiOverflow   = multiOp{OpAllowNWithOverflow, "AllowNWithOverflow", multiSpillAllOrNothing}
+	multiHierarchy  = multiOp{OpAllowHierarchy, "AllowHierarchy", multiEach}
+	multiDimensions = multiOp{OpAllowDimensions, "AllowDimensions", multiEach}
+	multiTiered     = multiOp{OpAllowTiered, "AllowTiered", multiEach}
+)
+
+func (l *Limiter) allowMulti(
+	ctx context.Context,
+	limits []KeyLimit,
+	n int,
+	mo multiOp,
+) (_ []*Result, err error) {
+	defer l.recoverPanic(mo.op, "", &err)
+	if len(limits) == 0 {
+		return nil, nil
 	}
-	err = rv.parseScriptResult(values)
-	if err != nil {
+	if err := l.checkWritable(mo.method); err != nil {
 		return nil, err
 	}
+	shadow := l.shadowed(ctx)
+	if shadow && mo.mode != multiEach {
+		return nil, ErrShadowUnsupported
+	}
+
+	keys := make([]string, 0, len(limits))
+	values := make([]interface{}, 0, 3+3*len(limits))
+	values = append(values, n, int(mo.mode), l.scriptNow())
+	limits = append([]KeyLimit(nil), limits...)
+	// tags holds the tags the Classifier added to each key, for its hooks.
+	tags := make([][]Tag, len(limits))
+	prefix := l.allowKeyPrefix(ctx)
+	for i, kl := range limits {
+		tags[i], kl.Key, kl.Limit = l.classifyTags(ctx, kl.Key, kl.Limit)
+		if kl.Limit.IsZero() {
+			return nil, ErrNoLimit
+		}
+		if kl.Limit.Calendar != CalendarNone {
+			return nil, ErrCalendarLimit
+		}
+		limits[i] = kl
+		keys = append(keys, prefix+l.hashTagged(kl.Key))
+		values = append(values, kl.Limit.Burst, kl.Limit.Rate, kl.Limit.Period.Seconds())
+	}
+	values = l.storageValues(values)
+
+	op := mo.op
+	ctx, span := l.startSpan(ctx, op)
+	defer span.End()
+	span.SetAttributes(Attribute{AttrKeyCount, len(limits)})
+
+	start := time.Now()
+	killed := l.killed(ctx)
+	var rows scriptReply
+	if !killed {
+		rows = replyOf(l.runScript(ctx, allowMulti, keys, values...))
+		if err := rows.err; err != nil {
+			l.onAllow(WithTags(ctx, tags[0]...), op, limits[0].Key, n, nil, start, err)
+			span.RecordError(err)
+			return nil, err
+		}
+	}
+
+	rv := make([]*Result, 0, len(limits))
+	allowed := int64(0)
+	for i, kl := range limits {
+		res := &Result{
+			Key:   kl.Key,
+			Limit: kl.Limit,
+		}
+		if killed {
+			res.kill()
+		} else {
+			row := rows.row(i)
+			if err := res.parseScriptResult(&row); err != nil {
+				l.onAllow(WithTags(ctx, tags[i]...), op, kl.Key, n, nil, start, err)
+				span.RecordError(err)
+				return nil, err
+			}
+			if shadow {
+				res.grantShadow(n)
+			}
+		}
+		res.stamp(l.now(), l.now)
+		l.onAllow(WithTags(ctx, tags[i]...), op, kl.Key, n, res, start, nil)
+		allowed += res.Allowed
+		rv = append(rv, res)
+	}
+	span.SetAttributes(Attribute{AttrAllowed, allowed})
+	if f := l.fairness; f != nil && !shadow && !killed {
+		switch mo {
+		case multiHierarchy:
+			for i := 1; i < len(rv); i++ {
+				f.record(rv[i-1].Key, rv[i].Key, rv[i].Allowed)
+			}
+		case multiOverflow:
+			f.record(rv[1].Key, rv[0].Key, rv[1].Allowed)
+		}
+	}
 	return rv, nil
 }
 
 // Reset gets a key and reset all limitations and previous usages.
 func (l *Limiter) Reset(ctx context.Context, key string) error {
-	return l.rdb.Del(ctx, l.ratePrefix+key).Err()
+	if err := l.checkWritable("Reset"); err != nil {
+		return err
+	}
+	l.forgetLocal(key)
+	return l.rdb.Del(ctx, l.rateKey(ctx, key)).Err()
+}
+
+// forgetLocal drops what the Limiter's local caches hold for key, so the next
+// call for it goes to Redis.
+func (l *Limiter) forgetLocal(key string) {
+	l.denials.forget(key)
+	l.decisions.forget(key)
+	l.shares.forget(key)
+	l.tokenCache.forget(key)
 }
 
 func dur(f float64) time.Duration {
@@ -196,6 +663,7 @@ type Result struct {
 	Allowed int64
 
 	// Used is the number of events that have already happened at time now.
+	// It is only reported for calendar limits and by Usage.
 	Used int64
 
 	// Remaining is the maximum number of requests that could be
@@ -215,4 +683,106 @@ type Result struct {
 	// Reset would return 800ms. You can also think of this as the time
 	// until Limit and Remaining will be equal.
 	ResetAfter time.Duration
+
+	// Fallback is true when Redis was unavailable and the result was
+	// produced by the Limiter's FallbackPolicy.
+	Fallback bool
+
+	// Grace is true when the request exceeded a limit that is still in its
+	// grace period and was allowed anyway. See AllowDynamic.
+	Grace bool
+
+	// Shed is true when Redis was skipped to shed load and every event
+	// requested was allowed. See WithLoadShedding.
+	Shed bool
+
+	// Err is set when this allow failed in a Pipeline whose other
+	// operations may have succeeded. See PipelineError.
+	Err error
+
+	// ResetAt is when the key returns to its initial state, which is
+	// ResetAfter after the result was received.
+	ResetAt time.Time
+
+	// Cost is the fractional cost charged by AllowCost, or 0 if the request
+	// was denied, and RemainingCost the fractional capacity left, of which
+	// Remaining is the whole part. Both are 0 for other methods.
+	Cost          float64
+	RemainingCost float64
+
+	// Shadow is true when the limit was evaluated in shadow mode, see
+	// WithShadow, so every event requested is allowed. ShadowAllowed is
+	// then the number of events the limit would have allowed.
+	Shadow        bool
+	ShadowAllowed int64
+
+	// Boosted is the number of boost tokens spent on the request. See
+	// WithBoosts.
+	Boosted int64
+
+	// Banned is true when the request was denied because the key is banned,
+	// see WithBans. RetryAfter is then the time until the ban ends.
+	Banned bool
+
+	// Frozen is true when the request was denied because the key is frozen,
+	// see WithFreezes. RetryAfter is then -1, as it is not known when the key
+	// will be unfrozen.
+	Frozen bool
+
+	// Reason is why the request was denied, or empty if any event requested
+	// was allowed.
+	Reason Reason
+
+	// at is when the result was received, which RetryAfter and ResetAfter
+	// are relative to, by the clock now reads.
+	at  time.Time
+	now func() time.Time
+}
+
+// stamp records that the result was received at at, as read by now, once
+// ResetAfter is known, and gives a denial without a more specific Reason
+// ReasonRateExceeded.
+func (r *Result) stamp(at time.Time, now func() time.Time) {
+	r.at = at
+	r.now = now
+	r.ResetAt = at.Add(r.ResetAfter)
+	if r.Reason == "" && r.Allowed == 0 && r.RetryAfter >= 0 {
+		r.Reason = ReasonRateExceeded
+	}
+}
+
+// RetryAt returns the time at which the next request will be permitted, or
+// the zero Time if the rate limit has not been exceeded.
+func (r *Result) RetryAt() time.Time {
+	if r.RetryAfter < 0 {
+		return time.Time{}
+	}
+	return r.at.Add(r.RetryAfter)
+}
+
+// RetryWithin returns how long the caller has to wait before retrying and
+// whether it can do so before ctx's deadline. It is useful for deciding
+// between waiting inline and responding with 429 and a Retry-After header.
+// A ctx without a deadline can always wait.
+//
+// The wait is measured on the clock of the Limiter that returned the
+// result, see WithClock, while the deadline is on the wall clock.
+func (r *Result) RetryWithin(ctx context.Context) (time.Duration, bool) {
+	retryAt := r.RetryAt()
+	if retryAt.IsZero() {
+		return 0, true
+	}
+	now := time.Now
+	if r.now != nil {
+		now = r.now
+	}
+	wait := retryAt.Sub(now())
+	if wait < 0 {
+		wait = 0
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return wait, true
+	}
+	return wait, !time.Now().Add(wait).After(deadline)
 }
@@ -2,8 +2,15 @@ package redis_rate_test
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -13,7 +20,7 @@ import (
 	"github.com/ductone/redis_rate/v11"
 )
 
-func newTestLimiter(t require.TestingT, loadScripts bool) *redis_rate.Limiter {
+func newTestRing() *redis.Ring {
 	redisHost := os.Getenv("TEST_REDIS_HOST")
 	redisPort := os.Getenv("TEST_REDIS_PORT")
 	if redisHost == "" {
@@ -22,9 +29,13 @@ func newTestLimiter(t require.TestingT, loadScripts bool) *redis_rate.Limiter {
 	if redisPort == "" {
 		redisPort = "6379"
 	}
-	ring := redis.NewRing(&redis.RingOptions{
+	return redis.NewRing(&redis.RingOptions{
 		Addrs: map[string]string{"server0": net.JoinHostPort(redisHost, redisPort)},
 	})
+}
+
+func newTestLimiter(t require.TestingT, loadScripts bool, options ...func(*redis_rate.Limiter)) *redis_rate.Limiter {
+	ring := newTestRing()
 	if err := ring.FlushDB(context.TODO()).Err(); err != nil {
 		require.NoError(t, err)
 	}
@@ -32,7 +43,7 @@ func newTestLimiter(t require.TestingT, loadScripts bool) *redis_rate.Limiter {
 		require.NoError(t, err)
 	}
 
-	ll := redis_rate.New(ring)
+	ll := redis_rate.New(ring, options...)
 
 	if loadScripts {
 		if err := ll.LoadScripts(context.Background()); err != nil {
@@ -252,6 +263,7 @@ func BenchmarkAllow(b *testing.B) {
 	l := newTestLimiter(b, true)
 	limit := redis_rate.PerSecond(1e6)
 
+	b.ReportAllocs()
 	b.ResetTimer()
 
 	b.RunParallel(func(pb *testing.PB) {
@@ -272,6 +284,7 @@ func BenchmarkAllowAtMost(b *testing.B) {
 	l := newTestLimiter(b, true)
 	limit := redis_rate.PerSecond(1e6)
 
+	b.ReportAllocs()
 	b.ResetTimer()
 
 	b.RunParallel(func(pb *testing.PB) {
@@ -297,6 +310,7 @@ func BenchmarkAllowMulti(b *testing.B) {
 		"ip:123.123.123.200/hour":              redis_rate.PerHour(1e6),
 	}
 
+	b.ReportAllocs()
 	b.ResetTimer()
 
 	b.RunParallel(func(pb *testing.PB) {
@@ -318,3 +332,2364 @@ func BenchmarkAllowMulti(b *testing.B) {
 		}
 	})
 }
+
+// cannedRediser replies to every command with the reply of an allowed
+// GCRA request, so pipelines can be benchmarked without a Redis server.
+type cannedRediser struct{}
+
+func (cannedRediser) Do(ctx context.Context, args ...interface{}) (interface{}, error) {
+	return []interface{}{int64(1), int64(9), "-1", "0.1"}, nil
+}
+
+func (r cannedRediser) DoMulti(ctx context.Context, cmds ...[]interface{}) ([]interface{}, []error) {
+	replies := make([]interface{}, len(cmds))
+	for i, args := range cmds {
+		replies[i], _ = r.Do(ctx, args...)
+	}
+	return replies, make([]error, len(cmds))
+}
+
+func BenchmarkPipelineExec(b *testing.B) {
+	ctx := context.Background()
+	l := redis_rate.New(redis_rate.NewRediserConn(cannedRediser{}))
+	limit := redis_rate.PerSecond(1e6)
+	keys := make([]string, 100)
+	for i := range keys {
+		keys[i] = "key" + strconv.Itoa(i)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p := l.Pipeline()
+		for _, key := range keys {
+			p.Allow(ctx, key, limit)
+		}
+		if err := p.Exec(ctx); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestAllowLazy(t *testing.T) {
+	ctx := context.Background()
+	l := newTestLimiter(t, true)
+
+	limits := map[string]redis_rate.Limit{
+		"tenant:a": redis_rate.PerSecond(10),
+		"tenant:b": redis_rate.PerMinute(5),
+	}
+	provider := redis_rate.LimitProviderFunc(func(ctx context.Context, key string) (redis_rate.Limit, error) {
+		return limits[key], nil
+	})
+
+	p := l.Pipeline()
+	a := p.AllowLazy(ctx, "tenant:a", provider)
+	b := p.AllowLazy(ctx, "tenant:b", provider)
+	err := p.Exec(ctx)
+	require.Nil(t, err)
+
+	require.Equal(t, limits["tenant:a"], a.Limit)
+	require.Equal(t, int64(1), a.Allowed)
+	require.Equal(t, int64(9), a.Remaining)
+	require.Equal(t, int64(1), b.Allowed)
+	require.Equal(t, int64(4), b.Remaining)
+
+	// A key without a limit uses the default limit, as with Allow.
+	l = newTestLimiter(t, true, redis_rate.WithDefaultLimit(redis_rate.PerSecond(3)))
+	p = l.Pipeline()
+	c := p.AllowLazy(ctx, "tenant:c", provider)
+	require.NoError(t, p.Exec(ctx))
+	require.Equal(t, redis_rate.PerSecond(3), c.Limit)
+	require.Equal(t, int64(1), c.Allowed)
+	require.Equal(t, int64(2), c.Remaining)
+}
+
+func TestAllowLazyNoLimit(t *testing.T) {
+	ctx := context.Background()
+	l := newUnreachableLimiter()
+	provider := redis_rate.LimitProviderFunc(func(ctx context.Context, key string) (redis_rate.Limit, error) {
+		return redis_rate.Limit{}, nil
+	})
+
+	p := l.Pipeline()
+	p.AllowLazy(ctx, "tenant:c", provider)
+	require.ErrorIs(t, p.Exec(ctx), redis_rate.ErrNoLimit)
+}
+
+func TestAllowAtMostMulti(t *testing.T) {
+	ctx := context.Background()
+	l := newTestLimiter(t, true)
+
+	limits := []redis_rate.KeyLimit{
+		{Key: "tenant", Limit: redis_rate.PerSecond(5)},
+		{Key: "overflow", Limit: redis_rate.PerSecond(10)},
+	}
+
+	res, err := l.AllowAtMostMulti(ctx, limits, 3)
+	require.Nil(t, err)
+	require.Len(t, res, 2)
+	require.Equal(t, int64(3), res[0].Allowed)
+	require.Equal(t, int64(2), res[0].Remaining)
+	require.Equal(t, int64(0), res[1].Allowed)
+	require.Equal(t, int64(10), res[1].Remaining)
+
+	res, err = l.AllowAtMostMulti(ctx, limits, 6)
+	require.Nil(t, err)
+	require.Equal(t, int64(2), res[0].Allowed)
+	require.Equal(t, int64(0), res[0].Remaining)
+	require.Equal(t, int64(4), res[1].Allowed)
+	require.Equal(t, int64(6), res[1].Remaining)
+
+	res, err = l.AllowAtMostMulti(ctx, limits, 20)
+	require.Nil(t, err)
+	require.Equal(t, int64(0), res[0].Allowed)
+	require.Greater(t, res[0].RetryAfter, time.Duration(0))
+	require.Equal(t, int64(6), res[1].Allowed)
+	require.Equal(t, int64(0), res[1].Remaining)
+}
+
+func TestAllowNWithOverflow(t *testing.T) {
+	ctx := context.Background()
+	l := newTestLimiter(t, true)
+
+	limit := redis_rate.PerSecond(5)
+	pool := redis_rate.KeyLimit{Key: "pool", Limit: redis_rate.PerSecond(10)}
+
+	res, err := l.AllowNWithOverflow(ctx, "tenant", limit, pool, 4)
+	require.Nil(t, err)
+	require.Equal(t, int64(4), res.Allowed())
+	require.Equal(t, int64(4), res.Primary.Allowed)
+	require.Equal(t, int64(0), res.Overflow.Allowed)
+
+	res, err = l.AllowNWithOverflow(ctx, "tenant", limit, pool, 3)
+	require.Nil(t, err)
+	require.Equal(t, int64(3), res.Allowed())
+	require.Equal(t, int64(1), res.Primary.Allowed)
+	require.Equal(t, int64(2), res.Overflow.Allowed)
+	require.Equal(t, int64(8), res.Overflow.Remaining)
+
+	// Not enough left in the pool, so nothing is charged.
+	res, err = l.AllowNWithOverflow(ctx, "tenant", limit, pool, 9)
+	require.Nil(t, err)
+	require.Equal(t, int64(0), res.Allowed())
+	require.Equal(t, int64(8), res.Overflow.Remaining)
+	require.Greater(t, res.Overflow.RetryAfter, time.Duration(0))
+}
+
+func TestAllowHierarchy(t *testing.T) {
+	ctx := context.Background()
+	l := newTestLimiter(t, true)
+
+	levels := []redis_rate.KeyLimit{
+		{Key: "{org:123}", Limit: redis_rate.PerSecond(5)},
+		{Key: "{org:123}:user:456", Limit: redis_rate.PerSecond(3)},
+	}
+
+	res, err := l.AllowHierarchy(ctx, levels, 2)
+	require.Nil(t, err)
+	require.Len(t, res, 2)
+	require.Equal(t, int64(2), res[0].Allowed)
+	require.Equal(t, int64(3), res[0].Remaining)
+	require.Equal(t, int64(2), res[1].Allowed)
+	require.Equal(t, int64(1), res[1].Remaining)
+
+	// The user is exhausted, so the org is not charged either.
+	res, err = l.AllowHierarchy(ctx, levels, 2)
+	require.Nil(t, err)
+	require.Equal(t, int64(0), res[0].Allowed)
+	require.Equal(t, int64(3), res[0].Remaining)
+	require.Equal(t, time.Duration(-1), res[0].RetryAfter)
+	require.Equal(t, int64(0), res[1].Allowed)
+	require.Greater(t, res[1].RetryAfter, time.Duration(0))
+
+	// Another user of the same org can still use what is left.
+	res, err = l.AllowHierarchy(ctx, []redis_rate.KeyLimit{
+		levels[0],
+		{Key: "{org:123}:user:789", Limit: redis_rate.PerSecond(3)},
+	}, 3)
+	require.Nil(t, err)
+	require.Equal(t, int64(3), res[0].Allowed)
+	require.Equal(t, int64(0), res[0].Remaining)
+	require.Equal(t, int64(3), res[1].Allowed)
+}
+
+func TestAllowDimensions(t *testing.T) {
+	ctx := context.Background()
+	l := newTestLimiter(t, true)
+
+	dims := []redis_rate.Dimension{
+		{Name: "ip", Value: "10.0.0.1", Limit: redis_rate.PerSecond(5)},
+		{Name: "user", Value: "456", Limit: redis_rate.PerSecond(2)},
+	}
+
+	res, err := l.AllowDimensions(ctx, "tenant:1", dims, 2)
+	require.Nil(t, err)
+	require.True(t, res.Allowed)
+	require.Empty(t, res.Denied)
+	require.Equal(t, time.Duration(-1), res.RetryAfter())
+	require.Equal(t, int64(3), res.Results[0].Remaining)
+	require.Equal(t, int64(0), res.Results[1].Remaining)
+
+	// The user is exhausted, so the ip is not charged either.
+	res, err = l.AllowDimensions(ctx, "tenant:1", dims, 1)
+	require.Nil(t, err)
+	require.False(t, res.Allowed)
+	require.Equal(t, []string{"user"}, res.Denied)
+	require.Equal(t, int64(3), res.Results[0].Remaining)
+	require.Greater(t, res.RetryAfter(), time.Duration(0))
+
+	// Asking for no events is allowed even though the user is exhausted.
+	res, err = l.AllowDimensions(ctx, "tenant:1", dims, 0)
+	require.Nil(t, err)
+	require.True(t, res.Allowed)
+	require.Empty(t, res.Denied)
+	require.Equal(t, time.Duration(-1), res.RetryAfter())
+
+	// Dimensions are limited separately within each group.
+	res, err = l.AllowDimensions(ctx, "tenant:2", dims, 2)
+	require.Nil(t, err)
+	require.True(t, res.Allowed)
+
+	require.Equal(t, "{tenant:1}:ip:10.0.0.1", redis_rate.DimensionKey("tenant:1", dims[0]))
+}
+
+func TestAllowTiered(t *testing.T) {
+	ctx := context.Background()
+	l := newTestLimiter(t, true)
+	limits := []redis_rate.Limit{redis_rate.PerSecond(10), redis_rate.PerMinute(3)}
+
+	res, err := l.AllowTiered(ctx, "ip:10.0.0.1", limits, 2)
+	require.NoError(t, err)
+	require.True(t, res.Allowed)
+	require.Len(t, res.Tiers, 2)
+	require.Equal(t, "ip:10.0.0.1/minute", res.Result.Key)
+	require.Equal(t, int64(1), res.Result.Remaining)
+
+	// the minute is exhausted, so the second is not charged either.
+	res, err = l.AllowTiered(ctx, "ip:10.0.0.1", limits, 2)
+	require.NoError(t, err)
+	require.False(t, res.Allowed)
+	require.Equal(t, "ip:10.0.0.1/minute", res.Result.Key)
+	require.Equal(t, int64(8), res.Tiers[0].Remaining)
+
+	_, err = l.AllowTiered(ctx, "ip:10.0.0.1", []redis_rate.Limit{limits[0], limits[0]}, 1)
+	require.ErrorIs(t, err, redis_rate.ErrDuplicateTier)
+	require.Equal(t, "ip:10.0.0.1/second", redis_rate.TierKey("ip:10.0.0.1", limits[0]))
+}
+
+func TestPenalty(t *testing.T) {
+	ctx := context.Background()
+	clock := redis_rate.NewManualClock(time.Now())
+	l := newTestLimiter(t, true, redis_rate.WithClock(clock))
+	limit := redis_rate.PerSecond(10)
+	limit.Penalty = 2
+	require.Equal(t, "10 req/s (burst 10, penalty 2)", limit.String())
+
+	res, err := l.AllowN(ctx, "test_id", limit, 10)
+	require.Nil(t, err)
+	require.Equal(t, int64(10), res.Allowed)
+
+	res, err = l.Allow(ctx, "test_id", limit)
+	require.Nil(t, err)
+	require.Equal(t, int64(0), res.Allowed)
+	require.InDelta(t, 300*time.Millisecond, res.RetryAfter, float64(time.Millisecond))
+	require.InDelta(t, 1200*time.Millisecond, res.ResetAfter, float64(time.Millisecond))
+
+	res, err = l.AllowAtMost(ctx, "test_id", limit, 1)
+	require.Nil(t, err)
+	require.Equal(t, int64(0), res.Allowed)
+	require.InDelta(t, 500*time.Millisecond, res.RetryAfter, float64(time.Millisecond))
+
+	clock.Advance(500 * time.Millisecond)
+	res, err = l.Allow(ctx, "test_id", limit)
+	require.Nil(t, err)
+	require.Equal(t, int64(1), res.Allowed)
+}
+
+func TestWarmUp(t *testing.T) {
+	ctx := context.Background()
+	clock := redis_rate.NewManualClock(time.Now())
+	l := newTestLimiter(t, true, redis_rate.WithClock(clock))
+	limit := redis_rate.PerSecond(100)
+	limit.WarmUp = 10 * time.Second
+	limit.WarmUpRate = 10
+	require.Equal(t, "100 req/s (burst 100, warmup 10s, from 10)", limit.String())
+
+	res, err := l.AllowAtMost(ctx, "test_id", limit, 100)
+	require.NoError(t, err)
+	require.Equal(t, int64(10), res.Allowed)
+
+	res, err = l.Allow(ctx, "test_id", limit)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), res.Allowed)
+	require.InDelta(t, 100*time.Millisecond, res.RetryAfter, float64(time.Millisecond))
+
+	// halfway through, the rate and burst are halfway to the target.
+	clock.Advance(5 * time.Second)
+	res, err = l.AllowAtMost(ctx, "test_id", limit, 100)
+	require.NoError(t, err)
+	require.InDelta(t, 55, res.Allowed, 1)
+
+	clock.Advance(5 * time.Second)
+	res, err = l.AllowN(ctx, "test_id", limit, 100)
+	require.NoError(t, err)
+	require.Equal(t, int64(100), res.Allowed)
+
+	// other keys warm up on their own.
+	res, err = l.AllowAtMost(ctx, "test_id2", limit, 100)
+	require.NoError(t, err)
+	require.Equal(t, int64(10), res.Allowed)
+}
+
+func TestAllowCost(t *testing.T) {
+	ctx := context.Background()
+	clock := redis_rate.NewManualClock(time.Now())
+	l := newTestLimiter(t, true, redis_rate.WithClock(clock))
+	limit := redis_rate.PerSecond(10)
+
+	for i := 0; i < 4; i++ {
+		res, err := l.AllowCost(ctx, "test_id", limit, 0.25)
+		require.Nil(t, err)
+		require.Equal(t, int64(1), res.Allowed)
+		require.Equal(t, 0.25, res.Cost)
+	}
+
+	res, err := l.AllowCost(ctx, "test_id", limit, 8.5)
+	require.Nil(t, err)
+	require.Equal(t, int64(1), res.Allowed)
+	require.Equal(t, 8.5, res.Cost)
+	require.InDelta(t, 0.5, res.RemainingCost, 1e-6)
+	require.Equal(t, int64(0), res.Remaining)
+
+	res, err = l.AllowCost(ctx, "test_id", limit, 1)
+	require.Nil(t, err)
+	require.Equal(t, int64(0), res.Allowed)
+	require.Equal(t, 0.0, res.Cost)
+	require.InDelta(t, 50*time.Millisecond, res.RetryAfter, float64(time.Millisecond))
+
+	// integer and fractional costs share the key's state.
+	clock.Advance(50 * time.Millisecond)
+	res, err = l.Allow(ctx, "test_id", limit)
+	require.Nil(t, err)
+	require.Equal(t, int64(1), res.Allowed)
+
+	_, err = l.AllowCost(ctx, "test_id", limit, -1)
+	require.ErrorIs(t, err, redis_rate.ErrInvalidCost)
+	_, err = l.AllowCost(ctx, "test_id", redis_rate.PerDay(10), 1)
+	require.ErrorIs(t, err, redis_rate.ErrCalendarLimit)
+}
+
+func TestBatching(t *testing.T) {
+	ctx := context.Background()
+	var mu sync.Mutex
+	var events int
+	l := newTestLimiter(t, true,
+		redis_rate.WithBatching(50*time.Millisecond, 20),
+		redis_rate.WithHooks(redis_rate.Hooks{
+			OnAllow: func(ctx context.Context, ev redis_rate.AllowEvent) {
+				mu.Lock()
+				events++
+				mu.Unlock()
+			},
+		}))
+	limit := redis_rate.PerSecond(10)
+
+	results := make([]*redis_rate.Result, 20)
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			res, err := l.Allow(ctx, "test_id", limit)
+			require.NoError(t, err)
+			results[i] = res
+		}(i)
+	}
+	wg.Wait()
+
+	allowed := 0
+	remaining := make(map[int64]bool)
+	for _, res := range results {
+		if res.Allowed == 1 {
+			allowed++
+			remaining[res.Remaining] = true
+		} else {
+			require.InDelta(t, 100*time.Millisecond, res.RetryAfter, float64(10*time.Millisecond))
+		}
+	}
+	require.Equal(t, 10, allowed)
+	require.Len(t, remaining, 10)
+	require.Equal(t, 20, events)
+
+	// a lone call is sent once the window passes.
+	res, err := l.Allow(ctx, "other", limit)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), res.Allowed)
+	require.Equal(t, int64(9), res.Remaining)
+}
+
+func TestLocalTokenCache(t *testing.T) {
+	ctx := context.Background()
+	clock := redis_rate.NewManualClock(time.Now())
+	l := newTestLimiter(t, true, redis_rate.WithClock(clock), redis_rate.WithLocalTokenCache(redis_rate.LocalTokenCacheOptions{
+		Block:        5,
+		MaxStaleness: time.Minute,
+	}))
+	limit := redis_rate.PerSecond(20)
+
+	res, err := l.Allow(ctx, "test_id", limit)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), res.Allowed)
+	require.Equal(t, int64(19), res.Remaining)
+
+	res, err = l.AllowN(ctx, "test_id", limit, 2)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), res.Allowed)
+	require.Equal(t, int64(17), res.Remaining)
+
+	// only the reserved block was taken from Redis.
+	usage, err := l.Usage(ctx, []string{"test_id"}, map[string]redis_rate.Limit{"test_id": limit})
+	require.NoError(t, err)
+	require.Equal(t, int64(5), usage[0].Used)
+
+	small := redis_rate.PerSecond(5)
+	for i := 0; i < 5; i++ {
+		res, err = l.Allow(ctx, "small", small)
+		require.NoError(t, err)
+		require.Equal(t, int64(1), res.Allowed)
+	}
+	res, err = l.Allow(ctx, "small", small)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), res.Allowed)
+	require.InDelta(t, 200*time.Millisecond, res.RetryAfter, float64(time.Millisecond))
+}
+
+func TestWaitAtMost(t *testing.T) {
+	ctx := context.Background()
+	l := newTestLimiter(t, true)
+	limit := redis_rate.PerSecond(10)
+
+	res, err := l.AllowN(ctx, "test_id", limit, 10)
+	require.NoError(t, err)
+	require.Equal(t, int64(10), res.Allowed)
+
+	// 2 events fit after 200ms, well before the deadline.
+	wctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	start := time.Now()
+	res, err = l.WaitAtMost(wctx, "test_id", limit, 2)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), res.Allowed)
+	require.InDelta(t, 200*time.Millisecond, time.Since(start), float64(50*time.Millisecond))
+
+	// 5 events do not fit within 300ms, so only those that do are taken.
+	wctx, cancel = context.WithTimeout(ctx, 300*time.Millisecond)
+	defer cancel()
+	res, err = l.WaitAtMost(wctx, "test_id", limit, 5)
+	require.NoError(t, err)
+	require.InDelta(t, 3, res.Allowed, 1)
+
+	_, err = l.WaitAtMost(ctx, "test_id", limit, 20)
+	require.ErrorIs(t, err, redis_rate.ErrWaitUnbounded)
+}
+
+func TestDecisionCache(t *testing.T) {
+	ctx := context.Background()
+	clock := redis_rate.NewManualClock(time.Now())
+	trusted := func(key string) bool { return key == "trusted" }
+	l := newTestLimiter(t, true, redis_rate.WithClock(clock), redis_rate.WithDecisionCache(trusted, time.Minute, 10))
+	limit := redis_rate.PerMinute(2)
+
+	// requests for the trusted key after the first are allowed locally.
+	for i := 0; i < 3; i++ {
+		res, err := l.Allow(ctx, "trusted", limit)
+		require.NoError(t, err)
+		require.Equal(t, int64(1), res.Allowed)
+	}
+	for _, want := range []int64{1, 1, 0} {
+		res, err := l.Allow(ctx, "other", limit)
+		require.NoError(t, err)
+		require.Equal(t, want, res.Allowed)
+	}
+
+	// revalidation charges the requests allowed locally, which no longer
+	// fit, so the verdict is dropped.
+	clock.Advance(40 * time.Second)
+	require.Eventually(t, func() bool {
+		res, err := l.Allow(ctx, "trusted", limit)
+		require.NoError(t, err)
+		return res.Allowed == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestRateShares(t *testing.T) {
+	ctx := context.Background()
+	clock := redis_rate.NewManualClock(time.Now())
+	a := newTestLimiter(t, true, redis_rate.WithClock(clock),
+		redis_rate.WithRateShares(redis_rate.RateShareOptions{Instance: "a"}))
+	b := redis_rate.New(newTestRing(), redis_rate.WithClock(clock),
+		redis_rate.WithRateShares(redis_rate.RateShareOptions{Instance: "b"}))
+	limit := redis_rate.PerMinute(10)
+
+	// a claims the whole rate, then b half of it as the second instance.
+	res, err := a.Allow(ctx, "test_id", limit)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), res.Allowed)
+	require.Equal(t, int64(9), res.Remaining)
+
+	res, err = b.Allow(ctx, "test_id", limit)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), res.Allowed)
+	require.Equal(t, int64(4), res.Remaining)
+
+	res, err = b.AllowN(ctx, "test_id", limit, 5)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), res.Allowed)
+	require.Equal(t, redis_rate.ReasonRateExceeded, res.Reason)
+}
+
+func TestDenialCache(t *testing.T) {
+	ctx := context.Background()
+	clock := redis_rate.NewManualClock(time.Now())
+	l := newTestLimiter(t, true, redis_rate.WithClock(clock), redis_rate.WithDenialCache(time.Minute, 10))
+	limit := redis_rate.PerSecond(10)
+	limit.Penalty = 1
+
+	res, err := l.AllowN(ctx, "test_id", limit, 10)
+	require.NoError(t, err)
+	require.Equal(t, int64(10), res.Allowed)
+
+	res, err = l.Allow(ctx, "test_id", limit)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), res.Allowed)
+	require.InDelta(t, 200*time.Millisecond, res.RetryAfter, float64(time.Millisecond))
+
+	// served locally, so the penalty is not charged again.
+	clock.Advance(50 * time.Millisecond)
+	res, err = l.Allow(ctx, "test_id", limit)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), res.Allowed)
+	require.InDelta(t, 150*time.Millisecond, res.RetryAfter, float64(time.Millisecond))
+
+	clock.Advance(150 * time.Millisecond)
+	res, err = l.Allow(ctx, "test_id", limit)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), res.Allowed)
+
+	res, err = l.Allow(ctx, "test_id", limit)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), res.Allowed)
+	require.NoError(t, l.Reset(ctx, "test_id"))
+	res, err = l.Allow(ctx, "test_id", limit)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), res.Allowed)
+}
+
+func TestKillSwitch(t *testing.T) {
+	ctx := context.Background()
+	var killed atomic.Bool
+	killed.Store(true)
+	l := newUnreachableLimiter(redis_rate.WithKillSwitch(func(context.Context) bool {
+		return killed.Load()
+	}))
+	limit := redis_rate.PerSecond(10)
+	climit := redis_rate.ConcurrencyLimit{Max: 1, RequestMaxDuration: time.Minute}
+
+	res, err := l.Allow(ctx, "a", limit)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), res.Allowed)
+	require.Equal(t, redis_rate.ReasonKillSwitch, res.Reason)
+	require.Equal(t, time.Duration(-1), res.RetryAfter)
+
+	res, err = l.AllowCost(ctx, "a", limit, 0.5)
+	require.NoError(t, err)
+	require.Equal(t, redis_rate.ReasonKillSwitch, res.Reason)
+
+	sres, err := l.AllowSlidingWindow(ctx, "a", limit)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), sres.Allowed)
+	require.Equal(t, redis_rate.ReasonKillSwitch, sres.Reason)
+
+	multi, err := l.AllowAtMostMulti(ctx, []redis_rate.KeyLimit{{Key: "a", Limit: limit}, {Key: "b", Limit: limit}}, 1)
+	require.NoError(t, err)
+	require.Len(t, multi, 2)
+	for _, res := range multi {
+		require.Equal(t, redis_rate.ReasonKillSwitch, res.Reason)
+	}
+
+	cres, err := l.Take(ctx, "a", "req1", climit)
+	require.NoError(t, err)
+	require.False(t, cres.Allowed)
+	require.Equal(t, redis_rate.ReasonKillSwitch, cres.Reason)
+
+	cres, err = l.TakeOrQueue(ctx, "a", "req1", climit)
+	require.NoError(t, err)
+	require.False(t, cres.Allowed)
+	require.Equal(t, redis_rate.ReasonKillSwitch, cres.Reason)
+
+	pipe := l.Pipeline()
+	pres := pipe.Allow(ctx, "a", limit)
+	pcres := pipe.Take(ctx, "a", "req1", climit)
+	require.NoError(t, pipe.Exec(ctx))
+	require.Equal(t, redis_rate.ReasonKillSwitch, pres.Reason)
+	require.Equal(t, redis_rate.ReasonKillSwitch, pcres.Reason)
+
+	killed.Store(false)
+	_, err = l.Allow(ctx, "a", limit)
+	require.Error(t, err)
+}
+
+func TestShadow(t *testing.T) {
+	ctx := context.Background()
+	var denied []string
+	l := newTestLimiter(t, true, redis_rate.WithHooks(redis_rate.Hooks{
+		OnShadowDeny: func(ctx context.Context, ev redis_rate.AllowEvent) {
+			denied = append(denied, ev.Key)
+		},
+	}))
+	limit := redis_rate.PerSecond(1)
+	shadow := redis_rate.WithShadow(ctx)
+
+	res, err := l.Allow(shadow, "test_id", limit)
+	require.NoError(t, err)
+	require.True(t, res.Shadow)
+	require.Equal(t, int64(1), res.Allowed)
+	require.Equal(t, int64(1), res.ShadowAllowed)
+	require.Empty(t, denied)
+
+	res, err = l.Allow(shadow, "test_id", limit)
+	require.NoError(t, err)
+	require.True(t, res.Shadow)
+	require.Equal(t, int64(1), res.Allowed)
+	require.Equal(t, int64(0), res.ShadowAllowed)
+	require.Equal(t, time.Duration(-1), res.RetryAfter)
+	require.Equal(t, []string{"test_id"}, denied)
+
+	// the enforced limit is untouched by shadow evaluations.
+	res, err = l.Allow(ctx, "test_id", limit)
+	require.NoError(t, err)
+	require.False(t, res.Shadow)
+	require.Equal(t, int64(1), res.Allowed)
+
+	pipe := l.Pipeline()
+	res = pipe.Allow(shadow, "test_id", limit)
+	require.NoError(t, pipe.Exec(shadow))
+	require.True(t, res.Shadow)
+	require.Equal(t, int64(1), res.Allowed)
+	require.Equal(t, int64(0), res.ShadowAllowed)
+	require.Len(t, denied, 2)
+
+	// every single-key and all-or-nothing allow honors shadow mode.
+	res, err = l.AllowCost(shadow, "test_id", limit, 1.5)
+	require.NoError(t, err)
+	require.True(t, res.Shadow)
+	require.Equal(t, int64(1), res.Allowed)
+	require.Equal(t, int64(0), res.ShadowAllowed)
+
+	swres, err := l.AllowSlidingWindowN(shadow, "sliding", limit, 2)
+	require.NoError(t, err)
+	require.True(t, swres.Shadow)
+	require.Equal(t, int64(2), swres.Allowed)
+	require.Equal(t, int64(0), swres.ShadowAllowed)
+
+	levels := []redis_rate.KeyLimit{{Key: "org", Limit: limit}, {Key: "user", Limit: limit}}
+	results, err := l.AllowHierarchy(shadow, levels, 2)
+	require.NoError(t, err)
+	for _, res := range results {
+		require.True(t, res.Shadow)
+		require.Equal(t, int64(2), res.Allowed)
+	}
+	res, err = l.Allow(ctx, "org", limit)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), res.Allowed)
+
+	_, err = l.AllowAtMostMulti(shadow, levels, 2)
+	require.ErrorIs(t, err, redis_rate.ErrShadowUnsupported)
+}
+
+func TestOnDenied(t *testing.T) {
+	ctx := context.Background()
+	var denied, allowed []redis_rate.Operation
+	l := newTestLimiter(t, true,
+		redis_rate.WithOnDenied(func(ctx context.Context, key string, v redis_rate.Verdict) {
+			require.Equal(t, "test_id", key)
+			denied = append(denied, v.Op)
+		}),
+		redis_rate.WithOnAllowed(func(ctx context.Context, key string, v redis_rate.Verdict) {
+			allowed = append(allowed, v.Op)
+		}),
+	)
+	limit := redis_rate.PerSecond(1)
+	cl := redis_rate.ConcurrencyLimit{Max: 1, RequestMaxDuration: time.Minute}
+
+	_, err := l.Allow(ctx, "test_id", limit)
+	require.NoError(t, err)
+	_, err = l.Allow(ctx, "test_id", limit)
+	require.NoError(t, err)
+	_, err = l.Take(ctx, "test_id", "req1", cl)
+	require.NoError(t, err)
+	_, err = l.Take(ctx, "test_id", "req2", cl)
+	require.NoError(t, err)
+	require.NoError(t, l.Release(ctx, "test_id", "req1", cl))
+
+	pipe := l.Pipeline()
+	pipe.Allow(ctx, "test_id", limit)
+	require.NoError(t, pipe.Exec(ctx))
+
+	require.Equal(t, []redis_rate.Operation{
+		redis_rate.OpAllowN, redis_rate.OpTake,
+	}, allowed)
+	require.Equal(t, []redis_rate.Operation{
+		redis_rate.OpAllowN, redis_rate.OpTake, redis_rate.OpPipelineAllow,
+	}, denied)
+}
+
+func TestBoost(t *testing.T) {
+	ctx := context.Background()
+	l := newTestLimiter(t, true, redis_rate.WithBoosts())
+	limit := redis_rate.PerMinute(2)
+
+	_, err := l.GrantBoost(ctx, "test_id", 0, time.Hour)
+	require.ErrorIs(t, err, redis_rate.ErrInvalidBoost)
+
+	boost, err := l.GrantBoost(ctx, "test_id", 3, time.Hour)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), boost.Tokens)
+	require.InDelta(t, time.Hour, boost.ExpiresAfter, float64(time.Second))
+
+	// boost tokens are spent first, then the limit covers the rest.
+	res, err := l.AllowN(ctx, "test_id", limit, 4)
+	require.NoError(t, err)
+	require.Equal(t, int64(4), res.Allowed)
+	require.Equal(t, int64(3), res.Boosted)
+	require.Equal(t, int64(1), res.Remaining)
+
+	// a denied request spends no boost tokens.
+	_, err = l.GrantBoost(ctx, "test_id", 1, time.Hour)
+	require.NoError(t, err)
+	res, err = l.AllowN(ctx, "test_id", limit, 3)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), res.Allowed)
+	boost, err = l.Boost(ctx, "test_id")
+	require.NoError(t, err)
+	require.Equal(t, int64(1), boost.Tokens)
+
+	pipe := l.Pipeline()
+	res = pipe.Allow(ctx, "test_id", limit)
+	require.NoError(t, pipe.Exec(ctx))
+	require.Equal(t, int64(1), res.Allowed)
+	require.Equal(t, int64(1), res.Boosted)
+
+	boost, err = l.Boost(ctx, "test_id")
+	require.NoError(t, err)
+	require.Equal(t, int64(0), boost.Tokens)
+	require.Equal(t, time.Duration(-1), boost.ExpiresAfter)
+
+	_, err = l.GrantBoost(ctx, "test_id", 5, time.Hour)
+	require.NoError(t, err)
+	require.NoError(t, l.RevokeBoost(ctx, "test_id"))
+	boost, err = l.Boost(ctx, "test_id")
+	require.NoError(t, err)
+	require.Equal(t, int64(0), boost.Tokens)
+}
+
+func TestBans(t *testing.T) {
+	ctx := context.Background()
+	l := newTestLimiter(t, true, redis_rate.WithBans(redis_rate.BanPolicy{
+		Denials:  2,
+		Window:   time.Minute,
+		Duration: time.Hour,
+	}))
+	limit := redis_rate.PerMinute(1)
+
+	res, err := l.Allow(ctx, "test_id", limit)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), res.Allowed)
+
+	res, err = l.Allow(ctx, "test_id", limit)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), res.Allowed)
+	require.False(t, res.Banned)
+	require.Equal(t, redis_rate.ReasonRateExceeded, res.Reason)
+
+	// the second denial within the window bans the key.
+	res, err = l.Allow(ctx, "test_id", limit)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), res.Allowed)
+	require.True(t, res.Banned)
+	require.Equal(t, redis_rate.ReasonBanned, res.Reason)
+	require.Equal(t, time.Hour, res.RetryAfter)
+
+	left, err := l.BannedFor(ctx, "test_id")
+	require.NoError(t, err)
+	require.InDelta(t, time.Hour, left, float64(time.Second))
+
+	require.NoError(t, l.Unban(ctx, "test_id"))
+	left, err = l.BannedFor(ctx, "test_id")
+	require.NoError(t, err)
+	require.Equal(t, time.Duration(0), left)
+
+	require.ErrorIs(t, l.Ban(ctx, "test_other", 0), redis_rate.ErrInvalidBan)
+	require.NoError(t, l.Ban(ctx, "test_other", time.Minute))
+	pipe := l.Pipeline()
+	res = pipe.Allow(ctx, "test_other", limit)
+	require.NoError(t, pipe.Exec(ctx))
+	require.Equal(t, int64(0), res.Allowed)
+	require.True(t, res.Banned)
+	require.InDelta(t, time.Minute, res.RetryAfter, float64(time.Second))
+
+	res, err = l.AllowCost(ctx, "test_other", limit, 0.5)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), res.Allowed)
+	require.True(t, res.Banned)
+	require.Equal(t, redis_rate.ReasonBanned, res.Reason)
+	require.InDelta(t, time.Minute, res.RetryAfter, float64(time.Second))
+
+	// AllowAtMost and calendar limits do not check bans.
+	res, err = l.AllowAtMost(ctx, "test_other", limit, 1)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), res.Allowed)
+	require.False(t, res.Banned)
+	require.NoError(t, l.Ban(ctx, "test_calendar", time.Minute))
+	res, err = l.Allow(ctx, "test_calendar", redis_rate.PerDay(1))
+	require.NoError(t, err)
+	require.Equal(t, int64(1), res.Allowed)
+	require.False(t, res.Banned)
+}
+
+func TestBanPolicyDefaults(t *testing.T) {
+	ctx := context.Background()
+	snapshot, err := newUnreachableLimiter(redis_rate.WithBans(redis_rate.BanPolicy{Denials: 3})).ConfigSnapshot(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "denials=3 window=1m0s duration=10m0s", snapshot.Settings["bans"])
+
+	snapshot, err = newUnreachableLimiter(redis_rate.WithBans(redis_rate.BanPolicy{
+		Denials:  -1,
+		Window:   -time.Second,
+		Duration: time.Hour,
+	})).ConfigSnapshot(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "denials=0 window=1m0s duration=1h0m0s", snapshot.Settings["bans"])
+}
+
+func TestFreeze(t *testing.T) {
+	ctx := context.Background()
+	clock := redis_rate.NewManualClock(time.Now())
+	l := newTestLimiter(t, true, redis_rate.WithClock(clock), redis_rate.WithFreezes())
+	limit := redis_rate.PerMinute(2)
+
+	res, err := l.AllowN(ctx, "test_id", limit, 2)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), res.Allowed)
+
+	require.NoError(t, l.Freeze(ctx, "test_id"))
+	since, err := l.FrozenSince(ctx, "test_id")
+	require.NoError(t, err)
+	require.WithinDuration(t, clock.Now(), since, time.Millisecond)
+
+	clock.Advance(5 * time.Minute)
+	res, err = l.Allow(ctx, "test_id", limit)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), res.Allowed)
+	require.True(t, res.Frozen)
+	require.Equal(t, redis_rate.ReasonFrozen, res.Reason)
+	require.Equal(t, time.Duration(-1), res.RetryAfter)
+
+	// the key did not refill while frozen.
+	require.NoError(t, l.Unfreeze(ctx, "test_id"))
+	res, err = l.Allow(ctx, "test_id", limit)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), res.Allowed)
+	require.False(t, res.Frozen)
+	require.InDelta(t, 30*time.Second, res.RetryAfter, float64(time.Millisecond))
+
+	since, err = l.FrozenSince(ctx, "test_id")
+	require.NoError(t, err)
+	require.True(t, since.IsZero())
+
+	// every single-key allow checks the freeze.
+	require.NoError(t, l.Freeze(ctx, "test_id2"))
+	res, err = l.AllowAtMost(ctx, "test_id2", limit, 2)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), res.Allowed)
+	require.True(t, res.Frozen)
+	res, err = l.AllowCost(ctx, "test_id2", limit, 0.5)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), res.Allowed)
+	require.True(t, res.Frozen)
+	res, err = l.Allow(ctx, "test_id2", redis_rate.PerDay(10))
+	require.NoError(t, err)
+	require.Equal(t, int64(0), res.Allowed)
+	require.True(t, res.Frozen)
+	require.NoError(t, l.Unfreeze(ctx, "test_id2"))
+	res, err = l.AllowCost(ctx, "test_id2", limit, 0.5)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), res.Allowed)
+}
+
+func TestAdmission(t *testing.T) {
+	ctx := context.Background()
+	l := newTestLimiter(t, true)
+	limit := redis_rate.PerSecond(10)
+	climit := redis_rate.ConcurrencyLimit{Max: 1, RequestMaxDuration: time.Minute}
+
+	a := l.Admission()
+	res := a.Allow(ctx, "tenant", limit)
+	cres := a.Take(ctx, "tenant", "req1", climit)
+	incr := a.Do(ctx, "incr", "admissions")
+	rv, err := a.Exec(ctx)
+	require.NoError(t, err)
+	require.True(t, rv.Admitted)
+	require.Empty(t, rv.Denied)
+	require.Equal(t, int64(1), res.Allowed)
+	require.True(t, cres.Allowed)
+	n, err := incr.Int64()
+	require.NoError(t, err)
+	require.Equal(t, int64(1), n)
+
+	// "tenant" is busy, so the slot taken on "user" is released again.
+	a = l.Admission()
+	a.Allow(ctx, "tenant", limit)
+	a.Take(ctx, "user", "req2", climit)
+	a.Take(ctx, "tenant", "req2", climit)
+	incr = a.Do(ctx, "incr", "admissions")
+	rv, err = a.Exec(ctx)
+	require.NoError(t, err)
+	require.False(t, rv.Admitted)
+	require.Equal(t, []string{"tenant"}, rv.Denied)
+	require.Equal(t, time.Duration(-1), rv.RetryAfter)
+	n, err = incr.Int64()
+	require.NoError(t, err)
+	require.Equal(t, int64(2), n)
+
+	taken, err := l.Take(ctx, "user", "req3", climit)
+	require.NoError(t, err)
+	require.True(t, taken.Allowed)
+}
+
+func TestPipelineHooks(t *testing.T) {
+	ctx := context.Background()
+
+	var events []redis_rate.PipelineEvent
+	l := newTestLimiter(t, false, redis_rate.WithHooks(redis_rate.Hooks{
+		OnPipelineExec: func(ctx context.Context, ev redis_rate.PipelineEvent) {
+			events = append(events, ev)
+		},
+	}))
+
+	p := l.Pipeline()
+	_ = p.Allow(ctx, "a", redis_rate.PerSecond(1))
+	_ = p.Allow(ctx, "a", redis_rate.PerSecond(1))
+	p.Release(ctx, "c", "req1")
+	err := p.Exec(ctx)
+	require.Nil(t, err)
+
+	require.Len(t, events, 1)
+	require.Equal(t, 3, events[0].BatchSize())
+	require.Equal(t, 1, events[0].Denied)
+	require.Equal(t, 2, events[0].Attempts)
+}
+
+func TestAllowHooks(t *testing.T) {
+	ctx := context.Background()
+
+	var allows []redis_rate.AllowEvent
+	l := newTestLimiter(t, true, redis_rate.WithHooks(redis_rate.Hooks{
+		OnAllow: func(ctx context.Context, ev redis_rate.AllowEvent) {
+			allows = append(allows, ev)
+		},
+	}))
+
+	tagged := redis_rate.WithTags(ctx, redis_rate.Tag{Key: "route", Value: "/v1/items"})
+	_, err := l.Allow(tagged, "a", redis_rate.PerSecond(10))
+	require.Nil(t, err)
+
+	p := l.Pipeline()
+	_ = p.Allow(ctx, "b", redis_rate.PerSecond(10))
+	err = p.Exec(ctx)
+	require.Nil(t, err)
+
+	require.Len(t, allows, 2)
+	require.Equal(t, redis_rate.OpAllowN, allows[0].Op)
+	require.Equal(t, "rate:", allows[0].Prefix)
+	require.Equal(t, "a", allows[0].Key)
+	require.Equal(t, int64(1), allows[0].Result.Allowed)
+	require.Equal(t, []redis_rate.Tag{{Key: "route", Value: "/v1/items"}}, allows[0].Tags)
+	require.Equal(t, redis_rate.OpPipelineAllow, allows[1].Op)
+	require.Empty(t, allows[1].Tags)
+	require.Equal(t, int64(9), allows[1].Result.Remaining)
+}
+
+func TestRetryWithin(t *testing.T) {
+	ctx := context.Background()
+	l := newTestLimiter(t, true)
+	limit := redis_rate.PerSecond(10)
+
+	res, err := l.AllowN(ctx, "test_id", limit, 10)
+	require.Nil(t, err)
+	require.True(t, res.RetryAt().IsZero())
+	wait, ok := res.RetryWithin(ctx)
+	require.True(t, ok)
+	require.Equal(t, time.Duration(0), wait)
+
+	res, err = l.Allow(ctx, "test_id", limit)
+	require.Nil(t, err)
+	require.Equal(t, int64(0), res.Allowed)
+	require.False(t, res.RetryAt().IsZero())
+
+	shortCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	_, ok = res.RetryWithin(shortCtx)
+	require.False(t, ok)
+
+	longCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	wait, ok = res.RetryWithin(longCtx)
+	require.True(t, ok)
+	require.InDelta(t, 100*time.Millisecond, wait, float64(10*time.Millisecond))
+}
+
+func TestRetryWithinClock(t *testing.T) {
+	ctx := context.Background()
+	clock := redis_rate.NewManualClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	l := redis_rate.NewMemory(redis_rate.WithMemoryClock(clock))
+	limit := redis_rate.PerMinute(1)
+
+	_, err := l.Allow(ctx, "test_id", limit)
+	require.NoError(t, err)
+	res, err := l.Allow(ctx, "test_id", limit)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), res.Allowed)
+
+	// the wait is measured on the limiter's clock, not the wall clock.
+	wait, ok := res.RetryWithin(ctx)
+	require.True(t, ok)
+	require.Equal(t, time.Minute, wait)
+	clock.Advance(20 * time.Second)
+	wait, _ = res.RetryWithin(ctx)
+	require.Equal(t, 40*time.Second, wait)
+
+	// the deadline is on the wall clock.
+	shortCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	_, ok = res.RetryWithin(shortCtx)
+	require.False(t, ok)
+	longCtx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	_, ok = res.RetryWithin(longCtx)
+	require.True(t, ok)
+}
+
+type testSpan struct {
+	name  string
+	attrs map[string]interface{}
+	ended bool
+}
+
+func (s *testSpan) SetAttributes(attrs ...redis_rate.Attribute) {
+	for _, a := range attrs {
+		s.attrs[a.Key] = a.Value
+	}
+}
+
+func (s *testSpan) RecordError(err error) {
+	s.attrs["error"] = err
+}
+
+func (s *testSpan) End() {
+	s.ended = true
+}
+
+type testTracer struct {
+	spans []*testSpan
+}
+
+func (tr *testTracer) Start(ctx context.Context, name string) (context.Context, redis_rate.Span) {
+	s := &testSpan{name: name, attrs: map[string]interface{}{}}
+	tr.spans = append(tr.spans, s)
+	return ctx, s
+}
+
+func TestTracer(t *testing.T) {
+	ctx := context.Background()
+	tr := &testTracer{}
+	l := newTestLimiter(t, true, redis_rate.WithTracer(tr))
+
+	_, err := l.Allow(ctx, "test_id", redis_rate.PerSecond(10))
+	require.Nil(t, err)
+
+	require.Len(t, tr.spans, 1)
+	span := tr.spans[0]
+	require.Equal(t, "redis_rate.allow_n", span.name)
+	require.True(t, span.ended)
+	require.Equal(t, "test_id", span.attrs[redis_rate.AttrKey])
+	require.Equal(t, int64(1), span.attrs[redis_rate.AttrAllowed])
+	require.Equal(t, int64(9), span.attrs[redis_rate.AttrRemaining])
+}
+
+func TestDefaultLimit(t *testing.T) {
+	ctx := context.Background()
+
+	l := newTestLimiter(t, true)
+	_, err := l.Allow(ctx, "test_id", redis_rate.Limit{})
+	require.ErrorIs(t, err, redis_rate.ErrNoLimit)
+
+	l = newTestLimiter(t, true, redis_rate.WithDefaultLimit(redis_rate.PerSecond(5)))
+	res, err := l.Allow(ctx, "test_id", redis_rate.Limit{})
+	require.Nil(t, err)
+	require.Equal(t, redis_rate.PerSecond(5), res.Limit)
+	require.Equal(t, int64(4), res.Remaining)
+
+	p := l.Pipeline()
+	pres := p.Allow(ctx, "test_id", redis_rate.Limit{})
+	err = p.Exec(ctx)
+	require.Nil(t, err)
+	require.Equal(t, int64(3), pres.Remaining)
+}
+
+func TestPipelinePartitions(t *testing.T) {
+	ctx := context.Background()
+	l := newTestLimiter(t, false, redis_rate.WithPipelinePartitions(10, 2))
+
+	limit := redis_rate.PerMinute(5)
+	p := l.Pipeline()
+	results := make([][]*redis_rate.Result, 20)
+	for i := range results {
+		key := fmt.Sprintf("tenant:%d", i)
+		for j := 0; j < 6; j++ {
+			results[i] = append(results[i], p.Allow(ctx, key, limit))
+		}
+	}
+	err := p.Exec(ctx)
+	require.Nil(t, err)
+
+	for _, rs := range results {
+		for j, res := range rs[:5] {
+			require.Equal(t, int64(1), res.Allowed)
+			require.Equal(t, int64(4-j), res.Remaining)
+		}
+		require.Equal(t, int64(0), rs[5].Allowed)
+	}
+}
+
+func TestShardedPipelines(t *testing.T) {
+	ctx := context.Background()
+	live := newTestRing()
+	require.NoError(t, live.FlushDB(ctx).Err())
+
+	// server1 is unreachable, so only the keys it owns fail.
+	ring := redis.NewRing(&redis.RingOptions{
+		Addrs: map[string]string{
+			"server0": live.Options().Addrs["server0"],
+			"server1": "127.0.0.1:1",
+		},
+		HeartbeatFrequency: time.Hour,
+		DialTimeout:        10 * time.Millisecond,
+		MaxRetries:         -1,
+	})
+	var ev redis_rate.PipelineEvent
+	l := redis_rate.New(ring, redis_rate.WithShardedPipelines(0), redis_rate.WithHooks(redis_rate.Hooks{
+		OnPipelineExec: func(ctx context.Context, e redis_rate.PipelineEvent) { ev = e },
+	}))
+
+	limit := redis_rate.PerMinute(5)
+	p := l.Pipeline()
+	results := make([]*redis_rate.Result, 20)
+	for i := range results {
+		results[i] = p.Allow(ctx, fmt.Sprintf("tenant:%d", i), limit)
+	}
+	err := p.Exec(ctx)
+	var perr *redis_rate.PipelineError
+	require.ErrorAs(t, err, &perr)
+
+	failed := 0
+	for _, res := range results {
+		if res.Err != nil {
+			failed++
+			continue
+		}
+		require.Equal(t, int64(1), res.Allowed)
+	}
+	require.Equal(t, len(perr.Keys), failed)
+	require.Less(t, failed, len(results))
+
+	// each shard is timed on its own.
+	require.Len(t, ev.Shards, 2)
+	commands := 0
+	for _, shard := range ev.Shards {
+		commands += shard.Commands
+		if shard.Addr == "server1" {
+			require.Error(t, shard.Err)
+			require.Equal(t, failed, shard.Commands)
+		} else {
+			require.NoError(t, shard.Err)
+		}
+	}
+	require.Equal(t, len(results), commands)
+}
+
+func TestResetMany(t *testing.T) {
+	ctx := context.Background()
+	l := newTestLimiter(t, true)
+	limit := redis_rate.PerMinute(10)
+
+	keys := []string{"a", "b", "c"}
+	for _, key := range keys {
+		_, err := l.Allow(ctx, key, limit)
+		require.Nil(t, err)
+	}
+
+	_, err := l.ResetMany(ctx, keys, redis_rate.WithResetThreshold(2))
+	require.ErrorIs(t, err, redis_rate.ErrResetNotConfirmed)
+
+	removed, err := l.ResetMany(ctx, append(keys, "missing"), redis_rate.WithResetThreshold(2), redis_rate.ConfirmReset())
+	require.Nil(t, err)
+	require.Equal(t, int64(3), removed)
+
+	res, err := l.Allow(ctx, "a", limit)
+	require.Nil(t, err)
+	require.Equal(t, int64(9), res.Remaining)
+}
+
+func TestClock(t *testing.T) {
+	ctx := context.Background()
+	clock := redis_rate.NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	l := newTestLimiter(t, true, redis_rate.WithClock(clock))
+	limit := redis_rate.PerSecond(10)
+
+	res, err := l.AllowN(ctx, "test_id", limit, 10)
+	require.Nil(t, err)
+	require.Equal(t, int64(10), res.Allowed)
+	require.InDelta(t, time.Second, res.ResetAfter, float64(time.Microsecond))
+
+	res, err = l.Allow(ctx, "test_id", limit)
+	require.Nil(t, err)
+	require.Equal(t, int64(0), res.Allowed)
+	require.InDelta(t, 100*time.Millisecond, res.RetryAfter, float64(time.Microsecond))
+
+	clock.Advance(500 * time.Millisecond)
+	res, err = l.AllowAtMost(ctx, "test_id", limit, 10)
+	require.Nil(t, err)
+	require.Equal(t, int64(5), res.Allowed)
+	require.InDelta(t, time.Second, res.ResetAfter, float64(time.Microsecond))
+}
+
+func TestAllowSlidingWindow(t *testing.T) {
+	ctx := context.Background()
+	clock := redis_rate.NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	l := newTestLimiter(t, true, redis_rate.WithClock(clock))
+	limit := redis_rate.PerMinute(10)
+
+	res, err := l.AllowSlidingWindowN(ctx, "test_id", limit, 10)
+	require.Nil(t, err)
+	require.Equal(t, int64(10), res.Allowed)
+	require.Equal(t, int64(0), res.Remaining)
+	require.Equal(t, time.Duration(-1), res.RetryAfter)
+
+	res, err = l.AllowSlidingWindow(ctx, "test_id", limit)
+	require.Nil(t, err)
+	require.Equal(t, int64(0), res.Allowed)
+	require.InDelta(t, 66*time.Second, res.RetryAfter, float64(time.Microsecond))
+
+	// The previous window still fully overlaps the rolling window.
+	clock.Advance(time.Minute)
+	res, err = l.AllowSlidingWindow(ctx, "test_id", limit)
+	require.Nil(t, err)
+	require.Equal(t, int64(0), res.Allowed)
+	require.InDelta(t, 6*time.Second, res.RetryAfter, float64(time.Microsecond))
+
+	clock.Advance(7 * time.Second)
+	res, err = l.AllowSlidingWindow(ctx, "test_id", limit)
+	require.Nil(t, err)
+	require.Equal(t, int64(1), res.Allowed)
+	require.InDelta(t, 10*53.0/60+1, res.Count, 1e-9)
+
+	res, err = l.AllowSlidingWindowN(ctx, "test_id", limit, 11)
+	require.Nil(t, err)
+	require.Equal(t, int64(0), res.Allowed)
+	require.Equal(t, time.Duration(-1), res.RetryAfter)
+}
+
+func TestCalendarLimit(t *testing.T) {
+	ctx := context.Background()
+	clock := redis_rate.NewManualClock(time.Date(2024, 1, 31, 23, 0, 0, 0, time.UTC))
+	l := newTestLimiter(t, true, redis_rate.WithClock(clock))
+	limit := redis_rate.PerMonth(3)
+	require.Equal(t, "3 req/month (UTC)", limit.String())
+
+	res, err := l.AllowN(ctx, "test_id", limit, 2)
+	require.Nil(t, err)
+	require.Equal(t, int64(2), res.Allowed)
+	require.Equal(t, int64(2), res.Used)
+	require.Equal(t, int64(1), res.Remaining)
+	require.Equal(t, time.Hour, res.ResetAfter)
+
+	res, err = l.AllowN(ctx, "test_id", limit, 2)
+	require.Nil(t, err)
+	require.Equal(t, int64(0), res.Allowed)
+	require.Equal(t, time.Hour, res.RetryAfter)
+
+	// Asking for no events is never retried, and neither is asking for more
+	// than a window allows.
+	res, err = l.AllowN(ctx, "test_id", limit, 0)
+	require.Nil(t, err)
+	require.Equal(t, time.Duration(-1), res.RetryAfter)
+	require.Empty(t, res.Reason)
+	res, err = l.AllowN(ctx, "test_id", limit, 4)
+	require.Nil(t, err)
+	require.Equal(t, int64(0), res.Allowed)
+	require.Equal(t, time.Duration(-1), res.RetryAfter)
+	require.Equal(t, redis_rate.ReasonExceedsLimit, res.Reason)
+
+	res, err = l.AllowAtMost(ctx, "test_id", limit, 2)
+	require.Nil(t, err)
+	require.Equal(t, int64(1), res.Allowed)
+	require.Equal(t, int64(0), res.Remaining)
+
+	clock.Advance(time.Hour)
+	res, err = l.Allow(ctx, "test_id", limit)
+	require.Nil(t, err)
+	require.Equal(t, int64(1), res.Allowed)
+	require.Equal(t, int64(1), res.Used)
+	require.Equal(t, 29*24*time.Hour, res.ResetAfter)
+
+	pipe := l.Pipeline()
+	day := pipe.Allow(ctx, "test_day", redis_rate.PerDay(1))
+	require.NoError(t, pipe.Exec(ctx))
+	require.Equal(t, int64(1), day.Allowed)
+	require.Equal(t, 24*time.Hour, day.ResetAfter)
+
+	_, err = l.AllowAtMostMulti(ctx, []redis_rate.KeyLimit{{Key: "test_id", Limit: limit}}, 1)
+	require.ErrorIs(t, err, redis_rate.ErrCalendarLimit)
+}
+
+func TestEpochs(t *testing.T) {
+	ctx := context.Background()
+	l := newTestLimiter(t, true, redis_rate.WithEpochs(time.Hour), redis_rate.WithBans(redis_rate.BanPolicy{}))
+	limit := redis_rate.PerMinute(1)
+
+	_, err := redis_rate.New(newTestRing()).BumpEpoch(ctx)
+	require.ErrorIs(t, err, redis_rate.ErrNoEpochs)
+
+	res, err := l.Allow(ctx, "test_id", limit)
+	require.Nil(t, err)
+	require.Equal(t, int64(1), res.Allowed)
+	res, err = l.Allow(ctx, "test_id", limit)
+	require.Nil(t, err)
+	require.Equal(t, int64(0), res.Allowed)
+	require.NoError(t, l.Ban(ctx, "test_banned", time.Minute))
+
+	// A process that cached the old epoch still charges the new buckets.
+	stale := redis_rate.New(newTestRing(), redis_rate.WithEpochs(time.Hour))
+	require.Equal(t, int64(0), stale.Epoch(ctx))
+
+	epoch, err := l.BumpEpoch(ctx)
+	require.Nil(t, err)
+	require.Equal(t, int64(1), epoch)
+	require.Equal(t, int64(1), l.Epoch(ctx))
+
+	res, err = l.Allow(ctx, "test_id", limit)
+	require.Nil(t, err)
+	require.Equal(t, int64(1), res.Allowed)
+	res, err = stale.Allow(ctx, "test_id", limit)
+	require.Nil(t, err)
+	require.Equal(t, int64(0), res.Allowed)
+
+	// Bans are kept across epochs.
+	res, err = l.Allow(ctx, "test_banned", limit)
+	require.Nil(t, err)
+	require.Equal(t, int64(0), res.Allowed)
+
+	// Other processes read the new epoch once their cache expires.
+	other := redis_rate.New(newTestRing(), redis_rate.WithEpochs(0))
+	require.Equal(t, int64(1), other.Epoch(ctx))
+	res, err = other.Allow(ctx, "test_id", limit)
+	require.Nil(t, err)
+	require.Equal(t, int64(0), res.Allowed)
+}
+
+func TestUsage(t *testing.T) {
+	ctx := context.Background()
+	clock := redis_rate.NewManualClock(time.Date(2024, 1, 31, 23, 0, 0, 0, time.UTC))
+	l := newTestLimiter(t, true, redis_rate.WithClock(clock))
+	limits := map[string]redis_rate.Limit{
+		"a":     redis_rate.PerSecond(10),
+		"b":     redis_rate.PerSecond(10),
+		"month": redis_rate.PerMonth(100),
+	}
+
+	_, err := l.AllowN(ctx, "a", limits["a"], 4)
+	require.Nil(t, err)
+	_, err = l.AllowN(ctx, "month", limits["month"], 30)
+	require.Nil(t, err)
+
+	res, err := l.Usage(ctx, []string{"a", "b", "month"}, limits)
+	require.Nil(t, err)
+	require.Len(t, res, 3)
+
+	require.Equal(t, "a", res[0].Key)
+	require.Equal(t, int64(0), res[0].Allowed)
+	require.Equal(t, int64(4), res[0].Used)
+	require.Equal(t, int64(6), res[0].Remaining)
+	require.Equal(t, time.Duration(-1), res[0].RetryAfter)
+	require.InDelta(t, 400*time.Millisecond, res[0].ResetAfter, float64(time.Microsecond))
+
+	require.Equal(t, int64(0), res[1].Used)
+	require.Equal(t, int64(10), res[1].Remaining)
+
+	require.Equal(t, int64(30), res[2].Used)
+	require.Equal(t, int64(70), res[2].Remaining)
+	require.Equal(t, time.Hour, res[2].ResetAfter)
+
+	// Nothing was consumed.
+	again, err := l.Usage(ctx, []string{"a"}, limits)
+	require.Nil(t, err)
+	require.Equal(t, int64(4), again[0].Used)
+
+	_, err = l.Usage(ctx, []string{"missing"}, limits)
+	require.ErrorIs(t, err, redis_rate.ErrNoLimit)
+}
+
+func TestForecast(t *testing.T) {
+	ctx := context.Background()
+	clock := redis_rate.NewManualClock(time.Date(2024, 1, 31, 12, 0, 0, 0, time.UTC))
+	l := newTestLimiter(t, true, redis_rate.WithClock(clock))
+	limit := redis_rate.PerDay(100)
+
+	_, err := l.AllowN(ctx, "test_id", limit, 40)
+	require.NoError(t, err)
+
+	f, err := l.Forecast(ctx, "test_id", limit)
+	require.NoError(t, err)
+	require.Equal(t, int64(40), f.Used)
+	require.Equal(t, int64(60), f.Remaining)
+	require.False(t, f.Exhausts())
+	require.True(t, f.ExhaustAt.IsZero())
+	require.Equal(t, time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC), f.ResetAt)
+
+	_, err = l.AllowN(ctx, "test_id", limit, 20)
+	require.NoError(t, err)
+
+	f, err = l.Forecast(ctx, "test_id", limit)
+	require.NoError(t, err)
+	require.True(t, f.Exhausts())
+	require.InDelta(t, 8*time.Hour, f.ExhaustAfter, float64(time.Second))
+	require.InDelta(t, 60.0/(12*3600), f.Rate, 1e-9)
+
+	_, err = l.Forecast(ctx, "test_id", redis_rate.PerSecond(10))
+	require.ErrorIs(t, err, redis_rate.ErrForecastLimit)
+}
+
+func TestReadOnly(t *testing.T) {
+	ctx := context.Background()
+	clock := redis_rate.NewManualClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	l := newTestLimiter(t, true, redis_rate.WithClock(clock))
+	ro := redis_rate.New(newTestRing(), redis_rate.WithReadOnly(), redis_rate.WithClock(clock))
+	limit := redis_rate.PerSecond(10)
+
+	_, err := l.AllowN(ctx, "test_id", limit, 4)
+	require.Nil(t, err)
+
+	for i := 0; i < 2; i++ {
+		res, err := ro.AllowN(ctx, "test_id", limit, 3)
+		require.Nil(t, err)
+		require.Equal(t, int64(3), res.Allowed)
+		require.Equal(t, int64(3), res.Remaining)
+		require.InDelta(t, 700*time.Millisecond, res.ResetAfter, float64(time.Microsecond))
+	}
+
+	res, err := ro.AllowN(ctx, "test_id", limit, 7)
+	require.Nil(t, err)
+	require.Equal(t, int64(0), res.Allowed)
+	require.InDelta(t, 100*time.Millisecond, res.RetryAfter, float64(time.Microsecond))
+
+	res, err = ro.AllowAtMost(ctx, "test_id", limit, 10)
+	require.Nil(t, err)
+	require.Equal(t, int64(6), res.Allowed)
+
+	pipe := ro.Pipeline()
+	pres := pipe.Allow(ctx, "test_id", limit)
+	require.NoError(t, pipe.Exec(ctx))
+	require.Equal(t, int64(1), pres.Allowed)
+	require.Equal(t, int64(5), pres.Remaining)
+
+	_, err = l.AllowSlidingWindowN(ctx, "sliding", limit, 4)
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		sres, err := ro.AllowSlidingWindowN(ctx, "sliding", limit, 3)
+		require.NoError(t, err)
+		require.Equal(t, int64(3), sres.Allowed)
+		require.InDelta(t, 7, sres.Count, 1e-9)
+		require.Equal(t, int64(3), sres.Remaining)
+	}
+	sres, err := ro.AllowSlidingWindowN(ctx, "sliding", limit, 7)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), sres.Allowed)
+	require.Equal(t, redis_rate.ReasonRateExceeded, sres.Reason)
+
+	_, err = ro.Take(ctx, "test_id", "req", redis_rate.ConcurrencyLimit{Max: 1})
+	require.ErrorIs(t, err, redis_rate.ErrReadOnly)
+	var roErr *redis_rate.ReadOnlyError
+	require.ErrorAs(t, err, &roErr)
+	require.Equal(t, "TakeN", roErr.Method)
+
+	require.ErrorIs(t, ro.Reset(ctx, "test_id"), redis_rate.ErrReadOnly)
+
+	pipe = ro.Pipeline()
+	pipe.Release(ctx, "test_id", "req")
+	require.ErrorIs(t, pipe.Exec(ctx), redis_rate.ErrReadOnly)
+
+	// The writer's state was never touched.
+	res, err = l.AllowN(ctx, "test_id", limit, 6)
+	require.Nil(t, err)
+	require.Equal(t, int64(6), res.Allowed)
+}
+
+func TestResetByPrefix(t *testing.T) {
+	ctx := context.Background()
+	l := newTestLimiter(t, true)
+	limit := redis_rate.PerMinute(1)
+
+	for _, key := range []string{"tenant:a:x", "tenant:a:y", "tenant:b:x"} {
+		res, err := l.Allow(ctx, key, limit)
+		require.Nil(t, err)
+		require.Equal(t, int64(1), res.Allowed)
+	}
+	_, err := l.Take(ctx, "tenant:a:c", "req", redis_rate.ConcurrencyLimit{Max: 1})
+	require.Nil(t, err)
+
+	_, err = l.ResetByPrefix(ctx, "tenant:a:", redis_rate.WithResetThreshold(2))
+	require.ErrorIs(t, err, redis_rate.ErrResetNotConfirmed)
+
+	removed, err := l.ResetByPrefix(ctx, "tenant:a:")
+	require.Nil(t, err)
+	require.Equal(t, int64(3), removed)
+
+	res, err := l.Allow(ctx, "tenant:a:x", limit)
+	require.Nil(t, err)
+	require.Equal(t, int64(1), res.Allowed)
+	res, err = l.Allow(ctx, "tenant:b:x", limit)
+	require.Nil(t, err)
+	require.Equal(t, int64(0), res.Allowed)
+
+	require.Nil(t, l.ResetMulti(ctx, "tenant:a:x", "tenant:b:x"))
+	res, err = l.Allow(ctx, "tenant:b:x", limit)
+	require.Nil(t, err)
+	require.Equal(t, int64(1), res.Allowed)
+}
+
+func TestClusterHashTag(t *testing.T) {
+	ctx := context.Background()
+	l := newTestLimiter(t, true,
+		redis_rate.WithKeyPrefix("app1:"),
+		redis_rate.WithConcurrencyKeyPrefix("app1c:"),
+		redis_rate.WithClusterHashTag(func(key string) string {
+			org, _, _ := strings.Cut(key, ":user:")
+			return org
+		}),
+	)
+	ring := newTestRing()
+
+	res, err := l.AllowHierarchy(ctx, []redis_rate.KeyLimit{
+		{Key: "org:1", Limit: redis_rate.PerSecond(10)},
+		{Key: "org:1:user:2", Limit: redis_rate.PerSecond(5)},
+	}, 1)
+	require.Nil(t, err)
+	require.Equal(t, int64(1), res[1].Allowed)
+
+	_, err = l.Take(ctx, "org:1:user:2", "req", redis_rate.ConcurrencyLimit{Max: 1})
+	require.Nil(t, err)
+
+	n, err := ring.Exists(ctx, "app1:{org:1}org:1", "app1:{org:1}org:1:user:2", "app1c:{org:1}org:1:user:2").Result()
+	require.Nil(t, err)
+	require.Equal(t, int64(3), n)
+
+	removed, err := l.ResetByPrefix(ctx, "org:1:user:")
+	require.Nil(t, err)
+	require.Equal(t, int64(2), removed)
+}
+
+func TestClassifier(t *testing.T) {
+	ctx := context.Background()
+	var events []redis_rate.AllowEvent
+	l := newTestLimiter(t, true,
+		redis_rate.WithClassifier(func(ctx context.Context, req redis_rate.Request) redis_rate.Request {
+			if strings.HasPrefix(req.Key, "ip:10.0.0.") {
+				req.Key = "ip:crawlers"
+				req.Limit = redis_rate.PerMinute(1)
+				req.Tags = append(req.Tags, redis_rate.Tag{Key: "class", Value: "crawler"})
+			}
+			return req
+		}),
+		redis_rate.WithHooks(redis_rate.Hooks{
+			OnAllow: func(ctx context.Context, ev redis_rate.AllowEvent) {
+				events = append(events, ev)
+			},
+		}),
+	)
+
+	res, err := l.Allow(ctx, "ip:10.0.0.1", redis_rate.PerSecond(100))
+	require.Nil(t, err)
+	require.Equal(t, int64(1), res.Allowed)
+	require.Equal(t, "ip:crawlers", res.Key)
+	require.Equal(t, redis_rate.PerMinute(1), res.Limit)
+
+	pipe := l.Pipeline()
+	pres := pipe.Allow(ctx, "ip:10.0.0.2", redis_rate.PerSecond(100))
+	other := pipe.Allow(ctx, "ip:192.168.0.1", redis_rate.PerSecond(100))
+	require.NoError(t, pipe.Exec(ctx))
+	require.Equal(t, int64(0), pres.Allowed)
+	require.Equal(t, int64(1), other.Allowed)
+	require.Equal(t, "ip:192.168.0.1", other.Key)
+
+	multi, err := l.AllowAtMostMulti(ctx, []redis_rate.KeyLimit{
+		{Key: "ip:10.0.0.3", Limit: redis_rate.PerSecond(100)},
+		{Key: "ip:192.168.0.2", Limit: redis_rate.PerSecond(100)},
+	}, 1)
+	require.NoError(t, err)
+	require.Equal(t, "ip:crawlers", multi[0].Key)
+	require.Equal(t, redis_rate.PerMinute(1), multi[0].Limit)
+	require.Equal(t, int64(0), multi[0].Allowed)
+	require.Equal(t, "ip:192.168.0.2", multi[1].Key)
+
+	crawler := []redis_rate.Tag{{Key: "class", Value: "crawler"}}
+	require.Len(t, events, 5)
+	require.Equal(t, "ip:crawlers", events[0].Key)
+	require.Equal(t, crawler, events[0].Tags)
+	require.Equal(t, "ip:crawlers", events[1].Key)
+	require.Equal(t, crawler, events[1].Tags)
+	require.Empty(t, events[2].Tags)
+	require.Equal(t, crawler, events[3].Tags)
+	require.Empty(t, events[4].Tags)
+}
+
+func TestRedisFunctions(t *testing.T) {
+	ctx := context.Background()
+	l := newTestLimiter(t, false, redis_rate.WithRedisFunctions())
+	ring := newTestRing()
+	limit := redis_rate.PerSecond(10)
+	climit := redis_rate.ConcurrencyLimit{Max: 2}
+
+	// the library is loaded on first use, or the limiter switches to
+	// EVALSHA on servers without functions.
+	res, err := l.Allow(ctx, "a", limit)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), res.Allowed)
+
+	_ = ring.FunctionFlush(ctx).Err()
+	pipe := l.Pipeline()
+	pres := pipe.Allow(ctx, "a", limit)
+	take := pipe.Take(ctx, "c", "req1", climit)
+	require.NoError(t, pipe.Exec(ctx))
+	require.Equal(t, int64(1), pres.Allowed)
+	require.Equal(t, int64(8), pres.Remaining)
+	require.True(t, take.Allowed)
+
+	res, err = l.Allow(ctx, "a", limit)
+	require.NoError(t, err)
+	require.Equal(t, int64(7), res.Remaining)
+
+	require.NoError(t, l.LoadScripts(ctx))
+}
+
+func TestScriptFlushRecovery(t *testing.T) {
+	ctx := context.Background()
+	loads := 0
+	l := newTestLimiter(t, true, redis_rate.WithHooks(redis_rate.Hooks{
+		OnScriptLoad: func(ctx context.Context, ev redis_rate.ScriptLoadEvent) {
+			require.NoError(t, ev.Err)
+			loads++
+		},
+	}))
+	ring := newTestRing()
+	limit := redis_rate.PerSecond(10)
+	climit := redis_rate.ConcurrencyLimit{Max: 2}
+
+	res, err := l.Allow(ctx, "a", limit)
+	require.Nil(t, err)
+	require.Equal(t, int64(1), res.Allowed)
+
+	require.NoError(t, ring.ScriptFlush(ctx).Err())
+	loads = 0
+
+	var events []redis_rate.PipelineEvent
+	l2 := redis_rate.New(ring, redis_rate.WithHooks(redis_rate.Hooks{
+		OnPipelineExec: func(ctx context.Context, ev redis_rate.PipelineEvent) {
+			events = append(events, ev)
+		},
+	}))
+	pipe := l2.Pipeline()
+	pres := pipe.Allow(ctx, "a", limit)
+	take := pipe.Take(ctx, "c", "req1", climit)
+	require.NoError(t, pipe.Exec(ctx))
+	require.Equal(t, int64(1), pres.Allowed)
+	require.Equal(t, int64(8), pres.Remaining)
+	require.True(t, take.Allowed)
+	require.Equal(t, 2, events[0].Attempts)
+
+	require.NoError(t, ring.ScriptFlush(ctx).Err())
+	taken, err := l.TakeMulti(ctx, "req2", map[string]redis_rate.ConcurrencyLimit{"c": climit})
+	require.Nil(t, err)
+	require.True(t, taken["c"].Allowed)
+	require.Equal(t, int64(2), taken["c"].Used)
+
+	require.NoError(t, ring.ScriptFlush(ctx).Err())
+	require.Nil(t, l.Release(ctx, "c", "req2", climit))
+	require.Equal(t, 2, loads)
+
+	require.NoError(t, ring.ScriptFlush(ctx).Err())
+	res, err = l.Allow(ctx, "a", limit)
+	require.Nil(t, err)
+	require.Equal(t, int64(1), res.Allowed)
+}
+
+func TestVerifyScripts(t *testing.T) {
+	ctx := context.Background()
+	l := newTestLimiter(t, false)
+
+	err := l.VerifyScripts(ctx)
+	require.ErrorIs(t, err, redis_rate.ErrScriptNotLoaded)
+	var scriptErr *redis_rate.ScriptError
+	require.ErrorAs(t, err, &scriptErr)
+	require.Equal(t, 1, scriptErr.Total)
+	require.Len(t, scriptErr.Nodes, 1)
+
+	require.NoError(t, l.LoadScripts(ctx))
+	require.NoError(t, l.VerifyScripts(ctx))
+}
+
+func TestEvalCustom(t *testing.T) {
+	ctx := context.Background()
+	ring := newTestRing()
+	require.NoError(t, redis_rate.RegisterScript("test_incr_capped", `
+local n = redis.call("INCR", KEYS[1])
+if n > tonumber(ARGV[1]) then
+  redis.call("DECR", KEYS[1])
+  return 0
+end
+return n
+`))
+	l := newTestLimiter(t, false)
+	require.NoError(t, ring.Del(ctx, "custom:a").Err())
+
+	// not loaded yet, so sent again with EVAL.
+	n, err := l.EvalCustom(ctx, "test_incr_capped", []string{"custom:a"}, 2).Int64()
+	require.NoError(t, err)
+	require.Equal(t, int64(1), n)
+
+	require.NoError(t, l.LoadScripts(ctx))
+	require.NoError(t, l.VerifyScripts(ctx))
+
+	p := l.Pipeline()
+	first := p.EvalCustom(ctx, "test_incr_capped", []string{"custom:a"}, 2)
+	second := p.EvalCustom(ctx, "test_incr_capped", []string{"custom:a"}, 2)
+	require.NoError(t, p.Exec(ctx))
+	require.Equal(t, int64(2), first.Val())
+	require.Equal(t, int64(0), second.Val())
+}
+
+func TestScriptWatcher(t *testing.T) {
+	ctx := context.Background()
+	ring := newTestRing()
+	l := newTestLimiter(t, false)
+
+	w := l.StartScriptWatcher(ctx, time.Hour)
+	defer w.Stop()
+	require.Eventually(t, func() bool {
+		return w.Stats().Checks == 1
+	}, time.Second, 10*time.Millisecond)
+	require.NoError(t, l.VerifyScripts(ctx))
+	require.Equal(t, int64(1), w.Stats().Primed)
+
+	// a node that lost its scripts is primed again after the first NOSCRIPT.
+	require.NoError(t, ring.ScriptFlush(ctx).Err())
+	p := l.Pipeline()
+	res := p.Allow(ctx, "test_id", redis_rate.PerSecond(10))
+	require.NoError(t, p.Exec(ctx))
+	require.Equal(t, int64(1), res.Allowed)
+
+	require.Eventually(t, func() bool {
+		return w.Stats().Checks == 2
+	}, time.Second, 10*time.Millisecond)
+	require.NoError(t, l.VerifyScripts(ctx))
+	stats := w.Stats()
+	require.Equal(t, int64(1), stats.Invalidations)
+	require.Equal(t, int64(2), stats.Primed)
+	require.Equal(t, int64(0), stats.Errors)
+}
+
+func TestRediserConn(t *testing.T) {
+	ctx := context.Background()
+	ring := newTestRing()
+	require.NoError(t, ring.FlushDB(ctx).Err())
+	require.NoError(t, ring.ScriptFlush(ctx).Err())
+
+	conn := redis_rate.NewRediserConn(redis_rate.GoRediser(ring))
+	l := redis_rate.New(conn)
+	limit := redis_rate.PerSecond(10)
+	climit := redis_rate.ConcurrencyLimit{Max: 2, RequestMaxDuration: time.Minute}
+
+	// Scripts are not loaded yet, so this also covers NOSCRIPT errors.
+	res, err := l.Allow(ctx, "a", limit)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), res.Allowed)
+	require.Equal(t, int64(9), res.Remaining)
+
+	pipe := l.Pipeline()
+	pres := pipe.Allow(ctx, "a", limit)
+	take := pipe.Take(ctx, "c", "req1", climit)
+	require.NoError(t, pipe.Exec(ctx))
+	require.Equal(t, int64(8), pres.Remaining)
+	require.True(t, take.Allowed)
+
+	holders, err := l.Holders(ctx, "c", climit)
+	require.NoError(t, err)
+	require.Len(t, holders, 1)
+	require.Equal(t, "req1", holders[0].RequestID)
+
+	require.NoError(t, l.Reset(ctx, "a"))
+	res, err = l.AllowN(ctx, "a", limit, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(10), res.Remaining)
+
+	require.NoError(t, l.LoadScripts(ctx))
+	require.NoError(t, l.VerifyScripts(ctx))
+}
+
+// argsRediser records the types of the arguments it is sent.
+type argsRediser struct {
+	types map[string]bool
+}
+
+func (r *argsRediser) Do(ctx context.Context, args ...interface{}) (interface{}, error) {
+	for _, arg := range args {
+		r.types[fmt.Sprintf("%T", arg)] = true
+	}
+	return nil, redis_rate.ReplyError("ERR unavailable")
+}
+
+func (r *argsRediser) DoMulti(ctx context.Context, cmds ...[]interface{}) ([]interface{}, []error) {
+	errs := make([]error, len(cmds))
+	for i, args := range cmds {
+		_, errs[i] = r.Do(ctx, args...)
+	}
+	return make([]interface{}, len(cmds)), errs
+}
+
+func TestRediserConnArgs(t *testing.T) {
+	ctx := context.Background()
+	r := &argsRediser{types: make(map[string]bool)}
+	l := redis_rate.New(redis_rate.NewRediserConn(r))
+
+	_, err := l.Allow(ctx, "a", redis_rate.PerSecond(10))
+	require.Error(t, err)
+	pipe := l.Pipeline()
+	pipe.Allow(ctx, "a", redis_rate.PerSecond(10))
+	require.Error(t, pipe.Exec(ctx))
+
+	for typ := range r.types {
+		require.Contains(t, []string{"string", "[]uint8", "int64"}, typ)
+	}
+}
+
+func TestPipelinePartialFailure(t *testing.T) {
+	ctx := context.Background()
+	l := newTestLimiter(t, true)
+	require.NoError(t, newTestRing().Set(ctx, "concurrency:bad", "not a hash", 0).Err())
+	limit := redis_rate.PerSecond(10)
+	climit := redis_rate.ConcurrencyLimit{Max: 1, RequestMaxDuration: time.Minute}
+
+	pipe := l.Pipeline()
+	allow := pipe.Allow(ctx, "a", limit)
+	bad := pipe.Take(ctx, "bad", "req1", climit)
+	good := pipe.Take(ctx, "good", "req1", climit)
+	err := pipe.Exec(ctx)
+
+	var perr *redis_rate.PipelineError
+	require.ErrorAs(t, err, &perr)
+	require.Equal(t, []string{"bad"}, perr.Keys)
+	require.True(t, redis.HasErrorPrefix(perr.Err, "WRONGTYPE"))
+	require.Error(t, bad.Err)
+	require.NoError(t, allow.Err)
+	require.Equal(t, int64(1), allow.Allowed)
+	require.NoError(t, good.Err)
+	require.True(t, good.Allowed)
+
+	l = redis_rate.New(newTestRing(), redis_rate.WithPipelineAllOrNothing())
+	pipe = l.Pipeline()
+	pipe.Take(ctx, "bad", "req1", climit)
+	err = pipe.Exec(ctx)
+	require.Error(t, err)
+	require.False(t, errors.As(err, &perr))
+}
+
+// failingRediser fails the commands with an argument in fail and replies to
+// the others with the reply of an allowed request.
+type failingRediser struct {
+	fail map[string]bool
+}
+
+func (r *failingRediser) Do(ctx context.Context, args ...interface{}) (interface{}, error) {
+	for _, arg := range args {
+		if s, ok := arg.(string); ok && r.fail[s] {
+			return nil, redis_rate.ReplyError("ERR failed")
+		}
+	}
+	if strings.EqualFold(args[0].(string), "publish") {
+		return int64(0), nil
+	}
+	return []interface{}{int64(1), int64(9), "-1", "0.1"}, nil
+}
+
+func (r *failingRediser) DoMulti(ctx context.Context, cmds ...[]interface{}) ([]interface{}, []error) {
+	replies := make([]interface{}, len(cmds))
+	errs := make([]error, len(cmds))
+	for i, args := range cmds {
+		replies[i], errs[i] = r.Do(ctx, args...)
+	}
+	return replies, errs
+}
+
+func TestPipelineErrorsPerCommand(t *testing.T) {
+	ctx := context.Background()
+	r := &failingRediser{fail: map[string]bool{"req2": true}}
+	var releaseErrs []error
+	l := redis_rate.New(redis_rate.NewRediserConn(r), redis_rate.WithHooks(redis_rate.Hooks{
+		OnConcurrency: func(ctx context.Context, ev redis_rate.ConcurrencyEvent) {
+			releaseErrs = append(releaseErrs, ev.Err)
+		},
+	}))
+
+	// releases of the same key fail on their own.
+	pipe := l.Pipeline()
+	pipe.Release(ctx, "a", "req1")
+	pipe.Release(ctx, "a", "req2")
+	err := pipe.Exec(ctx)
+	var perr *redis_rate.PipelineError
+	require.ErrorAs(t, err, &perr)
+	require.Equal(t, []string{"a"}, perr.Keys)
+	require.Len(t, releaseErrs, 2)
+	require.NoError(t, releaseErrs[0])
+	require.Error(t, releaseErrs[1])
+
+	// errors do not outlive the Exec that set them.
+	r.fail = map[string]bool{"rate:b": true}
+	pipe = l.Pipeline()
+	res := pipe.Allow(ctx, "b", redis_rate.PerSecond(10))
+	require.Error(t, pipe.Exec(ctx))
+	require.Error(t, res.Err)
+	r.fail = nil
+	require.NoError(t, pipe.Exec(ctx))
+	require.NoError(t, res.Err)
+	require.Equal(t, int64(1), res.Allowed)
+}
+
+func TestInspectMulti(t *testing.T) {
+	ctx := context.Background()
+	l := newTestLimiter(t, true)
+
+	res, err := l.Allow(ctx, "gcra", redis_rate.PerSecond(10))
+	require.NoError(t, err)
+	_, err = l.AllowN(ctx, "calendar", redis_rate.PerDay(100), 3)
+	require.NoError(t, err)
+
+	states, err := l.InspectMulti(ctx, []string{"gcra", "calendar", "missing"})
+	require.NoError(t, err)
+	require.Len(t, states, 3)
+
+	require.NoError(t, states[0].Err)
+	require.True(t, states[0].Exists)
+	require.WithinDuration(t, res.ResetAt, states[0].ResetAt, 10*time.Millisecond)
+	require.Greater(t, states[0].TTL, time.Duration(0))
+
+	require.NoError(t, states[1].Err)
+	require.True(t, states[1].Exists)
+	require.Equal(t, int64(3), states[1].Used)
+
+	require.NoError(t, states[2].Err)
+	require.False(t, states[2].Exists)
+	require.True(t, states[2].ResetAt.IsZero())
+
+	state, err := l.Inspect(ctx, "gcra")
+	require.NoError(t, err)
+	require.Equal(t, "gcra", state.Key)
+}
+
+// keyspaceRediser serves reads from a fixed keyspace and counts the
+// replies that failed with WRONGTYPE.
+type keyspaceRediser struct {
+	strings   map[string]string
+	hashes    map[string]map[string]string
+	wrongType int
+}
+
+func (r *keyspaceRediser) Do(ctx context.Context, args ...interface{}) (interface{}, error) {
+	var key string
+	if len(args) > 1 {
+		key, _ = args[1].(string)
+	}
+	s, isString := r.strings[key]
+	h, isHash := r.hashes[key]
+	switch strings.ToLower(args[0].(string)) {
+	case "time":
+		return []interface{}{"1700000000", "0"}, nil
+	case "type":
+		if isString {
+			return "string", nil
+		} else if isHash {
+			return "hash", nil
+		}
+		return "none", nil
+	case "pttl":
+		if isString || isHash {
+			return int64(60000), nil
+		}
+		return int64(-2), nil
+	case "get":
+		if isHash {
+			r.wrongType++
+			return nil, redis_rate.ReplyError("WRONGTYPE Operation against a key holding the wrong kind of value")
+		}
+		if !isString {
+			return nil, nil
+		}
+		return s, nil
+	case "hget", "hmget":
+		if isString {
+			r.wrongType++
+			return nil, redis_rate.ReplyError("WRONGTYPE Operation against a key holding the wrong kind of value")
+		}
+		values := make([]interface{}, len(args)-2)
+		for i, field := range args[2:] {
+			if v, ok := h[field.(string)]; ok {
+				values[i] = v
+			}
+		}
+		if strings.EqualFold(args[0].(string), "hget") {
+			return values[0], nil
+		}
+		return values, nil
+	}
+	return nil, redis_rate.ReplyError("ERR unknown command")
+}
+
+func (r *keyspaceRediser) DoMulti(ctx context.Context, cmds ...[]interface{}) ([]interface{}, []error) {
+	replies := make([]interface{}, len(cmds))
+	errs := make([]error, len(cmds))
+	for i, args := range cmds {
+		replies[i], errs[i] = r.Do(ctx, args...)
+	}
+	return replies, errs
+}
+
+func TestInspectMultiReadsByType(t *testing.T) {
+	ctx := context.Background()
+	r := &keyspaceRediser{
+		strings: map[string]string{"rate:gcra": "1000.5"},
+		hashes:  map[string]map[string]string{"rate:calendar": {"w": "1", "n": "3"}},
+	}
+	l := redis_rate.New(redis_rate.NewRediserConn(r))
+
+	states, err := l.InspectMulti(ctx, []string{"gcra", "calendar", "missing"})
+	require.NoError(t, err)
+	for _, state := range states {
+		require.NoError(t, state.Err)
+	}
+	require.True(t, states[0].Exists)
+	require.Equal(t, int64(3), states[1].Used)
+	require.False(t, states[2].Exists)
+	require.Zero(t, r.wrongType)
+}
+
+func TestStorageFormat(t *testing.T) {
+	ctx := context.Background()
+	limit := redis_rate.PerMinute(10)
+	compact := newTestLimiter(t, true, redis_rate.WithStorageFormat(redis_rate.StorageCompact))
+	text := redis_rate.New(newTestRing())
+
+	res, err := compact.AllowN(ctx, "test_id", limit, 2)
+	require.NoError(t, err)
+	require.Equal(t, int64(8), res.Remaining)
+
+	v, err := newTestRing().Get(ctx, "rate:test_id").Result()
+	require.NoError(t, err)
+	require.Len(t, v, 9)
+
+	// either format is read by both.
+	res, err = text.AllowN(ctx, "test_id", limit, 3)
+	require.NoError(t, err)
+	require.Equal(t, int64(5), res.Remaining)
+
+	res, err = compact.AllowAtMost(ctx, "test_id", limit, 1)
+	require.NoError(t, err)
+	require.Equal(t, int64(4), res.Remaining)
+
+	usage, err := text.Usage(ctx, []string{"test_id"}, map[string]redis_rate.Limit{"test_id": limit})
+	require.NoError(t, err)
+	require.Equal(t, int64(6), usage[0].Used)
+
+	state, err := text.Inspect(ctx, "test_id")
+	require.NoError(t, err)
+	require.True(t, state.Exists)
+}
+
+func TestKeyTTL(t *testing.T) {
+	ctx := context.Background()
+	ring := newTestRing()
+
+	l := newTestLimiter(t, true, redis_rate.WithKeyTTLFactor(3))
+	_, err := l.Allow(ctx, "test_id", redis_rate.PerMinute(60))
+	require.NoError(t, err)
+	ttl, err := ring.TTL(ctx, "rate:test_id").Result()
+	require.NoError(t, err)
+	require.Equal(t, 3*time.Second, ttl)
+
+	l = newTestLimiter(t, true, redis_rate.WithKeyMaxTTL(time.Hour))
+	_, err = l.AllowHierarchy(ctx, []redis_rate.KeyLimit{
+		{Key: "{org}", Limit: redis_rate.PerSecond(1)},
+		{Key: "{org}:monthly", Limit: redis_rate.Limit{Rate: 10, Burst: 10, Period: 30 * 24 * time.Hour}},
+	}, 1)
+	require.NoError(t, err)
+	ttl, err = ring.TTL(ctx, "rate:{org}:monthly").Result()
+	require.NoError(t, err)
+	require.Equal(t, time.Hour, ttl)
+	ttl, err = ring.TTL(ctx, "rate:{org}").Result()
+	require.NoError(t, err)
+	require.Equal(t, time.Second, ttl)
+}
+
+func TestKeyWatcher(t *testing.T) {
+	ctx := context.Background()
+	ring := newTestRing()
+	require.NoError(t, ring.ForEachShard(ctx, func(ctx context.Context, client *redis.Client) error {
+		return client.ConfigSet(ctx, "notify-keyspace-events", "Exgn").Err()
+	}))
+
+	events := make(chan redis_rate.KeyEvent, 10)
+	l := newTestLimiter(t, true, redis_rate.WithHooks(redis_rate.Hooks{
+		OnKeyEvent: func(ctx context.Context, ev redis_rate.KeyEvent) {
+			events <- ev
+		},
+	}))
+	w, err := l.StartKeyWatcher(ctx)
+	require.NoError(t, err)
+	defer w.Stop()
+
+	_, err = l.Allow(ctx, "test_id", redis_rate.PerSecond(10))
+	require.NoError(t, err)
+	ev := <-events
+	require.Equal(t, redis_rate.KeyCreated, ev.Type)
+	require.Equal(t, redis_rate.KeyKindRate, ev.Kind)
+	require.Equal(t, "test_id", ev.Key)
+
+	require.NoError(t, l.Reset(ctx, "test_id"))
+	ev = <-events
+	require.Equal(t, redis_rate.KeyDeleted, ev.Type)
+	require.Equal(t, "test_id", ev.Key)
+
+	_, err = l.Allow(ctx, "test_id", redis_rate.PerSecond(10))
+	require.NoError(t, err)
+	require.Equal(t, redis_rate.KeyCreated, (<-events).Type)
+	ev = <-events
+	require.Equal(t, redis_rate.KeyExpired, ev.Type)
+	require.Equal(t, "test_id", ev.Key)
+	require.Equal(t, redis_rate.KeyWatcherStats{Created: 2, Expired: 1, Deleted: 1}, w.Stats())
+}
+
+func TestWatchResets(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ring := newTestRing()
+	require.NoError(t, ring.ForEachShard(ctx, func(ctx context.Context, client *redis.Client) error {
+		return client.ConfigSet(ctx, "notify-keyspace-events", "Eg").Err()
+	}))
+
+	l := newTestLimiter(t, true, redis_rate.WithDenialCache(time.Minute, 100))
+	resets, err := l.WatchResets(ctx, "tenant1:")
+	require.NoError(t, err)
+
+	limit := redis_rate.PerMinute(1)
+	res, err := l.Allow(ctx, "tenant1:api", limit)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), res.Allowed)
+	res, err = l.Allow(ctx, "tenant1:api", limit)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), res.Allowed)
+
+	// deleted out-of-band, so only the watcher can clear the denial cache.
+	require.NoError(t, ring.Del(ctx, "rate:tenant2:api").Err())
+	require.NoError(t, ring.Del(ctx, "rate:tenant1:api").Err())
+	require.Equal(t, "tenant1:api", <-resets)
+
+	res, err = l.Allow(ctx, "tenant1:api", limit)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), res.Allowed)
+
+	cancel()
+	for range resets {
+	}
+}
+
+func TestTopConsumers(t *testing.T) {
+	ctx := context.Background()
+	clock := redis_rate.NewManualClock(time.Unix(1700000000, 0))
+	l := newTestLimiter(t, true, redis_rate.WithClock(clock), redis_rate.WithTopConsumers(time.Minute))
+	limit := redis_rate.PerSecond(100)
+
+	_, err := l.AllowN(ctx, "heavy", limit, 10)
+	require.NoError(t, err)
+	_, err = l.Allow(ctx, "light", limit)
+	require.NoError(t, err)
+	_, err = l.AllowAtMost(ctx, "medium", limit, 5)
+	require.NoError(t, err)
+
+	top, err := l.TopConsumers(ctx, clock.Now(), 2)
+	require.NoError(t, err)
+	require.Equal(t, []redis_rate.Consumer{{Key: "heavy", Events: 10}, {Key: "medium", Events: 5}}, top)
+
+	clock.Advance(time.Minute)
+	_, err = l.Allow(ctx, "light", limit)
+	require.NoError(t, err)
+	top, err = l.TopConsumers(ctx, clock.Now(), 10)
+	require.NoError(t, err)
+	require.Equal(t, []redis_rate.Consumer{{Key: "light", Events: 1}}, top)
+
+	_, err = newTestLimiter(t, false).TopConsumers(ctx, clock.Now(), 10)
+	require.ErrorIs(t, err, redis_rate.ErrNoTopConsumers)
+}
+
+func TestFairnessReport(t *testing.T) {
+	ctx := context.Background()
+	clock := redis_rate.NewManualClock(time.Unix(1700000000, 0))
+	l := newTestLimiter(t, true, redis_rate.WithClock(clock), redis_rate.WithFairness(time.Minute, 3))
+	org := redis_rate.KeyLimit{Key: "{org}", Limit: redis_rate.PerMinute(100)}
+	child := func(name string) redis_rate.KeyLimit {
+		return redis_rate.KeyLimit{Key: "{org}:" + name, Limit: redis_rate.PerMinute(100)}
+	}
+
+	_, err := l.AllowHierarchy(ctx, []redis_rate.KeyLimit{org, child("a")}, 3)
+	require.NoError(t, err)
+	clock.Advance(time.Minute)
+	_, err = l.AllowHierarchy(ctx, []redis_rate.KeyLimit{org, child("a")}, 3)
+	require.NoError(t, err)
+	_, err = l.AllowHierarchy(ctx, []redis_rate.KeyLimit{org, child("b")}, 2)
+	require.NoError(t, err)
+
+	report, err := l.FairnessReport(ctx, "{org}", 5)
+	require.NoError(t, err)
+	require.Equal(t, "{org}", report.Parent)
+	require.Len(t, report.Windows, 3)
+	require.Equal(t, clock.Now().Truncate(time.Minute), report.Windows[0].Start)
+	require.Equal(t, int64(5), report.Windows[0].Total)
+	require.Equal(t, []redis_rate.ChildShare{
+		{Child: "{org}:a", Events: 3, Share: 0.6},
+		{Child: "{org}:b", Events: 2, Share: 0.4},
+	}, report.Windows[0].Children)
+	require.Equal(t, int64(3), report.Windows[1].Total)
+	require.Empty(t, report.Windows[2].Children)
+	require.Equal(t, []redis_rate.ChildShare{
+		{Child: "{org}:a", Events: 6, Share: 0.75},
+		{Child: "{org}:b", Events: 2, Share: 0.25},
+	}, report.Children)
+
+	_, err = newTestLimiter(t, false).FairnessReport(ctx, "{org}", 1)
+	require.ErrorIs(t, err, redis_rate.ErrNoFairness)
+}
+
+func TestDumpRestoreState(t *testing.T) {
+	ctx := context.Background()
+	l := newTestLimiter(t, true)
+	limit := redis_rate.PerMinute(10)
+	climit := redis_rate.ConcurrencyLimit{Max: 2, RequestMaxDuration: time.Minute}
+
+	_, err := l.AllowN(ctx, "tenant1:api", limit, 4)
+	require.NoError(t, err)
+	_, err = l.Take(ctx, "tenant1:jobs", "req1", climit)
+	require.NoError(t, err)
+	_, err = l.Allow(ctx, "tenant2:api", limit)
+	require.NoError(t, err)
+
+	entries, err := l.DumpState(ctx, "tenant1:")
+	require.NoError(t, err)
+	keys := make([]string, 0, len(entries))
+	for _, e := range entries {
+		keys = append(keys, e.Key)
+	}
+	require.Contains(t, keys, "rate:tenant1:api")
+	require.Contains(t, keys, "concurrency:tenant1:jobs")
+	require.NotContains(t, keys, "rate:tenant2:api")
+
+	// entries survive a round trip through JSON.
+	b, err := json.Marshal(entries)
+	require.NoError(t, err)
+	entries = nil
+	require.NoError(t, json.Unmarshal(b, &entries))
+
+	require.NoError(t, newTestRing().FlushDB(ctx).Err())
+	require.NoError(t, l.RestoreState(ctx, entries))
+
+	res, err := l.Allow(ctx, "tenant1:api", limit)
+	require.NoError(t, err)
+	require.Equal(t, int64(5), res.Remaining)
+
+	cres, err := l.Take(ctx, "tenant1:jobs", "req2", climit)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), cres.Used)
+
+	res, err = l.Allow(ctx, "tenant2:api", limit)
+	require.NoError(t, err)
+	require.Equal(t, int64(9), res.Remaining)
+}
+
+func TestLease(t *testing.T) {
+	ctx := context.Background()
+	clock := redis_rate.NewManualClock(time.Now())
+	l := newTestLimiter(t, true, redis_rate.WithClock(clock))
+	limit := redis_rate.PerMinute(60)
+
+	// the burst and one more minute of the rate.
+	ls, err := l.Lease(ctx, "test_id", limit, 200, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, int64(120), ls.Granted())
+
+	res, err := l.Allow(ctx, "test_id", limit)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), res.Allowed)
+
+	require.Equal(t, int64(30), ls.Draw(30))
+	require.Equal(t, int64(90), ls.Remaining())
+	refunded, err := ls.Close(ctx)
+	require.NoError(t, err)
+	require.Equal(t, int64(90), refunded)
+	require.Equal(t, int64(0), ls.Draw(1))
+	_, err = ls.Close(ctx)
+	require.ErrorIs(t, err, redis_rate.ErrLeaseClosed)
+
+	res, err = l.Allow(ctx, "test_id", limit)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), res.Allowed)
+	require.Equal(t, int64(29), res.Remaining)
+
+	ls, err = l.Lease(ctx, "test_id", limit, 10, time.Minute)
+	require.NoError(t, err)
+	clock.Advance(time.Minute)
+	require.Equal(t, int64(0), ls.Draw(1))
+}
+
+// baselineConn implements only RedisClientConn, like a custom client.
+type baselineConn struct {
+	redis_rate.RedisClientConn
+}
+
+func TestUnsupportedClient(t *testing.T) {
+	ctx := context.Background()
+	l := redis_rate.New(baselineConn{})
+
+	_, err := l.HoldStats(ctx, "test_id")
+	require.ErrorIs(t, err, redis_rate.ErrUnsupportedClient)
+	_, err = l.Sweep(ctx)
+	require.ErrorIs(t, err, redis_rate.ErrUnsupportedClient)
+	_, err = l.DumpState(ctx, "")
+	require.ErrorIs(t, err, redis_rate.ErrUnsupportedClient)
+}
@@ -0,0 +1,330 @@
+// Package ratebench measures the capacity and accuracy of a rate limiter
+// under an offered load, so limiter capacity tests can be embedded in load
+// testing tools. Run drives a limiter at a fixed request rate and reports
+// latency percentiles and how closely the allowed requests match the limit;
+// Generate, LatencyCollector and AccuracyCollector are its building blocks.
+package ratebench
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ductone/redis_rate/v11"
+)
+
+// DefaultWorkers is the number of concurrent requests Run allows unless
+// Config.Workers is set.
+const DefaultWorkers = 64
+
+// ErrInvalidConfig is returned by Run for a Config without a positive Rate
+// and Duration.
+var ErrInvalidConfig = errors.New("ratebench: rate and duration must be positive")
+
+// AllowFunc makes a single rate limited request for key.
+type AllowFunc func(ctx context.Context, key string) (*redis_rate.Result, error)
+
+// LimiterAllow returns an AllowFunc calling l.Allow with limit.
+func LimiterAllow(l redis_rate.LimiterI, limit redis_rate.Limit) AllowFunc {
+	return func(ctx context.Context, key string) (*redis_rate.Result, error) {
+		return l.Allow(ctx, key, limit)
+	}
+}
+
+// Generate calls fn rate times per second for d, or until ctx is done, with
+// at most workers calls in flight. The load is open loop: a call that is due
+// while every worker is busy is dropped rather than delayed, so a slow
+// limiter does not lower the offered rate. It returns the number of calls
+// made and dropped, and waits for every call to return.
+func Generate(ctx context.Context, rate float64, d time.Duration, workers int, fn func(ctx context.Context, i int)) (sent int, dropped int) {
+	if rate <= 0 || d <= 0 {
+		return 0, 0
+	}
+	if workers <= 0 {
+		workers = DefaultWorkers
+	}
+
+	interval := time.Duration(float64(time.Second) / rate)
+	total := int(math.Floor(d.Seconds() * rate))
+	sem := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	start := time.Now()
+	for i := 0; i < total; i++ {
+		if wait := time.Until(start.Add(time.Duration(i) * interval)); wait > 0 {
+			timer.Reset(wait)
+			select {
+			case <-ctx.Done():
+				return sent, dropped
+			case <-timer.C:
+			}
+		} else if ctx.Err() != nil {
+			return sent, dropped
+		}
+
+		select {
+		case sem <- struct{}{}:
+		default:
+			dropped++
+			continue
+		}
+		sent++
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			fn(ctx, i)
+		}(i)
+	}
+	return sent, dropped
+}
+
+// LatencyCollector records request latencies. It is safe for concurrent
+// use.
+type LatencyCollector struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	sorted  bool
+}
+
+// Observe records a single latency.
+func (c *LatencyCollector) Observe(d time.Duration) {
+	c.mu.Lock()
+	c.samples = append(c.samples, d)
+	c.sorted = false
+	c.mu.Unlock()
+}
+
+// Summary returns the count, mean, and 50th, 90th, 99th percentile and
+// maximum of the recorded latencies.
+func (c *LatencyCollector) Summary() LatencySummary {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.samples) == 0 {
+		return LatencySummary{}
+	}
+	c.sort()
+
+	var total time.Duration
+	for _, d := range c.samples {
+		total += d
+	}
+	return LatencySummary{
+		Count: len(c.samples),
+		Mean:  total / time.Duration(len(c.samples)),
+		P50:   c.percentile(50),
+		P90:   c.percentile(90),
+		P99:   c.percentile(99),
+		Max:   c.samples[len(c.samples)-1],
+	}
+}
+
+// Percentile returns the latency below which p percent of the recorded
+// latencies fall, or 0 if none were recorded.
+func (c *LatencyCollector) Percentile(p float64) time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.samples) == 0 {
+		return 0
+	}
+	c.sort()
+	return c.percentile(p)
+}
+
+func (c *LatencyCollector) sort() {
+	if !c.sorted {
+		sort.Slice(c.samples, func(i, j int) bool { return c.samples[i] < c.samples[j] })
+		c.sorted = true
+	}
+}
+
+// percentile uses the nearest-rank method on the sorted samples.
+func (c *LatencyCollector) percentile(p float64) time.Duration {
+	rank := int(math.Ceil(p / 100 * float64(len(c.samples))))
+	if rank < 1 {
+		rank = 1
+	}
+	if rank > len(c.samples) {
+		rank = len(c.samples)
+	}
+	return c.samples[rank-1]
+}
+
+// LatencySummary summarizes the latencies recorded by a LatencyCollector.
+type LatencySummary struct {
+	Count int
+	Mean  time.Duration
+	P50   time.Duration
+	P90   time.Duration
+	P99   time.Duration
+	Max   time.Duration
+}
+
+// AccuracyCollector counts allowed and denied requests per key to compare
+// them with what a limit should allow. It is safe for concurrent use.
+type AccuracyCollector struct {
+	limit redis_rate.Limit
+
+	mu   sync.Mutex
+	keys map[string]*keyCounts
+}
+
+type keyCounts struct {
+	requests int
+	allowed  int
+}
+
+// NewAccuracyCollector returns an AccuracyCollector for requests made
+// against limit.
+func NewAccuracyCollector(limit redis_rate.Limit) *AccuracyCollector {
+	return &AccuracyCollector{
+		limit: limit,
+		keys:  make(map[string]*keyCounts),
+	}
+}
+
+// Observe records the result of a request for key.
+func (c *AccuracyCollector) Observe(key string, res *redis_rate.Result) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counts := c.keys[key]
+	if counts == nil {
+		counts = &keyCounts{}
+		c.keys[key] = counts
+	}
+	counts.requests++
+	if res.Allowed > 0 {
+		counts.allowed++
+	}
+}
+
+// Accuracy compares the recorded results with what the limit allows over
+// elapsed, starting from fresh keys: for each key, the burst plus one
+// request per emission interval, but no more than were made.
+func (c *AccuracyCollector) Accuracy(elapsed time.Duration) Accuracy {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	capacity := float64(c.limit.Burst)
+	if c.limit.Period > 0 {
+		capacity += float64(c.limit.Rate) * elapsed.Seconds() / c.limit.Period.Seconds()
+	}
+
+	var rv Accuracy
+	for _, counts := range c.keys {
+		rv.Allowed += counts.allowed
+		rv.Denied += counts.requests - counts.allowed
+		rv.Expected += math.Min(float64(counts.requests), capacity)
+	}
+	if rv.Expected > 0 {
+		rv.Error = (float64(rv.Allowed) - rv.Expected) / rv.Expected
+	}
+	return rv
+}
+
+// Accuracy reports how many requests were allowed compared to the limit.
+type Accuracy struct {
+	Allowed int
+	Denied  int
+
+	// Expected is the number of requests the limit should have allowed.
+	Expected float64
+
+	// Error is the relative difference between Allowed and Expected, which
+	// is positive when the limiter allowed too many requests.
+	Error float64
+}
+
+// Config configures Run.
+type Config struct {
+	// Rate is the offered load in requests per second, across all keys.
+	Rate float64
+
+	// Duration is how long to offer the load for.
+	Duration time.Duration
+
+	// Workers is the maximum number of requests in flight. If unset the
+	// default is DefaultWorkers.
+	Workers int
+
+	// Keys are the keys requests are spread across, in turn. If unset every
+	// request uses the key "ratebench".
+	Keys []string
+
+	// Limit is the limit enforced by the AllowFunc, used to report
+	// Accuracy. Accuracy is not reported if it is zero.
+	Limit redis_rate.Limit
+}
+
+// Report is the result of Run.
+type Report struct {
+	// Sent is the number of requests made, Dropped the number not made
+	// because every worker was busy, and Errors the number that failed.
+	Sent    int
+	Dropped int
+	Errors  int
+
+	// Elapsed is the time from the first request until the last returned.
+	Elapsed time.Duration
+
+	// Throughput is the number of completed requests per second.
+	Throughput float64
+
+	Latency  LatencySummary
+	Accuracy Accuracy
+}
+
+// Run offers cfg.Rate requests per second to allow for cfg.Duration and
+// reports the outcome. Keys should be fresh, since Accuracy assumes they
+// start with their full burst available.
+func Run(ctx context.Context, cfg Config, allow AllowFunc) (*Report, error) {
+	if cfg.Rate <= 0 || cfg.Duration <= 0 {
+		return nil, ErrInvalidConfig
+	}
+	keys := cfg.Keys
+	if len(keys) == 0 {
+		keys = []string{"ratebench"}
+	}
+
+	var latency LatencyCollector
+	accuracy := NewAccuracyCollector(cfg.Limit)
+	var mu sync.Mutex
+	errs := 0
+
+	start := time.Now()
+	sent, dropped := Generate(ctx, cfg.Rate, cfg.Duration, cfg.Workers, func(ctx context.Context, i int) {
+		key := keys[i%len(keys)]
+		reqStart := time.Now()
+		res, err := allow(ctx, key)
+		latency.Observe(time.Since(reqStart))
+		if err != nil {
+			mu.Lock()
+			errs++
+			mu.Unlock()
+			return
+		}
+		accuracy.Observe(key, res)
+	})
+	elapsed := time.Since(start)
+
+	rv := &Report{
+		Sent:    sent,
+		Dropped: dropped,
+		Errors:  errs,
+		Elapsed: elapsed,
+		Latency: latency.Summary(),
+	}
+	if elapsed > 0 {
+		rv.Throughput = float64(sent-errs) / elapsed.Seconds()
+	}
+	if !cfg.Limit.IsZero() {
+		rv.Accuracy = accuracy.Accuracy(elapsed)
+	}
+	return rv, ctx.Err()
+}
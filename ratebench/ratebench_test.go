@@ -0,0 +1,72 @@
+package ratebench_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ductone/redis_rate/v11"
+	"github.com/ductone/redis_rate/v11/ratebench"
+)
+
+func TestRun(t *testing.T) {
+	limit := redis_rate.PerSecond(100)
+	report, err := ratebench.Run(context.Background(), ratebench.Config{
+		Rate:     1000,
+		Duration: 500 * time.Millisecond,
+		Keys:     []string{"a", "b"},
+		Limit:    limit,
+	}, ratebench.LimiterAllow(redis_rate.NewMemory(), limit))
+	require.NoError(t, err)
+
+	require.Equal(t, 500, report.Sent+report.Dropped)
+	require.Equal(t, 0, report.Errors)
+	require.Equal(t, report.Sent, report.Latency.Count)
+	require.Equal(t, report.Sent, report.Accuracy.Allowed+report.Accuracy.Denied)
+	// each key gets its burst of 100 plus about 50 more over 500ms.
+	require.InDelta(t, 300, report.Accuracy.Allowed, 20)
+	require.InDelta(t, 0, report.Accuracy.Error, 0.1)
+
+	_, err = ratebench.Run(context.Background(), ratebench.Config{}, nil)
+	require.ErrorIs(t, err, ratebench.ErrInvalidConfig)
+}
+
+func TestLatencyCollector(t *testing.T) {
+	var c ratebench.LatencyCollector
+	require.Equal(t, time.Duration(0), c.Percentile(50))
+
+	for i := 100; i >= 1; i-- {
+		c.Observe(time.Duration(i) * time.Millisecond)
+	}
+	s := c.Summary()
+	require.Equal(t, 100, s.Count)
+	require.Equal(t, 50500*time.Microsecond, s.Mean)
+	require.Equal(t, 50*time.Millisecond, s.P50)
+	require.Equal(t, 90*time.Millisecond, s.P90)
+	require.Equal(t, 99*time.Millisecond, s.P99)
+	require.Equal(t, 100*time.Millisecond, s.Max)
+	require.Equal(t, time.Millisecond, c.Percentile(0))
+}
+
+func TestAccuracyCollector(t *testing.T) {
+	c := ratebench.NewAccuracyCollector(redis_rate.PerSecond(10))
+	for i := 0; i < 30; i++ {
+		c.Observe("a", &redis_rate.Result{Allowed: int64(boolInt(i < 22))})
+	}
+	c.Observe("b", &redis_rate.Result{Allowed: 1})
+
+	a := c.Accuracy(time.Second)
+	require.Equal(t, 23, a.Allowed)
+	require.Equal(t, 8, a.Denied)
+	require.Equal(t, 21.0, a.Expected)
+	require.InDelta(t, 2.0/21, a.Error, 1e-9)
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
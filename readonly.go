@@ -0,0 +1,227 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strconv"
+	"time"
+)
+
+// ErrReadOnly is matched by every ReadOnlyError.
+var ErrReadOnly = errors.New("redis_rate: limiter is read-only")
+
+// ReadOnlyError is returned by methods that would modify Redis when the
+// Limiter was created WithReadOnly.
+type ReadOnlyError struct {
+	// Method is the name of the rejected Limiter method.
+	Method string
+}
+
+func (e *ReadOnlyError) Error() string {
+	return "redis_rate: " + e.Method + " is not allowed on a read-only limiter"
+}
+
+func (e *ReadOnlyError) Is(target error) bool {
+	return target == ErrReadOnly
+}
+
+// WithReadOnly makes the Limiter read-only, for analytics replicas and
+// staging environments pointed at a snapshot of production Redis.
+//
+// Allow, AllowN, AllowAtMost, AllowSlidingWindow and Pipeline allows become
+// peeks: they report what would have been allowed from the stored state,
+// without consuming anything. Every other method that modifies Redis, including Take,
+// Release, Reset and pipelines with takes or releases, fails with a
+// ReadOnlyError. Scripts are still loaded on demand.
+func WithReadOnly() func(*Limiter) {
+	return func(l *Limiter) {
+		l.readOnly = true
+	}
+}
+
+// checkWritable returns a ReadOnlyError for method if l is read-only.
+func (l *Limiter) checkWritable(method string) error {
+	if l.readOnly {
+		return &ReadOnlyError{Method: method}
+	}
+	return nil
+}
+
+// peek reports what AllowN or AllowAtMost would return for each key
+// without consuming anything.
+func (l *Limiter) peek(ctx context.Context, rvs []*Result, n int, atMost bool) error {
+	keys := make([]string, len(rvs))
+	limits := make([]Limit, len(rvs))
+	for i, rv := range rvs {
+		keys[i] = rv.Key
+		limits[i] = rv.Limit
+	}
+	states, now, err := l.readState(ctx, keys, limits)
+	if err != nil {
+		return err
+	}
+	for i, rv := range rvs {
+		if rv.Limit.Calendar != CalendarNone {
+			err = rv.calendarPeek(states[i], now, n, atMost)
+		} else {
+			err = rv.gcraPeek(states[i], now, n, atMost)
+		}
+		if err != nil {
+			return err
+		}
+		rv.stamp(now, l.now)
+	}
+	return nil
+}
+
+// gcraPeek fills in r like script_allow_n.lua, or script_allow_at_most.lua
+// if atMost, would without storing the result.
+func (r *Result) gcraPeek(values []interface{}, now time.Time, n int, atMost bool) error {
+	emission, burstOffset := gcraParams(r.Limit)
+	nowSec := toScriptTime(now)
+	tat, err := parseTAT(values, nowSec)
+	if err != nil {
+		return err
+	}
+
+	cost := float64(n)
+	if atMost {
+		diff := nowSec - (tat - burstOffset)
+		remaining := diff / emission
+		if remaining < 1 {
+			r.Allowed = 0
+			r.Remaining = 0
+			r.RetryAfter = dur(emission - diff)
+			r.ResetAfter = dur(tat - nowSec)
+			return nil
+		}
+		cost = math.Min(cost, math.Floor(remaining))
+	}
+
+	newTAT := tat + emission*cost
+	diff := nowSec - (newTAT - burstOffset)
+	if diff < 0 {
+		r.Allowed = 0
+		r.Remaining = 0
+		r.RetryAfter = dur(-diff)
+		r.ResetAfter = dur(tat - nowSec)
+		return nil
+	}
+	r.Allowed = int64(cost)
+	r.Remaining = int64(diff / emission)
+	r.RetryAfter = -1
+	r.ResetAfter = dur(newTAT - nowSec)
+	return nil
+}
+
+// calendarPeek fills in r like script_allow_fixed_window.lua would without
+// storing the result.
+func (r *Result) calendarPeek(values []interface{}, now time.Time, n int, atMost bool) error {
+	used, end, err := parseCalendarUsed(values, r.Limit, now)
+	if err != nil {
+		return err
+	}
+	remaining := int64(r.Limit.Rate) - used
+	allowed := int64(n)
+	if atMost && allowed > remaining {
+		allowed = remaining
+	}
+	if allowed <= 0 || allowed > remaining {
+		r.Allowed = 0
+		r.Remaining = remaining
+		r.Used = used
+		r.RetryAfter = end.Sub(now)
+		if used > 0 {
+			r.ResetAfter = end.Sub(now)
+		}
+		return nil
+	}
+	r.Allowed = allowed
+	r.Used = used + allowed
+	r.Remaining = remaining - allowed
+	r.RetryAfter = -1
+	r.ResetAfter = end.Sub(now)
+	return nil
+}
+
+// peekSlidingWindow reports what AllowSlidingWindowN would return for key
+// without counting anything.
+func (l *Limiter) peekSlidingWindow(ctx context.Context, key string, limit Limit, n int) (*SlidingWindowResult, error) {
+	pl := l.rdb.Pipeline()
+	timeCmd := pl.Time(ctx)
+	countsCmd := pl.HGetAll(ctx, l.epochKey(ctx, l.allowKeyPrefix(ctx)+l.hashTagged(key)))
+	if _, err := pl.Exec(ctx); err != nil {
+		return nil, err
+	}
+	now, err := timeCmd.Result()
+	if err != nil {
+		return nil, err
+	}
+	if l.clock != nil {
+		now = l.clock.Now()
+	}
+
+	rv := &SlidingWindowResult{Key: key, Limit: limit}
+	if err := rv.slidingPeek(countsCmd.Val(), now, n); err != nil {
+		return nil, err
+	}
+	return rv, nil
+}
+
+// slidingPeek fills in r from the window counts of a sliding window key like
+// script_allow_sliding_window.lua would without counting the events.
+func (r *SlidingWindowResult) slidingPeek(counts map[string]string, now time.Time, n int) error {
+	rate := float64(r.Limit.Rate)
+	period := r.Limit.Period.Seconds()
+	cost := float64(n)
+	nowSec := toScriptTime(now)
+	window := math.Floor(nowSec / period)
+	elapsed := nowSec - window*period
+
+	count := func(window float64) (float64, error) {
+		v, ok := counts[strconv.FormatFloat(window, 'f', -1, 64)]
+		if !ok {
+			return 0, nil
+		}
+		return strconv.ParseFloat(v, 64)
+	}
+	cur, err := count(window)
+	if err != nil {
+		return err
+	}
+	prev, err := count(window - 1)
+	if err != nil {
+		return err
+	}
+	weight := (period - elapsed) / period
+	r.Count = prev*weight + cur
+
+	if r.Count+cost > rate {
+		r.Allowed = 0
+		r.RetryAfter = -1
+		switch {
+		case cost > rate:
+		case prev > 0 && cur+cost <= rate:
+			r.RetryAfter = dur(period*(1-(rate-cur-cost)/prev) - elapsed)
+		case cur > 0:
+			r.RetryAfter = dur((period - elapsed) + period*(1-(rate-cost)/cur))
+		}
+		switch {
+		case cur > 0:
+			r.ResetAfter = dur(2*period - elapsed)
+		case prev > 0:
+			r.ResetAfter = dur(period - elapsed)
+		}
+		if r.RetryAfter >= 0 {
+			r.Reason = ReasonRateExceeded
+		}
+	} else {
+		r.Allowed = int64(n)
+		r.Count += cost
+		r.RetryAfter = -1
+		r.ResetAfter = dur(2*period - elapsed)
+	}
+	r.Remaining = int64(math.Max(0, math.Floor(rate-r.Count)))
+	return nil
+}
@@ -0,0 +1,49 @@
+package redis_rate //nolint:revive // upstream used this name
+
+// Reason is why a request was denied, for API responses and logs that need
+// to tell denials apart. It is empty for requests that were allowed.
+type Reason string
+
+const (
+	// ReasonRateExceeded is a request denied because its rate limit has
+	// no capacity left.
+	ReasonRateExceeded Reason = "rate_exceeded"
+
+	// ReasonBanned is a request denied because its key is banned, see
+	// WithBans.
+	ReasonBanned Reason = "banned"
+
+	// ReasonFrozen is a request denied because its key is frozen, see
+	// WithFreezes.
+	ReasonFrozen Reason = "frozen"
+
+	// ReasonQueueFull is a concurrency take denied because every slot of
+	// its limit is held.
+	ReasonQueueFull Reason = "queue_full"
+
+	// ReasonOwnerCap is a concurrency take denied because its owner holds
+	// as many slots as ConcurrencyLimit.MaxPerOwner allows.
+	ReasonOwnerCap Reason = "owner_cap"
+
+	// ReasonDegradedFailClosed is a request denied by the FailClosed
+	// FallbackPolicy while Redis was unavailable.
+	ReasonDegradedFailClosed Reason = "degraded_fail_closed"
+
+	// ReasonExceedsLimit is a request for more events than its Limit can
+	// ever allow at once, such as more than Rate events in one calendar
+	// window. RetryAfter is then -1, as retrying does not help.
+	ReasonExceedsLimit Reason = "exceeds_limit"
+
+	// ReasonKillSwitch is a request denied because the kill switch set with
+	// WithKillSwitch was on.
+	ReasonKillSwitch Reason = "kill_switch"
+)
+
+// takeReason returns the Reason of a concurrency take that was allowed or
+// not.
+func takeReason(allowed bool) Reason {
+	if allowed {
+		return ""
+	}
+	return ReasonQueueFull
+}
@@ -0,0 +1,475 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"context"
+	"encoding"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Rediser is the minimal interface a Redis client library must implement to
+// be used by a Limiter through NewRediserConn, so the Limiter is not bound
+// to go-redis. Commands are given as their arguments, such as "evalsha",
+// sha, 1, key, each a string, []byte or int64; a []byte may be reused once
+// Do or DoMulti returns. Replies are returned as plain Go values: nil, int64,
+// string, []interface{} or map[string]interface{}.
+//
+// Errors replied by Redis itself, such as NOSCRIPT, must be returned as a
+// ReplyError, or another error implementing redis.Error, so they can be
+// told apart from network errors.
+type Rediser interface {
+	// Do sends a single command.
+	Do(ctx context.Context, args ...interface{}) (interface{}, error)
+
+	// DoMulti sends cmds, in a single round trip if possible, and returns
+	// the reply and error of each.
+	DoMulti(ctx context.Context, cmds ...[]interface{}) ([]interface{}, []error)
+}
+
+// ReplyError is an error replied by Redis, such as "NOSCRIPT No matching
+// script".
+type ReplyError string
+
+func (e ReplyError) Error() string { return string(e) }
+
+// RedisError implements redis.Error.
+func (ReplyError) RedisError() {}
+
+// errNoDial is returned for anything that would open a go-redis connection
+// on a client returned by NewRediserConn.
+var errNoDial = errors.New("redis_rate: connections are managed by the Rediser")
+
+// rediserConn hides everything but RedisClientConn, so features needing a
+// dedicated connection, such as pub/sub in TakeOrWait, fall back to
+// polling.
+type rediserConn struct {
+	RedisClientConn
+}
+
+// NewRediserConn returns a RedisClientConn, for use with New, that sends
+// every command through r. TakeOrWait polls instead of subscribing to
+// release notifications, and ResetByPrefix and LoadScripts treat r as a
+// single node.
+func NewRediserConn(r Rediser) RedisClientConn {
+	client := redis.NewClient(&redis.Options{})
+	client.AddHook(rediserHook{r: r})
+	return rediserConn{client}
+}
+
+type rediserHook struct {
+	r Rediser
+}
+
+func (h rediserHook) DialHook(redis.DialHook) redis.DialHook {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return nil, errNoDial
+	}
+}
+
+func (h rediserHook) ProcessHook(redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		args, err := plainArgs(cmd.Args())
+		if err != nil {
+			cmd.SetErr(err)
+			return err
+		}
+		v, err := h.r.Do(ctx, args...)
+		setReply(cmd, v, err)
+		return cmd.Err()
+	}
+}
+
+func (h rediserHook) ProcessPipelineHook(redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		args := make([][]interface{}, len(cmds))
+		for i, cmd := range cmds {
+			var err error
+			if args[i], err = plainArgs(cmd.Args()); err != nil {
+				for _, cmd := range cmds {
+					cmd.SetErr(err)
+				}
+				return err
+			}
+		}
+		vals, errs := h.r.DoMulti(ctx, args...)
+		var first error
+		for i, cmd := range cmds {
+			var v interface{}
+			var err error
+			if i < len(vals) {
+				v = vals[i]
+			}
+			if i < len(errs) {
+				err = errs[i]
+			}
+			if i >= len(vals) && err == nil {
+				err = fmt.Errorf("redis_rate: no reply for %q", cmd.Name())
+			}
+			setReply(cmd, v, err)
+			if first == nil {
+				first = cmd.Err()
+			}
+		}
+		return first
+	}
+}
+
+// plainArgs returns the arguments of a go-redis command converted to the
+// types passed to a Rediser, formatting them as go-redis would.
+func plainArgs(args []interface{}) ([]interface{}, error) {
+	rv := make([]interface{}, len(args))
+	for i, arg := range args {
+		switch v := arg.(type) {
+		case string, []byte, int64:
+			rv[i] = v
+		case nil:
+			rv[i] = ""
+		case int:
+			rv[i] = int64(v)
+		case int8:
+			rv[i] = int64(v)
+		case int16:
+			rv[i] = int64(v)
+		case int32:
+			rv[i] = int64(v)
+		case uint:
+			rv[i] = strconv.FormatUint(uint64(v), 10)
+		case uint8:
+			rv[i] = int64(v)
+		case uint16:
+			rv[i] = int64(v)
+		case uint32:
+			rv[i] = int64(v)
+		case uint64:
+			rv[i] = strconv.FormatUint(v, 10)
+		case float32:
+			rv[i] = strconv.FormatFloat(float64(v), 'f', -1, 32)
+		case float64:
+			rv[i] = strconv.FormatFloat(v, 'f', -1, 64)
+		case bool:
+			if v {
+				rv[i] = int64(1)
+			} else {
+				rv[i] = int64(0)
+			}
+		case time.Duration:
+			rv[i] = int64(v)
+		case time.Time:
+			rv[i] = v.Format(time.RFC3339Nano)
+		case encoding.BinaryMarshaler:
+			b, err := v.MarshalBinary()
+			if err != nil {
+				return nil, err
+			}
+			rv[i] = b
+		default:
+			rv[i] = fmt.Sprint(v)
+		}
+	}
+	return rv, nil
+}
+
+// setReply stores the reply v, or err, in cmd, converting v to the type
+// cmd expects.
+func setReply(cmd redis.Cmder, v interface{}, err error) {
+	if err == nil && v == nil {
+		err = redis.Nil
+	}
+	if err == nil {
+		err = setVal(cmd, v)
+	}
+	cmd.SetErr(err)
+}
+
+func setVal(cmd redis.Cmder, v interface{}) error {
+	switch cmd := cmd.(type) {
+	case *redis.Cmd:
+		cmd.SetVal(v)
+	case *redis.StatusCmd:
+		s, err := replyString(v)
+		if err != nil {
+			return err
+		}
+		cmd.SetVal(s)
+	case *redis.StringCmd:
+		s, err := replyString(v)
+		if err != nil {
+			return err
+		}
+		cmd.SetVal(s)
+	case *redis.IntCmd:
+		n, err := replyInt(v)
+		if err != nil {
+			return err
+		}
+		cmd.SetVal(n)
+	case *redis.DurationCmd:
+		n, err := replyInt(v)
+		if err != nil {
+			return err
+		}
+		// negative replies report a missing key or expiry, not a duration.
+		unit := time.Second
+		if cmd.Name() == "pttl" {
+			unit = time.Millisecond
+		}
+		if n < 0 {
+			unit = 1
+		}
+		cmd.SetVal(time.Duration(n) * unit)
+	case *redis.SliceCmd:
+		vals, err := replyArray(v)
+		if err != nil {
+			return err
+		}
+		cmd.SetVal(vals)
+	case *redis.StringSliceCmd:
+		vals, err := replyStrings(v)
+		if err != nil {
+			return err
+		}
+		cmd.SetVal(vals)
+	case *redis.BoolSliceCmd:
+		vals, err := replyArray(v)
+		if err != nil {
+			return err
+		}
+		bools := make([]bool, len(vals))
+		for i, v := range vals {
+			n, err := replyInt(v)
+			if err != nil {
+				return err
+			}
+			bools[i] = n == 1
+		}
+		cmd.SetVal(bools)
+	case *redis.MapStringStringCmd:
+		m, err := replyMap(v)
+		if err != nil {
+			return err
+		}
+		rv := make(map[string]string, len(m))
+		for k, v := range m {
+			if rv[k], err = replyString(v); err != nil {
+				return err
+			}
+		}
+		cmd.SetVal(rv)
+	case *redis.MapStringIntCmd:
+		m, err := replyMap(v)
+		if err != nil {
+			return err
+		}
+		rv := make(map[string]int64, len(m))
+		for k, v := range m {
+			if rv[k], err = replyInt(v); err != nil {
+				return err
+			}
+		}
+		cmd.SetVal(rv)
+	case *redis.TimeCmd:
+		vals, err := replyStrings(v)
+		if err != nil {
+			return err
+		}
+		if len(vals) != 2 {
+			return fmt.Errorf("redis_rate: unexpected TIME reply %v", v)
+		}
+		sec, err := strconv.ParseInt(vals[0], 10, 64)
+		if err != nil {
+			return err
+		}
+		usec, err := strconv.ParseInt(vals[1], 10, 64)
+		if err != nil {
+			return err
+		}
+		cmd.SetVal(time.Unix(sec, usec*int64(time.Microsecond)))
+	case *redis.ScanCmd:
+		vals, err := replyArray(v)
+		if err != nil {
+			return err
+		}
+		if len(vals) != 2 {
+			return fmt.Errorf("redis_rate: unexpected SCAN reply %v", v)
+		}
+		cursor, err := replyString(vals[0])
+		if err != nil {
+			return err
+		}
+		next, err := strconv.ParseUint(cursor, 10, 64)
+		if err != nil {
+			return err
+		}
+		page, err := replyStrings(vals[1])
+		if err != nil {
+			return err
+		}
+		cmd.SetVal(page, next)
+	case *redis.XMessageSliceCmd:
+		vals, err := replyArray(v)
+		if err != nil {
+			return err
+		}
+		msgs := make([]redis.XMessage, len(vals))
+		for i, v := range vals {
+			entry, err := replyArray(v)
+			if err != nil {
+				return err
+			}
+			if len(entry) != 2 {
+				return fmt.Errorf("redis_rate: unexpected stream entry %v", v)
+			}
+			if msgs[i].ID, err = replyString(entry[0]); err != nil {
+				return err
+			}
+			fields, err := replyMap(entry[1])
+			if err != nil {
+				return err
+			}
+			msgs[i].Values = make(map[string]interface{}, len(fields))
+			for k, v := range fields {
+				msgs[i].Values[k] = v
+			}
+		}
+		cmd.SetVal(msgs)
+	default:
+		return fmt.Errorf("redis_rate: %q is not supported by NewRediserConn", cmd.Name())
+	}
+	return nil
+}
+
+func replyString(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case []byte:
+		return string(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case int:
+		return strconv.Itoa(v), nil
+	default:
+		return "", fmt.Errorf("redis_rate: unexpected reply %T, wanted a string", v)
+	}
+}
+
+func replyInt(v interface{}) (int64, error) {
+	switch v := v.(type) {
+	case int64:
+		return v, nil
+	case int:
+		return int64(v), nil
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	case string:
+		return strconv.ParseInt(v, 10, 64)
+	case []byte:
+		return strconv.ParseInt(string(v), 10, 64)
+	default:
+		return 0, fmt.Errorf("redis_rate: unexpected reply %T, wanted an integer", v)
+	}
+}
+
+func replyArray(v interface{}) ([]interface{}, error) {
+	vals, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("redis_rate: unexpected reply %T, wanted an array", v)
+	}
+	return vals, nil
+}
+
+func replyStrings(v interface{}) ([]string, error) {
+	vals, err := replyArray(v)
+	if err != nil {
+		return nil, err
+	}
+	rv := make([]string, len(vals))
+	for i, v := range vals {
+		if rv[i], err = replyString(v); err != nil {
+			return nil, err
+		}
+	}
+	return rv, nil
+}
+
+// replyMap accepts a RESP3 map or a RESP2 array of alternating keys and
+// values.
+func replyMap(v interface{}) (map[string]interface{}, error) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return v, nil
+	case map[interface{}]interface{}:
+		rv := make(map[string]interface{}, len(v))
+		for k, v := range v {
+			s, err := replyString(k)
+			if err != nil {
+				return nil, err
+			}
+			rv[s] = v
+		}
+		return rv, nil
+	}
+	vals, err := replyArray(v)
+	if err != nil {
+		return nil, err
+	}
+	if len(vals)%2 != 0 {
+		return nil, fmt.Errorf("redis_rate: unexpected reply of %d elements, wanted pairs", len(vals))
+	}
+	rv := make(map[string]interface{}, len(vals)/2)
+	for i := 0; i < len(vals); i += 2 {
+		k, err := replyString(vals[i])
+		if err != nil {
+			return nil, err
+		}
+		rv[k] = vals[i+1]
+	}
+	return rv, nil
+}
+
+// goRediser adapts a go-redis client to Rediser.
+type goRediser struct {
+	rdb redis.UniversalClient
+}
+
+// GoRediser returns a Rediser sending commands through a go-redis client.
+// It is mostly useful for testing a Rediser based setup; go-redis clients
+// can be passed to New directly.
+func GoRediser(rdb redis.UniversalClient) Rediser {
+	return goRediser{rdb: rdb}
+}
+
+func (g goRediser) Do(ctx context.Context, args ...interface{}) (interface{}, error) {
+	v, err := g.rdb.Do(ctx, args...).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	return v, err
+}
+
+func (g goRediser) DoMulti(ctx context.Context, cmds ...[]interface{}) ([]interface{}, []error) {
+	pl := g.rdb.Pipeline()
+	rcmds := make([]*redis.Cmd, len(cmds))
+	for i, args := range cmds {
+		rcmds[i] = pl.Do(ctx, args...)
+	}
+	_, _ = pl.Exec(ctx)
+
+	vals := make([]interface{}, len(cmds))
+	errs := make([]error, len(cmds))
+	for i, cmd := range rcmds {
+		vals[i], errs[i] = cmd.Result()
+		if errors.Is(errs[i], redis.Nil) {
+			errs[i] = nil
+		}
+	}
+	return vals, errs
+}
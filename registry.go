@@ -0,0 +1,328 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+)
+
+var (
+	// ErrUnknownLimitEntry is returned for a name, or the parent of an
+	// entry, that is not in a LimitRegistry.
+	ErrUnknownLimitEntry = errors.New("redis_rate: unknown limit entry")
+
+	// ErrLimitEntryCycle is returned by LimitRegistry.Set for an entry that
+	// would extend itself.
+	ErrLimitEntryCycle = errors.New("redis_rate: limit entry extends itself")
+)
+
+// MergeRule is how a LimitEntry combines its Limit with its parent's. An
+// entry whose limit is of another kind than its parent's, calendar or not,
+// replaces it whatever the rule.
+type MergeRule int
+
+const (
+	// MergeOverride replaces the fields of the parent's limit that are set
+	// in the entry's, and keeps the others. A Rate or Period replaces the
+	// pair.
+	MergeOverride MergeRule = iota
+
+	// MergeMin takes the stricter of the parent's and the entry's rate per
+	// second, burst and penalty, so an override can only tighten its
+	// parent.
+	MergeMin
+
+	// MergeMax takes the looser of the two, so an override can only loosen
+	// its parent.
+	MergeMax
+)
+
+func (m MergeRule) String() string {
+	switch m {
+	case MergeOverride:
+		return "override"
+	case MergeMin:
+		return "min"
+	case MergeMax:
+		return "max"
+	default:
+		return fmt.Sprintf("merge(%d)", int(m))
+	}
+}
+
+// LimitEntry is a named limit in a LimitRegistry, such as a plan, a regional
+// override of a plan or a customer override of a region.
+type LimitEntry struct {
+	Name string
+
+	// Extends is the name of the parent entry, or empty for an entry that
+	// stands alone.
+	Extends string
+
+	// Limit is the entry's own limit. Without a parent it is the resolved
+	// limit; with one it is merged into the parent's by Merge.
+	Limit Limit
+
+	// Merge is how Limit combines with the parent's limit.
+	Merge MergeRule
+
+	// Scale, if set, multiplies the rate and burst of the merged limit,
+	// such as 2 for a customer allowed twice their plan.
+	Scale float64
+}
+
+// String describes the entry for the AuditLog, such as
+// "pro:eu extends pro (override): 0 req/0s (burst 50)".
+func (e LimitEntry) String() string {
+	s := e.Name
+	if e.Extends != "" {
+		s += " extends " + e.Extends + " (" + e.Merge.String() + ")"
+	}
+	s += ": " + e.Limit.String()
+	if e.Scale != 0 {
+		s += fmt.Sprintf(" x%g", e.Scale)
+	}
+	return s
+}
+
+// LimitRegistry is a catalog of named limits that extend one another, so a
+// small variation of a plan does not duplicate its whole Limit. Entries are
+// resolved when they are looked up, so changing a plan changes every entry
+// extending it. Key patterns are bound to entries with Bind, matched like
+// Policy patterns, which makes the registry a LimitProvider.
+//
+// A LimitRegistry is safe for concurrent use.
+type LimitRegistry struct {
+	mu      sync.RWMutex
+	entries map[string]LimitEntry
+	names   map[string]string
+	audit   *AuditLog
+}
+
+// NewLimitRegistry returns a LimitRegistry holding entries, which may be in
+// any order.
+func NewLimitRegistry(entries ...LimitEntry) (*LimitRegistry, error) {
+	r := &LimitRegistry{
+		entries: make(map[string]LimitEntry, len(entries)),
+		names:   make(map[string]string),
+	}
+	for _, e := range entries {
+		r.entries[e.Name] = e
+	}
+	for _, e := range entries {
+		if _, err := r.resolve(e.Name); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// SetAuditLog records the changes made with Set, Delete and Bind to log.
+// It must be called before the registry is shared.
+func (r *LimitRegistry) SetAuditLog(log *AuditLog) {
+	r.audit = log
+}
+
+// Set adds or replaces an entry. Its parent need not exist yet, but it
+// fails with ErrLimitEntryCycle if the entry would end up extending itself.
+func (r *LimitRegistry) Set(ctx context.Context, entry LimitEntry) error {
+	r.mu.Lock()
+	for name := entry.Extends; name != ""; name = r.entries[name].Extends {
+		if name == entry.Name {
+			r.mu.Unlock()
+			return fmt.Errorf("%w: %q", ErrLimitEntryCycle, entry.Name)
+		}
+	}
+	old, ok := r.entries[entry.Name]
+	r.entries[entry.Name] = entry
+	r.mu.Unlock()
+
+	oldValue := ""
+	if ok {
+		oldValue = old.String()
+	}
+	return r.audit.record(ctx, AuditRegistrySet, entry.Name, oldValue, entry.String())
+}
+
+// Delete removes an entry. Entries extending it fail to resolve until it is
+// set again.
+func (r *LimitRegistry) Delete(ctx context.Context, name string) error {
+	r.mu.Lock()
+	old, ok := r.entries[name]
+	delete(r.entries, name)
+	r.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+	return r.audit.record(ctx, AuditRegistryDelete, name, old.String(), "")
+}
+
+// Bind makes keys matching pattern use the entry name. Patterns are an
+// exact key, or a prefix followed by "*"; an exact match wins, then the
+// longest matching prefix.
+func (r *LimitRegistry) Bind(ctx context.Context, pattern string, name string) error {
+	r.mu.Lock()
+	old := r.names[pattern]
+	r.names[pattern] = name
+	r.mu.Unlock()
+
+	return r.audit.record(ctx, AuditRegistryBind, pattern, old, name)
+}
+
+// Resolve returns the limit of the entry name, merged with those of the
+// entries it extends.
+func (r *LimitRegistry) Resolve(name string) (Limit, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.resolve(name)
+}
+
+// Chain returns the names of the entry name and of the entries it extends,
+// outermost parent first, such as to explain where a limit comes from.
+func (r *LimitRegistry) Chain(name string) ([]string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var rv []string
+	for name != "" {
+		e, ok := r.entries[name]
+		if !ok {
+			return nil, fmt.Errorf("%w: %q", ErrUnknownLimitEntry, name)
+		}
+		rv = append([]string{name}, rv...)
+		name = e.Extends
+	}
+	return rv, nil
+}
+
+// Limit returns the resolved limit of the entry bound to key, or a zero
+// Limit if no pattern matches. It implements LimitProvider.
+func (r *LimitRegistry) Limit(ctx context.Context, key string) (Limit, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	pattern, name := matchPattern(r.names, key)
+	if pattern == "" {
+		return Limit{}, nil
+	}
+	return r.resolve(name)
+}
+
+// resolve returns the limit of name. r.mu must be held.
+func (r *LimitRegistry) resolve(name string) (Limit, error) {
+	e, ok := r.entries[name]
+	if !ok {
+		return Limit{}, fmt.Errorf("%w: %q", ErrUnknownLimitEntry, name)
+	}
+	// follow the chain up to its root, then merge back down.
+	chain := []LimitEntry{e}
+	for e.Extends != "" {
+		parent, ok := r.entries[e.Extends]
+		if !ok {
+			return Limit{}, fmt.Errorf("%w: %q, extended by %q", ErrUnknownLimitEntry, e.Extends, e.Name)
+		}
+		if len(chain) > len(r.entries) {
+			return Limit{}, fmt.Errorf("%w: %q", ErrLimitEntryCycle, name)
+		}
+		chain = append(chain, parent)
+		e = parent
+	}
+
+	var limit Limit
+	for i := len(chain) - 1; i >= 0; i-- {
+		e := chain[i]
+		if i == len(chain)-1 {
+			limit = e.Limit
+		} else {
+			limit = mergeLimits(limit, e.Limit, e.Merge)
+		}
+		if e.Scale > 0 {
+			limit = scaleRate(limit, e.Scale)
+		}
+	}
+	return limit, nil
+}
+
+// mergeLimits merges child into parent by rule.
+func mergeLimits(parent, child Limit, rule MergeRule) Limit {
+	if child.IsZero() {
+		return parent
+	}
+	// limits of different kinds cannot be compared, so the child's wins.
+	if child.Calendar != parent.Calendar && (child.Rate != 0 || child.Calendar != CalendarNone) {
+		return child
+	}
+
+	rv := parent
+	switch rule {
+	case MergeMin, MergeMax:
+		looser := rule == MergeMax
+		if child.Rate != 0 {
+			period := child.Period
+			if period == 0 {
+				period = parent.Period
+			}
+			c := Limit{Rate: child.Rate, Period: period}
+			if parent.Rate == 0 || (perSecond(c) > perSecond(parent)) == looser {
+				rv.Rate, rv.Period = c.Rate, c.Period
+			}
+		}
+		if child.Burst != 0 && (parent.Burst == 0 || (child.Burst > parent.Burst) == looser) {
+			rv.Burst = child.Burst
+		}
+		if child.Penalty != 0 && (parent.Penalty == 0 || (child.Penalty < parent.Penalty) == looser) {
+			rv.Penalty = child.Penalty
+		}
+		if child.WarmUp != 0 && (parent.WarmUp == 0 || (child.WarmUp < parent.WarmUp) == looser) {
+			rv.WarmUp, rv.WarmUpRate = child.WarmUp, child.WarmUpRate
+		}
+	default:
+		if child.Rate != 0 {
+			rv.Rate = child.Rate
+		}
+		if child.Period != 0 {
+			rv.Period = child.Period
+		}
+		if child.Burst != 0 {
+			rv.Burst = child.Burst
+		}
+		if child.Penalty != 0 {
+			rv.Penalty = child.Penalty
+		}
+		if child.WarmUp != 0 {
+			rv.WarmUp = child.WarmUp
+		}
+		if child.WarmUpRate != 0 {
+			rv.WarmUpRate = child.WarmUpRate
+		}
+		rv.Calendar = child.Calendar
+	}
+	return rv
+}
+
+// perSecond returns the rate of a GCRA limit in events per second.
+func perSecond(l Limit) float64 {
+	if l.Period <= 0 {
+		return math.Inf(1)
+	}
+	return float64(l.Rate) / l.Period.Seconds()
+}
+
+// scaleRate multiplies the rate and burst of limit by factor, keeping them
+// at least 1.
+func scaleRate(limit Limit, factor float64) Limit {
+	scale := func(n int) int {
+		if n == 0 {
+			return 0
+		}
+		v := int(math.Round(float64(n) * factor))
+		if v < 1 {
+			v = 1
+		}
+		return v
+	}
+	limit.Rate = scale(limit.Rate)
+	limit.Burst = scale(limit.Burst)
+	return limit
+}
@@ -0,0 +1,75 @@
+package redis_rate_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ductone/redis_rate/v11"
+)
+
+func TestLimitRegistry(t *testing.T) {
+	ctx := context.Background()
+	r, err := redis_rate.NewLimitRegistry(
+		redis_rate.LimitEntry{Name: "customer:acme", Extends: "pro:eu", Scale: 2},
+		redis_rate.LimitEntry{Name: "pro", Limit: redis_rate.Limit{Rate: 100, Burst: 200, Period: time.Minute}},
+		redis_rate.LimitEntry{Name: "pro:eu", Extends: "pro", Limit: redis_rate.Limit{Burst: 50}},
+		redis_rate.LimitEntry{
+			Name:    "pro:capped",
+			Extends: "pro",
+			Limit:   redis_rate.Limit{Rate: 10, Burst: 500, Period: time.Second},
+			Merge:   redis_rate.MergeMin,
+		},
+		redis_rate.LimitEntry{
+			Name:    "pro:raised",
+			Extends: "pro",
+			Limit:   redis_rate.Limit{Rate: 10, Burst: 500, Period: time.Second},
+			Merge:   redis_rate.MergeMax,
+		},
+	)
+	require.NoError(t, err)
+
+	limit, err := r.Resolve("pro:eu")
+	require.NoError(t, err)
+	require.Equal(t, redis_rate.Limit{Rate: 100, Burst: 50, Period: time.Minute}, limit)
+
+	limit, err = r.Resolve("customer:acme")
+	require.NoError(t, err)
+	require.Equal(t, redis_rate.Limit{Rate: 200, Burst: 100, Period: time.Minute}, limit)
+
+	limit, err = r.Resolve("pro:capped")
+	require.NoError(t, err)
+	require.Equal(t, redis_rate.Limit{Rate: 100, Burst: 200, Period: time.Minute}, limit)
+
+	limit, err = r.Resolve("pro:raised")
+	require.NoError(t, err)
+	require.Equal(t, redis_rate.Limit{Rate: 10, Burst: 500, Period: time.Second}, limit)
+
+	chain, err := r.Chain("customer:acme")
+	require.NoError(t, err)
+	require.Equal(t, []string{"pro", "pro:eu", "customer:acme"}, chain)
+
+	// entries are resolved at lookup, so changing the plan changes its
+	// overrides.
+	require.NoError(t, r.Set(ctx, redis_rate.LimitEntry{Name: "pro", Limit: redis_rate.PerSecond(5)}))
+	require.NoError(t, r.Bind(ctx, "acme:*", "customer:acme"))
+	limit, err = r.Limit(ctx, "acme:api")
+	require.NoError(t, err)
+	require.Equal(t, redis_rate.Limit{Rate: 10, Burst: 100, Period: time.Second}, limit)
+	limit, err = r.Limit(ctx, "other")
+	require.NoError(t, err)
+	require.True(t, limit.IsZero())
+
+	require.ErrorIs(t, r.Set(ctx, redis_rate.LimitEntry{Name: "pro", Extends: "customer:acme"}), redis_rate.ErrLimitEntryCycle)
+	require.NoError(t, r.Delete(ctx, "pro:eu"))
+	_, err = r.Resolve("customer:acme")
+	require.ErrorIs(t, err, redis_rate.ErrUnknownLimitEntry)
+
+	require.Equal(t, "customer:acme extends pro:eu (override): 0 req/0s (burst 0) x2",
+		redis_rate.LimitEntry{Name: "customer:acme", Extends: "pro:eu", Scale: 2}.String())
+
+	_, err = redis_rate.NewLimitRegistry(redis_rate.LimitEntry{Name: "a", Extends: "missing"})
+	require.ErrorIs(t, err, redis_rate.ErrUnknownLimitEntry)
+}
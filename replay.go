@@ -0,0 +1,376 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// DefaultDecisionLogMaxLen is the approximate number of decisions a
+// DecisionLog keeps unless WithDecisionLogMaxLen is given.
+const DefaultDecisionLogMaxLen = 100000
+
+// Decision records a single rate limit decision made by a Limiter.
+type Decision struct {
+	// ID is the Redis stream entry id, which orders decisions.
+	ID string
+
+	// Time is when the decision was made, according to the Limiter's clock.
+	Time time.Time
+
+	Op Operation
+
+	// Key is the key without the Limiter's prefix.
+	Key string
+
+	// N is the number of events requested.
+	N int
+
+	// Allowed is the number of events that were allowed.
+	Allowed int64
+
+	// Limit is the limit the decision was made with.
+	Limit Limit
+
+	// Reason is why the events were denied, or empty if any was allowed.
+	Reason Reason
+
+	// Shadow reports whether the decision was made in shadow mode, in which
+	// case Allowed is the number of events the limit would have allowed and
+	// Reason is empty.
+	Shadow bool
+
+	// Tags are the tags on the context of the call.
+	Tags []Tag
+}
+
+// DecisionLogClient is the part of a Redis client a DecisionLog uses, which
+// every go-redis client implements.
+type DecisionLogClient interface {
+	Pipeline() redis.Pipeliner
+	XAdd(ctx context.Context, a *redis.XAddArgs) *redis.StringCmd
+	XRangeN(ctx context.Context, stream, start, stop string, count int64) *redis.XMessageSliceCmd
+}
+
+// DecisionLog appends the Limiter's decisions to a capped Redis Stream, so
+// they can be re-evaluated against other limits with Replay. Register it on
+// a Limiter with WithHooks(log.Hooks()).
+type DecisionLog struct {
+	rdb    DecisionLogClient
+	stream string
+	maxLen int64
+}
+
+// NewDecisionLog returns a DecisionLog writing to the Redis stream key.
+func NewDecisionLog(rdb DecisionLogClient, stream string, options ...func(*DecisionLog)) *DecisionLog {
+	d := &DecisionLog{
+		rdb:    rdb,
+		stream: stream,
+		maxLen: DefaultDecisionLogMaxLen,
+	}
+	for _, option := range options {
+		option(d)
+	}
+	return d
+}
+
+// WithDecisionLogMaxLen caps the stream at approximately maxLen decisions.
+func WithDecisionLogMaxLen(maxLen int64) func(*DecisionLog) {
+	return func(d *DecisionLog) {
+		d.maxLen = maxLen
+	}
+}
+
+// Hooks returns Hooks recording every successful rate limit decision to d.
+// Each decision costs an extra round trip to Redis, and failures to record
+// are ignored, so the log is best suited to sampled or shadow traffic. For
+// high volumes use an AsyncDecisionLog instead.
+func (d *DecisionLog) Hooks() Hooks {
+	return Hooks{
+		OnAllow: func(ctx context.Context, ev AllowEvent) {
+			if decision, ok := decisionOf(ev); ok {
+				_ = d.Record(ctx, decision)
+			}
+		},
+	}
+}
+
+// decisionOf returns the decision reported by ev, or false if ev is a
+// failure.
+func decisionOf(ev AllowEvent) (Decision, bool) {
+	if ev.Err != nil || ev.Result == nil {
+		return Decision{}, false
+	}
+	at := ev.Result.at
+	if at.IsZero() {
+		at = time.Now()
+	}
+	allowed := ev.Result.Allowed
+	if ev.Result.Shadow {
+		allowed = ev.Result.ShadowAllowed
+	}
+	return Decision{
+		Time:    at,
+		Op:      ev.Op,
+		Key:     ev.Key,
+		N:       ev.N,
+		Allowed: allowed,
+		Limit:   ev.Result.Limit,
+		Reason:  ev.Result.Reason,
+		Shadow:  ev.Result.Shadow,
+		Tags:    ev.Tags,
+	}, true
+}
+
+// Record appends decision to the log. ID is ignored, and Time is filled in
+// from the wall clock if it is empty.
+func (d *DecisionLog) Record(ctx context.Context, decision Decision) error {
+	return d.rdb.XAdd(ctx, d.xaddArgs(decision)).Err()
+}
+
+func (d *DecisionLog) xaddArgs(decision Decision) *redis.XAddArgs {
+	if decision.Time.IsZero() {
+		decision.Time = time.Now()
+	}
+	return &redis.XAddArgs{
+		Stream: d.stream,
+		MaxLen: d.maxLen,
+		Approx: true,
+		Values: []interface{}{
+			"time", decision.Time.UnixMicro(),
+			"op", string(decision.Op),
+			"key", decision.Key,
+			"n", decision.N,
+			"allowed", decision.Allowed,
+			"limit", decision.limitString(),
+			"reason", string(decision.Reason),
+			"shadow", decision.Shadow,
+			"tags", encodeTags(decision.Tags),
+		},
+	}
+}
+
+// limitString returns the Limit of d as stored in a DecisionLog, or an empty
+// string if it has none.
+func (d Decision) limitString() string {
+	if d.Limit.IsZero() {
+		return ""
+	}
+	return d.Limit.String()
+}
+
+// WriteDecisions appends decisions to the log in one round trip, so a
+// DecisionLog can be the DecisionSink of an AsyncDecisionLog.
+func (d *DecisionLog) WriteDecisions(ctx context.Context, decisions []Decision) error {
+	pl := d.rdb.Pipeline()
+	for _, decision := range decisions {
+		pl.XAdd(ctx, d.xaddArgs(decision))
+	}
+	_, err := pl.Exec(ctx)
+	return err
+}
+
+// Range returns up to count decisions recorded from start to end inclusive,
+// oldest first. A zero start or end leaves that side of the range open.
+func (d *DecisionLog) Range(ctx context.Context, start, end time.Time, count int64) ([]Decision, error) {
+	from, to := "-", "+"
+	if !start.IsZero() {
+		from = strconv.FormatInt(start.UnixMilli(), 10)
+	}
+	if !end.IsZero() {
+		to = strconv.FormatInt(end.UnixMilli(), 10)
+	}
+	msgs, err := d.rdb.XRangeN(ctx, d.stream, from, to, count).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	rv := make([]Decision, 0, len(msgs))
+	for _, msg := range msgs {
+		decision, err := parseDecision(msg)
+		if err != nil {
+			return nil, fmt.Errorf("redis_rate: invalid decision %s: %w", msg.ID, err)
+		}
+		rv = append(rv, decision)
+	}
+	return rv, nil
+}
+
+func parseDecision(msg redis.XMessage) (Decision, error) {
+	decision := Decision{
+		ID:  msg.ID,
+		Op:  Operation(auditField(msg, "op")),
+		Key: auditField(msg, "key"),
+	}
+	us, err := strconv.ParseInt(auditField(msg, "time"), 10, 64)
+	if err != nil {
+		return Decision{}, err
+	}
+	decision.Time = time.UnixMicro(us)
+	if decision.N, err = strconv.Atoi(auditField(msg, "n")); err != nil {
+		return Decision{}, err
+	}
+	if decision.Allowed, err = strconv.ParseInt(auditField(msg, "allowed"), 10, 64); err != nil {
+		return Decision{}, err
+	}
+	// Decisions recorded before limit, reason, shadow and tags were added
+	// have none of them.
+	if s := auditField(msg, "limit"); s != "" {
+		if decision.Limit, err = parseLimit(s); err != nil {
+			return Decision{}, err
+		}
+	}
+	decision.Reason = Reason(auditField(msg, "reason"))
+	decision.Shadow = auditField(msg, "shadow") == "1"
+	if decision.Tags, err = decodeTags(auditField(msg, "tags")); err != nil {
+		return Decision{}, err
+	}
+	return decision, nil
+}
+
+// ReplayCounts counts the outcomes of replayed decisions.
+type ReplayCounts struct {
+	// Decisions is the number of decisions replayed.
+	Decisions int
+
+	// Allowed and Denied count the recorded outcomes, and CandidateAllowed
+	// and CandidateDenied the outcomes under the candidate limits. A
+	// decision is denied when fewer events were allowed than requested.
+	Allowed          int
+	Denied           int
+	CandidateAllowed int
+	CandidateDenied  int
+
+	// NewlyDenied counts decisions that were allowed but would be denied,
+	// and NewlyAllowed decisions that were denied but would be allowed.
+	NewlyDenied  int
+	NewlyAllowed int
+}
+
+func (c *ReplayCounts) add(allowed, candidate bool) {
+	c.Decisions++
+	if allowed {
+		c.Allowed++
+	} else {
+		c.Denied++
+	}
+	if candidate {
+		c.CandidateAllowed++
+	} else {
+		c.CandidateDenied++
+	}
+	if allowed && !candidate {
+		c.NewlyDenied++
+	}
+	if !allowed && candidate {
+		c.NewlyAllowed++
+	}
+}
+
+// ReplayReport is the result of Replay.
+type ReplayReport struct {
+	// Total counts every replayed decision.
+	Total ReplayCounts
+
+	// Keys counts the decisions of each key.
+	Keys map[string]*ReplayCounts
+}
+
+// Replay re-evaluates decisions, in order, against the limits returned by
+// candidate and reports how the outcomes would differ, for example to see
+// what halving a limit would do to recorded traffic. It is a dry run: the
+// decisions are evaluated by a MemoryLimiter following their recorded
+// times, and nothing is written to Redis.
+//
+// Every key starts from its initial state, so decisions made shortly after
+// the first one of a key may be allowed more often than they were. Keys for
+// which candidate returns a zero Limit are skipped, and calendar limits fail
+// with ErrCalendarLimit.
+func Replay(ctx context.Context, decisions []Decision, candidate LimitProvider) (*ReplayReport, error) {
+	rv := &ReplayReport{
+		Keys: make(map[string]*ReplayCounts),
+	}
+	if len(decisions) == 0 {
+		return rv, nil
+	}
+
+	clock := NewManualClock(decisions[0].Time)
+	m := NewMemory(WithMemoryClock(clock))
+	limits := make(map[string]Limit)
+	for _, decision := range decisions {
+		limit, ok := limits[decision.Key]
+		if !ok {
+			var err error
+			limit, err = candidate.Limit(ctx, decision.Key)
+			if err != nil {
+				return nil, err
+			}
+			limits[decision.Key] = limit
+		}
+		if limit.IsZero() {
+			continue
+		}
+		if limit.Calendar != CalendarNone {
+			return nil, ErrCalendarLimit
+		}
+
+		if decision.Time.After(clock.Now()) {
+			clock.Set(decision.Time)
+		}
+		var res *Result
+		var err error
+		if decision.Op == OpAllowAtMost || decision.Op == OpAllowAtMostMulti {
+			res, err = m.AllowAtMost(ctx, decision.Key, limit, decision.N)
+		} else {
+			res, err = m.AllowN(ctx, decision.Key, limit, decision.N)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		counts := rv.Keys[decision.Key]
+		if counts == nil {
+			counts = &ReplayCounts{}
+			rv.Keys[decision.Key] = counts
+		}
+		allowed := decision.Allowed >= int64(decision.N)
+		wouldAllow := res.Allowed >= int64(decision.N)
+		counts.add(allowed, wouldAllow)
+		rv.Total.add(allowed, wouldAllow)
+	}
+	return rv, nil
+}
+
+// encodeTags encodes tags as a JSON array of [key, value] pairs, or an empty
+// string if there are none.
+func encodeTags(tags []Tag) string {
+	if len(tags) == 0 {
+		return ""
+	}
+	pairs := make([][2]string, len(tags))
+	for i, tag := range tags {
+		pairs[i] = [2]string{tag.Key, tag.Value}
+	}
+	b, _ := json.Marshal(pairs)
+	return string(b)
+}
+
+// decodeTags decodes tags encoded by encodeTags.
+func decodeTags(s string) ([]Tag, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var pairs [][2]string
+	if err := json.Unmarshal([]byte(s), &pairs); err != nil {
+		return nil, err
+	}
+	tags := make([]Tag, len(pairs))
+	for i, pair := range pairs {
+		tags[i] = Tag{Key: pair[0], Value: pair[1]}
+	}
+	return tags, nil
+}
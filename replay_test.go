@@ -0,0 +1,92 @@
+package redis_rate_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ductone/redis_rate/v11"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecisionLog(t *testing.T) {
+	tag := redis_rate.Tag{Key: "route", Value: "/v1/things"}
+	ctx := redis_rate.WithTags(context.Background(), tag)
+	log := redis_rate.NewDecisionLog(newTestRing(), "decisions", redis_rate.WithDecisionLogMaxLen(100))
+	clock := redis_rate.NewManualClock(time.Now())
+	l := newTestLimiter(t, true, redis_rate.WithClock(clock), redis_rate.WithHooks(log.Hooks()))
+
+	limit := redis_rate.PerSecond(10)
+	for i := 0; i < 12; i++ {
+		_, err := l.Allow(ctx, "test_id", limit)
+		require.NoError(t, err)
+	}
+
+	decisions, err := log.Range(ctx, time.Time{}, time.Time{}, 100)
+	require.NoError(t, err)
+	require.Len(t, decisions, 12)
+	require.Equal(t, redis_rate.OpAllowN, decisions[0].Op)
+	require.Equal(t, "test_id", decisions[0].Key)
+	require.Equal(t, 1, decisions[0].N)
+	require.Equal(t, int64(1), decisions[0].Allowed)
+	require.Equal(t, int64(0), decisions[11].Allowed)
+	require.Equal(t, limit, decisions[0].Limit)
+	require.Equal(t, redis_rate.Reason(""), decisions[0].Reason)
+	require.Equal(t, redis_rate.ReasonRateExceeded, decisions[11].Reason)
+	require.False(t, decisions[0].Shadow)
+	require.Equal(t, []redis_rate.Tag{tag}, decisions[0].Tags)
+	require.WithinDuration(t, clock.Now(), decisions[0].Time, time.Millisecond)
+
+	report, err := redis_rate.Replay(ctx, decisions, redis_rate.LimitProviderFunc(
+		func(ctx context.Context, key string) (redis_rate.Limit, error) {
+			return redis_rate.PerSecond(5), nil
+		}))
+	require.NoError(t, err)
+	require.Equal(t, 12, report.Total.Decisions)
+	require.Equal(t, 5, report.Total.NewlyDenied)
+}
+
+func TestReplay(t *testing.T) {
+	ctx := context.Background()
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	var decisions []redis_rate.Decision
+	for i := 0; i < 20; i++ {
+		decisions = append(decisions,
+			redis_rate.Decision{Time: start.Add(time.Duration(i) * 100 * time.Millisecond), Op: redis_rate.OpAllowN, Key: "a", N: 1, Allowed: 1},
+			redis_rate.Decision{Time: start.Add(time.Duration(i) * 100 * time.Millisecond), Op: redis_rate.OpAllowN, Key: "b", N: 2, Allowed: 0},
+		)
+	}
+
+	limits := map[string]redis_rate.Limit{
+		"a": redis_rate.PerSecond(5),
+		"b": redis_rate.PerSecond(100),
+	}
+	report, err := redis_rate.Replay(ctx, decisions, redis_rate.LimitProviderFunc(
+		func(ctx context.Context, key string) (redis_rate.Limit, error) {
+			return limits[key], nil
+		}))
+	require.NoError(t, err)
+
+	// the burst of 5 plus one every 200ms over 1.9s.
+	a := report.Keys["a"]
+	require.Equal(t, 20, a.Decisions)
+	require.Equal(t, 20, a.Allowed)
+	require.Equal(t, 14, a.CandidateAllowed)
+	require.Equal(t, 6, a.NewlyDenied)
+
+	b := report.Keys["b"]
+	require.Equal(t, 20, b.Denied)
+	require.Equal(t, 20, b.NewlyAllowed)
+
+	require.Equal(t, 40, report.Total.Decisions)
+	require.Equal(t, 6, report.Total.NewlyDenied)
+	require.Equal(t, 20, report.Total.NewlyAllowed)
+
+	limits["a"] = redis_rate.PerDay(5)
+	_, err = redis_rate.Replay(ctx, decisions, redis_rate.LimitProviderFunc(
+		func(ctx context.Context, key string) (redis_rate.Limit, error) {
+			return limits[key], nil
+		}))
+	require.ErrorIs(t, err, redis_rate.ErrCalendarLimit)
+}
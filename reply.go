@@ -0,0 +1,103 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// scriptReply decodes the array reply of a script with typed accessors. The
+// first value that is missing or of an unexpected type is kept in err and
+// later accessors return zero values, so a reply is decoded field by field
+// and checked once, without panicking on replies of the wrong shape.
+type scriptReply struct {
+	values []interface{}
+	err    error
+}
+
+// replyOf returns the reply of cmd, a script call.
+func replyOf(cmd *redis.Cmd) scriptReply {
+	values, err := cmd.Slice()
+	return scriptReply{values: values, err: err}
+}
+
+// has reports whether the reply has an i'th value.
+func (r *scriptReply) has(i int) bool {
+	return r.err == nil && i < len(r.values)
+}
+
+// fail records that the i'th value is not what was wanted.
+func (r *scriptReply) fail(i int, wanted string) {
+	if r.err != nil {
+		return
+	}
+	if i >= len(r.values) {
+		r.err = fmt.Errorf("redis_rate: unexpected reply of %d values, wanted %s at %d", len(r.values), wanted, i)
+		return
+	}
+	r.err = fmt.Errorf("redis_rate: unexpected reply %T at %d, wanted %s", r.values[i], i, wanted)
+}
+
+// int returns the i'th value, an integer.
+func (r *scriptReply) int(i int) int64 {
+	if !r.has(i) {
+		r.fail(i, "an integer")
+		return 0
+	}
+	v, ok := r.values[i].(int64)
+	if !ok {
+		r.fail(i, "an integer")
+	}
+	return v
+}
+
+// optInt returns the i'th value, an integer, or 0 if the reply is shorter.
+func (r *scriptReply) optInt(i int) int64 {
+	if !r.has(i) {
+		return 0
+	}
+	return r.int(i)
+}
+
+// float returns the i'th value, a number the script returned as a string so
+// that redis would not truncate it to an integer.
+func (r *scriptReply) float(i int) float64 {
+	if !r.has(i) {
+		r.fail(i, "a number")
+		return 0
+	}
+	switch v := r.values[i].(type) {
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			r.err = err
+		}
+		return f
+	case int64:
+		return float64(v)
+	default:
+		r.fail(i, "a number")
+		return 0
+	}
+}
+
+// seconds returns the i'th value, a number of seconds, as by dur.
+func (r *scriptReply) seconds(i int) time.Duration {
+	return dur(r.float(i))
+}
+
+// row returns the i'th value, a nested array reply.
+func (r *scriptReply) row(i int) scriptReply {
+	if !r.has(i) {
+		r.fail(i, "an array")
+		return scriptReply{err: r.err}
+	}
+	values, ok := r.values[i].([]interface{})
+	if !ok {
+		r.fail(i, "an array")
+		return scriptReply{err: r.err}
+	}
+	return scriptReply{values: values}
+}
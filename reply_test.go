@@ -0,0 +1,77 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/require"
+)
+
+func newReplyCmd(val interface{}) *redis.Cmd {
+	cmd := redis.NewCmd(context.Background())
+	cmd.SetVal(val)
+	return cmd
+}
+
+func TestScriptReply(t *testing.T) {
+	var rv Result
+	reply := replyOf(newReplyCmd([]interface{}{int64(3), int64(7), "-1", "0.25"}))
+	require.NoError(t, rv.parseScriptResult(&reply))
+	require.Equal(t, int64(3), rv.Allowed)
+	require.Equal(t, int64(7), rv.Remaining)
+	require.Equal(t, time.Duration(-1), rv.RetryAfter)
+	require.Equal(t, 250*time.Millisecond, rv.ResetAfter)
+	require.Equal(t, Reason(""), rv.Reason)
+
+	reply = replyOf(newReplyCmd([]interface{}{int64(0), int64(0), "5", "5", int64(0), int64(0), int64(1)}))
+	require.NoError(t, rv.parseScriptResult(&reply))
+	require.True(t, rv.Banned)
+	require.Equal(t, ReasonBanned, rv.Reason)
+
+	for _, val := range []interface{}{
+		"OK",
+		[]interface{}{int64(1), int64(2), "-1"},
+		[]interface{}{int64(1), "2", "-1", "0"},
+		[]interface{}{int64(1), int64(2), "soon", "0"},
+	} {
+		reply = replyOf(newReplyCmd(val))
+		require.Error(t, rv.parseScriptResult(&reply), "%v", val)
+	}
+
+	reply = replyOf(newReplyCmd([]interface{}{[]interface{}{int64(1)}, "x"}))
+	row := reply.row(0)
+	require.Equal(t, int64(1), row.int(0))
+	require.Equal(t, int64(0), row.optInt(1))
+	require.NoError(t, row.err)
+	reply.row(1)
+	require.Error(t, reply.err)
+}
+
+var benchResult Result
+
+func BenchmarkScriptReply(b *testing.B) {
+	allow := newReplyCmd([]interface{}{int64(1), int64(999999), "-1", "0.000001"})
+	cost := newReplyCmd([]interface{}{"1.5", "999997.5", "-1", "0.0000025"})
+
+	b.Run("allow", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			reply := replyOf(allow)
+			if err := benchResult.parseScriptResult(&reply); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("cost", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			reply := replyOf(cost)
+			if err := benchResult.parseCostResult(&reply); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,35 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// WithRequestIDHash stores request ids in Redis as a keyed HMAC-SHA256 of
+// the id instead of the id itself, for request ids that may contain personal
+// data such as email addresses. Take, Release and the other concurrency
+// methods still accept the original id and hash it before it is sent, so
+// callers do not need to change. Hooks and traces see the original id,
+// while Holders reports the hashed one, which HashRequestID reproduces.
+//
+// The key should be kept secret and be the same for every Limiter sharing
+// the concurrency keys, or releases will not find the slots taken by
+// another Limiter. Changing it orphans held slots until they expire.
+func WithRequestIDHash(key []byte) func(*Limiter) {
+	key = append([]byte(nil), key...)
+	return func(l *Limiter) {
+		l.requestIDKey = key
+	}
+}
+
+// HashRequestID returns requestID as it is stored in Redis, which is the id
+// itself unless WithRequestIDHash was given.
+func (l *Limiter) HashRequestID(requestID string) string {
+	if l.requestIDKey == nil {
+		return requestID
+	}
+	mac := hmac.New(sha256.New, l.requestIDKey)
+	_, _ = mac.Write([]byte(requestID))
+	return hex.EncodeToString(mac.Sum(nil))
+}
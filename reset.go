@@ -0,0 +1,226 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// DefaultResetThreshold is the number of keys ResetMany will reset
+	// without ConfirmReset.
+	DefaultResetThreshold = 1000
+
+	// resetChunkSize is the number of UNLINK commands sent per pipeline.
+	resetChunkSize = 500
+)
+
+// ErrResetNotConfirmed is returned by ResetMany when asked to reset more
+// keys than its threshold without ConfirmReset.
+var ErrResetNotConfirmed = errors.New("redis_rate: resetting this many keys requires ConfirmReset")
+
+// ResetOptions controls the safety guard of ResetMany.
+type ResetOptions struct {
+	// Confirm allows resetting more than Threshold keys.
+	Confirm bool
+
+	// Threshold is the largest number of keys that can be reset without
+	// Confirm. If unset the default is DefaultResetThreshold.
+	Threshold int
+}
+
+// ConfirmReset allows ResetMany to reset any number of keys.
+func ConfirmReset() func(*ResetOptions) {
+	return func(o *ResetOptions) {
+		o.Confirm = true
+	}
+}
+
+// WithResetThreshold sets the number of keys ResetMany will reset without
+// ConfirmReset.
+func WithResetThreshold(threshold int) func(*ResetOptions) {
+	return func(o *ResetOptions) {
+		o.Threshold = threshold
+	}
+}
+
+// ResetMany resets the rate limits of keys, like Reset, and returns how many
+// of them existed. Keys are removed with UNLINK in chunks, so memory is
+// reclaimed in the background and Redis is not blocked by large batches.
+//
+// Resetting more than DefaultResetThreshold keys fails with
+// ErrResetNotConfirmed unless ConfirmReset is given, to guard operational
+// tooling against accidentally wiping a whole keyspace.
+func (l *Limiter) ResetMany(ctx context.Context, keys []string, options ...func(*ResetOptions)) (int64, error) {
+	if err := l.checkWritable("ResetMany"); err != nil {
+		return 0, err
+	}
+	opts := ResetOptions{
+		Threshold: DefaultResetThreshold,
+	}
+	for _, option := range options {
+		option(&opts)
+	}
+	if len(keys) > opts.Threshold && !opts.Confirm {
+		return 0, ErrResetNotConfirmed
+	}
+
+	prefixed := l.rateKeys(ctx, keys)
+	for _, key := range keys {
+		l.forgetLocal(key)
+	}
+	removed, err := unlinkChunked(ctx, l.rdb, prefixed)
+	if err != nil {
+		return removed, err
+	}
+	return removed, l.audit.record(ctx, AuditReset, l.ratePrefix, "", strconv.Itoa(len(keys))+" keys")
+}
+
+// ResetMulti resets the rate limits of keys, like Reset, in as few round
+// trips as possible.
+func (l *Limiter) ResetMulti(ctx context.Context, keys ...string) error {
+	_, err := l.ResetMany(ctx, keys, ConfirmReset())
+	return err
+}
+
+// ResetByPrefix removes the rate limit and concurrency state of every key
+// starting with prefix, such as every key of one tenant, and returns how
+// many Redis keys were removed. Keys are found with SCAN on every shard of a
+// Ring and every master of a ClusterClient.
+//
+// Like ResetMany it fails with ErrResetNotConfirmed, without removing
+// anything, if more keys than the threshold match and ConfirmReset is not
+// given. Concurrency slots held by in-flight requests are dropped, so their
+// releases become no-ops.
+func (l *Limiter) ResetByPrefix(ctx context.Context, prefix string, options ...func(*ResetOptions)) (int64, error) {
+	if err := l.checkWritable("ResetByPrefix"); err != nil {
+		return 0, err
+	}
+	opts := ResetOptions{
+		Threshold: DefaultResetThreshold,
+	}
+	for _, option := range options {
+		option(&opts)
+	}
+
+	patterns := l.keyPatterns(ctx, prefix)
+
+	var mu sync.Mutex
+	var found []nodeKeys
+	total := 0
+	err := l.forEachNode(ctx, func(ctx context.Context, node redisNode) error {
+		scan, err := scanNode(node)
+		if err != nil {
+			return err
+		}
+		seen := make(map[string]bool)
+		var keys []string
+		for _, match := range patterns {
+			var cursor uint64
+			for {
+				page, next, err := scan.Scan(ctx, cursor, match, sweepScanCount).Result()
+				if err != nil {
+					return err
+				}
+				for _, key := range page {
+					if !seen[key] {
+						seen[key] = true
+						keys = append(keys, key)
+					}
+				}
+				cursor = next
+				if cursor == 0 {
+					break
+				}
+			}
+		}
+
+		mu.Lock()
+		found = append(found, nodeKeys{node: node, keys: keys})
+		total += len(keys)
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if total > opts.Threshold && !opts.Confirm {
+		return 0, ErrResetNotConfirmed
+	}
+
+	removed := int64(0)
+	for _, nk := range found {
+		n, err := unlinkChunked(ctx, nk.node, nk.keys)
+		removed += n
+		if err != nil {
+			return removed, err
+		}
+	}
+	return removed, l.audit.record(ctx, AuditReset, l.ratePrefix+prefix+"*", "", strconv.Itoa(total)+" keys")
+}
+
+type nodeKeys struct {
+	node redisNode
+	keys []string
+}
+
+// unlinkChunked removes keys from node with UNLINK, resetChunkSize at a time.
+func unlinkChunked(ctx context.Context, node redisNode, keys []string) (int64, error) {
+	removed := int64(0)
+	for start := 0; start < len(keys); start += resetChunkSize {
+		end := start + resetChunkSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		pl := node.Pipeline()
+		cmds := make([]*redis.IntCmd, 0, end-start)
+		for _, key := range keys[start:end] {
+			cmds = append(cmds, pl.Unlink(ctx, key))
+		}
+		_, err := pl.Exec(ctx)
+		if err != nil {
+			return removed, err
+		}
+		for _, cmd := range cmds {
+			removed += cmd.Val()
+		}
+	}
+	return removed, nil
+}
+
+// keyPatterns returns the SCAN patterns matching the rate limit and
+// concurrency keys starting with prefix and their side keys.
+func (l *Limiter) keyPatterns(ctx context.Context, prefix string) []string {
+	// With hash tags the tag comes before the key, so any tag is matched.
+	tag := ""
+	if l.hashTag != nil {
+		tag = "{*}"
+	}
+	rate, concurrency := escapeGlob(l.ratePrefix), escapeGlob(l.concurrentPrefix)
+	prefix = escapeGlob(prefix)
+	return []string{
+		rate + tag + prefix + "*",
+		concurrency + tag + prefix + "*",
+		// Side keys of untagged keys are tagged with the whole key.
+		"{" + rate + prefix + "*",
+		"{" + concurrency + prefix + "*",
+	}
+}
+
+// escapeGlob escapes the characters SCAN MATCH treats specially.
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			_, _ = b.WriteRune('\\')
+		}
+		_, _ = b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,59 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// resetWatchBuffer is the number of reset keys WatchResets buffers for a
+// reader that falls behind.
+const resetWatchBuffer = 100
+
+// WatchResets subscribes to the keyspace notifications of every node and,
+// whenever a rate limit key starting with prefix is deleted, by Reset from
+// any process or by an operator out-of-band, drops what the Limiter's local
+// caches hold for it and sends the key, without prefix, epoch or hash tag,
+// on the returned channel. The denial cache, decision cache, token cache and
+// shares otherwise keep serving the old state of a reset key until they
+// expire. The channel is closed once ctx is done.
+//
+// Caches are cleared even when the channel is not read; keys are dropped
+// from the channel, not held back, when its buffer is full. Notifications
+// must be enabled on the servers with at least the "Eg" flags of
+// notify-keyspace-events, and like those of StartKeyWatcher they are lost
+// while a node is unreachable. It fails with ErrKeyEventsUnsupported when
+// the Limiter's client cannot subscribe.
+func (l *Limiter) WatchResets(ctx context.Context, prefix string) (<-chan string, error) {
+	ch := make(chan string, resetWatchBuffer)
+	var wg sync.WaitGroup
+	subs, err := l.subscribeKeyEvents(ctx, []string{"__keyevent@*__:del"}, &wg, func(_ string, msg *redis.Message) {
+		ev, ok := l.parseKeyEvent(msg.Payload)
+		if !ok || ev.Kind != KeyKindRate || !strings.HasPrefix(ev.Key, prefix) {
+			return
+		}
+		l.forgetLocal(ev.Key)
+		select {
+		case ch <- ev.Key:
+		default:
+		}
+	})
+	closeAll := func() {
+		for _, ps := range subs {
+			_ = ps.Close()
+		}
+		wg.Wait()
+		close(ch)
+	}
+	if err != nil {
+		closeAll()
+		return nil, err
+	}
+	go func() {
+		<-ctx.Done()
+		closeAll()
+	}()
+	return ch, nil
+}
@@ -0,0 +1,83 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// WithRetry makes Allow and friends and Take and friends try up to
+// maxAttempts times in all when Redis fails transiently: on connection
+// errors and LOADING, READONLY, MOVED, ASK, TRYAGAIN, CLUSTERDOWN and
+// MASTERDOWN replies. The first retry waits about backoff, and every further
+// one twice as long as the last, with jitter so that callers failing
+// together do not retry together. Retries stop as soon as ctx is done.
+//
+// A request whose reply was lost may have been applied, so a retried allow
+// can be charged twice. Pipelines are not retried.
+func WithRetry(maxAttempts int, backoff time.Duration) Option {
+	return func(l *Limiter) {
+		l.retry = &retryPolicy{maxAttempts: maxAttempts, backoff: backoff}
+	}
+}
+
+type retryPolicy struct {
+	maxAttempts int
+	backoff     time.Duration
+}
+
+// again reports whether a call that failed with err on its attempt'th try
+// should be tried again, after waiting for the backoff. It reports false
+// without waiting out the backoff if ctx is done first.
+func (p *retryPolicy) again(ctx context.Context, err error, attempt int) bool {
+	if p == nil || attempt >= p.maxAttempts || !isTransient(err) {
+		return false
+	}
+	timer := time.NewTimer(p.delay(attempt))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// delay returns the wait before the attempt after the attempt'th: between
+// half and all of the backoff doubled attempt-1 times.
+func (p *retryPolicy) delay(attempt int) time.Duration {
+	d := p.backoff << (attempt - 1)
+	if d <= 0 || d < p.backoff {
+		d = p.backoff
+	}
+	if d <= 1 {
+		return d
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1)) //nolint:gosec // jitter
+}
+
+// transientPrefixes are the Redis error replies worth retrying.
+var transientPrefixes = []string{
+	"LOADING", "READONLY", "MOVED", "ASK", "TRYAGAIN", "CLUSTERDOWN", "MASTERDOWN",
+}
+
+// isTransient reports whether err may go away by trying again.
+func isTransient(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, redis.ErrClosed) {
+		return false
+	}
+	var rerr redis.Error
+	if errors.As(err, &rerr) {
+		for _, prefix := range transientPrefixes {
+			if redis.HasErrorPrefix(err, prefix) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
@@ -0,0 +1,35 @@
+package redis_rate_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ductone/redis_rate/v11"
+)
+
+func TestRetry(t *testing.T) {
+	ctx := context.Background()
+	limit := redis_rate.PerSecond(10)
+	l := newUnreachableLimiter(redis_rate.WithRetry(3, 20*time.Millisecond))
+
+	// two retries, waiting at least 10ms and then 20ms.
+	start := time.Now()
+	_, err := l.Allow(ctx, "test_id", limit)
+	require.Error(t, err)
+	require.GreaterOrEqual(t, time.Since(start), 30*time.Millisecond)
+
+	_, err = l.Take(ctx, "test_id", "req", redis_rate.ConcurrencyLimit{Max: 1})
+	require.Error(t, err)
+
+	// retries stop once ctx is done.
+	l = newUnreachableLimiter(redis_rate.WithRetry(10, time.Second))
+	ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	_, err = l.Allow(ctx, "test_id", limit)
+	require.Error(t, err)
+	require.Less(t, time.Since(start), time.Second)
+}
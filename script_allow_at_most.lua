@@ -6,6 +6,50 @@ local burst = ARGV[1]
 local rate = ARGV[2]
 local period = ARGV[3]
 local cost = tonumber(ARGV[4])
+-- ARGV[5] is an optional "now", see below. ARGV[6] is the number of events
+-- charged for each denied attempt.
+local penalty = tonumber(ARGV[6]) or 0
+-- ARGV[7], if "1", stores the tat in the compact form, and ARGV[8] and
+-- ARGV[9] set the time the key is kept for, see script_allow_n.lua.
+local compact = ARGV[7] == "1"
+local ttl_factor = tonumber(ARGV[8])
+local ttl_max = tonumber(ARGV[9])
+-- ARGV[10] and ARGV[11] ramp the rate up with the next key, see
+-- script_allow_n.lua.
+local warm_up = tonumber(ARGV[10])
+local next_key = 2
+local warm_up_key
+if warm_up then
+  warm_up_key = KEYS[next_key]
+  next_key = next_key + 1
+end
+-- ARGV[12], if "1", denies every request while the next key, holding when
+-- the key was frozen, exists, returning 2 as why the request was denied.
+local frozen_key
+if ARGV[12] == "1" then
+  frozen_key = KEYS[next_key]
+end
+
+local function get_tat(key)
+  local v = redis.call("GET", key)
+  if v and #v == 9 and string.byte(v, 1) == 203 then
+    return (struct.unpack(">d", v, 2))
+  end
+  return tonumber(v)
+end
+
+local function set_tat(key, tat, ttl)
+  if compact then
+    tat = "\203" .. struct.pack(">d", tat)
+  end
+  if ttl_factor then
+    ttl = math.ceil(ttl * ttl_factor)
+  end
+  if ttl_max then
+    ttl = math.min(ttl, ttl_max)
+  end
+  redis.call("SET", key, tat, "EX", math.max(ttl, 1))
+end
 
 local emission_interval = period / rate
 local burst_offset = emission_interval * burst
@@ -18,23 +62,54 @@ local burst_offset = emission_interval * burst
 -- point problems. this approach is good until "now" is 2,483,228,799 (Wed, 09
 -- Sep 2048 01:46:39 GMT), when the adjusted value is 16 digits.
 local jan_1_2017 = 1483228800
-local now = redis.call("TIME")
-now = (now[1] - jan_1_2017) + (now[2] / 1000000)
-
-local tat = redis.call("GET", rate_limit_key)
-
-if not tat then
-  tat = now
+-- callers may supply "now" in the same form for deterministic testing.
+local now
+if ARGV[5] and ARGV[5] ~= "" then
+  now = tonumber(ARGV[5])
 else
-  tat = tonumber(tat)
+  now = redis.call("TIME")
+  now = (now[1] - jan_1_2017) + (now[2] / 1000000)
+end
+
+-- a key is first seen when it has neither a warm-up start nor any state.
+-- the start is written once and expires when the warm-up ends, after which
+-- the key's own state keeps it warm.
+local since
+if warm_up_key then
+  since = tonumber(redis.call("GET", warm_up_key))
+  if not since and redis.call("EXISTS", rate_limit_key) == 0 then
+    since = now
+    redis.call("SET", warm_up_key, tostring(since), "EX", math.max(math.ceil(warm_up), 1))
+  end
 end
+if since then
+  local elapsed = math.max(now - since, 0)
+  if elapsed < warm_up then
+    local target = tonumber(rate)
+    local from = math.min(tonumber(ARGV[11]) or 1, target)
+    local ramped = from + (target - from) * elapsed / warm_up
+    burst = math.max(tonumber(burst) * ramped / target, 1)
+    emission_interval = period / ramped
+    burst_offset = emission_interval * burst
+  end
+end
+
+local tat = math.max(get_tat(rate_limit_key) or now, now)
 
-tat = math.max(tat, now)
+if frozen_key and redis.call("EXISTS", frozen_key) == 1 then
+  return {0, 0, "-1", tostring(tat - now), 0, 0, 2}
+end
 
 local diff = now - (tat - burst_offset)
 local remaining = diff / emission_interval
 
 if remaining < 1 then
+  if penalty > 0 and cost > 0 then
+    -- push the reset time further out for callers that ignore retry_after.
+    tat = tat + emission_interval * penalty
+    diff = now - (tat - burst_offset)
+    set_tat(rate_limit_key, tat, math.ceil(tat - now))
+  end
   local reset_after = tat - now
   local retry_after = emission_interval - diff
   return {
@@ -57,7 +132,7 @@ local new_tat = tat + increment
 
 local reset_after = new_tat - now
 if reset_after > 0 then
-  redis.call("SET", rate_limit_key, new_tat, "EX", math.ceil(reset_after))
+  set_tat(rate_limit_key, new_tat, math.ceil(reset_after))
 end
 
 return {
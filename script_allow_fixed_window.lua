@@ -0,0 +1,70 @@
+-- fixed window: up to rate events are counted per window, identified by the
+-- caller, and the count starts over when the window changes. the caller also
+-- supplies the time remaining in the window, since calendar boundaries such
+-- as the first of the month are not a fixed number of seconds apart.
+local rate_limit_key = KEYS[1]
+local rate = tonumber(ARGV[1])
+local cost = tonumber(ARGV[2])
+local window = ARGV[3]
+local reset_after = tonumber(ARGV[4])
+local at_most = ARGV[5] == "1"
+-- ARGV[6], if "1", denies every request while KEYS[2], holding when the key
+-- was frozen, exists, returning 2 as why the request was denied.
+--
+-- a request for no events is never retried, and neither is one for more
+-- events than rate, which no window can allow: it returns 3 as why it was
+-- denied.
+local frozen_key
+if ARGV[6] == "1" then
+  frozen_key = KEYS[2]
+end
+
+local state = redis.call("HMGET", rate_limit_key, "w", "n")
+local used = 0
+if state[1] == window then
+  used = tonumber(state[2]) or 0
+end
+
+local remaining = rate - used
+local current_reset = 0
+if used > 0 then
+  current_reset = reset_after
+end
+
+if frozen_key and redis.call("EXISTS", frozen_key) == 1 then
+  return {0, math.max(0, remaining), "-1", tostring(current_reset), used, 0, 2}
+end
+
+if cost == 0 then
+  return {0, math.max(0, remaining), "-1", tostring(current_reset), used}
+end
+if not at_most and cost > rate then
+  return {0, math.max(0, remaining), "-1", tostring(current_reset), used, 0, 3}
+end
+
+local allowed = cost
+if at_most then
+  allowed = math.max(0, math.min(cost, remaining))
+end
+
+if allowed == 0 or allowed > remaining then
+  return {
+    0, -- allowed
+    math.max(0, remaining),
+    tostring(reset_after),
+    tostring(current_reset),
+    used,
+  }
+end
+
+used = used + allowed
+redis.call("HSET", rate_limit_key, "w", window, "n", used)
+redis.call("EXPIRE", rate_limit_key, math.max(1, math.ceil(reset_after)))
+
+return {
+  allowed,
+  rate - used,
+  tostring(-1),
+  tostring(reset_after),
+  used,
+}
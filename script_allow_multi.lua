@@ -0,0 +1,133 @@
+-- this script has side-effects, so it requires replicate commands mode
+redis.replicate_commands()
+
+-- KEYS are consulted in order. ARGV[1] is the number of permits wanted,
+-- ARGV[2] is the mode and ARGV[3] is an optional "now", followed by a burst,
+-- rate, period triple for each key. in mode 0 the permits are spread across
+-- the keys, as many as are available; in mode 1 they are spread across the
+-- keys in full or not at all; in mode 2 every key must supply all of them,
+-- or none are taken from any key. the argument after the last triple, if
+-- "1", stores the tats in the compact form, and the two after it set the
+-- time the keys are kept for, see script_allow_n.lua.
+local cost = tonumber(ARGV[1])
+local mode = tonumber(ARGV[2])
+local all_or_nothing = mode >= 1
+local each = mode == 2
+local compact = ARGV[#KEYS * 3 + 4] == "1"
+local ttl_factor = tonumber(ARGV[#KEYS * 3 + 5])
+local ttl_max = tonumber(ARGV[#KEYS * 3 + 6])
+
+local function get_tat(key)
+  local v = redis.call("GET", key)
+  if v and #v == 9 and string.byte(v, 1) == 203 then
+    return (struct.unpack(">d", v, 2))
+  end
+  return tonumber(v)
+end
+
+local function set_tat(key, tat, ttl)
+  if compact then
+    tat = "\203" .. struct.pack(">d", tat)
+  end
+  if ttl_factor then
+    ttl = math.ceil(ttl * ttl_factor)
+  end
+  if ttl_max then
+    ttl = math.min(ttl, ttl_max)
+  end
+  redis.call("SET", key, tat, "EX", math.max(ttl, 1))
+end
+
+-- redis returns time as an array containing two integers: seconds of the epoch
+-- time (10 digits) and microseconds (6 digits). for convenience we need to
+-- convert them to a floating point number. the resulting number is 16 digits,
+-- bordering on the limits of a 64-bit double-precision floating point number.
+-- adjust the epoch to be relative to Jan 1, 2017 00:00:00 GMT to avoid floating
+-- point problems. this approach is good until "now" is 2,483,228,799 (Wed, 09
+-- Sep 2048 01:46:39 GMT), when the adjusted value is 16 digits.
+local jan_1_2017 = 1483228800
+-- callers may supply "now" in the same form for deterministic testing.
+local now
+if ARGV[3] and ARGV[3] ~= "" then
+  now = tonumber(ARGV[3])
+else
+  now = redis.call("TIME")
+  now = (now[1] - jan_1_2017) + (now[2] / 1000000)
+end
+
+-- tolerance for floating point error when rounding remaining permits down.
+local epsilon = 0.000001
+
+-- first pass: work out how many permits each key can supply.
+local states = {}
+local wanted = cost
+local short = false
+for i, rate_limit_key in ipairs(KEYS) do
+  local burst = tonumber(ARGV[i * 3 + 1])
+  local rate = tonumber(ARGV[i * 3 + 2])
+  local period = tonumber(ARGV[i * 3 + 3])
+
+  local emission_interval = period / rate
+  local burst_offset = emission_interval * burst
+
+  local tat = math.max(get_tat(rate_limit_key) or now, now)
+
+  local diff = now - (tat - burst_offset)
+  local remaining = math.max(math.floor(diff / emission_interval + epsilon), 0)
+  if each then
+    wanted = cost
+  end
+  local take = math.min(remaining, wanted)
+  if take < wanted then
+    short = true
+  end
+
+  states[i] = {
+    key = rate_limit_key,
+    emission_interval = emission_interval,
+    burst_offset = burst_offset,
+    tat = tat,
+    remaining = remaining,
+    wanted = wanted,
+    take = take,
+  }
+  wanted = wanted - take
+end
+
+local denied = all_or_nothing and wanted > 0
+if each then
+  denied = short
+end
+
+-- second pass: charge the keys, or report why the request was denied.
+local results = {}
+for i, s in ipairs(states) do
+  if denied or s.take < 1 then
+    local retry_after = -1
+    if s.wanted > 0 and s.remaining < s.wanted then
+      -- time until this key alone could supply what was still wanted from it.
+      retry_after = (s.tat + s.emission_interval * s.wanted - s.burst_offset) - now
+    end
+    results[i] = {
+      0, -- allowed
+      s.remaining,
+      tostring(retry_after),
+      tostring(s.tat - now),
+    }
+  else
+    local new_tat = s.tat + s.emission_interval * s.take
+    local reset_after = new_tat - now
+    if reset_after > 0 then
+      set_tat(s.key, new_tat, math.ceil(reset_after))
+    end
+
+    results[i] = {
+      s.take,
+      s.remaining - s.take,
+      tostring(-1),
+      tostring(reset_after),
+    }
+  end
+end
+
+return results
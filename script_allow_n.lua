@@ -6,6 +6,84 @@ local burst = ARGV[1]
 local rate = ARGV[2]
 local period = ARGV[3]
 local cost = tonumber(ARGV[4])
+-- ARGV[5] is an optional "now", see below. ARGV[6] is the number of events
+-- charged for each denied attempt.
+local penalty = tonumber(ARGV[6]) or 0
+-- ARGV[7], if "1", returns the allowed cost and remaining capacity as strings
+-- so that fractional costs are not truncated to integers by redis.
+local exact = ARGV[7] == "1"
+-- ARGV[8], if "1", spends the boost tokens held in the next key before the
+-- limit. ARGV[9] to ARGV[11], unless empty, ban the key for ARGV[11] seconds
+-- once it is denied ARGV[9] times within ARGV[10] seconds, or never if
+-- ARGV[9] is 0; the ban and the count of denials are the next two keys.
+-- ARGV[12], if "1", denies every request while the next key, holding when
+-- the key was frozen, exists. With any of them, the number of boost tokens
+-- spent and why the request was denied, 1 for a ban and 2 for a freeze,
+-- follow the usual values. A frozen key's reply always has them, even with
+-- only ARGV[12] set, as AllowCost does.
+local extended = ARGV[8] ~= nil and ARGV[8] ~= ""
+-- ARGV[13], if "1", stores the tat as a msgpack float64 instead of as text.
+-- either form is read.
+local compact = ARGV[13] == "1"
+-- ARGV[14], unless empty, multiplies the time the key is kept for, which is
+-- otherwise until it resets, and ARGV[15], unless empty, caps it in seconds.
+local ttl_factor = tonumber(ARGV[14])
+local ttl_max = tonumber(ARGV[15])
+-- ARGV[16], unless empty, ramps the rate up linearly from ARGV[17] over that
+-- many seconds after the key is first seen, as held in the key after the
+-- others, which expires once the key goes unused for as long.
+local warm_up = tonumber(ARGV[16])
+local next_key = 2
+local boost_key
+if ARGV[8] == "1" then
+  boost_key = KEYS[next_key]
+  next_key = next_key + 1
+end
+local ban_key, strikes_key, ban_denials, ban_window, ban_duration
+if ARGV[9] and ARGV[9] ~= "" then
+  ban_key = KEYS[next_key]
+  strikes_key = KEYS[next_key + 1]
+  next_key = next_key + 2
+  ban_denials = tonumber(ARGV[9])
+  ban_window = tonumber(ARGV[10])
+  ban_duration = tonumber(ARGV[11])
+end
+local frozen_key
+if ARGV[12] == "1" then
+  frozen_key = KEYS[next_key]
+  next_key = next_key + 1
+end
+local warm_up_key
+if warm_up then
+  warm_up_key = KEYS[next_key]
+end
+
+local function get_tat(key)
+  local v = redis.call("GET", key)
+  if v and #v == 9 and string.byte(v, 1) == 203 then
+    return (struct.unpack(">d", v, 2))
+  end
+  return tonumber(v)
+end
+
+local function set_tat(key, tat, ttl)
+  if compact then
+    tat = "\203" .. struct.pack(">d", tat)
+  end
+  if ttl_factor then
+    ttl = math.ceil(ttl * ttl_factor)
+  end
+  if ttl_max then
+    ttl = math.min(ttl, ttl_max)
+  end
+  redis.call("SET", key, tat, "EX", math.max(ttl, 1))
+end
+
+local boosted = 0
+if boost_key then
+  boosted = math.min(tonumber(redis.call("GET", boost_key) or 0), cost)
+  cost = cost - boosted
+end
 
 local emission_interval = period / rate
 local increment = emission_interval * cost
@@ -19,18 +97,51 @@ local burst_offset = emission_interval * burst
 -- point problems. this approach is good until "now" is 2,483,228,799 (Wed, 09
 -- Sep 2048 01:46:39 GMT), when the adjusted value is 16 digits.
 local jan_1_2017 = 1483228800
-local now = redis.call("TIME")
-now = (now[1] - jan_1_2017) + (now[2] / 1000000)
+-- callers may supply "now" in the same form for deterministic testing.
+local now
+if ARGV[5] and ARGV[5] ~= "" then
+  now = tonumber(ARGV[5])
+else
+  now = redis.call("TIME")
+  now = (now[1] - jan_1_2017) + (now[2] / 1000000)
+end
 
-local tat = redis.call("GET", rate_limit_key)
+-- a key is first seen when it has neither a warm-up start nor any state.
+-- the start is written once and expires when the warm-up ends, after which
+-- the key's own state keeps it warm.
+local since
+if warm_up_key then
+  since = tonumber(redis.call("GET", warm_up_key))
+  if not since and redis.call("EXISTS", rate_limit_key) == 0 then
+    since = now
+    redis.call("SET", warm_up_key, tostring(since), "EX", math.max(math.ceil(warm_up), 1))
+  end
+end
+if since then
+  local elapsed = math.max(now - since, 0)
+  if elapsed < warm_up then
+    local target = tonumber(rate)
+    local from = math.min(tonumber(ARGV[17]) or 1, target)
+    local ramped = from + (target - from) * elapsed / warm_up
+    burst = math.max(tonumber(burst) * ramped / target, 1)
+    emission_interval = period / ramped
+    increment = emission_interval * cost
+    burst_offset = emission_interval * burst
+  end
+end
 
-if not tat then
-  tat = now
-else
-  tat = tonumber(tat)
+local tat = math.max(get_tat(rate_limit_key) or now, now)
+
+if frozen_key and redis.call("EXISTS", frozen_key) == 1 then
+  return {0, 0, "-1", tostring(tat - now), 0, 0, 2}
 end
 
-tat = math.max(tat, now)
+if ban_key then
+  local ban_ttl = redis.call("PTTL", ban_key)
+  if ban_ttl > 0 then
+    return {0, 0, tostring(ban_ttl / 1000), tostring(tat - now), 0, 0, 1}
+  end
+end
 
 local new_tat = tat + increment
 local allow_at = new_tat - burst_offset
@@ -38,9 +149,34 @@ local allow_at = new_tat - burst_offset
 local diff = now - allow_at
 local remaining = diff / emission_interval
 
-if remaining < 0 then
+-- requests covered by boost tokens alone are allowed however far the limit
+-- is exceeded.
+if remaining < 0 and (boosted == 0 or cost > 0) then
+  if penalty > 0 and cost > 0 then
+    -- push the reset time further out for callers that ignore retry_after.
+    tat = tat + emission_interval * penalty
+    diff = now - (tat + increment - burst_offset)
+    set_tat(rate_limit_key, tat, math.ceil(tat - now))
+  end
   local reset_after = tat - now
   local retry_after = diff * -1
+  if ban_key and ban_denials > 0 and cost > 0 then
+    local strikes = redis.call("INCR", strikes_key)
+    if strikes == 1 then
+      redis.call("PEXPIRE", strikes_key, math.ceil(ban_window * 1000))
+    end
+    if strikes >= ban_denials then
+      redis.call("SET", ban_key, "1", "PX", math.ceil(ban_duration * 1000))
+      redis.call("DEL", strikes_key)
+      return {0, 0, tostring(ban_duration), tostring(reset_after), 0, 0, 1}
+    end
+  end
+  if exact then
+    return {"0", "0", tostring(retry_after), tostring(reset_after)}
+  end
+  if extended then
+    return {0, 0, tostring(retry_after), tostring(reset_after), 0, 0, 0}
+  end
   return {
     0, -- allowed
     0, -- remaining
@@ -51,7 +187,24 @@ end
 
 local reset_after = new_tat - now
 if reset_after > 0 then
-  redis.call("SET", rate_limit_key, new_tat, "EX", math.ceil(reset_after))
+  set_tat(rate_limit_key, new_tat, math.ceil(reset_after))
 end
 local retry_after = -1
+if extended then
+  if boosted > 0 then
+    redis.call("DECRBY", boost_key, boosted)
+  end
+  return {
+    cost + boosted, -- allowed
+    math.max(remaining, 0),
+    tostring(retry_after),
+    tostring(reset_after),
+    0, -- used
+    boosted,
+    0, -- banned
+  }
+end
+if exact then
+  return {tostring(cost), tostring(remaining), tostring(retry_after), tostring(reset_after)}
+end
 return {cost, remaining, tostring(retry_after), tostring(reset_after)}
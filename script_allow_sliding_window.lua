@@ -0,0 +1,80 @@
+-- this script has side-effects, so it requires replicate commands mode
+redis.replicate_commands()
+
+-- sliding window counter: events are counted in fixed windows of length
+-- period, stored as fields of a hash keyed by window index. the count for
+-- the rolling window ending at now is the current window's count plus the
+-- previous window's count weighted by how much of it still overlaps.
+local rate_limit_key = KEYS[1]
+local rate = tonumber(ARGV[1])
+local period = tonumber(ARGV[2])
+local cost = tonumber(ARGV[3])
+
+local jan_1_2017 = 1483228800
+-- callers may supply "now" in the same form for deterministic testing.
+local now
+if ARGV[4] and ARGV[4] ~= "" then
+  now = tonumber(ARGV[4])
+else
+  now = redis.call("TIME")
+  now = (now[1] - jan_1_2017) + (now[2] / 1000000)
+end
+
+local window = math.floor(now / period)
+local elapsed = now - window * period
+
+local counts = redis.call("HMGET", rate_limit_key, tostring(window), tostring(window - 1))
+local cur = tonumber(counts[1]) or 0
+local prev = tonumber(counts[2]) or 0
+
+local weight = (period - elapsed) / period
+local count = prev * weight + cur
+
+if count + cost > rate then
+  -- find when the weighted count drops far enough, first within the current
+  -- window as the previous one slides out, then within the next window.
+  local retry_after = -1
+  if cost > rate then
+    retry_after = -1
+  elseif prev > 0 and cur + cost <= rate then
+    retry_after = period * (1 - (rate - cur - cost) / prev) - elapsed
+  elseif cur > 0 then
+    retry_after = (period - elapsed) + period * (1 - (rate - cost) / cur)
+  end
+
+  local reset_after = 0
+  if cur > 0 then
+    reset_after = 2 * period - elapsed
+  elseif prev > 0 then
+    reset_after = period - elapsed
+  end
+  return {
+    0, -- allowed
+    tostring(count),
+    math.max(0, math.floor(rate - count)),
+    tostring(retry_after),
+    tostring(reset_after),
+  }
+end
+
+cur = redis.call("HINCRBY", rate_limit_key, tostring(window), cost)
+count = prev * weight + cur
+
+-- drop windows that no longer overlap the rolling window.
+local fields = redis.call("HKEYS", rate_limit_key)
+for _, field in ipairs(fields) do
+  if tonumber(field) < window - 1 then
+    redis.call("HDEL", rate_limit_key, field)
+  end
+end
+
+local reset_after = 2 * period - elapsed
+redis.call("EXPIRE", rate_limit_key, math.ceil(reset_after))
+
+return {
+  cost, -- allowed
+  tostring(count),
+  math.max(0, math.floor(rate - count)),
+  tostring(-1),
+  tostring(reset_after),
+}
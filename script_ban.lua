@@ -0,0 +1,21 @@
+-- Ban, unban or look up the ban of a rate limit key. KEYS[1] is the rate
+-- limit key, which only routes the script to the shard holding it, KEYS[2]
+-- the ban checked by script_allow_n.lua and KEYS[3] its count of recent
+-- denials. ARGV[1] is the length of a new ban in milliseconds, 0 to lift the
+-- ban or -1 to leave it as it is. Returns the milliseconds left of the ban,
+-- or -1 if the key is not banned.
+local ban_key = KEYS[2]
+local strikes_key = KEYS[3]
+local ttl = tonumber(ARGV[1])
+
+if ttl > 0 then
+  redis.call("SET", ban_key, "1", "PX", ttl)
+elseif ttl == 0 then
+  redis.call("DEL", ban_key, strikes_key)
+end
+
+local left = redis.call("PTTL", ban_key)
+if left < 0 then
+  return -1
+end
+return left
@@ -0,0 +1,24 @@
+-- Grant, read or revoke the boost tokens of a rate limit key. KEYS[1] is the
+-- rate limit key, which only routes the script to the shard holding it, and
+-- KEYS[2] the boost tokens spent by script_allow_n.lua before the limit.
+-- ARGV[1] is the number of tokens to add, ARGV[2] the new expiry of the boost
+-- tokens in milliseconds, and ARGV[3], if "1", deletes them instead.
+local boost_key = KEYS[2]
+local tokens = tonumber(ARGV[1])
+local ttl = tonumber(ARGV[2])
+
+if ARGV[3] == "1" then
+  redis.call("DEL", boost_key)
+  return {0, -1}
+end
+
+if tokens > 0 then
+  redis.call("INCRBY", boost_key, tokens)
+  redis.call("PEXPIRE", boost_key, ttl)
+end
+
+local balance = tonumber(redis.call("GET", boost_key) or 0)
+if balance <= 0 then
+  return {0, -1}
+end
+return {balance, redis.call("PTTL", boost_key)}
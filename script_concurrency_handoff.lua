@@ -0,0 +1,87 @@
+-- Move the slots held by one request id in a concurrency hash to another,
+-- without freeing them in between. KEYS[1] is the concurrency hash and
+-- KEYS[2] the counter of fencing tokens, of which the new holder is given a
+-- new one. ARGV[1] is the current holder, ARGV[2] the new holder and ARGV[3]
+-- the number of seconds the new holder may keep the slots. returns the
+-- number of slots moved, 0 if the current holder holds none, or -1 if the
+-- new holder already holds slots, followed by the number of slots in use
+-- and the new holder's fencing token.
+local rate_limit_key = KEYS[1]
+local fence_key = KEYS[2]
+local from_id = ARGV[1]
+local to_id = ARGV[2]
+local max_request_time_seconds = tonumber(ARGV[3])
+
+-- redis returns time as an array containing two integers: seconds of the epoch
+-- time (10 digits) and microseconds (6 digits). for convenience we need to
+-- convert them to a floating point number. the resulting number is 16 digits,
+-- bordering on the limits of a 64-bit double-precision floating point number.
+-- adjust the epoch to be relative to Jan 1, 2017 00:00:00 GMT to avoid floating
+-- point problems. this approach is good until "now" is 2,483,228,799 (Wed, 09
+-- Sep 2048 01:46:39 GMT), when the adjusted value is 16 digits.
+local jan_1_2017 = 1483228800
+-- callers may supply "now" in the same form for deterministic testing.
+local now
+if ARGV[4] and ARGV[4] ~= "" then
+  now = tonumber(ARGV[4])
+else
+  now = redis.call("TIME")
+  now = (now[1] - jan_1_2017) + (now[2] / 1000000)
+end
+
+-- fencing tokens increase with every slot granted. they never fall below
+-- the time in microseconds, so they keep increasing if the counter expires.
+local fence = function ()
+  local token = (tonumber(redis.call("GET", fence_key)) or 0) + 1
+  token = math.max(token, math.floor(now * 1000000))
+  redis.call("SET", fence_key, string.format("%d", token), "EX", 5 * max_request_time_seconds)
+  return token
+end
+
+local parseholder = function (v)
+    local parts = {}
+    for part in string.gmatch(v, "[^|]+") do
+        table.insert(parts, part)
+    end
+    return tonumber(parts[1]), tonumber(parts[2]) or 1, tonumber(parts[3])
+end
+
+-- count live holders, pruning expired ones.
+local count = 0
+local bulk = redis.call("HGETALL", rate_limit_key)
+local nextkey
+for i, v in ipairs(bulk) do
+  if i % 2 == 1 then
+    nextkey = v
+  else
+    local expires_at, held = parseholder(v)
+    if expires_at < now then
+      redis.call("HDEL", rate_limit_key, nextkey)
+    else
+      count = count + held
+    end
+  end
+end
+
+local v = redis.call("HGET", rate_limit_key, from_id)
+if not v then
+  return {0, count}
+end
+if redis.call("HEXISTS", rate_limit_key, to_id) == 1 then
+  return {-1, count}
+end
+
+local _, weight, acquired_at = parseholder(v)
+-- the slots are still considered taken when they were first acquired, so
+-- hold statistics cover the whole piece of work.
+acquired_at = acquired_at or now
+redis.call("HDEL", rate_limit_key, from_id)
+local value = (now + max_request_time_seconds) .. "|" .. weight .. "|" .. acquired_at
+-- the owner, if any, goes with the slots.
+local owner = string.match(v, "^[^|]*|[^|]*|[^|]*|(.*)$")
+if owner then
+  value = value .. "|" .. owner
+end
+redis.call("HSET", rate_limit_key, to_id, value)
+redis.call("EXPIRE", rate_limit_key, 5 * max_request_time_seconds)
+return {weight, count, fence()}
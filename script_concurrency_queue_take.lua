@@ -0,0 +1,136 @@
+-- Take a slot like script_concurrency_take.lua, but in FIFO order among
+-- callers waiting in a queue. KEYS[1] is the concurrency hash, KEYS[2] a
+-- sorted set of waiting request ids scored by when they joined the queue,
+-- KEYS[3] the list of recent hold durations kept on release and KEYS[4] a
+-- sorted set of waiting request ids scored by when their caller gives up,
+-- and KEYS[5] the counter of fencing tokens.
+-- ARGV[6] is how long, in seconds, the caller will keep waiting, or "" if
+-- it has no deadline.
+local rate_limit_key = KEYS[1]
+local queue_key = KEYS[2]
+local samples_key = KEYS[3]
+local deadlines_key = KEYS[4]
+local fence_key = KEYS[5]
+local request_id = ARGV[1]
+local limit = tonumber(ARGV[2])
+local max_request_time_seconds = tonumber(ARGV[3])
+local weight = tonumber(ARGV[4]) or 1
+local wait_for = tonumber(ARGV[6])
+
+-- redis returns time as an array containing two integers: seconds of the epoch
+-- time (10 digits) and microseconds (6 digits). for convenience we need to
+-- convert them to a floating point number. the resulting number is 16 digits,
+-- bordering on the limits of a 64-bit double-precision floating point number.
+-- adjust the epoch to be relative to Jan 1, 2017 00:00:00 GMT to avoid floating
+-- point problems. this approach is good until "now" is 2,483,228,799 (Wed, 09
+-- Sep 2048 01:46:39 GMT), when the adjusted value is 16 digits.
+local jan_1_2017 = 1483228800
+-- callers may supply "now" in the same form for deterministic testing.
+local now
+if ARGV[5] and ARGV[5] ~= "" then
+  now = tonumber(ARGV[5])
+else
+  now = redis.call("TIME")
+  now = (now[1] - jan_1_2017) + (now[2] / 1000000)
+end
+
+-- fencing tokens increase with every slot granted. they never fall below
+-- the time in microseconds, so they keep increasing if the counter expires.
+local fence = function ()
+  local token = (tonumber(redis.call("GET", fence_key)) or 0) + 1
+  token = math.max(token, math.floor(now * 1000000))
+  redis.call("SET", fence_key, string.format("%d", token), "EX", 5 * max_request_time_seconds)
+  return token
+end
+
+local parseholder = function (v)
+    local parts = {}
+    for part in string.gmatch(v, "[^|]+") do
+        table.insert(parts, part)
+    end
+    return tonumber(parts[1]), tonumber(parts[2]) or 1
+end
+
+-- count live holders, pruning expired ones, and remember when each frees up.
+local count = 0
+local frees = {}
+local bulk = redis.call("HGETALL", rate_limit_key)
+local nextkey
+for i, v in ipairs(bulk) do
+  if i % 2 == 1 then
+    nextkey = v
+  else
+    local expires_at, held = parseholder(v)
+    if expires_at < now then
+      redis.call("HDEL", rate_limit_key, nextkey)
+    else
+      count = count + held
+      table.insert(frees, {expires_at, held})
+    end
+  end
+end
+
+-- waiters that have been queued for longer than a slot can be held are
+-- assumed to be gone.
+local queue_ttl = 5 * max_request_time_seconds
+redis.call("ZREMRANGEBYSCORE", queue_key, "-inf", now - queue_ttl)
+-- so are waiters whose caller's deadline has passed.
+if deadlines_key then
+  local gone = redis.call("ZRANGEBYSCORE", deadlines_key, "-inf", now)
+  for _, id in ipairs(gone) do
+    redis.call("ZREM", queue_key, id)
+    redis.call("ZREM", deadlines_key, id)
+  end
+end
+redis.call("ZADD", queue_key, "NX", now, request_id)
+redis.call("EXPIRE", queue_key, queue_ttl)
+if deadlines_key then
+  if wait_for then
+    redis.call("ZADD", deadlines_key, now + wait_for, request_id)
+    redis.call("EXPIRE", deadlines_key, queue_ttl)
+  else
+    redis.call("ZREM", deadlines_key, request_id)
+  end
+end
+local rank = redis.call("ZRANK", queue_key, request_id)
+
+if count + weight <= limit and rank < limit - count then
+  redis.call("ZREM", queue_key, request_id)
+  if deadlines_key then
+    redis.call("ZREM", deadlines_key, request_id)
+  end
+  local value = (now + max_request_time_seconds) .. "|" .. weight .. "|" .. now
+  redis.call("HSET", rate_limit_key, request_id, value)
+  redis.call("EXPIRE", rate_limit_key, 5 * max_request_time_seconds)
+  return {1, count + weight, 0, tostring(0), fence()}
+end
+
+-- the wait is at most the time until enough holders expire to make room for
+-- this request and every waiter ahead of it.
+local needed = count + weight + rank - limit
+table.sort(frees, function (a, b) return a[1] < b[1] end)
+local wait = -1
+local freed = 0
+for _, f in ipairs(frees) do
+  freed = freed + f[2]
+  if freed >= needed then
+    wait = f[1] - now
+    break
+  end
+end
+
+-- holders usually release sooner, so when recent hold durations are known
+-- estimate the wait from the rate at which slots free up instead.
+local samples = redis.call("LRANGE", samples_key, 0, -1)
+if #samples > 0 then
+  local total = 0
+  for _, s in ipairs(samples) do
+    total = total + tonumber(s)
+  end
+  local estimate = needed * (total / #samples) / limit
+  if wait < 0 or estimate < wait then
+    wait = estimate
+  end
+end
+
+return {0, count, rank + 1, tostring(wait)}
@@ -0,0 +1,44 @@
+-- Release a request id from a concurrency hash and record how long it held
+-- its slots. KEYS[1] is the concurrency hash and KEYS[2] a list of recent hold
+-- durations in seconds, newest first.
+local rate_limit_key = KEYS[1]
+local samples_key = KEYS[2]
+local request_id = ARGV[1]
+local max_samples = tonumber(ARGV[3])
+
+-- redis returns time as an array containing two integers: seconds of the epoch
+-- time (10 digits) and microseconds (6 digits). for convenience we need to
+-- convert them to a floating point number. the resulting number is 16 digits,
+-- bordering on the limits of a 64-bit double-precision floating point number.
+-- adjust the epoch to be relative to Jan 1, 2017 00:00:00 GMT to avoid floating
+-- point problems. this approach is good until "now" is 2,483,228,799 (Wed, 09
+-- Sep 2048 01:46:39 GMT), when the adjusted value is 16 digits.
+local jan_1_2017 = 1483228800
+-- callers may supply "now" in the same form for deterministic testing.
+local now
+if ARGV[2] and ARGV[2] ~= "" then
+  now = tonumber(ARGV[2])
+else
+  now = redis.call("TIME")
+  now = (now[1] - jan_1_2017) + (now[2] / 1000000)
+end
+
+local v = redis.call("HGET", rate_limit_key, request_id)
+if not v then
+  return 0
+end
+redis.call("HDEL", rate_limit_key, request_id)
+
+local parts = {}
+for part in string.gmatch(v, "[^|]+") do
+  table.insert(parts, part)
+end
+local acquired_at = tonumber(parts[3])
+if acquired_at then
+  redis.call("LPUSH", samples_key, tostring(math.max(now - acquired_at, 0)))
+  redis.call("LTRIM", samples_key, 0, max_samples - 1)
+  -- keep statistics around for a day after the key was last used.
+  redis.call("EXPIRE", samples_key, 86400)
+end
+
+return 1
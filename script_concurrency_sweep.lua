@@ -0,0 +1,45 @@
+-- Remove expired request ids from a concurrency hash, returning how many
+-- were removed.
+local rate_limit_key = KEYS[1]
+
+if redis.call("TYPE", rate_limit_key).ok ~= "hash" then
+  return 0
+end
+
+-- redis returns time as an array containing two integers: seconds of the epoch
+-- time (10 digits) and microseconds (6 digits). for convenience we need to
+-- convert them to a floating point number. the resulting number is 16 digits,
+-- bordering on the limits of a 64-bit double-precision floating point number.
+-- adjust the epoch to be relative to Jan 1, 2017 00:00:00 GMT to avoid floating
+-- point problems. this approach is good until "now" is 2,483,228,799 (Wed, 09
+-- Sep 2048 01:46:39 GMT), when the adjusted value is 16 digits.
+local jan_1_2017 = 1483228800
+-- callers may supply "now" in the same form for deterministic testing.
+local now
+if ARGV[1] and ARGV[1] ~= "" then
+  now = tonumber(ARGV[1])
+else
+  now = redis.call("TIME")
+  now = (now[1] - jan_1_2017) + (now[2] / 1000000)
+end
+
+local removed = 0
+local bulk = redis.call("HGETALL", rate_limit_key)
+local nextkey
+for i, v in ipairs(bulk) do
+  if i % 2 == 1 then
+    nextkey = v
+  else
+    local sep = string.find(v, "|", 1, true)
+    if sep then
+      v = string.sub(v, 1, sep - 1)
+    end
+    local expires_at = tonumber(v)
+    if expires_at and expires_at < now then
+      redis.call("HDEL", rate_limit_key, nextkey)
+      removed = removed + 1
+    end
+  end
+end
+
+return removed
@@ -1,8 +1,23 @@
--- Maintain a hash of request ids and their expiration times.
+-- Maintain a hash of request ids and their expiration times. KEYS[2] is the
+-- counter of fencing tokens, of which a new one is returned with each slot
+-- granted.
+--
+-- Values are the expiration time, the number of slots held, the time the
+-- slots were taken and, if any, their owner, separated by "|". The owner is
+-- last and may itself contain "|". Older values may be just the expiration
+-- time, or omit the time taken.
+--
+-- ARGV[6], unless empty, is the owner of the request, and ARGV[7], unless 0,
+-- the most slots one owner may hold. With an owner the reply also has the
+-- slots the owner holds and 1 if the owner's cap denied the request.
 local rate_limit_key = KEYS[1]
+local fence_key = KEYS[2]
 local request_id = ARGV[1]
 local limit = tonumber(ARGV[2])
 local max_request_time_seconds = tonumber(ARGV[3])
+local weight = tonumber(ARGV[4]) or 1
+local owner = ARGV[6] or ""
+local max_per_owner = tonumber(ARGV[7]) or 0
 
 -- redis returns time as an array containing two integers: seconds of the epoch
 -- time (10 digits) and microseconds (6 digits). for convenience we need to
@@ -12,8 +27,33 @@ local max_request_time_seconds = tonumber(ARGV[3])
 -- point problems. this approach is good until "now" is 2,483,228,799 (Wed, 09
 -- Sep 2048 01:46:39 GMT), when the adjusted value is 16 digits.
 local jan_1_2017 = 1483228800
-local now = redis.call("TIME")
-now = (now[1] - jan_1_2017) + (now[2] / 1000000)
+-- callers may supply "now" in the same form for deterministic testing.
+local now
+if ARGV[5] and ARGV[5] ~= "" then
+  now = tonumber(ARGV[5])
+else
+  now = redis.call("TIME")
+  now = (now[1] - jan_1_2017) + (now[2] / 1000000)
+end
+
+-- fencing tokens increase with every slot granted. they never fall below
+-- the time in microseconds, so they keep increasing if the counter expires.
+local fence = function ()
+  local token = (tonumber(redis.call("GET", fence_key)) or 0) + 1
+  token = math.max(token, math.floor(now * 1000000))
+  redis.call("SET", fence_key, string.format("%d", token), "EX", 5 * max_request_time_seconds)
+  return token
+end
+
+local parseholder = function (v)
+    local parts = {}
+    for part in string.gmatch(v, "[^|]+") do
+        table.insert(parts, part)
+    end
+    return tonumber(parts[1]), tonumber(parts[2]) or 1
+end
+
+local owner_count = 0
 
 local hmcountandfilter = function (key)
     local count = 0
@@ -23,10 +63,14 @@ local hmcountandfilter = function (key)
 		if i % 2 == 1 then
 			nextkey = v
 		else
-		    if tonumber(v) < now then
+		    local expires_at, held = parseholder(v)
+		    if expires_at < now then
                 redis.call("HDEL", rate_limit_key, nextkey)
             else
-                count = count + 1
+                count = count + held
+                if owner ~= "" and string.match(v, "^[^|]*|[^|]*|[^|]*|(.*)$") == owner then
+                    owner_count = owner_count + held
+                end
 		    end
 		end
 	end
@@ -34,10 +78,24 @@ local hmcountandfilter = function (key)
 end
 
 local count = hmcountandfilter(rate_limit_key)
-if count >= limit then
+if owner ~= "" and max_per_owner > 0 and owner_count + weight > max_per_owner then
+  return {0, count, 0, owner_count, 1}
+end
+if count + weight > limit then
+  if owner ~= "" then
+    return {0, count, 0, owner_count, 0}
+  end
   return {0, count}
 end
 
-redis.call("HSET", rate_limit_key, request_id, now + max_request_time_seconds)
+local value = (now + max_request_time_seconds) .. "|" .. weight .. "|" .. now
+if owner ~= "" then
+  value = value .. "|" .. owner
+end
+
+redis.call("HSET", rate_limit_key, request_id, value)
 redis.call("EXPIRE", rate_limit_key, 5 * max_request_time_seconds)
-return {1, count + 1}
+if owner ~= "" then
+  return {1, count + weight, fence(), owner_count + weight, 0}
+end
+return {1, count + weight, fence()}
@@ -0,0 +1,19 @@
+-- With epochs ARGV[1] is "__epoch__", ARGV[2] the number of leading KEYS
+-- that are rate limit keys, and the last of KEYS the epoch counter of their
+-- slot. The rate limit keys are renamed for the counter's epoch, in the
+-- slot they name, and the arguments dropped before the script runs, so a
+-- bumped epoch is seen by every call that starts after it.
+if ARGV[1] == "__epoch__" then
+  local suffix = ":e" .. (redis.call("GET", table.remove(KEYS)) or "0")
+  local n = tonumber(ARGV[2])
+  table.remove(ARGV, 1)
+  table.remove(ARGV, 1)
+  for i = 1, n do
+    if string.find(KEYS[i], "}", 1, true) then
+      KEYS[i] = KEYS[i] .. suffix
+    else
+      KEYS[i] = "{" .. KEYS[i] .. "}" .. suffix
+    end
+  end
+end
+
@@ -0,0 +1,9 @@
+-- Raise the epoch counter KEYS[1] to ARGV[1], leaving it alone if it is
+-- already there, so racing bumps never lower it. Returns the epoch.
+local current = tonumber(redis.call("GET", KEYS[1]) or "0")
+local epoch = tonumber(ARGV[1])
+if epoch > current then
+  redis.call("SET", KEYS[1], epoch)
+  return epoch
+end
+return current
@@ -0,0 +1,75 @@
+-- this script has side-effects, so it requires replicate commands mode
+redis.replicate_commands()
+
+-- Freeze, unfreeze or look up the freeze of a rate limit key. KEYS[1] is the
+-- rate limit key and KEYS[2] when it was frozen, checked by the allow
+-- scripts. Calendar limits keep counting in windows, so only the tat of a
+-- GCRA key is pinned. ARGV[1] is "1" to freeze, "0" to unfreeze or "" to
+-- leave it as it is, ARGV[2] an optional "now" and ARGV[3], if "1", stores
+-- the tat in the compact form, with ARGV[4] and ARGV[5] setting the time it
+-- is kept for, see script_allow_n.lua. Returns when the key was frozen, as
+-- a string, or false if it is not frozen.
+local rate_limit_key = KEYS[1]
+local frozen_key = KEYS[2]
+local op = ARGV[1]
+local compact = ARGV[3] == "1"
+local ttl_factor = tonumber(ARGV[4])
+local ttl_max = tonumber(ARGV[5])
+
+local function get_tat(key)
+  local v = redis.call("GET", key)
+  if v and #v == 9 and string.byte(v, 1) == 203 then
+    return (struct.unpack(">d", v, 2))
+  end
+  return tonumber(v)
+end
+
+local function set_tat(key, tat, ttl)
+  if compact then
+    tat = "\203" .. struct.pack(">d", tat)
+  end
+  if ttl_factor then
+    ttl = math.ceil(ttl * ttl_factor)
+  end
+  if ttl_max then
+    ttl = math.min(ttl, ttl_max)
+  end
+  redis.call("SET", key, tat, "EX", math.max(ttl, 1))
+end
+
+-- see script_allow_n.lua.
+local jan_1_2017 = 1483228800
+local now
+if ARGV[2] and ARGV[2] ~= "" then
+  now = tonumber(ARGV[2])
+else
+  now = redis.call("TIME")
+  now = (now[1] - jan_1_2017) + (now[2] / 1000000)
+end
+
+local frozen_at = redis.call("GET", frozen_key)
+local gcra = redis.call("TYPE", rate_limit_key).ok == "string"
+
+if op == "1" and not frozen_at then
+  -- keep the bucket from expiring, which would refill it.
+  if gcra then
+    redis.call("PERSIST", rate_limit_key)
+  end
+  frozen_at = tostring(now)
+  redis.call("SET", frozen_key, frozen_at)
+elseif op == "0" and frozen_at then
+  -- shift the bucket by the time it was frozen, so it did not refill.
+  local tat = gcra and get_tat(rate_limit_key)
+  if tat then
+    tat = tat + (now - tonumber(frozen_at))
+    if tat > now then
+      set_tat(rate_limit_key, tat, math.ceil(tat - now))
+    else
+      redis.call("DEL", rate_limit_key)
+    end
+  end
+  redis.call("DEL", frozen_key)
+  return false
+end
+
+return frozen_at
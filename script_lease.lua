@@ -0,0 +1,71 @@
+-- this script has side-effects, so it requires replicate commands mode
+redis.replicate_commands()
+
+-- Reserve or refund events of a rate limit key for a lease. KEYS[1] is the
+-- rate limit key and ARGV[1] to ARGV[3] its burst, rate and period, as in
+-- script_allow_n.lua. A positive ARGV[4] reserves up to that many events,
+-- as many as the key can supply within ARGV[5] seconds; a negative one
+-- refunds that many. ARGV[6] is an optional "now" and ARGV[7], if "1",
+-- stores the tat in the compact form, with ARGV[8] and ARGV[9] setting the
+-- time it is kept for, see script_allow_n.lua. Returns the number of events
+-- reserved or refunded and the time until the key resets, as a string.
+local rate_limit_key = KEYS[1]
+local burst = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+local period = tonumber(ARGV[3])
+local cost = tonumber(ARGV[4])
+local within = tonumber(ARGV[5])
+local compact = ARGV[7] == "1"
+local ttl_factor = tonumber(ARGV[8])
+local ttl_max = tonumber(ARGV[9])
+
+local function get_tat(key)
+  local v = redis.call("GET", key)
+  if v and #v == 9 and string.byte(v, 1) == 203 then
+    return (struct.unpack(">d", v, 2))
+  end
+  return tonumber(v)
+end
+
+local function set_tat(key, tat, ttl)
+  if compact then
+    tat = "\203" .. struct.pack(">d", tat)
+  end
+  if ttl_factor then
+    ttl = math.ceil(ttl * ttl_factor)
+  end
+  if ttl_max then
+    ttl = math.min(ttl, ttl_max)
+  end
+  redis.call("SET", key, tat, "EX", math.max(ttl, 1))
+end
+
+-- see script_allow_n.lua.
+local jan_1_2017 = 1483228800
+local now
+if ARGV[6] and ARGV[6] ~= "" then
+  now = tonumber(ARGV[6])
+else
+  now = redis.call("TIME")
+  now = (now[1] - jan_1_2017) + (now[2] / 1000000)
+end
+
+local emission_interval = period / rate
+local burst_offset = emission_interval * burst
+
+local tat = math.max(get_tat(rate_limit_key) or now, now)
+
+if cost > 0 then
+  -- tolerance for floating point error when rounding events down.
+  local available = math.floor((now + within - (tat - burst_offset)) / emission_interval + 0.000001)
+  cost = math.max(math.min(cost, available), 0)
+end
+
+local new_tat = math.max(tat + emission_interval * cost, now)
+if new_tat > now then
+  set_tat(rate_limit_key, new_tat, math.ceil(new_tat - now))
+else
+  redis.call("DEL", rate_limit_key)
+end
+
+return {cost, tostring(new_tat - now)}
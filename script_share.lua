@@ -0,0 +1,41 @@
+-- this script has side-effects, so it requires replicate commands mode
+redis.replicate_commands()
+
+-- Claim a share of a rate limit key's rate. KEYS[1] holds the recent
+-- traffic of every instance sharing the key, by instance. ARGV[1] is the
+-- instance, ARGV[2] the events it was asked for since its last claim,
+-- ARGV[3] how many seconds a claim counts for and ARGV[4] an optional "now".
+-- Returns the traffic of the instance and of every instance, as strings, and
+-- the number of instances.
+local shares_key = KEYS[1]
+local instance = ARGV[1]
+local traffic = tonumber(ARGV[2])
+local stale_after = tonumber(ARGV[3])
+
+-- see script_allow_n.lua.
+local jan_1_2017 = 1483228800
+local now
+if ARGV[4] and ARGV[4] ~= "" then
+  now = tonumber(ARGV[4])
+else
+  now = redis.call("TIME")
+  now = (now[1] - jan_1_2017) + (now[2] / 1000000)
+end
+
+redis.call("HSET", shares_key, instance, now .. " " .. traffic)
+
+local total = 0
+local instances = 0
+local claims = redis.call("HGETALL", shares_key)
+for i = 1, #claims, 2 do
+  local at, n = string.match(claims[i + 1], "^(%S+) (%S+)$")
+  if not at or tonumber(at) < now - stale_after then
+    redis.call("HDEL", shares_key, claims[i])
+  else
+    total = total + tonumber(n)
+    instances = instances + 1
+  end
+end
+redis.call("EXPIRE", shares_key, math.ceil(stale_after))
+
+return {tostring(traffic), tostring(total), instances}
@@ -9,11 +9,41 @@ import (
 // Copyright (c) 2017 Pavel Pravosud
 // https://github.com/rwz/redis-gcra/blob/master/vendor/perform_gcra_ratelimit.lua
 
+// epochScript is prepended to the scripts evaluating rate limit keys, and
+// renames them for the current epoch; see WithEpochs.
+//
+//go:embed script_epoch.lua
+var epochScript string
+
+//go:embed script_epoch_raise.lua
+var epochRaiseScript string
+
+var epochRaise = redis.NewScript(epochRaiseScript)
+
 //go:embed script_allow_n.lua
-var alloNScript string
+var alloNFile string
+
+var alloNScript = epochScript + alloNFile
 
 //go:embed script_allow_at_most.lua
-var allowAtMostScript string
+var allowAtMostFile string
+
+var allowAtMostScript = epochScript + allowAtMostFile
+
+//go:embed script_allow_multi.lua
+var allowMultiFile string
+
+var allowMultiScript = epochScript + allowMultiFile
+
+//go:embed script_allow_sliding_window.lua
+var allowSlidingWindowFile string
+
+var allowSlidingWindowScript = epochScript + allowSlidingWindowFile
+
+//go:embed script_allow_fixed_window.lua
+var allowFixedWindowFile string
+
+var allowFixedWindowScript = epochScript + allowFixedWindowFile
 
 //go:embed script_concurrency_take.lua
 var concurrencyTakeScript string
@@ -22,4 +52,88 @@ var allowN = redis.NewScript(alloNScript)
 
 var allowAtMost = redis.NewScript(allowAtMostScript)
 
+var allowMulti = redis.NewScript(allowMultiScript)
+
+var allowSlidingWindow = redis.NewScript(allowSlidingWindowScript)
+
+var allowFixedWindow = redis.NewScript(allowFixedWindowScript)
+
 var concurrencyTake = redis.NewScript(concurrencyTakeScript)
+
+//go:embed script_concurrency_queue_take.lua
+var concurrencyQueueTakeScript string
+
+var concurrencyQueueTake = redis.NewScript(concurrencyQueueTakeScript)
+
+//go:embed script_concurrency_release.lua
+var concurrencyReleaseScript string
+
+var concurrencyRelease = redis.NewScript(concurrencyReleaseScript)
+
+//go:embed script_concurrency_sweep.lua
+var concurrencySweepScript string
+
+var concurrencySweep = redis.NewScript(concurrencySweepScript)
+
+//go:embed script_concurrency_handoff.lua
+var concurrencyHandoffScript string
+
+var concurrencyHandoff = redis.NewScript(concurrencyHandoffScript)
+
+//go:embed script_boost.lua
+var boostScriptSrc string
+
+var boostScript = redis.NewScript(boostScriptSrc)
+
+//go:embed script_ban.lua
+var banScriptSrc string
+
+var banScript = redis.NewScript(banScriptSrc)
+
+//go:embed script_freeze.lua
+var freezeScriptFile string
+
+var freezeScriptSrc = epochScript + freezeScriptFile
+
+var freezeScript = redis.NewScript(freezeScriptSrc)
+
+//go:embed script_share.lua
+var shareScriptSrc string
+
+var shareScript = redis.NewScript(shareScriptSrc)
+
+//go:embed script_lease.lua
+var leaseScriptFile string
+
+var leaseScriptSrc = epochScript + leaseScriptFile
+
+var leaseScript = redis.NewScript(leaseScriptSrc)
+
+// scriptFile is a script with the file it is embedded from, or the name it
+// was registered under.
+type scriptFile struct {
+	name   string
+	src    string
+	script *redis.Script
+}
+
+// scriptFiles lists every script, in the order LoadScripts loads them, with
+// the file it is embedded from.
+var scriptFiles = []scriptFile{
+	{"script_concurrency_take.lua", concurrencyTakeScript, concurrencyTake},
+	{"script_concurrency_queue_take.lua", concurrencyQueueTakeScript, concurrencyQueueTake},
+	{"script_concurrency_release.lua", concurrencyReleaseScript, concurrencyRelease},
+	{"script_concurrency_sweep.lua", concurrencySweepScript, concurrencySweep},
+	{"script_concurrency_handoff.lua", concurrencyHandoffScript, concurrencyHandoff},
+	{"script_allow_n.lua", alloNScript, allowN},
+	{"script_allow_at_most.lua", allowAtMostScript, allowAtMost},
+	{"script_allow_multi.lua", allowMultiScript, allowMulti},
+	{"script_allow_sliding_window.lua", allowSlidingWindowScript, allowSlidingWindow},
+	{"script_allow_fixed_window.lua", allowFixedWindowScript, allowFixedWindow},
+	{"script_boost.lua", boostScriptSrc, boostScript},
+	{"script_ban.lua", banScriptSrc, banScript},
+	{"script_freeze.lua", freezeScriptSrc, freezeScript},
+	{"script_share.lua", shareScriptSrc, shareScript},
+	{"script_lease.lua", leaseScriptSrc, leaseScript},
+	{"script_epoch_raise.lua", epochRaiseScript, epochRaise},
+}
@@ -0,0 +1,210 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ScriptWatcherStats describes the work done by a ScriptWatcher.
+type ScriptWatcherStats struct {
+	// Checks is the number of completed passes over the nodes.
+	Checks int64
+
+	// Primed is the number of times scripts were loaded onto a node that was
+	// new or had lost them.
+	Primed int64
+
+	// Invalidations is the number of NOSCRIPT replies that caused every
+	// node to be checked again.
+	Invalidations int64
+
+	// Errors is the number of passes that failed on at least one node.
+	Errors int64
+}
+
+// ScriptWatcher keeps the Limiter's scripts loaded on every node as a Ring
+// is resharded or a ClusterClient's topology changes. It is created by
+// StartScriptWatcher.
+//
+// The watcher remembers which nodes it has primed. Each pass loads the
+// scripts onto nodes it has not seen before, such as a new shard or a
+// promoted replica, and forgets nodes that are gone. A NOSCRIPT reply in a
+// Pipeline, after a node restarts or is replaced at the same address,
+// invalidates every node and starts a pass right away, so the remaining
+// scripts are loaded before other commands fail with NOSCRIPT too.
+type ScriptWatcher struct {
+	l      *Limiter
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	wake   chan struct{}
+
+	mu     sync.Mutex
+	primed map[string]bool
+	stale  bool
+
+	checks        atomic.Int64
+	loads         atomic.Int64
+	invalidations atomic.Int64
+	errors        atomic.Int64
+}
+
+// StartScriptWatcher checks the nodes every interval, and whenever a
+// pipelined command fails with NOSCRIPT, until ctx is done or Stop is
+// called. The first pass runs immediately.
+func (l *Limiter) StartScriptWatcher(ctx context.Context, interval time.Duration) *ScriptWatcher {
+	ctx, cancel := context.WithCancel(ctx)
+	w := &ScriptWatcher{
+		l:      l,
+		cancel: cancel,
+		wake:   make(chan struct{}, 1),
+		primed: make(map[string]bool),
+	}
+	l.scriptWatcher.Store(w)
+
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			if err := w.Check(ctx); err != nil && ctx.Err() == nil {
+				w.errors.Add(1)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			case <-w.wake:
+			}
+		}
+	}()
+
+	return w
+}
+
+// Stop stops the watcher and waits for a running pass to finish.
+func (w *ScriptWatcher) Stop() {
+	w.cancel()
+	w.wg.Wait()
+	w.l.scriptWatcher.CompareAndSwap(w, nil)
+}
+
+// Stats returns the totals across all passes run so far.
+func (w *ScriptWatcher) Stats() ScriptWatcherStats {
+	return ScriptWatcherStats{
+		Checks:        w.checks.Load(),
+		Primed:        w.loads.Load(),
+		Invalidations: w.invalidations.Load(),
+		Errors:        w.errors.Load(),
+	}
+}
+
+// Check makes a single pass over the nodes, loading the scripts onto every
+// node that has not been primed since it appeared or was invalidated. Nodes
+// that fail are reported in a *ScriptError and retried on the next pass.
+func (w *ScriptWatcher) Check(ctx context.Context) error {
+	w.mu.Lock()
+	stale := w.stale
+	w.stale = false
+	known := make(map[string]bool, len(w.primed))
+	for addr := range w.primed {
+		known[addr] = !stale
+	}
+	w.mu.Unlock()
+
+	start := time.Now()
+	var mu sync.Mutex
+	seen := make(map[string]bool, len(known))
+	var primed []string
+	err := w.l.forEachScriptNode(ctx, func(ctx context.Context, node redisNode) error {
+		addr := nodeAddr(node)
+		mu.Lock()
+		seen[addr] = true
+		mu.Unlock()
+		if known[addr] {
+			return nil
+		}
+
+		loaded, err := primeNode(ctx, node)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		primed = append(primed, addr)
+		mu.Unlock()
+		if loaded {
+			w.loads.Add(1)
+		}
+		return nil
+	})
+	if len(primed) > 0 || err != nil {
+		w.l.onScriptLoad(ctx, start, err)
+	}
+
+	w.mu.Lock()
+	for addr := range w.primed {
+		if !seen[addr] {
+			delete(w.primed, addr)
+		}
+	}
+	for _, addr := range primed {
+		w.primed[addr] = true
+	}
+	w.mu.Unlock()
+
+	if err == nil {
+		w.checks.Add(1)
+	}
+	return err
+}
+
+// primeNode loads the scripts missing from node and reports whether any
+// were.
+func primeNode(ctx context.Context, node redisNode) (bool, error) {
+	files := allScripts()
+	hashes := make([]string, len(files))
+	for i, f := range files {
+		hashes[i] = f.script.Hash()
+	}
+	exists, err := node.ScriptExists(ctx, hashes...).Result()
+	if err != nil {
+		return false, err
+	}
+
+	var failed []string
+	loaded := false
+	for i, ok := range exists {
+		if ok {
+			continue
+		}
+		if _, err := node.ScriptLoad(ctx, files[i].src).Result(); err != nil {
+			failed = append(failed, files[i].name)
+			continue
+		}
+		loaded = true
+	}
+	if len(failed) > 0 {
+		return loaded, fmt.Errorf("redis_rate: failed to load %s", strings.Join(failed, ", "))
+	}
+	return loaded, nil
+}
+
+// invalidate marks every node as needing a check and wakes the watcher.
+func (w *ScriptWatcher) invalidate() {
+	w.mu.Lock()
+	w.stale = true
+	w.mu.Unlock()
+	w.invalidations.Add(1)
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,254 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"math"
+	"sync"
+	"time"
+)
+
+// Defaults used by WithRateShares for unset RateShareOptions.
+const (
+	DefaultRateShareInterval = time.Second
+	DefaultRateShareMaxKeys  = 1024
+)
+
+// RateShareOptions configures WithRateShares.
+type RateShareOptions struct {
+	// Instance identifies this process among those sharing keys, and must
+	// be unique to it. If unset a random one is used.
+	Instance string
+
+	// Interval is how often the share of a key is claimed again. If unset
+	// the default is DefaultRateShareInterval.
+	Interval time.Duration
+
+	// MaxKeys bounds the number of keys with a local share. Other keys go
+	// to Redis as usual. If unset the default is DefaultRateShareMaxKeys.
+	MaxKeys int
+
+	// Keys selects the keys to share, such as the busiest tenants. If nil
+	// every key is shared.
+	Keys func(key string) bool
+}
+
+// WithRateShares makes Allow, AllowN and AllowAtMost enforce a share of each
+// key's limit in process instead of asking Redis every time. Every Interval
+// each process claims a share proportional to the events it was asked for
+// since its last claim, recorded in Redis next to the key, and enforces the
+// limit scaled by that share locally, so Redis sees one call per key and
+// Interval.
+//
+// The shares of live processes add up to the whole limit, so the limit is
+// exceeded globally only by how far traffic shifts between processes within
+// an Interval, plus up to one event per process. A process that stops
+// claiming drops out after three Intervals. Results report the Remaining and
+// ResetAfter of the local share, and shared keys do not update the key's
+// state in Redis, so Usage and Inspect do not see them. Calendar limits
+// always go to Redis.
+func WithRateShares(opts RateShareOptions) Option {
+	if opts.Instance == "" {
+		var b [8]byte
+		_, _ = rand.Read(b[:])
+		opts.Instance = hex.EncodeToString(b[:])
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = DefaultRateShareInterval
+	}
+	if opts.MaxKeys <= 0 {
+		opts.MaxKeys = DefaultRateShareMaxKeys
+	}
+	return func(l *Limiter) {
+		l.shares = &rateShares{
+			l:       l,
+			opts:    opts,
+			entries: make(map[localKey]*shareEntry),
+			local:   newGCRABuckets(0),
+		}
+	}
+}
+
+type rateShares struct {
+	l    *Limiter
+	opts RateShareOptions
+
+	mu      sync.Mutex
+	entries map[localKey]*shareEntry
+
+	local gcraBuckets
+}
+
+// shareEntry is the share of a key's rate claimed by this process.
+type shareEntry struct {
+	mu        sync.Mutex
+	share     float64
+	claimedAt time.Time
+	claiming  bool
+
+	// demand is the number of events asked for since the last claim.
+	demand int64
+}
+
+// cacheable reports whether an allow with limit may be enforced with a
+// local share.
+func (s *rateShares) cacheable(key string, limit Limit) bool {
+	return s != nil && !s.l.extendedAllows() && limit.Calendar == CalendarNone && limit.WarmUp == 0 &&
+		(s.opts.Keys == nil || s.opts.Keys(key))
+}
+
+// allow enforces key's share of limit for n events locally, claiming the
+// share first if it is missing or stale, and in the background once it is
+// due.
+func (s *rateShares) allow(ctx context.Context, key string, limit Limit, n int, atMost bool) (*Result, error) {
+	lk := localKey{prefix: s.l.localPrefix(ctx), key: key, limit: limit}
+	e := s.entry(lk)
+	if e == nil {
+		script := allowN
+		if atMost {
+			script = allowAtMost
+		}
+		return s.l.runAllow(ctx, script, key, limit, n)
+	}
+
+	now := s.l.now()
+	e.mu.Lock()
+	age := now.Sub(e.claimedAt)
+	stale := e.claimedAt.IsZero() || age >= 3*s.opts.Interval
+	claim := !stale && !e.claiming && age >= s.opts.Interval
+	if claim {
+		e.claiming = true
+	}
+	e.demand += int64(n)
+	e.mu.Unlock()
+
+	if stale {
+		if err := s.claim(ctx, lk, e); err != nil {
+			return nil, err
+		}
+	} else if claim {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), s.opts.Interval)
+			defer cancel()
+			_ = s.claim(ctx, lk, e)
+		}()
+	}
+
+	e.mu.Lock()
+	share := e.share
+	e.mu.Unlock()
+
+	rv := &Result{
+		Key:   s.localKey(lk),
+		Limit: scaleLimit(limit, share),
+		at:    now,
+	}
+	s.local.allow(rv, n, atMost)
+	rv.Key = key
+	rv.Limit = limit
+	rv.stamp(now, s.l.now)
+	return rv, nil
+}
+
+// entry returns the share for lk, or nil if MaxKeys shares are held.
+func (s *rateShares) entry(lk localKey) *shareEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.entries[lk]
+	if e == nil {
+		if len(s.entries) >= s.opts.MaxKeys {
+			s.evictStale()
+			if len(s.entries) >= s.opts.MaxKeys {
+				return nil
+			}
+		}
+		e = &shareEntry{}
+		s.entries[lk] = e
+	}
+	return e
+}
+
+// evictStale removes shares that have not been claimed for three Intervals.
+// s.mu must be held.
+func (s *rateShares) evictStale() {
+	now := s.l.now()
+	for lk, e := range s.entries {
+		e.mu.Lock()
+		stale := !e.claiming && now.Sub(e.claimedAt) >= 3*s.opts.Interval
+		e.mu.Unlock()
+		if stale {
+			delete(s.entries, lk)
+			s.local.reset(s.localKey(lk))
+		}
+	}
+}
+
+// claim claims e's share of lk's rate, reporting the demand since the last
+// claim.
+func (s *rateShares) claim(ctx context.Context, lk localKey, e *shareEntry) error {
+	e.mu.Lock()
+	demand := e.demand
+	e.demand = 0
+	e.mu.Unlock()
+
+	args := getScriptArgs()
+	args.key(sideKey(lk.prefix+s.l.hashTagged(lk.key), ":shares"), "")
+	args.str(s.opts.Instance).int(demand).float((3 * s.opts.Interval).Seconds()).str(s.l.scriptNow())
+	reply := replyOf(s.l.runScript(ctx, shareScript, args.keys, args.args...))
+	args.release()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.claiming = false
+	if reply.err != nil {
+		e.demand += demand
+		return reply.err
+	}
+	own := reply.float(0)
+	total := reply.float(1)
+	instances := float64(reply.int(2))
+	if reply.err != nil {
+		return reply.err
+	}
+	// every instance is counted as asking for one more event, so idle
+	// instances keep a sliver of the rate to ramp up from.
+	e.share = (own + 1) / (total + instances)
+	e.claimedAt = s.l.now()
+	return nil
+}
+
+// localKey returns the key of lk's bucket in s.local.
+func (s *rateShares) localKey(lk localKey) string {
+	return lk.prefix + lk.key + "|" + lk.limit.String()
+}
+
+// forget drops the shares held for key.
+func (s *rateShares) forget(key string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for lk := range s.entries {
+		if lk.key == key {
+			delete(s.entries, lk)
+			s.local.reset(s.localKey(lk))
+		}
+	}
+}
+
+// scaleLimit returns limit with its rate and burst scaled by share, keeping
+// a burst of at least one event.
+func scaleLimit(limit Limit, share float64) Limit {
+	period := float64(limit.Period) / share
+	if period > math.MaxInt64 {
+		period = math.MaxInt64
+	}
+	limit.Period = time.Duration(period)
+	limit.Burst = int(math.Ceil(float64(limit.Burst) * share))
+	if limit.Burst < 1 {
+		limit.Burst = 1
+	}
+	return limit
+}
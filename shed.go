@@ -0,0 +1,183 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults used by WithLoadShedding for unset LoadSheddingOptions.
+const (
+	DefaultShedMaxRatio = 0.9
+	DefaultShedWindow   = 100
+)
+
+// LoadSheddingOptions configures WithLoadShedding. At least one of
+// LatencyThreshold and ErrorRateThreshold must be set for anything to be
+// shed.
+type LoadSheddingOptions struct {
+	// LatencyThreshold is the average Redis round trip above which calls
+	// start to be shed. Zero ignores latency.
+	LatencyThreshold time.Duration
+
+	// ErrorRateThreshold is the fraction of Redis round trips failing to
+	// reach Redis above which calls start to be shed. Zero ignores errors.
+	ErrorRateThreshold float64
+
+	// MaxRatio is the largest fraction of calls shed, so that the rest keep
+	// sampling Redis and notice when it recovers. If unset the default is
+	// DefaultShedMaxRatio.
+	MaxRatio float64
+
+	// Window is roughly the number of recent round trips the averages are
+	// taken over. If unset the default is DefaultShedWindow.
+	Window int
+}
+
+// WithLoadShedding makes Allow, AllowN and AllowAtMost skip Redis for a
+// share of calls while Redis is slow or failing, allowing every event they
+// ask for, to keep Redis off the hot path while it is degraded.
+//
+// The Limiter keeps moving averages of the latency of its script calls to
+// Redis and of the fraction of them that fail to reach it. Once either
+// average exceeds its threshold, calls are shed at random with a
+// probability growing with how far it is exceeded: none at the threshold and
+// MaxRatio from twice the threshold on. Shed results have Shed set and are
+// reported to Hooks.OnShed; SheddingStats reports the current averages.
+// Pipelines are neither measured nor shed.
+func WithLoadShedding(opts LoadSheddingOptions) Option {
+	if opts.MaxRatio <= 0 || opts.MaxRatio > 1 {
+		opts.MaxRatio = DefaultShedMaxRatio
+	}
+	if opts.Window <= 0 {
+		opts.Window = DefaultShedWindow
+	}
+	return func(l *Limiter) {
+		l.shedder = &shedder{opts: opts, alpha: 2 / (float64(opts.Window) + 1)}
+	}
+}
+
+// SheddingStats reports the state of load shedding. See WithLoadShedding.
+type SheddingStats struct {
+	// Latency is the average latency of script calls to Redis, and
+	// ErrorRate the average fraction of them that failed to reach it.
+	Latency   time.Duration
+	ErrorRate float64
+
+	// Ratio is the fraction of calls currently shed.
+	Ratio float64
+
+	// Calls is the number of calls that could have been shed, and Shed the
+	// number that were, since the Limiter was created.
+	Calls int64
+	Shed  int64
+}
+
+// SheddingStats returns the state of load shedding, or zero SheddingStats
+// without WithLoadShedding.
+func (l *Limiter) SheddingStats() SheddingStats {
+	s := l.shedder
+	if s == nil {
+		return SheddingStats{}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return SheddingStats{
+		Latency:   time.Duration(s.latency),
+		ErrorRate: s.errorRate,
+		Ratio:     s.ratio(),
+		Calls:     s.calls.Load(),
+		Shed:      s.shed.Load(),
+	}
+}
+
+type shedder struct {
+	opts  LoadSheddingOptions
+	alpha float64
+
+	mu        sync.Mutex
+	latency   float64
+	errorRate float64
+
+	// ratioBits is the float64 bits of the fraction of calls to shed.
+	ratioBits atomic.Uint64
+
+	calls atomic.Int64
+	shed  atomic.Int64
+}
+
+// observe records a script call to Redis made with ctx that took d and
+// failed with err.
+func (s *shedder) observe(ctx context.Context, d time.Duration, err error) {
+	if s == nil {
+		return
+	}
+	failed := 0.0
+	if isUnavailable(ctx, err) {
+		failed = 1
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latency += s.alpha * (float64(d) - s.latency)
+	s.errorRate += s.alpha * (failed - s.errorRate)
+	s.ratioBits.Store(math.Float64bits(s.ratio()))
+}
+
+// ratio returns the fraction of calls to shed for the current averages.
+// s.mu must be held.
+func (s *shedder) ratio() float64 {
+	overload := 0.0
+	if s.opts.LatencyThreshold > 0 {
+		overload = s.latency / float64(s.opts.LatencyThreshold)
+	}
+	if s.opts.ErrorRateThreshold > 0 {
+		overload = math.Max(overload, s.errorRate/s.opts.ErrorRateThreshold)
+	}
+	return math.Max(0, math.Min(overload-1, 1)) * s.opts.MaxRatio
+}
+
+// shouldShed reports whether the current call should skip Redis.
+func (s *shedder) shouldShed() bool {
+	if s == nil {
+		return false
+	}
+	s.calls.Add(1)
+	ratio := math.Float64frombits(s.ratioBits.Load())
+	if ratio <= 0 || rand.Float64() >= ratio { //nolint:gosec // sampling
+		return false
+	}
+	s.shed.Add(1)
+	return true
+}
+
+// allow returns a result allowing all n events of key without Redis.
+func (s *shedder) allow(key string, limit Limit, n int, now func() time.Time) *Result {
+	rv := &Result{
+		Key:        key,
+		Limit:      limit,
+		Allowed:    int64(n),
+		Remaining:  int64(limit.Burst),
+		RetryAfter: -1,
+		Shed:       true,
+	}
+	rv.stamp(now(), now)
+	return rv
+}
+
+func (l *Limiter) onShed(ctx context.Context, op Operation, key string, n int, rv *Result) {
+	for _, h := range l.hooks {
+		if h.OnShed != nil {
+			h.OnShed(ctx, AllowEvent{
+				Op:     op,
+				Prefix: l.ratePrefix,
+				Key:    key,
+				N:      n,
+				Tags:   TagsFromContext(ctx),
+				Result: rv,
+			})
+		}
+	}
+}
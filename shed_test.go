@@ -0,0 +1,53 @@
+package redis_rate_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ductone/redis_rate/v11"
+)
+
+func TestLoadShedding(t *testing.T) {
+	ctx := context.Background()
+	limit := redis_rate.PerSecond(10)
+
+	var shed int
+	l := newUnreachableLimiter(
+		redis_rate.WithLoadShedding(redis_rate.LoadSheddingOptions{
+			ErrorRateThreshold: 0.1,
+			MaxRatio:           1,
+			Window:             1,
+		}),
+		redis_rate.WithHooks(redis_rate.Hooks{
+			OnShed: func(ctx context.Context, ev redis_rate.AllowEvent) {
+				require.True(t, ev.Result.Shed)
+				shed++
+			},
+		}),
+	)
+
+	_, err := l.Allow(ctx, "test_id", limit)
+	require.Error(t, err)
+	stats := l.SheddingStats()
+	require.Equal(t, 1.0, stats.ErrorRate)
+	require.Equal(t, 1.0, stats.Ratio)
+
+	for i := 0; i < 3; i++ {
+		res, err := l.AllowN(ctx, "test_id", limit, 5)
+		require.NoError(t, err)
+		require.True(t, res.Shed)
+		require.Equal(t, int64(5), res.Allowed)
+		require.Equal(t, "", string(res.Reason))
+	}
+	require.Equal(t, 3, shed)
+	stats = l.SheddingStats()
+	require.Equal(t, int64(4), stats.Calls)
+	require.Equal(t, int64(3), stats.Shed)
+
+	l = newUnreachableLimiter(redis_rate.WithLoadShedding(redis_rate.LoadSheddingOptions{}))
+	_, err = l.Allow(ctx, "test_id", limit)
+	require.Error(t, err)
+	require.Zero(t, l.SheddingStats().Ratio)
+}
@@ -0,0 +1,149 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"context"
+	"time"
+)
+
+// SlidingWindowResult is the outcome of AllowSlidingWindow.
+type SlidingWindowResult struct {
+	// Name of the key used for this result.
+	Key string
+
+	// Limit is the limit that was used to obtain this result.
+	Limit Limit
+
+	// Allowed is the number of events that may happen at time now.
+	Allowed int64
+
+	// Count is the estimated number of events in the window ending at time
+	// now, including those just allowed.
+	Count float64
+
+	// Remaining is the number of events that could still be allowed in the
+	// window ending at time now.
+	Remaining int64
+
+	// RetryAfter is the time until the denied events would be allowed.
+	// It is -1 if the events were allowed or can never be, because n is
+	// larger than the limit's Rate.
+	RetryAfter time.Duration
+
+	// ResetAfter is the time until every event counted so far has slid out
+	// of the window.
+	ResetAfter time.Duration
+
+	// Shadow and ShadowAllowed are as in Result.
+	Shadow        bool
+	ShadowAllowed int64
+
+	// Reason is why the events were denied, or empty if they were allowed.
+	Reason Reason
+}
+
+// AllowSlidingWindow is a shortcut for AllowSlidingWindowN(ctx, key, limit, 1).
+func (l *Limiter) AllowSlidingWindow(ctx context.Context, key string, limit Limit) (*SlidingWindowResult, error) {
+	return l.AllowSlidingWindowN(ctx, key, limit, 1)
+}
+
+// AllowSlidingWindowN reports whether n events may happen at time now
+// without exceeding limit.Rate events in any window of limit.Period ending
+// at now. limit.Burst is ignored and limits with a Calendar are not
+// supported.
+//
+// Unlike AllowN, which spaces events out evenly with GCRA, this enforces the
+// "at most Rate per rolling Period" semantics of a sliding window counter.
+// Events are counted in fixed windows and the previous window's count is
+// weighted by how much of it still overlaps the rolling window, which
+// assumes events were spread evenly across it.
+//
+// Sliding window keys store different data than AllowN keys, so the same
+// key must not be used with both.
+func (l *Limiter) AllowSlidingWindowN(
+	ctx context.Context,
+	key string,
+	limit Limit,
+	n int,
+) (_ *SlidingWindowResult, err error) {
+	defer l.recoverPanic(OpAllowSlidingWindow, key, &err)
+	ctx, key, limit = l.classify(ctx, key, limit)
+	ctx, span := l.startSpan(ctx, OpAllowSlidingWindow)
+	defer span.End()
+
+	if limit.IsZero() {
+		traceAllow(span, key, limit, nil, ErrNoLimit)
+		return nil, ErrNoLimit
+	}
+	if limit.Calendar != CalendarNone {
+		traceAllow(span, key, limit, nil, ErrCalendarLimit)
+		return nil, ErrCalendarLimit
+	}
+
+	start := time.Now()
+	var rv *SlidingWindowResult
+	if l.killed(ctx) {
+		rv = &SlidingWindowResult{Key: key, Limit: limit, RetryAfter: -1, Reason: ReasonKillSwitch}
+	} else if l.readOnly {
+		rv, err = l.peekSlidingWindow(ctx, key, limit, n)
+	} else {
+		rv, err = l.runSlidingWindow(ctx, key, limit, n)
+		if err == nil && l.shadowed(ctx) {
+			rv.Shadow = true
+			rv.ShadowAllowed = rv.Allowed
+			rv.Allowed = int64(n)
+			rv.RetryAfter = -1
+			rv.Reason = ""
+		}
+	}
+	var res *Result
+	if err == nil {
+		res = rv.result()
+	}
+	l.onAllow(ctx, OpAllowSlidingWindow, key, n, res, start, err)
+	traceAllow(span, key, limit, res, err)
+	if err != nil {
+		return nil, err
+	}
+	return rv, nil
+}
+
+func (l *Limiter) runSlidingWindow(
+	ctx context.Context,
+	key string,
+	limit Limit,
+	n int,
+) (*SlidingWindowResult, error) {
+	values := []interface{}{limit.Rate, limit.Period.Seconds(), n, l.scriptNow()}
+	reply := replyOf(l.runScript(ctx, allowSlidingWindow, []string{l.allowKeyPrefix(ctx) + l.hashTagged(key)}, values...))
+	rv := &SlidingWindowResult{
+		Key:        key,
+		Limit:      limit,
+		Allowed:    reply.int(0),
+		Count:      reply.float(1),
+		Remaining:  reply.int(2),
+		RetryAfter: reply.seconds(3),
+		ResetAfter: reply.seconds(4),
+	}
+	if reply.err != nil {
+		return nil, reply.err
+	}
+	if rv.Allowed == 0 && rv.RetryAfter >= 0 {
+		rv.Reason = ReasonRateExceeded
+	}
+	return rv, nil
+}
+
+// result converts r to a Result for hooks and tracing.
+func (r *SlidingWindowResult) result() *Result {
+	return &Result{
+		Key:           r.Key,
+		Limit:         r.Limit,
+		Allowed:       r.Allowed,
+		Remaining:     r.Remaining,
+		RetryAfter:    r.RetryAfter,
+		ResetAfter:    r.ResetAfter,
+		Shadow:        r.Shadow,
+		ShadowAllowed: r.ShadowAllowed,
+		Reason:        r.Reason,
+	}
+}
@@ -0,0 +1,134 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrSlotReleased is returned by Slot.Release for a slot that was already
+// released.
+var ErrSlotReleased = errors.New("redis_rate: slot already released")
+
+// slotReleaseTimeout bounds the release of a Slot whose context is done,
+// which cannot use that context.
+const slotReleaseTimeout = 5 * time.Second
+
+// Slot is a concurrency slot taken by TakeWithContext, released when its
+// context is done unless it is released with Release first.
+type Slot struct {
+	l      *Limiter
+	result ConcurrencyResult
+	stop   chan struct{}
+	done   chan struct{}
+
+	mu       sync.Mutex
+	released bool
+	err      error
+}
+
+// TakeWithContext is Take for a slot that is released automatically once
+// ctx is done, such as when the request it guards completes or is
+// cancelled, so a slot is not leaked by a panic or an error path that
+// skips Release. The slot is released from a goroutine with a fresh
+// context, as ctx can no longer be used by then. Releasing it with
+// Slot.Release first stops the goroutine.
+//
+// A slot that was denied holds nothing and starts no goroutine; check
+// Allowed.
+func (tk *Limiter) TakeWithContext(ctx context.Context, key string, requestID string, limit ConcurrencyLimit) (*Slot, error) {
+	res, err := tk.Take(ctx, key, requestID, limit)
+	if err != nil {
+		return nil, err
+	}
+	s := &Slot{
+		l:      tk,
+		result: res,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	if !res.Allowed {
+		s.released = true
+		close(s.done)
+		return s, nil
+	}
+	go s.watch(ctx)
+	return s, nil
+}
+
+// watch releases s once ctx is done, unless s is released first.
+func (s *Slot) watch(ctx context.Context) {
+	select {
+	case <-s.stop:
+	case <-ctx.Done():
+		if !s.claim() {
+			return
+		}
+		rctx, cancel := context.WithTimeout(context.Background(), slotReleaseTimeout)
+		defer cancel()
+		s.finish(s.release(rctx))
+	}
+}
+
+// Result returns the result of the take.
+func (s *Slot) Result() ConcurrencyResult {
+	return s.result
+}
+
+// Allowed reports whether the slot was taken.
+func (s *Slot) Allowed() bool {
+	return s.result.Allowed
+}
+
+// Release releases the slot now. It does nothing for a slot that was
+// denied and returns ErrSlotReleased for one already released, by Release
+// or because its context is done.
+func (s *Slot) Release(ctx context.Context) error {
+	if !s.result.Allowed {
+		return nil
+	}
+	if !s.claim() {
+		return ErrSlotReleased
+	}
+	close(s.stop)
+	err := s.release(ctx)
+	s.finish(err)
+	return err
+}
+
+// Done returns a channel closed once the slot is released, or at once for
+// a slot that was denied.
+func (s *Slot) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns the error of releasing the slot, once Done is closed.
+func (s *Slot) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// claim marks s as released and reports whether it was not already.
+func (s *Slot) claim() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.released {
+		return false
+	}
+	s.released = true
+	return true
+}
+
+func (s *Slot) release(ctx context.Context) error {
+	return s.l.Release(ctx, s.result.Key, s.result.RequestID, s.result.Limit)
+}
+
+// finish records the outcome of the release and closes Done.
+func (s *Slot) finish(err error) {
+	s.mu.Lock()
+	s.err = err
+	s.mu.Unlock()
+	close(s.done)
+}
@@ -0,0 +1,52 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"strconv"
+	"sync"
+)
+
+// clusterSlots is the number of hash slots of a Redis Cluster.
+const clusterSlots = 16384
+
+// clusterSlot returns the hash slot of the Redis key key, as CLUSTER
+// KEYSLOT does.
+func clusterSlot(key string) int {
+	return int(crc16(hashSlotKey(key)) % clusterSlots)
+}
+
+// crc16 is the CRC16/XMODEM checksum Redis Cluster hashes keys with.
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+var slotTags struct {
+	once sync.Once
+	tags []string
+}
+
+// slotTag returns a hash tag, without braces, that hashes to slot.
+func slotTag(slot int) string {
+	slotTags.once.Do(func() {
+		tags := make([]string, clusterSlots)
+		for n, left := 0, clusterSlots; left > 0; n++ {
+			tag := strconv.Itoa(n)
+			if s := clusterSlot(tag); tags[s] == "" {
+				tags[s] = tag
+				left--
+			}
+		}
+		slotTags.tags = tags
+	})
+	return slotTags.tags[slot]
+}
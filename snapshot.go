@@ -0,0 +1,290 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultSnapshotTopRoutes is the number of routes reported per tenant by
+// Snapshot if SnapshotOptions.TopRoutes is unset.
+const DefaultSnapshotTopRoutes = 5
+
+// SnapshotOptions configures Limiter.Snapshot.
+type SnapshotOptions struct {
+	// Tenants are the tenants to report on, in order.
+	Tenants []TenantLimits
+
+	// Traffic adds each tenant's requests, denials and busiest routes, as
+	// counted by its Hooks. If nil they are left out.
+	Traffic *TrafficStats
+
+	// TopRoutes is the number of routes reported per tenant. If unset the
+	// default is DefaultSnapshotTopRoutes.
+	TopRoutes int
+}
+
+// TenantLimits are the limits of a tenant reported by Snapshot.
+type TenantLimits struct {
+	Tenant string
+
+	// Limits are the tenant's rate limit keys and their limits.
+	Limits []KeyLimit
+
+	// Concurrency are the tenant's concurrency keys and their limits.
+	Concurrency map[string]ConcurrencyLimit
+}
+
+// Snapshot is a point-in-time report of how much of their limits tenants
+// use, produced by Limiter.Snapshot. It can be marshaled to JSON as is, to
+// back usage pages shown to customers.
+type Snapshot struct {
+	Time    time.Time        `json:"time"`
+	Tenants []TenantSnapshot `json:"tenants"`
+}
+
+// TenantSnapshot is the part of a Snapshot about one tenant.
+type TenantSnapshot struct {
+	Tenant string `json:"tenant"`
+
+	Limits      []LimitUtilization      `json:"limits,omitempty"`
+	Concurrency []ConcurrencySaturation `json:"concurrency,omitempty"`
+
+	// Requests and Denied count the rate limit decisions made for the
+	// tenant, and DenialRate is the fraction of them that were denied.
+	Requests   int64   `json:"requests"`
+	Denied     int64   `json:"denied"`
+	DenialRate float64 `json:"denial_rate"`
+
+	// TopRoutes are the tenant's routes with the most requests, busiest
+	// first.
+	TopRoutes []RouteTraffic `json:"top_routes,omitempty"`
+}
+
+// LimitUtilization is how much of a rate limit is in use.
+type LimitUtilization struct {
+	Key   string `json:"key"`
+	Limit string `json:"limit"`
+
+	// Used is the number of events the key is charged for, and Remaining
+	// the number that could be allowed right now.
+	Used      int64 `json:"used"`
+	Remaining int64 `json:"remaining"`
+
+	// Utilization is Used as a fraction of the burst, or of the rate for
+	// calendar limits.
+	Utilization float64 `json:"utilization"`
+
+	// ResetAt is when the key returns to its initial state.
+	ResetAt time.Time `json:"reset_at"`
+}
+
+// ConcurrencySaturation is how much of a concurrency limit is in use.
+type ConcurrencySaturation struct {
+	Key     string `json:"key"`
+	Max     int64  `json:"max"`
+	Used    int64  `json:"used"`
+	Waiting int64  `json:"waiting"`
+
+	// Saturation is Used as a fraction of Max.
+	Saturation float64 `json:"saturation"`
+}
+
+// RouteTraffic counts the rate limit decisions made for a route.
+type RouteTraffic struct {
+	Route    string `json:"route"`
+	Requests int64  `json:"requests"`
+	Denied   int64  `json:"denied"`
+}
+
+// Snapshot reports the utilization of every tenant in opts.Tenants, reading
+// their rate and concurrency limits in two round trips without modifying
+// them, together with their traffic if opts.Traffic is set.
+func (l *Limiter) Snapshot(ctx context.Context, opts SnapshotOptions) (_ *Snapshot, err error) {
+	defer l.recoverPanic(OpSnapshot, "", &err)
+	if opts.TopRoutes <= 0 {
+		opts.TopRoutes = DefaultSnapshotTopRoutes
+	}
+
+	var keys []string
+	limits := make(map[string]Limit)
+	concurrency := make(map[string]ConcurrencyLimit)
+	for _, t := range opts.Tenants {
+		for _, kl := range t.Limits {
+			keys = append(keys, kl.Key)
+			limits[kl.Key] = kl.Limit
+		}
+		for key, limit := range t.Concurrency {
+			concurrency[key] = limit
+		}
+	}
+
+	usage, err := l.Usage(ctx, keys, limits)
+	if err != nil {
+		return nil, err
+	}
+	slots, err := l.ConcurrencySnapshot(ctx, concurrency)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := &Snapshot{
+		Time:    l.now(),
+		Tenants: make([]TenantSnapshot, 0, len(opts.Tenants)),
+	}
+	for _, t := range opts.Tenants {
+		ts := TenantSnapshot{Tenant: t.Tenant}
+		for range t.Limits {
+			ts.Limits = append(ts.Limits, limitUtilization(usage[0]))
+			usage = usage[1:]
+		}
+		for key := range t.Concurrency {
+			ts.Concurrency = append(ts.Concurrency, concurrencySaturation(slots[key]))
+		}
+		sort.Slice(ts.Concurrency, func(i, j int) bool {
+			return ts.Concurrency[i].Key < ts.Concurrency[j].Key
+		})
+		opts.Traffic.fill(&ts, opts.TopRoutes)
+		rv.Tenants = append(rv.Tenants, ts)
+	}
+	return rv, nil
+}
+
+func limitUtilization(res *Result) LimitUtilization {
+	capacity := res.Limit.Burst
+	if res.Limit.Calendar != CalendarNone {
+		capacity = res.Limit.Rate
+	}
+	rv := LimitUtilization{
+		Key:       res.Key,
+		Limit:     res.Limit.String(),
+		Used:      res.Used,
+		Remaining: res.Remaining,
+		ResetAt:   res.ResetAt,
+	}
+	if capacity > 0 {
+		rv.Utilization = float64(res.Used) / float64(capacity)
+	}
+	return rv
+}
+
+func concurrencySaturation(u ConcurrencyUsage) ConcurrencySaturation {
+	rv := ConcurrencySaturation{
+		Key:     u.Key,
+		Max:     u.Limit.Max,
+		Used:    u.Used,
+		Waiting: u.Waiting,
+	}
+	if u.Limit.Max > 0 {
+		rv.Saturation = float64(u.Used) / float64(u.Limit.Max)
+	}
+	return rv
+}
+
+// TrafficStats counts the rate limit decisions made for each tenant and
+// route, identified by the values of two tags, for Snapshot. Register its
+// Hooks with WithHooks. Decisions without the tenant tag are not counted,
+// and failed calls are not decisions.
+type TrafficStats struct {
+	tenantTag string
+	routeTag  string
+
+	mu      sync.Mutex
+	tenants map[string]*tenantTraffic
+}
+
+type tenantTraffic struct {
+	requests int64
+	denied   int64
+	routes   map[string]*RouteTraffic
+}
+
+// NewTrafficStats returns TrafficStats telling tenants apart by the tag
+// tenantTag and routes by the tag routeTag, as added with WithTags.
+func NewTrafficStats(tenantTag string, routeTag string) *TrafficStats {
+	return &TrafficStats{
+		tenantTag: tenantTag,
+		routeTag:  routeTag,
+		tenants:   make(map[string]*tenantTraffic),
+	}
+}
+
+// Hooks returns the Hooks counting decisions into s.
+func (s *TrafficStats) Hooks() Hooks {
+	return Hooks{
+		OnAllow: func(ctx context.Context, ev AllowEvent) {
+			if ev.Err != nil || ev.Result == nil {
+				return
+			}
+			denied := ev.Result.Allowed == 0 && ev.N > 0
+			s.record(ev.Tags, denied)
+		},
+	}
+}
+
+func (s *TrafficStats) record(tags []Tag, denied bool) {
+	var tenant, route string
+	var ok bool
+	for _, tag := range tags {
+		switch tag.Key {
+		case s.tenantTag:
+			tenant, ok = tag.Value, true
+		case s.routeTag:
+			route = tag.Value
+		}
+	}
+	if !ok {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := s.tenants[tenant]
+	if t == nil {
+		t = &tenantTraffic{routes: make(map[string]*RouteTraffic)}
+		s.tenants[tenant] = t
+	}
+	r := t.routes[route]
+	if r == nil {
+		r = &RouteTraffic{Route: route}
+		t.routes[route] = r
+	}
+	t.requests++
+	r.Requests++
+	if denied {
+		t.denied++
+		r.Denied++
+	}
+}
+
+// fill adds the traffic of ts's tenant and its top busiest routes to ts.
+func (s *TrafficStats) fill(ts *TenantSnapshot, top int) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := s.tenants[ts.Tenant]
+	if t == nil {
+		return
+	}
+	ts.Requests = t.requests
+	ts.Denied = t.denied
+	if t.requests > 0 {
+		ts.DenialRate = float64(t.denied) / float64(t.requests)
+	}
+	for _, r := range t.routes {
+		ts.TopRoutes = append(ts.TopRoutes, *r)
+	}
+	sort.Slice(ts.TopRoutes, func(i, j int) bool {
+		a, b := ts.TopRoutes[i], ts.TopRoutes[j]
+		if a.Requests != b.Requests {
+			return a.Requests > b.Requests
+		}
+		return a.Route < b.Route
+	})
+	if len(ts.TopRoutes) > top {
+		ts.TopRoutes = ts.TopRoutes[:top]
+	}
+}
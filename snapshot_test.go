@@ -0,0 +1,64 @@
+package redis_rate_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ductone/redis_rate/v11"
+)
+
+func TestSnapshotTraffic(t *testing.T) {
+	traffic := redis_rate.NewTrafficStats("tenant", "route")
+	l := newUnreachableLimiter(
+		redis_rate.WithFallback(redis_rate.FallbackLocal),
+		redis_rate.WithHooks(traffic.Hooks()),
+	)
+	limit := redis_rate.PerSecond(2)
+
+	allow := func(tenant, route string) {
+		ctx := redis_rate.WithTags(context.Background(),
+			redis_rate.Tag{Key: "tenant", Value: tenant},
+			redis_rate.Tag{Key: "route", Value: route})
+		_, err := l.Allow(ctx, tenant, limit)
+		require.NoError(t, err)
+	}
+	allow("acme", "/a")
+	allow("acme", "/b")
+	allow("acme", "/b")
+	allow("acme", "/c")
+	allow("initech", "/a")
+	_, err := l.Allow(context.Background(), "untagged", limit)
+	require.NoError(t, err)
+
+	snap, err := l.Snapshot(context.Background(), redis_rate.SnapshotOptions{
+		Tenants: []redis_rate.TenantLimits{
+			{Tenant: "acme"},
+			{Tenant: "initech"},
+			{Tenant: "globex"},
+		},
+		Traffic:   traffic,
+		TopRoutes: 2,
+	})
+	require.NoError(t, err)
+	require.Len(t, snap.Tenants, 3)
+
+	acme := snap.Tenants[0]
+	require.Equal(t, "acme", acme.Tenant)
+	require.Equal(t, int64(4), acme.Requests)
+	require.Equal(t, int64(2), acme.Denied)
+	require.Equal(t, 0.5, acme.DenialRate)
+	require.Equal(t, []redis_rate.RouteTraffic{
+		{Route: "/b", Requests: 2, Denied: 1},
+		{Route: "/a", Requests: 1},
+	}, acme.TopRoutes)
+
+	require.Equal(t, int64(1), snap.Tenants[1].Requests)
+	require.Zero(t, snap.Tenants[1].Denied)
+	require.Zero(t, snap.Tenants[2].Requests)
+
+	_, err = json.Marshal(snap)
+	require.NoError(t, err)
+}
@@ -0,0 +1,261 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// StateEntry is the state of one Redis key of a Limiter, as dumped by
+// DumpState and written back by RestoreState. Only the field matching Type
+// is set. It can be marshaled to JSON as is.
+type StateEntry struct {
+	// Key is the full Redis key, including the Limiter's prefix.
+	Key string
+
+	// Type is the Redis type of the key: "string", "hash", "zset" or "list".
+	Type string
+
+	// TTL is the time the key had left to live when it was dumped, or 0 if
+	// it does not expire.
+	TTL time.Duration
+
+	// Value is the value of a string, such as the theoretical arrival time
+	// of a GCRA key.
+	Value []byte `json:",omitempty"`
+
+	// Fields are the fields of a hash, such as the holders of a concurrency
+	// key or the counters of a calendar limit.
+	Fields map[string]string `json:",omitempty"`
+
+	// Members are the members of a sorted set, such as the requests queued
+	// for a concurrency key.
+	Members []StateMember `json:",omitempty"`
+
+	// Items are the items of a list, from head to tail.
+	Items []string `json:",omitempty"`
+}
+
+// StateMember is a member of a sorted set in a StateEntry.
+type StateMember struct {
+	Member string
+	Score  float64
+}
+
+// DumpState returns the state of every rate limit and concurrency key
+// starting with prefix, matched as by ResetByPrefix, including the side keys
+// of bans, boosts, freezes and queues, so it can be moved to another Redis
+// with RestoreState without resetting anyone's quota. An empty prefix dumps
+// every key of the Limiter, and with epochs the current epoch too.
+//
+// Keys are read a batch at a time rather than at a single point in time, and
+// events charged after a key is read are not carried over. Theoretical
+// arrival times and holder expiries are absolute times, so the clocks of
+// both servers should agree.
+func (l *Limiter) DumpState(ctx context.Context, prefix string) (_ []StateEntry, err error) {
+	defer l.recoverPanic(OpDumpState, "", &err)
+	patterns := l.keyPatterns(ctx, prefix)
+	if l.epoch != nil && prefix == "" {
+		patterns = append(patterns, escapeGlob(l.ratePrefix+epochKeySuffix))
+	}
+
+	var mu sync.Mutex
+	var rv []StateEntry
+	err = l.forEachNode(ctx, func(ctx context.Context, node redisNode) (err error) {
+		// nodes are dumped concurrently, out of reach of the defer above.
+		defer l.recoverPanic(OpDumpState, "", &err)
+		scan, err := scanNode(node)
+		if err != nil {
+			return err
+		}
+		seen := make(map[string]bool)
+		for _, match := range patterns {
+			var cursor uint64
+			for {
+				page, next, err := scan.Scan(ctx, cursor, match, sweepScanCount).Result()
+				if err != nil {
+					return err
+				}
+				keys := page[:0]
+				for _, key := range page {
+					if !seen[key] {
+						seen[key] = true
+						keys = append(keys, key)
+					}
+				}
+				entries, err := dumpKeys(ctx, node, keys)
+				if err != nil {
+					return err
+				}
+				mu.Lock()
+				rv = append(rv, entries...)
+				mu.Unlock()
+
+				cursor = next
+				if cursor == 0 {
+					break
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rv, nil
+}
+
+// dumpKeys reads the state of keys from node in two round trips. Keys that
+// are gone by the time they are read are left out.
+func dumpKeys(ctx context.Context, node redisNode, keys []string) ([]StateEntry, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	pl := node.Pipeline()
+	types := make([]*redis.StatusCmd, len(keys))
+	for i, key := range keys {
+		types[i] = pl.Type(ctx, key)
+	}
+	if _, err := pl.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	pl = node.Pipeline()
+	ttls := make([]*redis.DurationCmd, len(keys))
+	values := make([]redis.Cmder, len(keys))
+	for i, key := range keys {
+		ttls[i] = pl.PTTL(ctx, key)
+		switch types[i].Val() {
+		case "string":
+			values[i] = pl.Get(ctx, key)
+		case "hash":
+			values[i] = pl.HGetAll(ctx, key)
+		case "zset":
+			values[i] = pl.ZRangeWithScores(ctx, key, 0, -1)
+		case "list":
+			values[i] = pl.LRange(ctx, key, 0, -1)
+		}
+	}
+	if _, err := pl.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	rv := make([]StateEntry, 0, len(keys))
+	for i, key := range keys {
+		e := StateEntry{Key: key, Type: types[i].Val()}
+		switch cmd := values[i].(type) {
+		case *redis.StringCmd:
+			b, err := cmd.Bytes()
+			if err == redis.Nil {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			e.Value = b
+		case *redis.MapStringStringCmd:
+			e.Fields = cmd.Val()
+		case *redis.ZSliceCmd:
+			for _, z := range cmd.Val() {
+				e.Members = append(e.Members, StateMember{Member: z.Member.(string), Score: z.Score})
+			}
+		case *redis.StringSliceCmd:
+			e.Items = cmd.Val()
+		default:
+			// gone, or of a type the Limiter does not use.
+			continue
+		}
+		if err := values[i].Err(); err != nil {
+			return nil, err
+		}
+		if ttl := ttls[i].Val(); ttl > 0 {
+			e.TTL = ttl
+		}
+		rv = append(rv, e)
+	}
+	return rv, nil
+}
+
+// RestoreState writes entries dumped by DumpState, replacing keys that
+// already exist, and gives each the time to live it had left when it was
+// dumped. Entries are written a batch at a time and not atomically, so they
+// should be restored before traffic is moved over, and an error may leave
+// some of them written. With epochs, a restored epoch is written to every
+// node or slot, as BumpEpoch does.
+func (l *Limiter) RestoreState(ctx context.Context, entries []StateEntry) (err error) {
+	defer l.recoverPanic(OpRestoreState, "", &err)
+	if err := l.checkWritable("RestoreState"); err != nil {
+		return err
+	}
+	for start := 0; start < len(entries); start += resetChunkSize {
+		end := start + resetChunkSize
+		if end > len(entries) {
+			end = len(entries)
+		}
+
+		pl := l.rdb.Pipeline()
+		for _, e := range entries[start:end] {
+			if err := restoreEntry(ctx, pl, e); err != nil {
+				return err
+			}
+		}
+		if _, err := pl.Exec(ctx); err != nil {
+			return err
+		}
+	}
+	for _, e := range entries {
+		if l.epoch == nil || e.Key != l.ratePrefix+epochKeySuffix {
+			continue
+		}
+		v, err := strconv.ParseInt(string(e.Value), 10, 64)
+		if err != nil {
+			return fmt.Errorf("redis_rate: cannot restore epoch %q: %w", e.Value, err)
+		}
+		if err := l.raiseEpoch(ctx, v); err != nil {
+			return err
+		}
+		l.epoch.set(v)
+		break
+	}
+	return l.audit.record(ctx, AuditRestore, l.ratePrefix, "", strconv.Itoa(len(entries))+" keys")
+}
+
+// restoreEntry queues the commands writing e on pipe.
+func restoreEntry(ctx context.Context, pipe redis.Pipeliner, e StateEntry) error {
+	var cmds []interface{}
+	switch e.Type {
+	case "string":
+		cmds = []interface{}{"set", e.Key, e.Value}
+	case "hash":
+		cmds = []interface{}{"hset", e.Key}
+		for field, value := range e.Fields {
+			cmds = append(cmds, field, value)
+		}
+	case "zset":
+		cmds = []interface{}{"zadd", e.Key}
+		for _, m := range e.Members {
+			cmds = append(cmds, m.Score, m.Member)
+		}
+	case "list":
+		cmds = []interface{}{"rpush", e.Key}
+		for _, item := range e.Items {
+			cmds = append(cmds, item)
+		}
+	default:
+		return fmt.Errorf("redis_rate: cannot restore %q of type %q", e.Key, e.Type)
+	}
+
+	pipe.Del(ctx, e.Key)
+	if len(cmds) > 2 {
+		pipe.Do(ctx, cmds...)
+		if e.TTL > 0 {
+			pipe.PExpire(ctx, e.Key, e.TTL)
+		}
+	}
+	return nil
+}
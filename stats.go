@@ -0,0 +1,162 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// statsSampleSize is the number of recent latencies kept for each operation
+// to estimate its 99th percentile.
+const statsSampleSize = 1024
+
+// OperationStats counts the calls of one Operation since the Limiter was
+// created or its stats were last reset.
+type OperationStats struct {
+	// Calls is the number of keys evaluated, taken or released, so a
+	// multi-key call counts once per key.
+	Calls int64
+
+	// Denied is the number of calls that allowed nothing.
+	Denied int64
+
+	// Errors is the number of calls that failed.
+	Errors int64
+
+	// Retries is the number of times a call was tried again, see WithRetry.
+	Retries int64
+
+	// MeanLatency is the mean time spent per call, and P99Latency the 99th
+	// percentile of the last calls.
+	MeanLatency time.Duration
+	P99Latency  time.Duration
+}
+
+// LimiterStats is a snapshot of the stats of a Limiter, returned by Stats.
+type LimiterStats struct {
+	// Since is when the stats started counting.
+	Since time.Time
+
+	// Operations are the stats of each operation called at least once.
+	Operations map[Operation]OperationStats
+}
+
+// Stats returns the number of calls, denials, errors and retries and the
+// latency of each operation since the Limiter was created or ResetStats was
+// last called, for health endpoints of services without a metrics stack and
+// for assertions in integration tests. The stats are kept in process and
+// are always on; they are recorded with atomic operations only, so calls
+// never wait on each other to record them.
+func (l *Limiter) Stats() LimiterStats {
+	t := l.stats.table()
+	rv := LimiterStats{
+		Since:      t.since,
+		Operations: make(map[Operation]OperationStats),
+	}
+	t.ops.Range(func(k, v interface{}) bool {
+		rv.Operations[k.(Operation)] = v.(*opStats).snapshot()
+		return true
+	})
+	return rv
+}
+
+// ResetStats starts the stats returned by Stats over.
+func (l *Limiter) ResetStats() {
+	l.stats.reset()
+}
+
+type limiterStats struct {
+	current atomic.Pointer[statsTable]
+}
+
+type statsTable struct {
+	since time.Time
+	ops   sync.Map
+}
+
+func (s *limiterStats) table() *statsTable {
+	if t := s.current.Load(); t != nil {
+		return t
+	}
+	s.current.CompareAndSwap(nil, &statsTable{since: time.Now()})
+	return s.current.Load()
+}
+
+func (s *limiterStats) reset() {
+	s.current.Store(&statsTable{since: time.Now()})
+}
+
+func (s *limiterStats) op(op Operation) *opStats {
+	t := s.table()
+	if v, ok := t.ops.Load(op); ok {
+		return v.(*opStats)
+	}
+	v, _ := t.ops.LoadOrStore(op, &opStats{})
+	return v.(*opStats)
+}
+
+// record counts a call of op that took d.
+func (s *limiterStats) record(op Operation, d time.Duration, denied bool, err error) {
+	os := s.op(op)
+	os.calls.Add(1)
+	if err != nil {
+		os.errors.Add(1)
+	} else if denied {
+		os.denied.Add(1)
+	}
+	os.total.Add(int64(d))
+	i := os.next.Add(1) - 1
+	os.samples[i%statsSampleSize].Store(int64(d))
+}
+
+// retried counts a retry of the operation of ctx, if it is known.
+func (s *limiterStats) retried(ctx context.Context) {
+	if op, ok := ctx.Value(statsOpKey{}).(Operation); ok {
+		s.op(op).retries.Add(1)
+	}
+}
+
+// statsOpKey is the context key of the operation whose retries are counted,
+// set by startSpan when the Limiter retries.
+type statsOpKey struct{}
+
+// opStats are the stats of one operation. Latencies are sampled into a ring
+// claimed slot by slot with next, so a snapshot taken while calls are being
+// recorded may mix samples of consecutive laps.
+type opStats struct {
+	calls   atomic.Int64
+	denied  atomic.Int64
+	errors  atomic.Int64
+	retries atomic.Int64
+	total   atomic.Int64
+	samples [statsSampleSize]atomic.Int64
+	next    atomic.Uint64
+}
+
+func (os *opStats) snapshot() OperationStats {
+	rv := OperationStats{
+		Calls:   os.calls.Load(),
+		Denied:  os.denied.Load(),
+		Errors:  os.errors.Load(),
+		Retries: os.retries.Load(),
+	}
+	if rv.Calls > 0 {
+		rv.MeanLatency = time.Duration(os.total.Load() / rv.Calls)
+	}
+	n := os.next.Load()
+	if n > statsSampleSize {
+		n = statsSampleSize
+	}
+	samples := make([]time.Duration, n)
+	for i := range samples {
+		samples[i] = time.Duration(os.samples[i].Load())
+	}
+
+	if len(samples) > 0 {
+		sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+		rv.P99Latency = samples[(len(samples)*99+99)/100-1]
+	}
+	return rv
+}
@@ -0,0 +1,48 @@
+package redis_rate_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/ductone/redis_rate/v11"
+)
+
+func TestStats(t *testing.T) {
+	ctx := context.Background()
+	l := newUnreachableLimiter(redis_rate.WithRetry(3, time.Millisecond))
+	limit := redis_rate.PerMinute(1)
+
+	_, err := l.Allow(ctx, "test_id", limit)
+	require.Error(t, err)
+	_, err = l.Take(ctx, "test_id", "req1", redis_rate.ConcurrencyLimit{Max: 1})
+	require.Error(t, err)
+
+	stats := l.Stats()
+	require.False(t, stats.Since.IsZero())
+	allow := stats.Operations[redis_rate.OpAllowN]
+	require.Equal(t, int64(1), allow.Calls)
+	require.Equal(t, int64(1), allow.Errors)
+	require.Equal(t, int64(2), allow.Retries)
+	require.Greater(t, allow.MeanLatency, time.Duration(0))
+	require.GreaterOrEqual(t, allow.P99Latency, allow.MeanLatency)
+	require.Equal(t, int64(2), stats.Operations[redis_rate.OpTake].Retries)
+
+	l.ResetStats()
+	require.Empty(t, l.Stats().Operations)
+
+	l = newUnreachableLimiter(redis_rate.WithFallback(redis_rate.FallbackLocal))
+	for i := 0; i < 3; i++ {
+		_, err = l.Allow(ctx, "test_id", limit)
+		require.NoError(t, err)
+	}
+	require.Equal(t, redis_rate.OperationStats{Calls: 3, Denied: 2},
+		withoutLatency(l.Stats().Operations[redis_rate.OpAllowN]))
+}
+
+func withoutLatency(s redis_rate.OperationStats) redis_rate.OperationStats {
+	s.MeanLatency, s.P99Latency = 0, 0
+	return s
+}
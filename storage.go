@@ -0,0 +1,164 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"encoding/binary"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// StorageFormat is how the state of GCRA rate limit keys is stored in Redis.
+type StorageFormat int
+
+const (
+	// StorageText stores the theoretical arrival time of a key as a decimal
+	// string. It is the default.
+	StorageText StorageFormat = iota
+
+	// StorageCompact stores the theoretical arrival time of a key as a
+	// MessagePack float64, a 9 byte blob instead of a string of up to 18
+	// bytes, to save memory on deployments with many keys.
+	StorageCompact
+)
+
+func (f StorageFormat) String() string {
+	switch f {
+	case StorageText:
+		return "text"
+	case StorageCompact:
+		return "compact"
+	default:
+		return "storage(" + strconv.Itoa(int(f)) + ")"
+	}
+}
+
+// WithStorageFormat sets the format in which GCRA rate limit keys are
+// written. Keys are read in either format whatever the setting, so the
+// format can be changed on a live deployment, one process at a time, and
+// keys move to the new format as they are next charged. Calendar and
+// sliding window limits are unaffected.
+func WithStorageFormat(format StorageFormat) Option {
+	return func(l *Limiter) {
+		l.storage = format
+	}
+}
+
+// WithKeyTTLFactor multiplies the time GCRA rate limit keys are kept for in
+// Redis, which is otherwise exactly until they return to their initial
+// state. A factor above 1 keeps keys around after they reset, for example
+// so Inspect and DumpState can still see short-period keys; a factor below
+// 1 lets them expire early, refilling them at once. Calendar and sliding
+// window limits are unaffected.
+func WithKeyTTLFactor(factor float64) Option {
+	return func(l *Limiter) {
+		l.keyTTLFactor = factor
+	}
+}
+
+// WithKeyMaxTTL caps the time GCRA rate limit keys are kept for in Redis,
+// after WithKeyTTLFactor, so that keys of very long periods such as monthly
+// quotas do not stay alive for months after a tenant churns. A key that
+// expires before it resets is refilled at once, so the cap should be well
+// above the reset time of the keys that matter.
+func WithKeyMaxTTL(ttl time.Duration) Option {
+	return func(l *Limiter) {
+		l.keyMaxTTL = ttl
+	}
+}
+
+// keyTTLSet reports whether the time GCRA keys are kept for is changed.
+func (l *Limiter) keyTTLSet() bool {
+	return (l.keyTTLFactor > 0 && l.keyTTLFactor != 1) || l.keyMaxTTL > 0
+}
+
+// keyMaxTTLSeconds returns the cap of WithKeyMaxTTL in whole seconds, at
+// least 1.
+func (l *Limiter) keyMaxTTLSeconds() int64 {
+	secs := int64(math.Ceil(l.keyMaxTTL.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	return secs
+}
+
+// storageArgs appends the arguments selecting the storage format and the
+// time keys are kept for to the call of script built so far in args,
+// padding the optional arguments before them, unless the Limiter uses the
+// defaults.
+func (l *Limiter) storageArgs(args *scriptArgs, script *redis.Script) {
+	if l.storage == StorageText && !l.keyTTLSet() {
+		return
+	}
+	argc := 0
+	switch script {
+	case allowN:
+		argc = 12
+	case allowAtMost:
+		argc = 6
+	case freezeScript:
+		argc = 2
+	case leaseScript:
+		argc = 6
+	}
+	for len(args.args) < argc {
+		args.str("")
+	}
+	if l.storage == StorageCompact {
+		args.int(1)
+	} else {
+		args.str("")
+	}
+	if !l.keyTTLSet() {
+		return
+	}
+	if l.keyTTLFactor > 0 {
+		args.float(l.keyTTLFactor)
+	} else {
+		args.str("")
+	}
+	if l.keyMaxTTL > 0 {
+		args.int(l.keyMaxTTLSeconds())
+	} else {
+		args.str("")
+	}
+}
+
+// storageValues is storageArgs for script_allow_multi.lua, whose arguments
+// are built in values.
+func (l *Limiter) storageValues(values []interface{}) []interface{} {
+	if l.storage == StorageText && !l.keyTTLSet() {
+		return values
+	}
+	if l.storage == StorageCompact {
+		values = append(values, 1)
+	} else {
+		values = append(values, "")
+	}
+	if !l.keyTTLSet() {
+		return values
+	}
+	if l.keyTTLFactor > 0 {
+		values = append(values, l.keyTTLFactor)
+	} else {
+		values = append(values, "")
+	}
+	if l.keyMaxTTL > 0 {
+		values = append(values, l.keyMaxTTLSeconds())
+	} else {
+		values = append(values, "")
+	}
+	return values
+}
+
+// compactTATPrefix is the MessagePack type byte of a float64.
+const compactTATPrefix = 0xcb
+
+// decodeTAT decodes a theoretical arrival time stored in either format.
+func decodeTAT(s string) (float64, error) {
+	if len(s) == 9 && s[0] == compactTATPrefix {
+		return math.Float64frombits(binary.BigEndian.Uint64([]byte(s[1:]))), nil
+	}
+	return strconv.ParseFloat(s, 64)
+}
@@ -0,0 +1,144 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// sweepScanCount is the SCAN batch size used when sweeping.
+const sweepScanCount = 100
+
+// SweepStats describes the work done by one or more sweeps.
+type SweepStats struct {
+	// Sweeps is the number of completed passes over the keyspace.
+	Sweeps int64
+
+	// Keys is the number of concurrency keys that were inspected.
+	Keys int64
+
+	// Reclaimed is the number of expired request ids that were removed.
+	Reclaimed int64
+
+	// Errors is the number of sweeps that stopped early due to an error.
+	Errors int64
+}
+
+// Sweep makes a single pass over every key under the concurrency prefix, on
+// every node of a Ring or ClusterClient, and removes request ids whose
+// RequestMaxDuration has passed. Expired holders
+// are otherwise only pruned when another Take evaluates the same key.
+func (tk *Limiter) Sweep(ctx context.Context) (SweepStats, error) {
+	if err := tk.checkWritable("Sweep"); err != nil {
+		return SweepStats{}, err
+	}
+	match := tk.concurrentPrefix + "*"
+
+	var mu sync.Mutex
+	stats := SweepStats{}
+	err := tk.forEachNode(ctx, func(ctx context.Context, node redisNode) error {
+		scan, err := scanNode(node)
+		if err != nil {
+			return err
+		}
+		var keys, reclaimed int64
+		defer func() {
+			mu.Lock()
+			stats.Keys += keys
+			stats.Reclaimed += reclaimed
+			mu.Unlock()
+		}()
+
+		var cursor uint64
+		for {
+			page, next, err := scan.Scan(ctx, cursor, match, sweepScanCount).Result()
+			if err != nil {
+				return err
+			}
+
+			for _, key := range page {
+				removed, err := tk.runScript(ctx, concurrencySweep, []string{key}, tk.scriptNow()).Int64()
+				if err != nil {
+					return err
+				}
+				keys++
+				reclaimed += removed
+			}
+
+			cursor = next
+			if cursor == 0 {
+				return nil
+			}
+		}
+	})
+	if err != nil {
+		return stats, err
+	}
+
+	stats.Sweeps = 1
+	return stats, nil
+}
+
+// Sweeper periodically runs Sweep in the background. It is created by
+// StartSweeper.
+type Sweeper struct {
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	sweeps    atomic.Int64
+	keys      atomic.Int64
+	reclaimed atomic.Int64
+	errors    atomic.Int64
+}
+
+// StartSweeper runs Sweep every interval until ctx is done or Stop is called.
+func (tk *Limiter) StartSweeper(ctx context.Context, interval time.Duration) *Sweeper {
+	ctx, cancel := context.WithCancel(ctx)
+	s := &Sweeper{
+		cancel: cancel,
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			stats, err := tk.Sweep(ctx)
+			s.keys.Add(stats.Keys)
+			s.reclaimed.Add(stats.Reclaimed)
+			if err != nil {
+				s.errors.Add(1)
+				continue
+			}
+			s.sweeps.Add(1)
+		}
+	}()
+
+	return s
+}
+
+// Stats returns the totals across all sweeps run so far.
+func (s *Sweeper) Stats() SweepStats {
+	return SweepStats{
+		Sweeps:    s.sweeps.Load(),
+		Keys:      s.keys.Load(),
+		Reclaimed: s.reclaimed.Load(),
+		Errors:    s.errors.Load(),
+	}
+}
+
+// Stop stops the sweeper and waits for an in-progress sweep to finish.
+func (s *Sweeper) Stop() {
+	s.cancel()
+	s.wg.Wait()
+}
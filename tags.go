@@ -0,0 +1,35 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"context"
+)
+
+// Tag is a key/value pair describing a call, such as the route or method of
+// the HTTP request being limited. Tags do not affect limiting; they are
+// passed through to hooks and trace spans so decisions can be sliced without
+// joining other logs.
+type Tag struct {
+	Key   string
+	Value string
+}
+
+type tagsKey struct{}
+
+// WithTags returns a copy of ctx carrying tags in addition to any tags
+// already on ctx. Pass the returned context to Allow, Take and friends.
+func WithTags(ctx context.Context, tags ...Tag) context.Context {
+	if len(tags) == 0 {
+		return ctx
+	}
+	existing := TagsFromContext(ctx)
+	merged := make([]Tag, 0, len(existing)+len(tags))
+	merged = append(merged, existing...)
+	merged = append(merged, tags...)
+	return context.WithValue(ctx, tagsKey{}, merged)
+}
+
+// TagsFromContext returns the tags added to ctx with WithTags.
+func TagsFromContext(ctx context.Context) []Tag {
+	tags, _ := ctx.Value(tagsKey{}).([]Tag)
+	return tags
+}
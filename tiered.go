@@ -0,0 +1,87 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrDuplicateTier is returned by AllowTiered when two limits have the same
+// period, and so the same key.
+var ErrDuplicateTier = errors.New("redis_rate: tiers must have distinct periods")
+
+// TieredResult is the outcome of AllowTiered.
+type TieredResult struct {
+	// Allowed is true if the events were allowed by every tier.
+	Allowed bool
+
+	// Result is the result of the most restrictive tier: the one denying
+	// the events the longest, or if they were allowed, the one with the
+	// fewest events remaining.
+	Result *Result
+
+	// Tiers are the results of each tier, in the order given.
+	Tiers []*Result
+}
+
+// TierKey returns the key AllowTiered uses for limit under baseKey, such as
+// "ip:10.0.0.1/second" or "ip:10.0.0.1/day", for use with Reset, Usage and
+// friends.
+func TierKey(baseKey string, limit Limit) string {
+	return baseKey + "/" + tierName(limit.Period)
+}
+
+func tierName(period time.Duration) string {
+	switch period {
+	case time.Second:
+		return "second"
+	case time.Minute:
+		return "minute"
+	case time.Hour:
+		return "hour"
+	case 24 * time.Hour:
+		return "day"
+	default:
+		return period.String()
+	}
+}
+
+// AllowTiered reports whether n events may happen at time now for an
+// identity limited over several periods at once, such as per second, per
+// hour and per day. Each limit is kept under its own key, see TierKey, and
+// all of them are evaluated in a single script: the events are taken from
+// every tier or, if any is exhausted, from none.
+//
+// All keys must hash to the same slot on Redis Cluster, for example by
+// giving baseKey a hash tag such as "{ip:10.0.0.1}".
+func (l *Limiter) AllowTiered(ctx context.Context, baseKey string, limits []Limit, n int) (*TieredResult, error) {
+	levels := make([]KeyLimit, len(limits))
+	seen := make(map[string]bool, len(limits))
+	for i, limit := range limits {
+		limit = l.limitOrDefault(limit)
+		key := TierKey(baseKey, limit)
+		if seen[key] {
+			return nil, ErrDuplicateTier
+		}
+		seen[key] = true
+		levels[i] = KeyLimit{Key: key, Limit: limit}
+	}
+
+	res, err := l.allowMulti(ctx, levels, n, multiTiered)
+	if err != nil || len(res) == 0 {
+		return nil, err
+	}
+
+	rv := &TieredResult{
+		Allowed: res[0].Allowed > 0 || n == 0,
+		Result:  res[0],
+		Tiers:   res,
+	}
+	for _, r := range res[1:] {
+		if rv.Allowed && r.Remaining < rv.Result.Remaining ||
+			!rv.Allowed && r.RetryAfter > rv.Result.RetryAfter {
+			rv.Result = r
+		}
+	}
+	return rv, nil
+}
@@ -0,0 +1,250 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Defaults used by WithLocalTokenCache for unset LocalTokenCacheOptions.
+const (
+	DefaultTokenCacheBlock        = 50
+	DefaultTokenCacheMaxStaleness = time.Second
+	DefaultTokenCacheMaxKeys      = 1024
+)
+
+// LocalTokenCacheOptions configures WithLocalTokenCache.
+type LocalTokenCacheOptions struct {
+	// Block is the number of events reserved from Redis at a time. If unset
+	// the default is DefaultTokenCacheBlock.
+	Block int
+
+	// RefillBelow starts an asynchronous reservation of another block when
+	// fewer events than this are left locally. If unset the default is a
+	// quarter of Block.
+	RefillBelow int
+
+	// MaxStaleness is how long reserved events may be handed out locally.
+	// Events still unused after that are dropped, so they count against the
+	// limit without having happened. If unset the default is
+	// DefaultTokenCacheMaxStaleness.
+	MaxStaleness time.Duration
+
+	// MaxKeys bounds the number of keys with local reservations. Other keys
+	// go to Redis as usual. If unset the default is DefaultTokenCacheMaxKeys.
+	MaxKeys int
+
+	// Keys selects the keys to cache, such as the busiest tenants. If nil
+	// every key is cached.
+	Keys func(key string) bool
+}
+
+// WithLocalTokenCache makes Allow and AllowN reserve a block of events from
+// Redis at a time for each key and hand them out locally until the block is
+// used up or MaxStaleness has passed, cutting latency and Redis load for hot
+// keys.
+//
+// Reserved events are taken from the limit up front, so a process may deny
+// requests that another process's reservation would have allowed, and
+// results served locally report the Remaining and ResetAfter of the last
+// reservation. Calendar limits, AllowAtMost and requests for more than Block
+// events always go to Redis.
+func WithLocalTokenCache(opts LocalTokenCacheOptions) Option {
+	if opts.Block <= 0 {
+		opts.Block = DefaultTokenCacheBlock
+	}
+	if opts.RefillBelow <= 0 {
+		opts.RefillBelow = (opts.Block + 3) / 4
+	}
+	if opts.MaxStaleness <= 0 {
+		opts.MaxStaleness = DefaultTokenCacheMaxStaleness
+	}
+	if opts.MaxKeys <= 0 {
+		opts.MaxKeys = DefaultTokenCacheMaxKeys
+	}
+	return func(l *Limiter) {
+		l.tokenCache = &tokenCache{
+			l:       l,
+			opts:    opts,
+			entries: make(map[localKey]*tokenEntry),
+		}
+	}
+}
+
+type tokenCache struct {
+	l    *Limiter
+	opts LocalTokenCacheOptions
+
+	mu      sync.Mutex
+	entries map[localKey]*tokenEntry
+}
+
+// tokenEntry holds the events reserved locally for a key.
+type tokenEntry struct {
+	mu        sync.Mutex
+	tokens    int64
+	expiresAt time.Time
+	refilling bool
+
+	// last is the result of the last reservation.
+	last *Result
+}
+
+// cacheable reports whether an allow of n events with limit may be served
+// from the cache.
+func (c *tokenCache) cacheable(key string, limit Limit, n int, atMost bool) bool {
+	return c != nil && !c.l.extendedAllows() && !atMost && n >= 1 && n <= c.opts.Block &&
+		limit.Calendar == CalendarNone && limit.WarmUp == 0 && (c.opts.Keys == nil || c.opts.Keys(key))
+}
+
+func (c *tokenCache) entry(ctx context.Context, key string, limit Limit) *tokenEntry {
+	lk := localKey{
+		prefix: c.l.localPrefix(ctx),
+		key:    key,
+		limit:  limit,
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := c.entries[lk]
+	if e == nil {
+		if len(c.entries) >= c.opts.MaxKeys {
+			c.evictExpired()
+			if len(c.entries) >= c.opts.MaxKeys {
+				return nil
+			}
+		}
+		e = &tokenEntry{}
+		c.entries[lk] = e
+	}
+	return e
+}
+
+// evictExpired removes entries whose reservation has expired. c.mu must be
+// held.
+func (c *tokenCache) evictExpired() {
+	now := c.l.now()
+	for lk, e := range c.entries {
+		e.mu.Lock()
+		expired := !e.refilling && !now.Before(e.expiresAt)
+		e.mu.Unlock()
+		if expired {
+			delete(c.entries, lk)
+		}
+	}
+}
+
+// forget drops the reservations held for key.
+func (c *tokenCache) forget(key string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for lk := range c.entries {
+		if lk.key == key {
+			delete(c.entries, lk)
+		}
+	}
+}
+
+// allow takes n events from the local reservation for key, reserving a new
+// block from Redis when there are not enough.
+func (c *tokenCache) allow(ctx context.Context, key string, limit Limit, n int) (*Result, error) {
+	e := c.entry(ctx, key, limit)
+	if e == nil {
+		return c.l.runAllow(ctx, allowN, key, limit, n)
+	}
+
+	if rv := c.take(e, key, limit, n); rv != nil {
+		return rv, nil
+	}
+
+	res, err := c.l.runAllow(ctx, allowAtMost, key, limit, c.opts.Block)
+	if err != nil {
+		return nil, err
+	}
+	c.add(e, res)
+	if rv := c.take(e, key, limit, n); rv != nil {
+		return rv, nil
+	}
+
+	// the reservation fell short, so report when the missing events fit.
+	rv := *res
+	rv.Allowed = 0
+	rv.Remaining = 0
+	if rv.RetryAfter < 0 {
+		emission, _ := gcraParams(limit)
+		e.mu.Lock()
+		missing := int64(n) - e.tokens
+		e.mu.Unlock()
+		rv.RetryAfter = dur(emission * float64(missing))
+	}
+	rv.stamp(res.at, res.now)
+	return &rv, nil
+}
+
+// take hands out n events from e, or returns nil if it does not hold
+// enough, and starts a refill when e runs low.
+func (c *tokenCache) take(e *tokenEntry, key string, limit Limit, n int) *Result {
+	now := c.l.now()
+	e.mu.Lock()
+	if !now.Before(e.expiresAt) {
+		e.tokens = 0
+	}
+	if e.tokens < int64(n) {
+		e.mu.Unlock()
+		return nil
+	}
+	e.tokens -= int64(n)
+	rv := &Result{
+		Key:        key,
+		Limit:      limit,
+		Allowed:    int64(n),
+		Remaining:  e.last.Remaining + e.tokens,
+		RetryAfter: -1,
+		ResetAfter: e.last.ResetAfter - now.Sub(e.last.at),
+	}
+	if rv.ResetAfter < 0 {
+		rv.ResetAfter = 0
+	}
+	refill := e.tokens < int64(c.opts.RefillBelow) && !e.refilling
+	if refill {
+		e.refilling = true
+	}
+	e.mu.Unlock()
+
+	rv.stamp(now, c.l.now)
+	if refill {
+		go c.refill(e, key, limit)
+	}
+	return rv
+}
+
+// add adds the events reserved by res to e.
+func (c *tokenCache) add(e *tokenEntry, res *Result) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !res.at.Before(e.expiresAt) {
+		e.tokens = 0
+	}
+	e.tokens += res.Allowed
+	if res.Allowed > 0 {
+		e.expiresAt = res.at.Add(c.opts.MaxStaleness)
+	}
+	e.last = res
+}
+
+// refill reserves another block for e in the background. Failures are
+// ignored; the next call that runs out reserves synchronously and reports
+// them.
+func (c *tokenCache) refill(e *tokenEntry, key string, limit Limit) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.opts.MaxStaleness)
+	defer cancel()
+	res, err := c.l.runAllow(ctx, allowAtMost, key, limit, c.opts.Block)
+	if err == nil {
+		c.add(e, res)
+	}
+	e.mu.Lock()
+	e.refilling = false
+	e.mu.Unlock()
+}
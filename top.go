@@ -0,0 +1,78 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrNoTopConsumers is returned by TopConsumers without WithTopConsumers.
+var ErrNoTopConsumers = errors.New("redis_rate: top consumers are not enabled")
+
+// topConsumersPrefix follows the rate limit prefix in the keys of the sorted
+// sets kept by WithTopConsumers.
+const topConsumersPrefix = "top:"
+
+// WithTopConsumers makes Allow, AllowN and AllowAtMost count the events
+// requested for each key in windows of the given length, so TopConsumers can
+// report the heaviest keys of a window. The counts of a window are kept in a
+// sorted set named by the rate limit prefix, "top:" and the unix time the
+// window starts, for two windows.
+//
+// Counts are added up in process and sent to Redis in the background about
+// once a second, in one round trip, so they lag by up to that long and
+// counts not yet sent when the process exits are lost. Every process adds to
+// the same sorted set, so on a cluster it lives on a single node.
+func WithTopConsumers(window time.Duration) Option {
+	return func(l *Limiter) {
+		c := newWindowCounter(l, window, 2)
+		c.key = func(start int64, _ string) string {
+			return l.ratePrefix + topConsumersPrefix + strconv.FormatInt(start, 10)
+		}
+		c.incr = func(ctx context.Context, pipe redis.Pipeliner, key string, member string, n int64) {
+			pipe.ZIncrBy(ctx, key, float64(n), member)
+		}
+		l.top = c
+	}
+}
+
+// Consumer is a key and the number of events requested for it in a window,
+// reported by TopConsumers.
+type Consumer struct {
+	Key    string
+	Events int64
+}
+
+// TopConsumers returns up to n keys with the most events requested in the
+// window containing at, heaviest first, such as TopConsumers(ctx, time.Now(),
+// 10) for the current window. The counts of this process are sent first. It
+// requires WithTopConsumers.
+func (l *Limiter) TopConsumers(ctx context.Context, at time.Time, n int) ([]Consumer, error) {
+	t := l.top
+	if t == nil {
+		return nil, ErrNoTopConsumers
+	}
+	if n <= 0 {
+		return nil, nil
+	}
+	if err := t.flush(ctx); err != nil {
+		return nil, err
+	}
+	pl := l.rdb.Pipeline()
+	cmd := pl.ZRevRangeWithScores(ctx, t.key(t.start(at), ""), 0, int64(n-1))
+	if _, err := pl.Exec(ctx); err != nil {
+		return nil, err
+	}
+	zs, err := cmd.Result()
+	if err != nil {
+		return nil, err
+	}
+	rv := make([]Consumer, len(zs))
+	for i, z := range zs {
+		rv[i] = Consumer{Key: z.Member.(string), Events: int64(z.Score)}
+	}
+	return rv, nil
+}
@@ -0,0 +1,117 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"context"
+)
+
+// Attribute keys set on spans.
+const (
+	AttrKey        = "ratelimit.key"
+	AttrKeyCount   = "ratelimit.key_count"
+	AttrLimit      = "ratelimit.limit"
+	AttrAllowed    = "ratelimit.allowed"
+	AttrRemaining  = "ratelimit.remaining"
+	AttrRetryAfter = "ratelimit.retry_after_ms"
+	AttrRequestID  = "ratelimit.request_id"
+	AttrBatchSize  = "ratelimit.batch_size"
+	AttrDenied     = "ratelimit.denied"
+
+	// AttrShadowAllowed is only set for limits evaluated in shadow mode.
+	AttrShadowAllowed = "ratelimit.shadow_allowed"
+
+	// AttrReason is only set for requests that were denied.
+	AttrReason = "ratelimit.reason"
+
+	// AttrTagPrefix is prepended to the key of each Tag on the context.
+	AttrTagPrefix = "ratelimit.tag."
+)
+
+// Attribute is a key/value pair attached to a Span.
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// Tracer starts spans around Limiter operations. It mirrors the subset of
+// the OpenTelemetry trace API the Limiter needs, so an adapter is a few
+// lines. Because the returned context is passed on to the Redis client,
+// spans created by go-redis instrumentation become children of these spans.
+type Tracer interface {
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a single traced operation started by a Tracer.
+type Span interface {
+	SetAttributes(attrs ...Attribute)
+	RecordError(err error)
+	End()
+}
+
+// WithTracer traces Allow*, Pipeline.Exec, Take and Release calls.
+func WithTracer(tracer Tracer) func(*Limiter) {
+	return func(s *Limiter) {
+		s.tracer = tracer
+	}
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttributes(...Attribute) {}
+func (noopSpan) RecordError(error)          {}
+func (noopSpan) End()                       {}
+
+func (l *Limiter) startSpan(ctx context.Context, op Operation) (context.Context, Span) {
+	if l.retry != nil {
+		// so that retries are counted against op by Stats.
+		ctx = context.WithValue(ctx, statsOpKey{}, op)
+	}
+	if l.tracer == nil {
+		return ctx, noopSpan{}
+	}
+	ctx, span := l.tracer.Start(ctx, "redis_rate."+string(op))
+	for _, tag := range TagsFromContext(ctx) {
+		span.SetAttributes(Attribute{AttrTagPrefix + tag.Key, tag.Value})
+	}
+	return ctx, span
+}
+
+func traceAllow(span Span, key string, limit Limit, rv *Result, err error) {
+	span.SetAttributes(
+		Attribute{AttrKey, key},
+		Attribute{AttrLimit, limit.String()},
+	)
+	if err != nil {
+		span.RecordError(err)
+		return
+	}
+	span.SetAttributes(
+		Attribute{AttrAllowed, rv.Allowed},
+		Attribute{AttrRemaining, rv.Remaining},
+		Attribute{AttrRetryAfter, rv.RetryAfter.Milliseconds()},
+	)
+	if rv.Shadow {
+		span.SetAttributes(Attribute{AttrShadowAllowed, rv.ShadowAllowed})
+	}
+	if rv.Reason != "" {
+		span.SetAttributes(Attribute{AttrReason, string(rv.Reason)})
+	}
+}
+
+func traceTake(span Span, key string, requestID string, rv *ConcurrencyResult, err error) {
+	span.SetAttributes(
+		Attribute{AttrKey, key},
+		Attribute{AttrRequestID, requestID},
+	)
+	if err != nil {
+		span.RecordError(err)
+		return
+	}
+	span.SetAttributes(
+		Attribute{AttrLimit, rv.Limit.Max},
+		Attribute{AttrAllowed, rv.Allowed},
+		Attribute{AttrRemaining, rv.Remaining},
+	)
+	if rv.Reason != "" {
+		span.SetAttributes(Attribute{AttrReason, string(rv.Reason)})
+	}
+}
@@ -0,0 +1,167 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Usage reports the current state of keys without consuming anything, in a
+// single round trip. Each key's limit is looked up in limits, falling back
+// to the Limiter's default limit. The returned results are in the same order
+// as keys, with Allowed 0 and RetryAfter -1, and Used set to the number of
+// events the key is currently charged for.
+//
+// Keys evaluated with AllowSlidingWindow are not supported.
+func (l *Limiter) Usage(ctx context.Context, keys []string, limits map[string]Limit) (_ []*Result, err error) {
+	defer l.recoverPanic(OpUsage, "", &err)
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	resolved := make([]Limit, len(keys))
+	for i, key := range keys {
+		resolved[i] = l.limitOrDefault(limits[key])
+		if resolved[i].IsZero() {
+			return nil, ErrNoLimit
+		}
+	}
+
+	states, now, err := l.readState(ctx, keys, resolved)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := make([]*Result, len(keys))
+	for i, key := range keys {
+		res := &Result{
+			Key:        key,
+			Limit:      resolved[i],
+			RetryAfter: -1,
+			at:         now,
+		}
+		if res.Limit.Calendar != CalendarNone {
+			err = res.calendarUsage(states[i], now)
+		} else {
+			err = res.gcraUsage(states[i], now)
+		}
+		if err != nil {
+			return nil, err
+		}
+		res.stamp(now, l.now)
+		rv[i] = res
+	}
+	return rv, nil
+}
+
+// readState fetches the stored state of rate limit keys along with the
+// current time, in a single round trip and without modifying them.
+func (l *Limiter) readState(ctx context.Context, keys []string, limits []Limit) ([][]interface{}, time.Time, error) {
+	rkeys := l.rateKeys(ctx, keys)
+	pl := l.rdb.Pipeline()
+	timeCmd := pl.Time(ctx)
+	cmds := make([]*redis.SliceCmd, len(keys))
+	for i, rkey := range rkeys {
+		if limits[i].Calendar != CalendarNone {
+			cmds[i] = pl.HMGet(ctx, rkey, "w", "n")
+		} else {
+			cmds[i] = pl.MGet(ctx, rkey)
+		}
+	}
+
+	_, err := pl.Exec(ctx)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	now, err := timeCmd.Result()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if l.clock != nil {
+		now = l.clock.Now()
+	}
+
+	rv := make([][]interface{}, len(keys))
+	for i, cmd := range cmds {
+		rv[i], err = cmd.Result()
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+	}
+	return rv, now, nil
+}
+
+// gcraUsage fills in r from the stored theoretical arrival time of a GCRA
+// key, mirroring script_allow_n.lua.
+func (r *Result) gcraUsage(values []interface{}, now time.Time) error {
+	limit := r.Limit
+	emission, burstOffset := gcraParams(limit)
+	nowSec := toScriptTime(now)
+	tat, err := parseTAT(values, nowSec)
+	if err != nil {
+		return err
+	}
+
+	remaining := int64(math.Floor((nowSec-(tat-burstOffset))/emission + 1e-6))
+	if remaining < 0 {
+		remaining = 0
+	}
+	r.Remaining = remaining
+	r.Used = int64(limit.Burst) - remaining
+	r.ResetAfter = dur(tat - nowSec)
+	return nil
+}
+
+func gcraParams(limit Limit) (float64, float64) {
+	emission := limit.Period.Seconds() / float64(limit.Rate)
+	return emission, emission * float64(limit.Burst)
+}
+
+// parseTAT returns the stored theoretical arrival time, or now if there is
+// none or it is in the past.
+func parseTAT(values []interface{}, now float64) (float64, error) {
+	s, ok := values[0].(string)
+	if !ok {
+		return now, nil
+	}
+	v, err := decodeTAT(s)
+	if err != nil {
+		return 0, err
+	}
+	return math.Max(v, now), nil
+}
+
+// calendarUsage fills in r from the stored window and count of a calendar
+// key, mirroring script_allow_fixed_window.lua.
+func (r *Result) calendarUsage(values []interface{}, now time.Time) error {
+	used, end, err := parseCalendarUsed(values, r.Limit, now)
+	if err != nil {
+		return err
+	}
+	r.Used = used
+	r.Remaining = int64(r.Limit.Rate) - used
+	if used > 0 {
+		r.ResetAfter = end.Sub(now)
+	}
+	return nil
+}
+
+// parseCalendarUsed returns the count stored for the current window of a
+// calendar key and when that window ends.
+func parseCalendarUsed(values []interface{}, limit Limit, now time.Time) (int64, time.Time, error) {
+	start, end := limit.Calendar.window(now)
+	w, ok := values[0].(string)
+	if !ok || w != strconv.FormatInt(start.Unix(), 10) {
+		return 0, end, nil
+	}
+	n, _ := values[1].(string)
+	used, err := strconv.ParseInt(n, 10, 64)
+	if err != nil {
+		return 0, end, err
+	}
+	return used, end, nil
+}
@@ -0,0 +1,69 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"context"
+)
+
+// Verdict is a single decision made by a Limiter, passed to the callbacks
+// registered with WithOnDenied and WithOnAllowed. Exactly one of Result and
+// Concurrency is set.
+type Verdict struct {
+	Op Operation
+
+	// Tags are the tags on the call's context.
+	Tags []Tag
+
+	// N is the number of events requested from a rate limit. It is 0 for
+	// concurrency limits.
+	N int
+
+	Result      *Result
+	Concurrency *ConcurrencyResult
+}
+
+// Allowed reports whether the request was allowed. A rate limit decision is
+// allowed unless it granted none of the events requested.
+func (v Verdict) Allowed() bool {
+	if v.Concurrency != nil {
+		return v.Concurrency.Allowed
+	}
+	return v.Result.Allowed > 0 || v.N == 0
+}
+
+// WithOnDenied calls fn for every request a Limiter denies, across Allow and
+// friends, Take and friends, and Pipelines. Failed calls are not decisions
+// and are not reported. fn is called synchronously, after the Hooks
+// registered before it, so it should hand slow work off.
+func WithOnDenied(fn func(ctx context.Context, key string, v Verdict)) Option {
+	return withVerdicts(fn, false)
+}
+
+// WithOnAllowed is like WithOnDenied, for requests a Limiter allows.
+func WithOnAllowed(fn func(ctx context.Context, key string, v Verdict)) Option {
+	return withVerdicts(fn, true)
+}
+
+// withVerdicts registers hooks calling fn for every verdict whose Allowed
+// is allowed.
+func withVerdicts(fn func(ctx context.Context, key string, v Verdict), allowed bool) Option {
+	return WithHooks(Hooks{
+		OnAllow: func(ctx context.Context, ev AllowEvent) {
+			if ev.Err != nil || ev.Result == nil {
+				return
+			}
+			v := Verdict{Op: ev.Op, Tags: ev.Tags, N: ev.N, Result: ev.Result}
+			if v.Allowed() == allowed {
+				fn(ctx, ev.Key, v)
+			}
+		},
+		OnConcurrency: func(ctx context.Context, ev ConcurrencyEvent) {
+			if ev.Err != nil || ev.Result == nil {
+				return
+			}
+			v := Verdict{Op: ev.Op, Tags: ev.Tags, Concurrency: ev.Result}
+			if v.Allowed() == allowed {
+				fn(ctx, ev.Key, v)
+			}
+		},
+	})
+}
@@ -0,0 +1,73 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrWaitUnbounded is returned by WaitAtMost when n exceeds what the limit
+// can ever allow at once and ctx has no deadline, so it would wait forever.
+var ErrWaitUnbounded = errors.New("redis_rate: n exceeds the limit's burst and ctx has no deadline")
+
+// waitAtMostLead is how long before ctx's deadline WaitAtMost makes its
+// final attempt, so the round trip completes before the deadline.
+const waitAtMostLead = 10 * time.Millisecond
+
+// WaitAtMost waits until n events are allowed for key and takes them, or,
+// when ctx's deadline comes first, takes as many as AllowAtMost grants just
+// before the deadline, which may be none. It suits batch processors that
+// prefer partial progress over failure. Attempts are spaced by RetryAfter,
+// so limit.Penalty is not charged for them.
+//
+// If ctx has no deadline n must be at most the limit's burst, or its rate
+// for calendar limits. If ctx is canceled while waiting, ctx.Err() is
+// returned. If key is frozen, see WithFreezes, the denied result is returned
+// right away.
+func (l *Limiter) WaitAtMost(ctx context.Context, key string, limit Limit, n int) (_ *Result, err error) {
+	defer l.recoverPanic(OpWaitAtMost, key, &err)
+	limit = l.limitOrDefault(limit)
+	if limit.IsZero() {
+		return nil, ErrNoLimit
+	}
+	deadline, hasDeadline := ctx.Deadline()
+	capacity := limit.Burst
+	if limit.Calendar != CalendarNone {
+		capacity = limit.Rate
+	}
+	if !hasDeadline && n > capacity {
+		return nil, ErrWaitUnbounded
+	}
+
+	probe := limit
+	probe.Penalty = 0
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	<-timer.C
+
+	for {
+		res, err := l.AllowN(ctx, key, probe, n)
+		if err != nil || res.Allowed > 0 || n == 0 || res.Frozen {
+			return res, err
+		}
+
+		wait := res.RetryAfter
+		final := false
+		if hasDeadline {
+			if left := time.Until(deadline) - waitAtMostLead; wait >= left {
+				wait, final = left, true
+			}
+		}
+		if wait > 0 {
+			timer.Reset(wait)
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-timer.C:
+			}
+		}
+		if final {
+			return l.AllowAtMost(ctx, key, probe, n)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package redis_rate //nolint:revive // upstream used this name
+
+import (
+	"github.com/redis/go-redis/v9"
+)
+
+// warmUpKeySuffix follows a rate limit key in the key holding when a
+// warming key was first seen.
+const warmUpKeySuffix = ":warmup"
+
+// warmUpArgs appends the key and arguments ramping up limit to the call of
+// script built so far in args, padding the optional arguments before them,
+// if limit warms up.
+func (l *Limiter) warmUpArgs(args *scriptArgs, script *redis.Script, limit Limit) {
+	if limit.WarmUp <= 0 || limit.Calendar != CalendarNone {
+		return
+	}
+	argc := 0
+	switch script {
+	case allowN:
+		argc = 15
+	case allowAtMost:
+		argc = 9
+	default:
+		return
+	}
+	for len(args.args) < argc {
+		args.str("")
+	}
+	args.float(limit.WarmUp.Seconds()).
+		int(int64(limit.warmUpRate())).
+		key(sideKey(args.keys[0], warmUpKeySuffix), "")
+}